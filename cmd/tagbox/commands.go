@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/export"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/ingest"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// newFlags creates the flag set of a command.
+func newFlags(env *env, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(env.stderr)
+	return fs
+}
+
+// tagCount is a row of the tags and count commands.
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count uint64 `json:"count"`
+}
+
+// writeCounts writes tag cardinalities.
+func writeCounts(env *env, counts []tagCount) error {
+	rows := make([][]string, len(counts))
+	for i, c := range counts {
+		rows[i] = []string{c.Tag, strconv.FormatUint(c.Count, 10)}
+	}
+	return env.out.table([]string{"TAG", "COUNT"}, rows, counts)
+}
+
+func cmdTags(env *env, args []string) error {
+	fs := newFlags(env, "tags")
+	byCount := fs.Bool("by-count", false, "sort by cardinality, largest first")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tags := env.ts.GetAllTags()
+	counts := make([]tagCount, 0, len(tags))
+	for _, tag := range tags {
+		count, err := env.ts.GetTagCount(tag)
+		if err != nil {
+			return err
+		}
+		counts = append(counts, tagCount{Tag: tag, Count: count})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if *byCount && counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Tag < counts[j].Tag
+	})
+	return writeCounts(env, counts)
+}
+
+func cmdCount(env *env, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: count TAG...")
+	}
+
+	counts := make([]tagCount, 0, len(args))
+	for _, tag := range args {
+		count, err := env.ts.GetTagCount(tag)
+		if err != nil {
+			return err
+		}
+		counts = append(counts, tagCount{Tag: tag, Count: count})
+	}
+	return writeCounts(env, counts)
+}
+
+func cmdQuery(env *env, args []string) error {
+	fs := newFlags(env, "query")
+	limit := fs.Int("limit", 20, "number of objects to show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: query [-limit N] EXPR")
+	}
+
+	result, err := env.ts.QueryExpr(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	objects := []uint32{}
+	it := result.Iterator()
+	for len(objects) < *limit && it.HasNext() {
+		objects = append(objects, it.Next())
+	}
+
+	ids := make([]string, len(objects))
+	for i, id := range objects {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	if it.HasNext() {
+		ids = append(ids, "...")
+	}
+
+	count := result.GetCardinality()
+	return env.out.table(
+		[]string{"COUNT", "OBJECTS"},
+		[][]string{{strconv.FormatUint(count, 10), strings.Join(ids, " ")}},
+		struct {
+			Count   uint64   `json:"count"`
+			Objects []uint32 `json:"objects"`
+		}{count, objects},
+	)
+}
+
+func cmdDump(env *env, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: dump EXPR")
+	}
+
+	result, err := env.ts.QueryExpr(args[0])
+	if err != nil {
+		return err
+	}
+
+	it := result.Iterator()
+	return env.out.ids(func() (uint32, bool) {
+		if !it.HasNext() {
+			return 0, false
+		}
+		return it.Next(), true
+	})
+}
+
+func cmdObjTags(env *env, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: objtags ID...")
+	}
+
+	type objectTags struct {
+		Object uint32   `json:"object"`
+		Tags   []string `json:"tags"`
+	}
+	var objects []objectTags
+	var rows [][]string
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid object ID %q", arg)
+		}
+
+		tags, err := env.ts.GetObjectTags(uint32(id))
+		if err != nil {
+			return err
+		}
+		if tags == nil {
+			tags = []string{}
+		}
+		sort.Strings(tags)
+
+		objects = append(objects, objectTags{Object: uint32(id), Tags: tags})
+		rows = append(rows, []string{arg, strings.Join(tags, ", ")})
+	}
+
+	return env.out.table([]string{"OBJECT", "TAGS"}, rows, objects)
+}
+
+func cmdStats(env *env, args []string) error {
+	stats := env.ts.GetStats()
+
+	rows := [][]string{
+		{"tags", strconv.Itoa(stats.TotalTags)},
+		{"assignments", strconv.FormatUint(stats.TotalObjects, 10)},
+		{"objects", strconv.FormatUint(stats.UniqueObjects, 10)},
+		{"memory", strconv.FormatUint(stats.MemoryUsage, 10)},
+		{"largest tag", fmt.Sprintf("%s (%d)", stats.LargestTag, stats.LargestTagSize)},
+		{"object keys", strconv.Itoa(stats.ObjectKeys)},
+		{"expiring", strconv.FormatUint(stats.Expiring, 10)},
+		{"attributes", strconv.Itoa(stats.Attrs)},
+	}
+	return env.out.table([]string{"STAT", "VALUE"}, rows, stats)
+}
+
+// cmdConvert rewrites a snapshot in another format: binary, the current
+// format; binary64, the format of TagSystem64; or json, the legacy format
+// read by older versions. Converting to binary64 or json keeps only the
+// tags, and converting a binary64 snapshot back requires every object ID
+// to fit in 32 bits.
+func cmdConvert(env *env, args []string) error {
+	fs := newFlags(env, "convert")
+	to := fs.String("to", "binary", "output format: binary, binary64 or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: convert [-to binary|binary64|json] IN OUT")
+	}
+	in, out := fs.Arg(0), fs.Arg(1)
+	if *to != "binary" && *to != "binary64" && *to != "json" {
+		return fmt.Errorf("unknown snapshot format %q", *to)
+	}
+
+	ts, err := tagbox.New(storeConfig(tagbox.NewMemoryStore()))
+	if err != nil {
+		return err
+	}
+	defer ts.Close()
+
+	err = ts.LoadSnapshot(in)
+	if errors.Is(err, tagbox.ErrIDWidthMismatch) {
+		ts64, err := tagbox.New64(storeConfig(tagbox.NewMemoryStore()))
+		if err != nil {
+			return err
+		}
+		defer ts64.Close()
+
+		if err := ts64.LoadSnapshot(in); err != nil {
+			return err
+		}
+		if *to == "binary64" {
+			return ts64.SaveSnapshot(out)
+		}
+		if err := narrow(ts64, ts); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if *to != "binary" {
+		if stats := ts.GetStats(); stats.ObjectKeys > 0 || stats.Expiring > 0 || stats.Attrs > 0 {
+			fmt.Fprintf(env.stderr, "tagbox: %s keeps only tags; dropping %d object keys, %d expiring assignments and %d attributes\n",
+				*to, stats.ObjectKeys, stats.Expiring, stats.Attrs)
+		}
+	}
+
+	switch *to {
+	case "binary64":
+		ts64, err := tagbox.New64(storeConfig(tagbox.NewMemoryStore()))
+		if err != nil {
+			return err
+		}
+		defer ts64.Close()
+
+		if err := widen(ts, ts64); err != nil {
+			return err
+		}
+		return ts64.SaveSnapshot(out)
+	case "json":
+		return saveLegacySnapshot(ts, out)
+	}
+	return ts.SaveSnapshot(out)
+}
+
+// widen copies the tags of ts into ts64.
+func widen(ts *tagbox.TagSystem, ts64 *tagbox.TagSystem64) error {
+	for _, tag := range ts.GetAllTags() {
+		bitmap, err := ts.Query(tag)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]uint64, 0, bitmap.GetCardinality())
+		for it := bitmap.Iterator(); it.HasNext(); {
+			ids = append(ids, uint64(it.Next()))
+		}
+		if err := ts64.BatchAddObjectsToTag(ids, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// narrow copies the tags of ts64 into ts, failing if an object ID does
+// not fit in 32 bits.
+func narrow(ts64 *tagbox.TagSystem64, ts *tagbox.TagSystem) error {
+	for _, tag := range ts64.GetAllTags() {
+		bitmap, err := ts64.Query(tag)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]uint32, 0, bitmap.GetCardinality())
+		for it := bitmap.Iterator(); it.HasNext(); {
+			id := it.Next()
+			if id > math.MaxUint32 {
+				return fmt.Errorf("tag %s: object ID %d does not fit in 32 bits", tag, id)
+			}
+			ids = append(ids, uint32(id))
+		}
+		if err := ts.BatchAddObjectsToTag(ids, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveLegacySnapshot writes the JSON map of tag to portable bitmap that
+// versions before the binary snapshot format read.
+func saveLegacySnapshot(ts *tagbox.TagSystem, path string) error {
+	data := make(map[string][]byte)
+	for _, tag := range ts.GetAllTags() {
+		bitmap, err := ts.Query(tag)
+		if err != nil {
+			return err
+		}
+		if data[tag], err = bitmap.ToBytes(); err != nil {
+			return fmt.Errorf("failed to serialize tag %s: %w", tag, err)
+		}
+	}
+
+	return tagbox.WriteFileAtomic(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(data)
+	})
+}
+
+// cmdCopy copies the source, including object keys, deadlines and
+// attributes, to a snapshot file or another store. Tags already in the
+// destination store that the source lacks are kept.
+func cmdCopy(env *env, args []string) error {
+	fs := newFlags(env, "copy")
+	toSnapshot := fs.String("to-snapshot", "", "write a snapshot file")
+	toData := fs.String("to-data", "", "write a file store directory")
+	toRedis := fs.String("to-redis", "", "write a Redis server at this address")
+	toDB := fs.Int("to-db", env.opts.db, "Redis database number of the destination")
+	toPrefix := fs.String("to-prefix", env.opts.prefix, "Redis key prefix of the destination")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var dests int
+	for _, dest := range []string{*toSnapshot, *toData, *toRedis} {
+		if dest != "" {
+			dests++
+		}
+	}
+	if dests != 1 || fs.NArg() != 0 {
+		return errors.New("usage: copy -to-snapshot FILE | -to-redis ADDR | -to-data DIR")
+	}
+
+	tags := len(env.ts.GetAllTags())
+	if *toSnapshot != "" {
+		if err := env.ts.SaveSnapshot(*toSnapshot); err != nil {
+			return err
+		}
+		return env.out.table([]string{"COPIED", "TO"},
+			[][]string{{strconv.Itoa(tags), *toSnapshot}},
+			map[string]interface{}{"tags": tags, "to": *toSnapshot})
+	}
+
+	// Stores are filled from a snapshot of the source
+	snapshot := env.opts.snapshot
+	if snapshot == "" {
+		dir, err := os.MkdirTemp("", "tagbox-copy")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		snapshot = filepath.Join(dir, "copy.snap")
+		if err := env.ts.SaveSnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+
+	var config tagbox.Config
+	dest := *toData
+	if *toData != "" {
+		store, err := tagbox.NewFileStore(*toData)
+		if err != nil {
+			return err
+		}
+		config = storeConfig(store)
+	} else {
+		config = redisConfig(env.opts, *toRedis)
+		config.RedisDB = *toDB
+		config.KeyPrefix = *toPrefix
+		dest = fmt.Sprintf("redis://%s/%d (prefix %q)", *toRedis, *toDB, *toPrefix)
+	}
+
+	ts, err := tagbox.New(config)
+	if err != nil {
+		return err
+	}
+	if err := ts.LoadSnapshot(snapshot); err != nil {
+		ts.Close()
+		return err
+	}
+	if err := ts.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+
+	return env.out.table([]string{"COPIED", "TO"},
+		[][]string{{strconv.Itoa(tags), dest}},
+		map[string]interface{}{"tags": tags, "to": dest})
+}
+
+// cmdImport loads assignments into the source. A snapshot source is
+// rewritten with the result; other stores are saved.
+func cmdImport(env *env, args []string) error {
+	fs := newFlags(env, "import")
+	format := fs.String("format", "csv", "input format: csv (object_id,tag), wide or jsonl")
+	header := fs.Bool("header", false, "skip the first row of csv input")
+	replace := fs.Bool("replace", false, "replace the contents of the tags in the input")
+	skipBad := fs.Bool("skip-bad", false, "skip rows that cannot be parsed")
+	maxErrors := fs.Int("max-errors", 0, "with -skip-bad, abort after this many bad rows (0 for no limit)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: import [-format csv|wide|jsonl] [-header] [-replace] [-skip-bad] [-max-errors N] FILE")
+	}
+
+	opts := ingest.Options{
+		Header:    *header,
+		Replace:   *replace,
+		MaxErrors: *maxErrors,
+		Progress: func(stats ingest.Stats) {
+			fmt.Fprintf(env.stderr, "tagbox: %d rows, %d skipped, %d assignments loaded\n",
+				stats.Rows, stats.Skipped, stats.Assignments)
+		},
+	}
+	var err error
+	if opts.Format, err = ingest.ParseFormat(*format); err != nil {
+		return err
+	}
+	if *skipBad {
+		opts.OnError = ingest.Skip
+	}
+
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	stats, err := ingest.Import(context.Background(), env.ts, in, opts)
+	for _, rerr := range stats.Errors {
+		fmt.Fprintf(env.stderr, "tagbox: skipped %v\n", rerr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if env.opts.snapshot != "" {
+		if err := env.ts.SaveSnapshot(env.opts.snapshot); err != nil {
+			return err
+		}
+	} else if err := env.ts.Save(); err != nil {
+		return err
+	}
+
+	return env.out.table(
+		[]string{"ROWS", "SKIPPED", "ASSIGNMENTS", "TAGS", "ELAPSED"},
+		[][]string{{
+			strconv.FormatInt(stats.Rows, 10),
+			strconv.FormatInt(stats.Skipped, 10),
+			strconv.FormatInt(stats.Assignments, 10),
+			strconv.Itoa(stats.Tags),
+			stats.Elapsed.Round(time.Millisecond).String(),
+		}},
+		struct {
+			Rows        int64   `json:"rows"`
+			Skipped     int64   `json:"skipped"`
+			Assignments int64   `json:"assignments"`
+			Tags        int     `json:"tags"`
+			Seconds     float64 `json:"seconds"`
+		}{stats.Rows, stats.Skipped, stats.Assignments, stats.Tags, stats.Elapsed.Seconds()},
+	)
+}
+
+// cmdExport streams the objects matching an expression, or without one
+// the tags, to stdout or a file. The summary goes to stderr so that it
+// never mixes with the data.
+func cmdExport(env *env, args []string) error {
+	fs := newFlags(env, "export")
+	format := fs.String("format", "csv", "output format: csv, jsonl or roaring")
+	header := fs.Bool("header", false, "write a csv header row")
+	keys := fs.Bool("keys", false, "add the external key of every object")
+	tags := fs.String("tags", "", "without EXPR, export only these comma-separated tags")
+	out := fs.String("out", "", "write to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New("usage: export [-format csv|jsonl|roaring] [-header] [-keys] [-tags T,...] [-out FILE] [EXPR]")
+	}
+
+	opts := export.Options{Header: *header}
+	var err error
+	if opts.Format, err = export.ParseFormat(*format); err != nil {
+		return err
+	}
+	if *keys {
+		opts.Keys = env.ts
+	}
+	if *tags != "" {
+		opts.Tags = strings.Split(*tags, ",")
+	}
+
+	w := env.out.w
+	var f *os.File
+	if *out != "" {
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var stats export.Stats
+	if fs.NArg() == 1 {
+		stats, err = export.Query(context.Background(), w, env.ts, fs.Arg(0), opts)
+	} else {
+		stats, err = export.Tags(context.Background(), w, env.ts, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	if fs.NArg() == 1 {
+		fmt.Fprintf(env.stderr, "tagbox: exported %d objects (%d bytes)\n", stats.Objects, stats.Bytes)
+	} else {
+		fmt.Fprintf(env.stderr, "tagbox: exported %d tags in %d rows (%d bytes)\n", stats.Tags, stats.Rows, stats.Bytes)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Command tagbox inspects and operates a tag store.
+//
+// Usage:
+//
+//	tagbox [source] [-o table|json] <command> [arguments]
+//
+// The source is one of
+//
+//	-snapshot FILE    a snapshot file
+//	-data DIR         a file store directory
+//	-redis ADDR       a Redis server (with -password, -db and -prefix)
+//
+// Commands:
+//
+//	tags [-by-count]          list tags and their cardinalities
+//	count TAG...              show the cardinality of tags
+//	query [-limit N] EXPR     count an expression and show the first objects
+//	dump EXPR                 print every object matching an expression
+//	objtags ID...             show the tags of objects
+//	stats                     show tag system statistics
+//	convert [-to FORMAT] IN OUT
+//	                          rewrite a snapshot as binary, binary64 or json
+//	copy -to-snapshot FILE | -to-redis ADDR | -to-data DIR
+//	                          copy the source to another store
+//	import [-format csv|wide|jsonl] [-replace] [-skip-bad] FILE
+//	                          load assignments from a file, or - for stdin
+//	export [-format csv|jsonl|roaring] [-keys] [-tags T,...] [-out FILE] [EXPR]
+//	                          stream a query result, or tags, to stdout or a file
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "tagbox: %v\n", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// options are the global flags.
+type options struct {
+	snapshot string
+	data     string
+	redis    string
+	password string
+	db       int
+	prefix   string
+	output   string
+}
+
+// command is a subcommand. Commands with noSource get no tag system, and
+// only commands with writes may change the source.
+type command struct {
+	usage    string
+	noSource bool
+	writes   bool
+	run      func(env *env, args []string) error
+}
+
+var commands = map[string]command{
+	"tags":    {usage: "tags [-by-count]", run: cmdTags},
+	"count":   {usage: "count TAG...", run: cmdCount},
+	"query":   {usage: "query [-limit N] EXPR", run: cmdQuery},
+	"dump":    {usage: "dump EXPR", run: cmdDump},
+	"objtags": {usage: "objtags ID...", run: cmdObjTags},
+	"stats":   {usage: "stats", run: cmdStats},
+	"convert": {usage: "convert [-to binary|binary64|json] IN OUT", noSource: true, run: cmdConvert},
+	"copy":    {usage: "copy -to-snapshot FILE | -to-redis ADDR | -to-data DIR", run: cmdCopy},
+	"import":  {usage: "import [-format csv|wide|jsonl] [-header] [-replace] [-skip-bad] [-max-errors N] FILE", writes: true, run: cmdImport},
+	"export":  {usage: "export [-format csv|jsonl|roaring] [-header] [-keys] [-tags T,...] [-out FILE] [EXPR]", run: cmdExport},
+}
+
+// env is what a command runs with.
+type env struct {
+	opts   options
+	ts     *tagbox.TagSystem // nil for noSource commands
+	out    *output
+	stderr io.Writer
+}
+
+// run parses the command line and runs one command.
+func run(args []string, stdout, stderr io.Writer) error {
+	var opts options
+	fs := flag.NewFlagSet("tagbox", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.snapshot, "snapshot", "", "read a snapshot file")
+	fs.StringVar(&opts.data, "data", "", "read a file store directory")
+	fs.StringVar(&opts.redis, "redis", "", "read a Redis server at this address")
+	fs.StringVar(&opts.password, "password", "", "Redis password")
+	fs.IntVar(&opts.db, "db", 0, "Redis database number")
+	fs.StringVar(&opts.prefix, "prefix", "tags:", "Redis key prefix for tags")
+	fs.StringVar(&opts.output, "o", "table", "output format: table or json")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: tagbox [-snapshot FILE | -data DIR | -redis ADDR] [-o table|json] <command> [arguments]\n\ncommands:\n")
+		for _, name := range []string{"tags", "count", "query", "dump", "objtags", "stats", "convert", "copy", "import", "export"} {
+			fmt.Fprintf(stderr, "  %s\n", commands[name].usage)
+		}
+		fmt.Fprintf(stderr, "\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	cmd, exists := commands[fs.Arg(0)]
+	if !exists {
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+
+	out, err := newOutput(stdout, opts.output)
+	if err != nil {
+		return err
+	}
+	e := &env{opts: opts, out: out, stderr: stderr}
+
+	if !cmd.noSource {
+		ts, err := openSource(opts, !cmd.writes)
+		if err != nil {
+			return err
+		}
+		defer ts.Close()
+		e.ts = ts
+	}
+
+	return cmd.run(e, fs.Args()[1:])
+}
+
+// storeConfig returns the configuration of a tag system on store. Nothing
+// is saved until Close and expired assignments are not reaped.
+func storeConfig(store tagbox.Store) tagbox.Config {
+	config := tagbox.DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+	config.ExpiryResolution = 24 * time.Hour
+	return config
+}
+
+// redisConfig returns the configuration of a tag system on a Redis server.
+func redisConfig(opts options, addr string) tagbox.Config {
+	config := storeConfig(nil)
+	config.RedisAddr = addr
+	config.RedisPassword = opts.password
+	config.RedisDB = opts.db
+	config.KeyPrefix = opts.prefix
+	return config
+}
+
+// openSource opens and loads the tag system selected by the global flags.
+// A readOnly tag system never writes to the source, so inspecting a store
+// leaves it as it was.
+func openSource(opts options, readOnly bool) (*tagbox.TagSystem, error) {
+	var sources []string
+	for _, source := range []string{opts.snapshot, opts.data, opts.redis} {
+		if source != "" {
+			sources = append(sources, source)
+		}
+	}
+	switch len(sources) {
+	case 0:
+		return nil, errors.New("no source: pass -snapshot, -data or -redis")
+	case 1:
+	default:
+		return nil, fmt.Errorf("more than one source: %s", strings.Join(sources, ", "))
+	}
+
+	if opts.snapshot != "" {
+		cfg := storeConfig(tagbox.NewMemoryStore())
+		cfg.ReadOnly = readOnly
+		ts, err := tagbox.New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := ts.LoadSnapshot(opts.snapshot); err != nil {
+			ts.Close()
+			if errors.Is(err, tagbox.ErrIDWidthMismatch) {
+				return nil, fmt.Errorf("%w; convert it with -to binary first", err)
+			}
+			return nil, err
+		}
+		return ts, nil
+	}
+
+	var cfg tagbox.Config
+	if opts.data != "" {
+		// NewFileStore creates missing directories; a mistyped path must
+		// not open as an empty store
+		info, err := os.Stat(opts.data)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", opts.data)
+		}
+
+		store, err := tagbox.NewFileStore(opts.data)
+		if err != nil {
+			return nil, err
+		}
+		cfg = storeConfig(store)
+	} else {
+		cfg = redisConfig(opts, opts.redis)
+	}
+	cfg.ReadOnly = readOnly
+
+	ts, err := tagbox.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := ts.Recover(); err != nil {
+		ts.Close()
+		return nil, err
+	}
+	return ts, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// writeSnapshot saves a small tag system to a snapshot file.
+func writeSnapshot(t *testing.T) string {
+	t.Helper()
+
+	ts, err := tagbox.New(storeConfig(tagbox.NewMemoryStore()))
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.BatchAddObjectsToTag([]uint32{1, 2, 3}, "vip")
+	ts.BatchAddObjectsToTag([]uint32{2, 3}, "city:beijing")
+	ts.AddTag(4, "new")
+
+	path := filepath.Join(t.TempDir(), "tags.snap")
+	if err := ts.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runCmd runs the command line and returns its output.
+func runCmd(t *testing.T, args ...string) string {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	if err := run(args, &stdout, &stderr); err != nil {
+		t.Fatalf("tagbox %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return stdout.String()
+}
+
+// TestRun_Inspect tests the inspection commands on a snapshot
+func TestRun_Inspect(t *testing.T) {
+	snap := writeSnapshot(t)
+
+	got := runCmd(t, "-snapshot", snap, "tags")
+	want := "TAG           COUNT\ncity:beijing  2\nnew           1\nvip           3\n"
+	if got != want {
+		t.Errorf("tags =\n%s\nwant\n%s", got, want)
+	}
+
+	got = runCmd(t, "-snapshot", snap, "query", "-limit", "1", "vip AND NOT new")
+	want = "COUNT  OBJECTS\n3      1 ...\n"
+	if got != want {
+		t.Errorf("query =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := runCmd(t, "-snapshot", snap, "dump", "city:*"); got != "2\n3\n" {
+		t.Errorf("dump = %q", got)
+	}
+
+	var counts []tagCount
+	out := runCmd(t, "-snapshot", snap, "-o", "json", "tags", "-by-count")
+	if err := json.Unmarshal([]byte(out), &counts); err != nil {
+		t.Fatalf("tags -o json: %v\n%s", err, out)
+	}
+	if len(counts) != 3 || counts[0] != (tagCount{"vip", 3}) {
+		t.Errorf("tags -by-count = %v", counts)
+	}
+
+	var ids []uint32
+	out = runCmd(t, "-snapshot", snap, "-o", "json", "dump", "vip")
+	if err := json.Unmarshal([]byte(out), &ids); err != nil || !reflect.DeepEqual(ids, []uint32{1, 2, 3}) {
+		t.Errorf("dump -o json = %v, %v", ids, err)
+	}
+
+	var objects []struct {
+		Object uint32
+		Tags   []string
+	}
+	out = runCmd(t, "-snapshot", snap, "-o", "json", "objtags", "2", "9")
+	if err := json.Unmarshal([]byte(out), &objects); err != nil {
+		t.Fatalf("objtags -o json: %v\n%s", err, out)
+	}
+	if len(objects) != 2 || !reflect.DeepEqual(objects[0].Tags, []string{"city:beijing", "vip"}) || len(objects[1].Tags) != 0 {
+		t.Errorf("objtags = %+v", objects)
+	}
+}
+
+// TestRun_ConvertCopy tests converting a snapshot through every format
+// and copying it to a file store
+func TestRun_ConvertCopy(t *testing.T) {
+	snap := writeSnapshot(t)
+	dir := t.TempDir()
+
+	wide := filepath.Join(dir, "wide.snap")
+	legacy := filepath.Join(dir, "legacy.json")
+	narrow := filepath.Join(dir, "narrow.snap")
+	runCmd(t, "convert", "-to", "binary64", snap, wide)
+	runCmd(t, "convert", "-to", "json", wide, legacy)
+	runCmd(t, "convert", legacy, narrow)
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-snapshot", wide, "tags"}, &stdout, &stderr); err == nil || !strings.Contains(err.Error(), "convert") {
+		t.Errorf("opening a binary64 snapshot = %v, want a hint to convert", err)
+	}
+
+	data := filepath.Join(dir, "data")
+	runCmd(t, "-snapshot", narrow, "copy", "-to-data", data)
+	got := runCmd(t, "-data", data, "count", "vip", "city:beijing", "missing")
+	want := "TAG           COUNT\nvip           3\ncity:beijing  2\nmissing       0\n"
+	if got != want {
+		t.Errorf("count after copy =\n%s\nwant\n%s", got, want)
+	}
+
+	// Inspecting or copying the store writes nothing to it
+	idWidth := filepath.Join(data, "idwidth.meta")
+	if err := os.Remove(idWidth); err != nil {
+		t.Fatal(err)
+	}
+	vip := filepath.Join(data, "vip.bitmap")
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(vip, past, past); err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, "-data", data, "stats")
+	runCmd(t, "-data", data, "export", "vip")
+	runCmd(t, "-data", data, "copy", "-to-snapshot", filepath.Join(dir, "copy.snap"))
+	if _, err := os.Stat(idWidth); !os.IsNotExist(err) {
+		t.Errorf("the ID width was recorded in the source: %v", err)
+	}
+	if info, err := os.Stat(vip); err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("the vip tag of the source was rewritten: %v", err)
+	}
+
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, ".tmp-*")); len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
+
+// TestRun_Import tests importing into a snapshot
+func TestRun_Import(t *testing.T) {
+	snap := writeSnapshot(t)
+	input := filepath.Join(t.TempDir(), "segment.csv")
+	if err := os.WriteFile(input, []byte("object_id,tag\n7,vip\nx,vip\n8,vip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-snapshot", snap, "import", "-header", "-replace", input}, &stdout, &stderr); err == nil {
+		t.Error("import of a bad row succeeded")
+	}
+
+	runCmd(t, "-snapshot", snap, "import", "-header", "-replace", "-skip-bad", input)
+	if got := runCmd(t, "-snapshot", snap, "dump", "vip"); got != "7\n8\n" {
+		t.Errorf("vip after import = %q", got)
+	}
+}
+
+// TestRun_Export tests exporting a query result and tags
+func TestRun_Export(t *testing.T) {
+	snap := writeSnapshot(t)
+
+	if got := runCmd(t, "-snapshot", snap, "export", "-format", "jsonl", "vip AND NOT city:*"); got != `{"id":1}`+"\n" {
+		t.Errorf("export query = %q", got)
+	}
+
+	out := filepath.Join(t.TempDir(), "tags.csv")
+	if got := runCmd(t, "-snapshot", snap, "export", "-tags", "new,city:beijing", "-out", out); got != "" {
+		t.Errorf("export -out wrote %q to stdout", got)
+	}
+	data, err := os.ReadFile(out)
+	if want := "2,city:beijing\n3,city:beijing\n4,new\n"; err != nil || string(data) != want {
+		t.Errorf("export -out = %q, %v, want %q", data, err, want)
+	}
+}
+
+// TestRun_Errors tests command line errors
+func TestRun_Errors(t *testing.T) {
+	snap := writeSnapshot(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	for _, args := range [][]string{
+		{"tags"},
+		{"-snapshot", snap, "-data", "x", "tags"},
+		{"-snapshot", snap, "nope"},
+		{"-snapshot", snap, "-o", "xml", "tags"},
+		{"-snapshot", snap, "query", "vip AND"},
+		{"-snapshot", snap, "objtags", "x"},
+		{"-snapshot", snap, "copy"},
+		{"-data", missing, "tags"},
+		{"convert", "-to", "yaml", snap, snap},
+	} {
+		var stdout, stderr bytes.Buffer
+		if err := run(args, &stdout, &stderr); err == nil {
+			t.Errorf("tagbox %s succeeded", strings.Join(args, " "))
+		}
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("a missing -data directory was created: %v", err)
+	}
+}
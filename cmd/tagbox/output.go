@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// output writes command results as an aligned table or as JSON.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// newOutput creates an output in the given format.
+func newOutput(w io.Writer, format string) (*output, error) {
+	switch format {
+	case "table":
+		return &output{w: w}, nil
+	case "json":
+		return &output{w: w, json: true}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// table writes rows under a header, or v as JSON.
+func (o *output) table(header []string, rows [][]string, v interface{}) error {
+	if o.json {
+		return o.value(v)
+	}
+
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// value writes v as indented JSON.
+func (o *output) value(v interface{}) error {
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// ids writes object IDs one per line, or as a JSON array, without
+// holding them in memory.
+func (o *output) ids(next func() (uint32, bool)) error {
+	bw := bufio.NewWriter(o.w)
+	sep := ""
+	if o.json {
+		bw.WriteString("[")
+		sep = "\n  "
+	}
+
+	first := true
+	for {
+		id, ok := next()
+		if !ok {
+			break
+		}
+		if o.json && !first {
+			bw.WriteString(",")
+		}
+		first = false
+		fmt.Fprintf(bw, "%s%d", sep, id)
+		if !o.json {
+			bw.WriteString("\n")
+		}
+	}
+
+	if o.json {
+		if !first {
+			bw.WriteString("\n")
+		}
+		bw.WriteString("]\n")
+	}
+	return bw.Flush()
+}
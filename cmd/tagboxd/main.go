@@ -0,0 +1,181 @@
+// Command tagboxd serves one tag system over HTTP.
+//
+// Usage:
+//
+//	tagboxd [-addr :8080] [-grpc :9090] [-resp :6380] [-redis localhost:6379 | -data DIR | -memory] [-wal DIR] [-snapshot FILE]
+//
+// See package httpapi for the routes, package grpcapi for the gRPC service
+// served when -grpc is set and package respapi for the Redis protocol
+// commands served when -resp is set. On SIGINT or SIGTERM the
+// servers stop accepting requests, wait for the ones in flight and the tag
+// system is closed, which saves it to the store.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/grpcapi"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/httpapi"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/respapi"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "HTTP listen address")
+	grpcAddr := flag.String("grpc", "", "gRPC listen address, disabled when empty")
+	respAddr := flag.String("resp", "", "Redis protocol listen address, disabled when empty")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis server address")
+	redisPassword := flag.String("redis-password", "", "Redis password")
+	redisDB := flag.Int("redis-db", 0, "Redis database number")
+	keyPrefix := flag.String("prefix", "tags:", "Redis key prefix for tags")
+	dataDir := flag.String("data", "", "store tags in this directory instead of Redis")
+	memory := flag.Bool("memory", false, "keep tags in memory only, for testing")
+	walDir := flag.String("wal", "", "write-ahead log directory")
+	snapshotPath := flag.String("snapshot", "", "snapshot file, enables POST /v1/snapshot")
+	snapshotInterval := flag.Duration("snapshot-interval", 0, "write a snapshot at this interval (requires -snapshot)")
+	cache := flag.Bool("cache", false, "cache query results")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for requests in flight on shutdown")
+	flag.Parse()
+
+	config := tagbox.DefaultConfig()
+	config.RedisAddr = *redisAddr
+	config.RedisPassword = *redisPassword
+	config.RedisDB = *redisDB
+	config.KeyPrefix = *keyPrefix
+	config.WALDir = *walDir
+	config.SnapshotPath = *snapshotPath
+	config.CacheResults = *cache
+	if *snapshotInterval > 0 {
+		config.EnableSnapshot = true
+		config.SnapshotInterval = *snapshotInterval
+	}
+
+	switch {
+	case *memory:
+		config.Store = tagbox.NewMemoryStore()
+	case *dataDir != "":
+		store, err := tagbox.NewFileStore(*dataDir)
+		if err != nil {
+			log.Fatalf("Failed to open data directory: %v", err)
+		}
+		config.Store = store
+	}
+
+	ts, err := tagbox.New(config)
+	if err != nil {
+		log.Fatalf("Failed to create tag system: %v", err)
+	}
+	if err := ts.Recover(); err != nil {
+		ts.Close()
+		log.Fatalf("Failed to recover tags: %v", err)
+	}
+	ts.StartSnapshot()
+
+	var opts []httpapi.Option
+	if *snapshotPath != "" {
+		opts = append(opts, httpapi.WithSnapshotPath(*snapshotPath))
+	}
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           httpapi.New(ts, opts...),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var grpcLis net.Listener
+	if *grpcAddr != "" {
+		grpcLis, err = net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			ts.Close()
+			log.Fatalf("Failed to listen on %s: %v", *grpcAddr, err)
+		}
+	}
+	var respLis net.Listener
+	if *respAddr != "" {
+		respLis, err = net.Listen("tcp", *respAddr)
+		if err != nil {
+			ts.Close()
+			log.Fatalf("Failed to listen on %s: %v", *respAddr, err)
+		}
+	}
+
+	serveErr := make(chan error, 3)
+	go func() {
+		log.Printf("Serving %d tags on %s", len(ts.GetAllTags()), *addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	var grpcServer *grpc.Server
+	if grpcLis != nil {
+		grpcServer = grpc.NewServer(grpcapi.ServerCodec())
+		grpcapi.Register(grpcServer, ts)
+		go func() {
+			log.Printf("Serving gRPC on %s", *grpcAddr)
+			serveErr <- grpcServer.Serve(grpcLis)
+		}()
+	}
+
+	var respServer *respapi.Server
+	if respLis != nil {
+		respServer = respapi.NewServer(ts)
+		go func() {
+			log.Printf("Serving RESP on %s", *respAddr)
+			serveErr <- respServer.Serve(respLis)
+		}()
+	}
+
+	failed := false
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Server failed: %v", err)
+			failed = true
+		}
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	grpcStopped := make(chan struct{})
+	go func() {
+		defer close(grpcStopped)
+		if grpcServer == nil {
+			return
+		}
+		go func() {
+			<-shutdownCtx.Done()
+			grpcServer.Stop() // Cut off streams still open at the deadline
+		}()
+		grpcServer.GracefulStop()
+	}()
+	if respServer != nil {
+		if err := respServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("RESP shutdown incomplete: %v", err)
+		}
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown incomplete: %v", err)
+	}
+	<-grpcStopped
+	cancel()
+
+	if err := ts.Close(); err != nil {
+		log.Fatalf("Failed to close tag system: %v", err)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,27 @@
+// Package tagboxtest creates tag systems for the tests of the packages
+// built on tagbox.
+package tagboxtest
+
+import (
+	"testing"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// New creates a TagSystem on a MemoryStore with auto-save disabled, and
+// closes it when the test ends.
+func New(t testing.TB) *tagbox.TagSystem {
+	t.Helper()
+
+	config := tagbox.DefaultConfig()
+	config.AutoSave = false
+	config.Store = tagbox.NewMemoryStore()
+
+	ts, err := tagbox.New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	t.Cleanup(func() { ts.Close() })
+
+	return ts
+}
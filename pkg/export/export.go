@@ -0,0 +1,559 @@
+// Package export streams query results and tags out of a tag system as
+// CSV, JSON Lines or portable roaring bitmaps.
+//
+// Objects are written straight from bitmap iterators, so exporting a
+// segment of tens of millions of objects never holds them in a slice:
+//
+//	w := bufio.NewWriter(f)
+//	stats, err := export.Query(ctx, w, ts, "vip AND NOT churned", export.Options{
+//		Format: export.CSV,
+//		Header: true,
+//		Keys:   ts, // Add the external key of every object
+//	})
+//
+// The layouts, with the key parts present when Options.Keys is set:
+//
+//	CSV      Query: object_id[,object_key]
+//	         Tags:  object_id[,object_key],tag, tag by tag
+//	JSONL    Query: {"id":1[,"key":"k"]}
+//	         Tags:  {"id":1[,"key":"k"],"tags":["a","b"]}, object by object
+//	Roaring  Query: one portable bitmap
+//	         Tags:  a frame per tag, see ReadTags
+//
+// CSV and JSONL exports of tags without keys read back with the ingest
+// package.
+package export
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// Format is the layout of the output.
+type Format int
+
+const (
+	CSV Format = iota
+	JSONL
+	Roaring
+)
+
+// ParseFormat parses "csv", "jsonl" or "roaring".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "csv":
+		return CSV, nil
+	case "jsonl", "ndjson":
+		return JSONL, nil
+	case "roaring":
+		return Roaring, nil
+	}
+	return 0, fmt.Errorf("unknown format %q", s)
+}
+
+func (f Format) String() string {
+	switch f {
+	case CSV:
+		return "csv"
+	case JSONL:
+		return "jsonl"
+	case Roaring:
+		return "roaring"
+	}
+	return "Format(" + strconv.Itoa(int(f)) + ")"
+}
+
+// ContentType returns the MIME type of the format.
+func (f Format) ContentType() string {
+	switch f {
+	case CSV:
+		return "text/csv"
+	case JSONL:
+		return "application/x-ndjson"
+	}
+	return "application/octet-stream"
+}
+
+// KeyResolver translates object IDs to external keys, as
+// tagbox.TagSystem.ObjectKey does.
+type KeyResolver interface {
+	ObjectKey(objectID uint32) (string, bool)
+}
+
+// Querier evaluates expressions.
+type Querier interface {
+	QueryExpr(expr string) (*roaring.Bitmap, error)
+}
+
+// Source lists and reads tags.
+type Source interface {
+	GetAllTags() []string
+	Query(tag string) (*roaring.Bitmap, error)
+}
+
+// PagedSource is a Source that also reads tags a page at a time, as
+// tagbox.TagSystem does. A JSONL export of its tags holds a page of every
+// tag rather than a copy of it.
+type PagedSource interface {
+	Source
+	TagPage(tag, cursor string, limit int) (tagbox.Page, error)
+}
+
+// Options configures an export.
+type Options struct {
+	Format Format
+	Header bool // Write a header row to CSV
+
+	// Keys, when set, adds the external key of each object. Objects
+	// without a key get an empty CSV field and no JSON "key". The roaring
+	// format cannot carry keys.
+	Keys KeyResolver
+
+	// Tags limits Tags to these tags; all tags when nil.
+	Tags []string
+}
+
+// Stats describes a finished export.
+type Stats struct {
+	Objects int64 // Distinct objects written; not counted by Tags in CSV and roaring
+	Rows    int64 // CSV rows or JSON lines written, without the header
+	Tags    int   // Tags written, for Tags
+	Bytes   int64 // Bytes written
+}
+
+// ErrKeysUnsupported is returned when key translation is requested for
+// the roaring format.
+var ErrKeysUnsupported = errors.New("export: the roaring format cannot carry object keys")
+
+// checkInterval is how many objects are written between checks of the
+// context.
+const checkInterval = 4096
+
+// tagPageSize is how many objects of each tag a JSONL export of tags
+// reads at a time from a PagedSource.
+const tagPageSize = 4096
+
+// maxTagLen bounds the tag names ReadTags accepts.
+const maxTagLen = 1 << 20
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Query exports the objects matching an expression.
+func Query(ctx context.Context, w io.Writer, q Querier, expr string, opts Options) (Stats, error) {
+	result, err := q.QueryExpr(expr)
+	if err != nil {
+		return Stats{}, err
+	}
+	return Bitmap(ctx, w, result, opts)
+}
+
+// Bitmap exports a set of objects, such as a query result.
+func Bitmap(ctx context.Context, w io.Writer, bitmap *roaring.Bitmap, opts Options) (Stats, error) {
+	if opts.Format == Roaring {
+		if opts.Keys != nil {
+			return Stats{}, ErrKeysUnsupported
+		}
+		n, err := bitmap.WriteTo(w)
+		return Stats{Objects: int64(bitmap.GetCardinality()), Bytes: n}, err
+	}
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriterSize(cw, 64<<10)
+	var stats Stats
+	var err error
+	switch opts.Format {
+	case CSV:
+		err = bitmapCSV(ctx, bw, bitmap, opts, &stats)
+	case JSONL:
+		err = bitmapJSONL(ctx, bw, bitmap, opts, &stats)
+	default:
+		err = fmt.Errorf("export: unknown format %v", opts.Format)
+	}
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	stats.Objects = stats.Rows
+	stats.Bytes = cw.n
+	return stats, err
+}
+
+func bitmapCSV(ctx context.Context, w io.Writer, bitmap *roaring.Bitmap, opts Options, stats *Stats) error {
+	cw := csv.NewWriter(w)
+	record := []string{"object_id"}
+	if opts.Keys != nil {
+		record = append(record, "object_key")
+	}
+	if opts.Header {
+		cw.Write(record)
+	}
+
+	for it := bitmap.Iterator(); it.HasNext(); {
+		if stats.Rows%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		objectID := it.Next()
+		record[0] = strconv.FormatUint(uint64(objectID), 10)
+		if opts.Keys != nil {
+			record[1], _ = opts.Keys.ObjectKey(objectID)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		stats.Rows++
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func bitmapJSONL(ctx context.Context, w *bufio.Writer, bitmap *roaring.Bitmap, opts Options, stats *Stats) error {
+	buf := make([]byte, 0, 128)
+	for it := bitmap.Iterator(); it.HasNext(); {
+		if stats.Rows%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		buf = appendObject(buf[:0], it.Next(), opts.Keys)
+		buf = append(buf, "}\n"...)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		stats.Rows++
+	}
+	return nil
+}
+
+// appendObject appends the opening of a JSON object line:
+// {"id":1 or {"id":1,"key":"k".
+func appendObject(buf []byte, objectID uint32, keys KeyResolver) []byte {
+	buf = append(buf, `{"id":`...)
+	buf = strconv.AppendUint(buf, uint64(objectID), 10)
+	if keys != nil {
+		if key, ok := keys.ObjectKey(objectID); ok {
+			buf = append(buf, `,"key":`...)
+			buf = appendString(buf, key)
+		}
+	}
+	return buf
+}
+
+// appendString appends s as a JSON string.
+func appendString(buf []byte, s string) []byte {
+	quoted, _ := json.Marshal(s)
+	return append(buf, quoted...)
+}
+
+// Tags exports tags with their objects: CSV tag by tag, JSONL object by
+// object, and roaring as a frame per tag. CSV and roaring read one tag at
+// a time, so a tag modified during the export is written as it was when
+// it was read; JSONL reads a PagedSource a page at a time.
+func Tags(ctx context.Context, w io.Writer, src Source, opts Options) (Stats, error) {
+	if opts.Format == Roaring && opts.Keys != nil {
+		return Stats{}, ErrKeysUnsupported
+	}
+
+	tags := opts.Tags
+	if tags == nil {
+		tags = src.GetAllTags()
+	}
+	tags = append([]string(nil), tags...)
+	sort.Strings(tags)
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriterSize(cw, 64<<10)
+	stats := Stats{Tags: len(tags)}
+	var err error
+	switch opts.Format {
+	case CSV:
+		err = tagsCSV(ctx, bw, src, tags, opts, &stats)
+	case JSONL:
+		err = tagsJSONL(ctx, bw, src, tags, opts, &stats)
+	case Roaring:
+		err = tagsRoaring(ctx, bw, src, tags, &stats)
+	default:
+		err = fmt.Errorf("export: unknown format %v", opts.Format)
+	}
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	stats.Bytes = cw.n
+	return stats, err
+}
+
+func tagsCSV(ctx context.Context, w io.Writer, src Source, tags []string, opts Options, stats *Stats) error {
+	cw := csv.NewWriter(w)
+	record := []string{"object_id", "tag"}
+	if opts.Keys != nil {
+		record = []string{"object_id", "object_key", "tag"}
+	}
+	if opts.Header {
+		cw.Write(record)
+	}
+
+	for _, tag := range tags {
+		bitmap, err := src.Query(tag)
+		if err != nil {
+			return err
+		}
+
+		record[len(record)-1] = tag
+		for it := bitmap.Iterator(); it.HasNext(); {
+			if stats.Rows%checkInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+
+			objectID := it.Next()
+			record[0] = strconv.FormatUint(uint64(objectID), 10)
+			if opts.Keys != nil {
+				record[1], _ = opts.Keys.ObjectKey(objectID)
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+			stats.Rows++
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// objectIterator walks the objects of one tag in ID order.
+type objectIterator interface {
+	next() (uint32, bool, error)
+}
+
+// bitmapIterator walks a copy of a tag.
+type bitmapIterator struct {
+	it roaring.IntPeekable
+}
+
+func (it bitmapIterator) next() (uint32, bool, error) {
+	if !it.it.HasNext() {
+		return 0, false, nil
+	}
+	return it.it.Next(), true, nil
+}
+
+// pageIterator walks a tag of a PagedSource a page at a time.
+type pageIterator struct {
+	src  PagedSource
+	tag  string
+	page tagbox.Page
+	read bool // Whether the first page was read
+}
+
+func (it *pageIterator) next() (uint32, bool, error) {
+	if len(it.page.Objects) == 0 {
+		if it.read && it.page.Next == "" {
+			return 0, false, nil
+		}
+		page, err := it.src.TagPage(it.tag, it.page.Next, tagPageSize)
+		if err != nil {
+			return 0, false, err
+		}
+		it.page, it.read = page, true
+		if len(page.Objects) == 0 {
+			return 0, false, nil
+		}
+	}
+
+	objectID := it.page.Objects[0]
+	it.page.Objects = it.page.Objects[1:]
+	return objectID, true, nil
+}
+
+// cursor is the position of a merge in one tag.
+type cursor struct {
+	tag  string
+	it   objectIterator
+	next uint32
+}
+
+// cursorHeap orders cursors by their next object, then by tag.
+type cursorHeap []*cursor
+
+func (h cursorHeap) Len() int { return len(h) }
+func (h cursorHeap) Less(i, j int) bool {
+	if h[i].next != h[j].next {
+		return h[i].next < h[j].next
+	}
+	return h[i].tag < h[j].tag
+}
+func (h cursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x interface{}) { *h = append(*h, x.(*cursor)) }
+func (h *cursorHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// tagsJSONL merges the iterators of every tag to write each object once
+// with all its tags, holding one cursor per tag. Tags of a PagedSource
+// are read a page at a time, so a tag modified during the export may be
+// written partly before and partly after the change.
+func tagsJSONL(ctx context.Context, w *bufio.Writer, src Source, tags []string, opts Options, stats *Stats) error {
+	paged, _ := src.(PagedSource)
+	h := make(cursorHeap, 0, len(tags))
+	for _, tag := range tags {
+		var it objectIterator
+		if paged != nil {
+			it = &pageIterator{src: paged, tag: tag}
+		} else {
+			bitmap, err := src.Query(tag)
+			if err != nil {
+				return err
+			}
+			it = bitmapIterator{bitmap.Iterator()}
+		}
+
+		objectID, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, &cursor{tag: tag, it: it, next: objectID})
+		}
+	}
+	heap.Init(&h)
+
+	buf := make([]byte, 0, 256)
+	for h.Len() > 0 {
+		if stats.Rows%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		objectID := h[0].next
+		buf = appendObject(buf[:0], objectID, opts.Keys)
+		buf = append(buf, `,"tags":[`...)
+		for first := true; h.Len() > 0 && h[0].next == objectID; first = false {
+			c := h[0]
+			if !first {
+				buf = append(buf, ',')
+			}
+			buf = appendString(buf, c.tag)
+
+			next, ok, err := c.it.next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				c.next = next
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		buf = append(buf, "]}\n"...)
+
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		stats.Rows++
+	}
+
+	stats.Objects = stats.Rows
+	return nil
+}
+
+// tagsRoaring writes a frame per tag: the uvarint length of the tag, the
+// tag, the uvarint size of the bitmap and the bitmap in the portable
+// roaring format.
+func tagsRoaring(ctx context.Context, w io.Writer, src Source, tags []string, stats *Stats) error {
+	var header []byte
+	for _, tag := range tags {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		bitmap, err := src.Query(tag)
+		if err != nil {
+			return err
+		}
+
+		header = binary.AppendUvarint(header[:0], uint64(len(tag)))
+		header = append(header, tag...)
+		header = binary.AppendUvarint(header, bitmap.GetSerializedSizeInBytes())
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := bitmap.WriteTo(w); err != nil {
+			return err
+		}
+		stats.Rows++
+	}
+
+	return nil
+}
+
+// ReadTags reads a roaring export of Tags, calling fn with every tag.
+func ReadTags(r io.Reader, fn func(tag string, bitmap *roaring.Bitmap) error) error {
+	br := bufio.NewReader(r)
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("export: bad frame: %w", err)
+		}
+		if size > maxTagLen {
+			return fmt.Errorf("export: bad frame: tag of %d bytes", size)
+		}
+		tag := make([]byte, size)
+		if _, err := io.ReadFull(br, tag); err != nil {
+			return fmt.Errorf("export: bad frame: %w", err)
+		}
+
+		size, err = binary.ReadUvarint(br)
+		if err != nil {
+			return fmt.Errorf("export: bad frame for tag %s: %w", tag, err)
+		}
+		bitmap := roaring.NewBitmap()
+		n, err := bitmap.ReadFrom(io.LimitReader(br, int64(size)))
+		if err != nil {
+			return fmt.Errorf("export: bad bitmap for tag %s: %w", tag, err)
+		}
+		if n != int64(size) {
+			return fmt.Errorf("export: bad frame for tag %s: bitmap of %d bytes, frame of %d", tag, n, size)
+		}
+
+		if err := fn(string(tag), bitmap); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/internal/tagboxtest"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/ingest"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// TestQuery tests exporting a query result in every format
+func TestQuery(t *testing.T) {
+	ts := tagboxtest.New(t)
+	ts.AddTagByKey("u-1", "vip")
+	ts.AddTagByKey(`u,"2"`, "vip")
+	ts.AddTagByKey("u-3", "churned")
+
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"csv", Options{Format: CSV, Header: true}, "object_id\n0\n1\n"},
+		{"csv keys", Options{Format: CSV, Keys: ts}, "0,u-1\n1,\"u,\"\"2\"\"\"\n"},
+		{"jsonl", Options{Format: JSONL}, "{\"id\":0}\n{\"id\":1}\n"},
+		{"jsonl keys", Options{Format: JSONL, Keys: ts}, `{"id":0,"key":"u-1"}` + "\n" + `{"id":1,"key":"u,\"2\""}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		stats, err := Query(context.Background(), &buf, ts, "vip AND NOT churned", tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, buf.String(), tt.want)
+		}
+		if stats.Objects != 2 || stats.Rows != 2 || stats.Bytes != int64(len(tt.want)) {
+			t.Errorf("%s stats = %+v", tt.name, stats)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := Query(context.Background(), &buf, ts, "vip", Options{Format: Roaring}); err != nil {
+		t.Fatal(err)
+	}
+	bitmap := roaring.NewBitmap()
+	if _, err := bitmap.ReadFrom(&buf); err != nil || !reflect.DeepEqual(bitmap.ToArray(), []uint32{0, 1}) {
+		t.Errorf("roaring export = %v, %v", bitmap.ToArray(), err)
+	}
+
+	if _, err := Query(context.Background(), &buf, ts, "vip", Options{Format: Roaring, Keys: ts}); err != ErrKeysUnsupported {
+		t.Errorf("roaring with keys error = %v", err)
+	}
+	var perr *tagbox.ParseError
+	if _, err := Query(context.Background(), &buf, ts, "vip AND", Options{}); !errors.As(err, &perr) {
+		t.Errorf("bad expression error = %v", err)
+	}
+}
+
+// TestTags tests exporting tags and importing them back
+func TestTags(t *testing.T) {
+	ts := tagboxtest.New(t)
+	ts.BatchAddObjectsToTag([]uint32{1, 2, 3}, "vip")
+	ts.BatchAddObjectsToTag([]uint32{2, 3, 70000}, "city:beijing")
+	ts.AddTag(4, "new")
+
+	var buf bytes.Buffer
+	stats, err := Tags(context.Background(), &buf, ts, Options{Format: JSONL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":1,"tags":["vip"]}
+{"id":2,"tags":["city:beijing","vip"]}
+{"id":3,"tags":["city:beijing","vip"]}
+{"id":4,"tags":["new"]}
+{"id":70000,"tags":["city:beijing"]}
+`
+	if buf.String() != want {
+		t.Errorf("jsonl =\n%s\nwant\n%s", buf.String(), want)
+	}
+	if stats.Objects != 5 || stats.Tags != 3 {
+		t.Errorf("jsonl stats = %+v", stats)
+	}
+
+	buf.Reset()
+	if _, err := Tags(context.Background(), &buf, ts, Options{Format: CSV, Tags: []string{"vip", "new"}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "4,new\n1,vip\n2,vip\n3,vip\n"; buf.String() != want {
+		t.Errorf("csv = %q, want %q", buf.String(), want)
+	}
+
+	// Every format reads back into the same tags
+	for _, format := range []Format{CSV, JSONL, Roaring} {
+		buf.Reset()
+		if _, err := Tags(context.Background(), &buf, ts, Options{Format: format}); err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+
+		ts2 := tagboxtest.New(t)
+		switch format {
+		case Roaring:
+			err = ReadTags(&buf, func(tag string, bitmap *roaring.Bitmap) error {
+				return ts2.BatchAddObjectsToTag(bitmap.ToArray(), tag)
+			})
+		case CSV:
+			_, err = ingest.Import(context.Background(), ts2, &buf, ingest.Options{Format: ingest.CSV})
+		case JSONL:
+			_, err = ingest.Import(context.Background(), ts2, &buf, ingest.Options{Format: ingest.JSONL})
+		}
+		if err != nil {
+			t.Fatalf("%v: read back: %v", format, err)
+		}
+
+		for _, tag := range []string{"vip", "city:beijing", "new"} {
+			want, _ := ts.Query(tag)
+			got, _ := ts2.Query(tag)
+			if !got.Equals(want) {
+				t.Errorf("%v: tag %s = %v, want %v", format, tag, got.ToArray(), want.ToArray())
+			}
+		}
+	}
+
+	if err := ReadTags(strings.NewReader("\x03vi"), func(string, *roaring.Bitmap) error { return nil }); err == nil {
+		t.Error("truncated frame was accepted")
+	}
+	// A bitmap shorter than its frame leaves bytes that must not be read
+	// as the next frame
+	data, _ := roaring.BitmapOf(1, 2).ToBytes()
+	empty, _ := roaring.NewBitmap().ToBytes()
+	next := append([]byte{1, 'x', byte(len(empty))}, empty...)
+	frame := append([]byte{3, 'v', 'i', 'p', byte(len(data) + len(next))}, data...)
+	frame = append(frame, next...)
+	if err := ReadTags(bytes.NewReader(frame), func(string, *roaring.Bitmap) error { return nil }); err == nil {
+		t.Error("frame longer than its bitmap was accepted")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Tags(ctx, &buf, ts, Options{Format: JSONL}); err != context.Canceled {
+		t.Errorf("canceled export error = %v", err)
+	}
+}
+
+// TestTags_Paged tests that reading the tags of a PagedSource a page at a
+// time exports the same JSONL as reading copies of them
+func TestTags_Paged(t *testing.T) {
+	ts := tagboxtest.New(t)
+	ids := make([]uint32, 3*tagPageSize)
+	for i := range ids {
+		ids[i] = uint32(i * 2)
+	}
+	ts.BatchAddObjectsToTag(ids, "even")
+	ts.BatchAddObjectsToTag(ids[:tagPageSize+1], "low")
+	ts.AddTag(1, "odd")
+
+	var paged, copied bytes.Buffer
+	stats, err := Tags(context.Background(), &paged, ts, Options{Format: JSONL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Tags(context.Background(), &copied, struct{ Source }{ts}, Options{Format: JSONL}); err != nil {
+		t.Fatal(err)
+	}
+
+	if paged.String() != copied.String() {
+		t.Error("paged and copied exports differ")
+	}
+	if stats.Objects != int64(len(ids)+1) || stats.Rows != stats.Objects {
+		t.Errorf("paged stats = %+v, want %d objects", stats, len(ids)+1)
+	}
+}
@@ -0,0 +1,263 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// DefaultTimeout is the deadline of a Client call when Client.Timeout is 0.
+const DefaultTimeout = 30 * time.Second
+
+// Client calls a remote TagService. It implements tagbox.Tagger, so it can
+// stand in for an embedded TagSystem. Errors are gRPC status errors; those
+// reporting an expression that does not parse also unwrap to a
+// *tagbox.ParseError, as from an embedded TagSystem.
+type Client struct {
+	Timeout time.Duration // Deadline of each call, DefaultTimeout when 0
+
+	conn   grpc.ClientConnInterface
+	closer io.Closer
+}
+
+var _ tagbox.Tagger = (*Client)(nil)
+
+// NewClient creates a Client on an existing connection, which the caller
+// keeps ownership of.
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{conn: conn}
+}
+
+// Dial creates a Client with its own connection to target. Close releases
+// the connection.
+func Dial(target string, opts ...grpc.DialOption) (*Client, error) {
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, closer: conn}, nil
+}
+
+// Close closes the connection if the Client created it.
+func (c *Client) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// context returns the context of one call.
+func (c *Client) context() (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// invoke makes a unary call.
+func (c *Client) invoke(method string, req, resp interface{}) error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	return fromStatus(c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp, callCodec))
+}
+
+// statusError is a gRPC status error that unwraps to the tag system error
+// it reports.
+type statusError struct {
+	err   error // The status error
+	cause error // The tag system error
+}
+
+func (e *statusError) Error() string              { return e.err.Error() }
+func (e *statusError) Unwrap() error              { return e.cause }
+func (e *statusError) GRPCStatus() *status.Status { return status.Convert(e.err) }
+
+// fromStatus returns err, which may be a gRPC status error, with the tag
+// system error that toStatus described in it.
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != ServiceName {
+			continue
+		}
+		if info.Reason == reasonParseError {
+			pos, _ := strconv.Atoi(info.Metadata["pos"])
+			return &statusError{err: err, cause: &tagbox.ParseError{Pos: pos, Msg: info.Metadata["msg"]}}
+		}
+	}
+	return err
+}
+
+// AddTag adds a tag to an object.
+func (c *Client) AddTag(objectID uint32, tag string) error {
+	return c.invoke("AddTag", &TagRequest{ObjectID: objectID, Tag: tag}, &Empty{})
+}
+
+// RemoveTag removes a tag from an object.
+func (c *Client) RemoveTag(objectID uint32, tag string) error {
+	return c.invoke("RemoveTag", &TagRequest{ObjectID: objectID, Tag: tag}, &Empty{})
+}
+
+// BatchAddTags adds tags to one object.
+func (c *Client) BatchAddTags(objectID uint32, tags []string) error {
+	return c.invoke("BatchAddTags", &BatchAddTagsRequest{ObjectID: objectID, Tags: tags}, &Empty{})
+}
+
+// BatchAddObjectsToTag adds objects to one tag.
+func (c *Client) BatchAddObjectsToTag(objectIDs []uint32, tag string) error {
+	return c.invoke("BatchAddObjects", &BatchAddObjectsRequest{ObjectIDs: objectIDs, Tag: tag}, &Empty{})
+}
+
+// GetObjectTags returns the tags of an object.
+func (c *Client) GetObjectTags(objectID uint32) ([]string, error) {
+	var resp TagList
+	if err := c.invoke("GetObjectTags", &ObjectRequest{ObjectID: objectID}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Tags, nil
+}
+
+// GetTagCount returns the number of objects with a tag.
+func (c *Client) GetTagCount(tag string) (uint64, error) {
+	var resp CountResponse
+	if err := c.invoke("GetTagCount", &TagName{Tag: tag}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// Count returns the number of objects matching an expression without
+// transferring them.
+func (c *Client) Count(expr string) (uint64, error) {
+	var resp CountResponse
+	if err := c.invoke("Count", &QueryRequest{Expr: expr}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// Query returns the objects that have a tag.
+func (c *Client) Query(tag string) (*roaring.Bitmap, error) {
+	return c.QueryExpr(tagbox.Tag(tag).String())
+}
+
+// QueryExpr evaluates an expression on the server and transfers the result
+// as a serialized bitmap.
+func (c *Client) QueryExpr(expr string) (*roaring.Bitmap, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	var data []byte
+	err := c.query(ctx, &QueryRequest{Expr: expr, Encoding: EncodingRoaring}, func(chunk *QueryChunk) error {
+		data = append(data, chunk.Roaring...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := roaring.NewBitmap()
+	if _, err := result.ReadFrom(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// QueryIDs evaluates an expression on the server and passes the result to
+// fn in ascending chunks of at most chunkSize IDs (0 selects
+// DefaultIDChunk), without holding the whole result in memory. An error
+// returned by fn cancels the call and is returned.
+func (c *Client) QueryIDs(ctx context.Context, expr string, chunkSize int, fn func(objectIDs []uint32) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	return c.query(ctx, &QueryRequest{Expr: expr, ChunkSize: uint32(chunkSize)}, func(chunk *QueryChunk) error {
+		return fn(chunk.ObjectIDs)
+	})
+}
+
+// query makes a Query call and passes every chunk to fn.
+func (c *Client) query(ctx context.Context, req *QueryRequest, fn func(*QueryChunk) error) error {
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], "/"+ServiceName+"/Query", callCodec)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var chunk QueryChunk
+		err := stream.RecvMsg(&chunk)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fromStatus(err)
+		}
+		if err := fn(&chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// IngestStream sends batch adds to the server over one stream.
+type IngestStream struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+// Ingest opens a stream for bulk ingestion. The batches are applied in
+// the order they are sent; the stream ends at the first failing batch.
+func (c *Client) Ingest(ctx context.Context) (*IngestStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[1], "/"+ServiceName+"/Ingest", callCodec)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &IngestStream{stream: stream, cancel: cancel}, nil
+}
+
+// Send queues objects to be added to a tag. It returns io.EOF when the
+// server has ended the stream; CloseAndRecv then returns the reason.
+func (s *IngestStream) Send(objectIDs []uint32, tag string) error {
+	return s.stream.SendMsg(&BatchAddObjectsRequest{ObjectIDs: objectIDs, Tag: tag})
+}
+
+// CloseAndRecv ends the stream and waits for the server to report what it
+// applied.
+func (s *IngestStream) CloseAndRecv() (*IngestResponse, error) {
+	defer s.cancel()
+
+	if err := s.stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	var resp IngestResponse
+	if err := s.stream.RecvMsg(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,46 @@
+package grpcapi
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// codec marshals the messages of this package with their hand-written
+// encoding and any other proto.Message with the protobuf runtime, so a
+// server forced to use it can still host generated services. It is named
+// "proto", which keeps the wire format and content type compatible with
+// clients and servers generated from tagbox.proto.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case message:
+		return m.marshal(nil), nil
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("grpcapi: cannot marshal %T", v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	switch m := v.(type) {
+	case message:
+		return m.unmarshal(data)
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("grpcapi: cannot unmarshal into %T", v)
+}
+
+func (codec) Name() string { return "proto" }
+
+// ServerCodec returns the server option a grpc.Server hosting the
+// TagService must be created with.
+func ServerCodec() grpc.ServerOption {
+	return grpc.ForceServerCodec(codec{})
+}
+
+// callCodec is passed to every call a Client makes.
+var callCodec = grpc.ForceCodec(codec{})
@@ -0,0 +1,245 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/internal/tagboxtest"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// newTestClient serves ts over an in-memory listener and returns a client.
+func newTestClient(t *testing.T, ts *tagbox.TagSystem) *Client {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(ServerCodec())
+	Register(s, ts)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	client, err := Dial("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// TestMessages_Encoding tests the hand-written protobuf encoding
+func TestMessages_Encoding(t *testing.T) {
+	msgs := []message{
+		&TagRequest{ObjectID: 300, Tag: "vip"},
+		&BatchAddTagsRequest{ObjectID: 1, Tags: []string{"a", "", "c"}},
+		&BatchAddObjectsRequest{ObjectIDs: []uint32{0, 1, 1 << 31}, Tag: "x"},
+		&QueryRequest{Expr: "a AND b", Encoding: EncodingRoaring, ChunkSize: 7},
+		&QueryChunk{ObjectIDs: []uint32{5, 6}, Roaring: []byte{1, 2, 3}},
+		&CountResponse{Count: 1 << 40},
+		&ObjectRequest{ObjectID: 9},
+		&TagName{Tag: "t"},
+		&TagList{Tags: []string{"a", "b"}},
+		&IngestResponse{Batches: 2, Objects: 10},
+	}
+
+	for _, msg := range msgs {
+		data := msg.marshal(nil)
+
+		// Unknown fields of every wire type are skipped
+		data = protowire.AppendTag(data, 99, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+		data = protowire.AppendTag(data, 100, protowire.BytesType)
+		data = protowire.AppendString(data, "unknown")
+
+		got := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(message)
+		if err := got.unmarshal(data); err != nil {
+			t.Errorf("%T: %v", msg, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%T round trip = %+v, want %+v", msg, got, msg)
+		}
+	}
+
+	// Field 1 = 300, field 2 = "vip", as protoc would encode them
+	want := []byte{0x08, 0xac, 0x02, 0x12, 0x03, 'v', 'i', 'p'}
+	if data := (&TagRequest{ObjectID: 300, Tag: "vip"}).marshal(nil); !reflect.DeepEqual(data, want) {
+		t.Errorf("TagRequest encoding = %x, want %x", data, want)
+	}
+
+	// Unpacked repeated fields are accepted
+	var unpacked []byte
+	for _, id := range []uint32{3, 4} {
+		unpacked = protowire.AppendTag(unpacked, 1, protowire.VarintType)
+		unpacked = protowire.AppendVarint(unpacked, uint64(id))
+	}
+	var req BatchAddObjectsRequest
+	if err := req.unmarshal(unpacked); err != nil || !reflect.DeepEqual(req.ObjectIDs, []uint32{3, 4}) {
+		t.Errorf("unpacked = %v, %v", req.ObjectIDs, err)
+	}
+
+	if err := req.unmarshal([]byte{0x0a, 0x05, 0x01}); err == nil {
+		t.Error("truncated message should fail")
+	}
+}
+
+// TestClient_Tagger tests that the client and the embedded TagSystem are
+// interchangeable
+func TestClient_Tagger(t *testing.T) {
+	local := tagboxtest.New(t)
+	remote := tagboxtest.New(t)
+	client := newTestClient(t, remote)
+
+	for _, tagger := range []tagbox.Tagger{local, client} {
+		tagger.AddTag(1, "vip")
+		tagger.AddTag(2, "vip")
+		tagger.AddTag(2, "rare tag")
+		tagger.BatchAddTags(3, []string{"vip", "male"})
+		tagger.BatchAddObjectsToTag([]uint32{1, 4, 70000}, "male")
+		tagger.RemoveTag(1, "vip")
+	}
+
+	for _, tagger := range []tagbox.Tagger{local, client} {
+		result, err := tagger.QueryExpr("vip OR male")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{1, 2, 3, 4, 70000}) {
+			t.Errorf("%T QueryExpr = %v", tagger, got)
+		}
+
+		result, _ = tagger.Query("rare tag")
+		if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{2}) {
+			t.Errorf("%T Query = %v", tagger, got)
+		}
+
+		tags, _ := tagger.GetObjectTags(3)
+		sort.Strings(tags)
+		if !reflect.DeepEqual(tags, []string{"male", "vip"}) {
+			t.Errorf("%T GetObjectTags = %v", tagger, tags)
+		}
+
+		if count, _ := tagger.GetTagCount("male"); count != 4 {
+			t.Errorf("%T GetTagCount = %d, want 4", tagger, count)
+		}
+	}
+
+	if count, err := client.Count("vip AND NOT male"); err != nil || count != 1 {
+		t.Errorf("Count = %d, %v, want 1", count, err)
+	}
+}
+
+// TestClient_QueryIDs tests streaming a large result in chunks
+func TestClient_QueryIDs(t *testing.T) {
+	ts := tagboxtest.New(t)
+	client := newTestClient(t, ts)
+
+	ids := make([]uint32, 10000)
+	for i := range ids {
+		ids[i] = uint32(i * 7)
+	}
+	ts.BatchAddObjectsToTag(ids, "many")
+
+	var got []uint32
+	chunks := 0
+	err := client.QueryIDs(context.Background(), "many", 3000, func(objectIDs []uint32) error {
+		if len(objectIDs) > 3000 {
+			t.Errorf("chunk of %d IDs exceeds the chunk size", len(objectIDs))
+		}
+		got = append(got, objectIDs...)
+		chunks++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks != 4 || !reflect.DeepEqual(got, ids) {
+		t.Errorf("received %d IDs in %d chunks, want %d in 4", len(got), chunks, len(ids))
+	}
+
+	stop := errors.New("stop")
+	err = client.QueryIDs(context.Background(), "many", 100, func([]uint32) error { return stop })
+	if err != stop {
+		t.Errorf("QueryIDs error = %v, want the callback's", err)
+	}
+
+	// The serialized result is reassembled from several chunks
+	ts.BatchAddObjectsToTag([]uint32{1 << 20, 1 << 30}, "many")
+	var data []byte
+	chunks = 0
+	err = client.query(context.Background(), &QueryRequest{Expr: "many", Encoding: EncodingRoaring, ChunkSize: 64}, func(chunk *QueryChunk) error {
+		data = append(data, chunk.Roaring...)
+		chunks++
+		return nil
+	})
+	want, _ := ts.Query("many")
+	if wantData, _ := want.ToBytes(); err != nil || chunks < 2 || !reflect.DeepEqual(data, wantData) {
+		t.Errorf("received %d bytes in %d chunks, %v", len(data), chunks, err)
+	}
+
+	result, err := client.QueryExpr("many")
+	if err != nil || !result.Equals(want) {
+		t.Errorf("QueryExpr = %d objects, %v", result.GetCardinality(), err)
+	}
+}
+
+// TestClient_Ingest tests the client-streaming bulk ingestion
+func TestClient_Ingest(t *testing.T) {
+	ts := tagboxtest.New(t)
+	client := newTestClient(t, ts)
+
+	stream, err := client.Ingest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < 50; i++ {
+		if err := stream.Send([]uint32{i, i + 100}, "bulk"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.Send([]uint32{7}, "other")
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Batches != 51 || resp.Objects != 101 {
+		t.Errorf("ingest response = %+v", resp)
+	}
+	if count, _ := ts.GetTagCount("bulk"); count != 100 || !ts.HasTag(7, "other") {
+		t.Errorf("bulk count = %d", count)
+	}
+}
+
+// TestClient_Errors tests the status codes of failed calls
+func TestClient_Errors(t *testing.T) {
+	client := newTestClient(t, tagboxtest.New(t))
+
+	// Parse errors unwrap as from an embedded TagSystem
+	for _, expr := range []string{"a AND (", "OR"} {
+		_, want := tagbox.ParseQuery(expr)
+
+		_, err := client.QueryExpr(expr)
+		var perr *tagbox.ParseError
+		if status.Code(err) != codes.InvalidArgument || !errors.As(err, &perr) || perr.Error() != want.Error() {
+			t.Errorf("QueryExpr(%q) error = %v, want InvalidArgument and %v", expr, err, want)
+		}
+		_, err = client.Count(expr)
+		if status.Code(err) != codes.InvalidArgument || !errors.As(err, &perr) || perr.Error() != want.Error() {
+			t.Errorf("Count(%q) error = %v, want InvalidArgument and %v", expr, err, want)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package grpcapi
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message is implemented by the request and response types of
+// tagbox.proto. The encoding is standard proto3: zero scalars are omitted,
+// repeated uint32 fields are packed and unknown fields are skipped.
+type message interface {
+	marshal(b []byte) []byte
+	unmarshal(b []byte) error
+}
+
+// ResultEncoding selects how Query streams its result.
+type ResultEncoding int32
+
+// Result encodings.
+const (
+	EncodingIDs     ResultEncoding = 0 // Chunks of object IDs in ascending order
+	EncodingRoaring ResultEncoding = 1 // Pieces of the portable roaring serialization
+)
+
+// Empty is the response of the mutation RPCs.
+type Empty struct{}
+
+// TagRequest names one object-tag assignment.
+type TagRequest struct {
+	ObjectID uint32
+	Tag      string
+}
+
+// BatchAddTagsRequest adds tags to one object.
+type BatchAddTagsRequest struct {
+	ObjectID uint32
+	Tags     []string
+}
+
+// BatchAddObjectsRequest adds objects to one tag.
+type BatchAddObjectsRequest struct {
+	ObjectIDs []uint32
+	Tag       string
+}
+
+// QueryRequest evaluates an expression.
+type QueryRequest struct {
+	Expr      string
+	Encoding  ResultEncoding
+	ChunkSize uint32 // IDs per chunk, or bytes per chunk for EncodingRoaring
+}
+
+// QueryChunk is one piece of a query result.
+type QueryChunk struct {
+	ObjectIDs []uint32
+	Roaring   []byte
+}
+
+// CountResponse carries a cardinality.
+type CountResponse struct {
+	Count uint64
+}
+
+// ObjectRequest names an object.
+type ObjectRequest struct {
+	ObjectID uint32
+}
+
+// TagName names a tag.
+type TagName struct {
+	Tag string
+}
+
+// TagList is a list of tag names.
+type TagList struct {
+	Tags []string
+}
+
+// IngestResponse reports what an Ingest stream applied.
+type IngestResponse struct {
+	Batches uint64
+	Objects uint64
+}
+
+func (m *Empty) marshal(b []byte) []byte { return b }
+
+func (m *Empty) unmarshal(b []byte) error {
+	return decodeFields(b, func(protowire.Number, protowire.Type, []byte) int { return 0 })
+}
+
+func (m *TagRequest) marshal(b []byte) []byte {
+	b = appendUvarint(b, 1, uint64(m.ObjectID))
+	return appendString(b, 2, m.Tag)
+}
+
+func (m *TagRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeUint32(typ, b, &m.ObjectID)
+		case 2:
+			return consumeString(typ, b, &m.Tag)
+		}
+		return 0
+	})
+}
+
+func (m *BatchAddTagsRequest) marshal(b []byte) []byte {
+	b = appendUvarint(b, 1, uint64(m.ObjectID))
+	return appendStrings(b, 2, m.Tags)
+}
+
+func (m *BatchAddTagsRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeUint32(typ, b, &m.ObjectID)
+		case 2:
+			return consumeStrings(typ, b, &m.Tags)
+		}
+		return 0
+	})
+}
+
+func (m *BatchAddObjectsRequest) marshal(b []byte) []byte {
+	b = appendPacked(b, 1, m.ObjectIDs)
+	return appendString(b, 2, m.Tag)
+}
+
+func (m *BatchAddObjectsRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumePacked(typ, b, &m.ObjectIDs)
+		case 2:
+			return consumeString(typ, b, &m.Tag)
+		}
+		return 0
+	})
+}
+
+func (m *QueryRequest) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Expr)
+	b = appendUvarint(b, 2, uint64(m.Encoding))
+	return appendUvarint(b, 3, uint64(m.ChunkSize))
+}
+
+func (m *QueryRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Expr)
+		case 2:
+			var v uint32
+			n := consumeUint32(typ, b, &v)
+			m.Encoding = ResultEncoding(v)
+			return n
+		case 3:
+			return consumeUint32(typ, b, &m.ChunkSize)
+		}
+		return 0
+	})
+}
+
+func (m *QueryChunk) marshal(b []byte) []byte {
+	b = appendPacked(b, 1, m.ObjectIDs)
+	if len(m.Roaring) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Roaring)
+	}
+	return b
+}
+
+func (m *QueryChunk) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumePacked(typ, b, &m.ObjectIDs)
+		case 2:
+			if typ != protowire.BytesType {
+				return 0
+			}
+			v, n := protowire.ConsumeBytes(b)
+			m.Roaring = append([]byte(nil), v...)
+			return n
+		}
+		return 0
+	})
+}
+
+func (m *CountResponse) marshal(b []byte) []byte {
+	return appendUvarint(b, 1, m.Count)
+}
+
+func (m *CountResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeUvarint(typ, b, &m.Count)
+		}
+		return 0
+	})
+}
+
+func (m *ObjectRequest) marshal(b []byte) []byte {
+	return appendUvarint(b, 1, uint64(m.ObjectID))
+}
+
+func (m *ObjectRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeUint32(typ, b, &m.ObjectID)
+		}
+		return 0
+	})
+}
+
+func (m *TagName) marshal(b []byte) []byte {
+	return appendString(b, 1, m.Tag)
+}
+
+func (m *TagName) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeString(typ, b, &m.Tag)
+		}
+		return 0
+	})
+}
+
+func (m *TagList) marshal(b []byte) []byte {
+	return appendStrings(b, 1, m.Tags)
+}
+
+func (m *TagList) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num == 1 {
+			return consumeStrings(typ, b, &m.Tags)
+		}
+		return 0
+	})
+}
+
+func (m *IngestResponse) marshal(b []byte) []byte {
+	b = appendUvarint(b, 1, m.Batches)
+	return appendUvarint(b, 2, m.Objects)
+}
+
+func (m *IngestResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case 1:
+			return consumeUvarint(typ, b, &m.Batches)
+		case 2:
+			return consumeUvarint(typ, b, &m.Objects)
+		}
+		return 0
+	})
+}
+
+// appendUvarint appends a varint field unless it is zero.
+func appendUvarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendString appends a string field unless it is empty.
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendStrings appends a repeated string field.
+func appendStrings(b []byte, num protowire.Number, vs []string) []byte {
+	for _, v := range vs {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+// appendPacked appends a packed repeated uint32 field.
+func appendPacked(b []byte, num protowire.Number, vs []uint32) []byte {
+	if len(vs) == 0 {
+		return b
+	}
+
+	size := 0
+	for _, v := range vs {
+		size += protowire.SizeVarint(uint64(v))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(size))
+	for _, v := range vs {
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+	return b
+}
+
+// decodeFields calls field with the number, wire type and remaining input
+// of every field. field returns the length of the value it consumed, 0 to
+// skip the field, or a negative protowire error code.
+func decodeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n = field(num, typ, b)
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeUvarint(typ protowire.Type, b []byte, v *uint64) int {
+	if typ != protowire.VarintType {
+		return 0
+	}
+	x, n := protowire.ConsumeVarint(b)
+	*v = x
+	return n
+}
+
+func consumeUint32(typ protowire.Type, b []byte, v *uint32) int {
+	var x uint64
+	n := consumeUvarint(typ, b, &x)
+	*v = uint32(x)
+	return n
+}
+
+func consumeString(typ protowire.Type, b []byte, v *string) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	x, n := protowire.ConsumeString(b)
+	*v = x
+	return n
+}
+
+func consumeStrings(typ protowire.Type, b []byte, vs *[]string) int {
+	var v string
+	n := consumeString(typ, b, &v)
+	if n > 0 {
+		*vs = append(*vs, v)
+	}
+	return n
+}
+
+// consumePacked reads a repeated uint32 field in packed or unpacked form.
+func consumePacked(typ protowire.Type, b []byte, vs *[]uint32) int {
+	switch typ {
+	case protowire.VarintType:
+		var v uint32
+		n := consumeUint32(typ, b, &v)
+		if n > 0 {
+			*vs = append(*vs, v)
+		}
+		return n
+	case protowire.BytesType:
+		data, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n
+		}
+		for len(data) > 0 {
+			v, m := protowire.ConsumeVarint(data)
+			if m < 0 {
+				return m
+			}
+			*vs = append(*vs, uint32(v))
+			data = data[m:]
+		}
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,322 @@
+// Package grpcapi exposes a tagbox.TagSystem as the gRPC TagService
+// defined in tagbox.proto, and provides a Client implementing
+// tagbox.Tagger on top of it.
+//
+// The message types are written by hand rather than generated, and are
+// encoded with a codec that must be installed on the server:
+//
+//	s := grpc.NewServer(grpcapi.ServerCodec())
+//	grpcapi.Register(s, ts)
+//
+// The wire format is standard protobuf, so clients generated from
+// tagbox.proto in other languages can call the service.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/RoaringBitmap/roaring"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// ServiceName is the fully qualified name of the TagService.
+const ServiceName = "tagbox.v1.TagService"
+
+// Query chunk sizes. Larger requested sizes are capped so a chunk stays
+// under the default 4 MB gRPC message limit.
+const (
+	DefaultIDChunk    = 64 << 10 // Object IDs per chunk
+	MaxIDChunk        = 512 << 10
+	DefaultBytesChunk = 1 << 20 // Bytes per chunk for EncodingRoaring
+	MaxBytesChunk     = 3 << 20
+)
+
+// TagServiceServer is the server side of the TagService.
+type TagServiceServer interface {
+	AddTag(context.Context, *TagRequest) (*Empty, error)
+	RemoveTag(context.Context, *TagRequest) (*Empty, error)
+	BatchAddTags(context.Context, *BatchAddTagsRequest) (*Empty, error)
+	BatchAddObjects(context.Context, *BatchAddObjectsRequest) (*Empty, error)
+	Query(*QueryRequest, grpc.ServerStream) error
+	Count(context.Context, *QueryRequest) (*CountResponse, error)
+	GetObjectTags(context.Context, *ObjectRequest) (*TagList, error)
+	GetTagCount(context.Context, *TagName) (*CountResponse, error)
+	Ingest(grpc.ServerStream) error
+}
+
+// Server implements the TagService for one tag system.
+type Server struct {
+	ts *tagbox.TagSystem
+}
+
+var _ TagServiceServer = (*Server)(nil)
+
+// NewServer creates a Server for ts. The caller keeps ownership of ts and
+// must close it after the gRPC server has stopped.
+func NewServer(ts *tagbox.TagSystem) *Server {
+	return &Server{ts: ts}
+}
+
+// Register registers a Server for ts with s, which must have been created
+// with ServerCodec.
+func Register(s grpc.ServiceRegistrar, ts *tagbox.TagSystem) {
+	s.RegisterService(&serviceDesc, NewServer(ts))
+}
+
+// reasonParseError is the ErrorInfo reason of an expression that does not
+// parse. Its metadata holds the position and message of the
+// tagbox.ParseError.
+const reasonParseError = "PARSE_ERROR"
+
+// toStatus converts a tag system error to a gRPC status error. A parse
+// error carries an ErrorInfo detail that lets the Client rebuild it.
+func toStatus(err error) error {
+	var perr *tagbox.ParseError
+	if errors.As(err, &perr) {
+		st := status.New(codes.InvalidArgument, err.Error())
+		info := &errdetails.ErrorInfo{
+			Reason:   reasonParseError,
+			Domain:   ServiceName,
+			Metadata: map[string]string{"pos": strconv.Itoa(perr.Pos), "msg": perr.Msg},
+		}
+		if detailed, derr := st.WithDetails(info); derr == nil {
+			st = detailed
+		}
+		return st.Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// AddTag adds a tag to an object.
+func (s *Server) AddTag(ctx context.Context, req *TagRequest) (*Empty, error) {
+	if err := s.ts.AddTag(req.ObjectID, req.Tag); err != nil {
+		return nil, toStatus(err)
+	}
+	return &Empty{}, nil
+}
+
+// RemoveTag removes a tag from an object.
+func (s *Server) RemoveTag(ctx context.Context, req *TagRequest) (*Empty, error) {
+	if err := s.ts.RemoveTag(req.ObjectID, req.Tag); err != nil {
+		return nil, toStatus(err)
+	}
+	return &Empty{}, nil
+}
+
+// BatchAddTags adds tags to one object.
+func (s *Server) BatchAddTags(ctx context.Context, req *BatchAddTagsRequest) (*Empty, error) {
+	if err := s.ts.BatchAddTags(req.ObjectID, req.Tags); err != nil {
+		return nil, toStatus(err)
+	}
+	return &Empty{}, nil
+}
+
+// BatchAddObjects adds objects to one tag.
+func (s *Server) BatchAddObjects(ctx context.Context, req *BatchAddObjectsRequest) (*Empty, error) {
+	if err := s.ts.BatchAddObjectsToTag(req.ObjectIDs, req.Tag); err != nil {
+		return nil, toStatus(err)
+	}
+	return &Empty{}, nil
+}
+
+// Query streams the result of an expression in chunks.
+func (s *Server) Query(req *QueryRequest, stream grpc.ServerStream) error {
+	result, err := s.ts.QueryExpr(req.Expr)
+	if err != nil {
+		return toStatus(err)
+	}
+
+	switch req.Encoding {
+	case EncodingIDs:
+		return sendIDs(stream, result, chunkSize(req.ChunkSize, DefaultIDChunk, MaxIDChunk))
+	case EncodingRoaring:
+		return sendRoaring(stream, result, chunkSize(req.ChunkSize, DefaultBytesChunk, MaxBytesChunk))
+	}
+	return status.Errorf(codes.InvalidArgument, "unknown result encoding %d", req.Encoding)
+}
+
+// chunkSize applies the default and the cap to a requested chunk size.
+func chunkSize(requested uint32, def, max int) int {
+	switch {
+	case requested == 0:
+		return def
+	case int(requested) > max:
+		return max
+	}
+	return int(requested)
+}
+
+// sendIDs streams the objects of a bitmap in chunks of size IDs. Every
+// chunk gets its own slice, as a sent message must not be modified.
+func sendIDs(stream grpc.ServerStream, result *roaring.Bitmap, size int) error {
+	it := result.ManyIterator()
+	buf := make([]uint32, size)
+	for {
+		n := it.NextMany(buf)
+		if n == 0 {
+			return nil
+		}
+		ids := make([]uint32, n)
+		copy(ids, buf)
+		if err := stream.SendMsg(&QueryChunk{ObjectIDs: ids}); err != nil {
+			return err
+		}
+	}
+}
+
+// sendRoaring streams the serialization of a bitmap in chunks of size
+// bytes.
+func sendRoaring(stream grpc.ServerStream, result *roaring.Bitmap, size int) error {
+	data, err := result.ToBytes()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := stream.SendMsg(&QueryChunk{Roaring: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Count returns the number of objects matching an expression.
+func (s *Server) Count(ctx context.Context, req *QueryRequest) (*CountResponse, error) {
+	result, err := s.ts.QueryExpr(req.Expr)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &CountResponse{Count: result.GetCardinality()}, nil
+}
+
+// GetObjectTags returns the tags of an object.
+func (s *Server) GetObjectTags(ctx context.Context, req *ObjectRequest) (*TagList, error) {
+	tags, err := s.ts.GetObjectTags(req.ObjectID)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &TagList{Tags: tags}, nil
+}
+
+// GetTagCount returns the number of objects with a tag.
+func (s *Server) GetTagCount(ctx context.Context, req *TagName) (*CountResponse, error) {
+	count, err := s.ts.GetTagCount(req.Tag)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &CountResponse{Count: count}, nil
+}
+
+// Ingest applies every batch received on the stream, in order, and
+// reports the totals once the client closes its side.
+func (s *Server) Ingest(stream grpc.ServerStream) error {
+	var resp IngestResponse
+	for {
+		var req BatchAddObjectsRequest
+		err := stream.RecvMsg(&req)
+		if err == io.EOF {
+			return stream.SendMsg(&resp)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.ts.BatchAddObjectsToTag(req.ObjectIDs, req.Tag); err != nil {
+			return status.Errorf(codes.Internal, "batch %d: %v", resp.Batches, err)
+		}
+		resp.Batches++
+		resp.Objects += uint64(len(req.ObjectIDs))
+	}
+}
+
+// unary describes a unary method whose handler decodes a request created
+// by newReq and passes it to call.
+func unary(method string, newReq func() interface{}, call func(TagServiceServer, context.Context, interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := newReq()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(TagServiceServer), ctx, req)
+			}
+			if interceptor == nil {
+				return handler(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + method}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*TagServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("AddTag", func() interface{} { return new(TagRequest) },
+			func(s TagServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.AddTag(ctx, req.(*TagRequest))
+			}),
+		unary("RemoveTag", func() interface{} { return new(TagRequest) },
+			func(s TagServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.RemoveTag(ctx, req.(*TagRequest))
+			}),
+		unary("BatchAddTags", func() interface{} { return new(BatchAddTagsRequest) },
+			func(s TagServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.BatchAddTags(ctx, req.(*BatchAddTagsRequest))
+			}),
+		unary("BatchAddObjects", func() interface{} { return new(BatchAddObjectsRequest) },
+			func(s TagServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.BatchAddObjects(ctx, req.(*BatchAddObjectsRequest))
+			}),
+		unary("Count", func() interface{} { return new(QueryRequest) },
+			func(s TagServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.Count(ctx, req.(*QueryRequest))
+			}),
+		unary("GetObjectTags", func() interface{} { return new(ObjectRequest) },
+			func(s TagServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.GetObjectTags(ctx, req.(*ObjectRequest))
+			}),
+		unary("GetTagCount", func() interface{} { return new(TagName) },
+			func(s TagServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return s.GetTagCount(ctx, req.(*TagName))
+			}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Query",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(QueryRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(TagServiceServer).Query(req, stream)
+			},
+		},
+		{
+			StreamName:    "Ingest",
+			ClientStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(TagServiceServer).Ingest(stream)
+			},
+		},
+	},
+	Metadata: "tagbox.proto",
+}
@@ -0,0 +1,548 @@
+// Package httpapi exposes a tagbox.TagSystem over HTTP with JSON bodies.
+//
+// Routes, all under /v1:
+//
+//	GET    /tags                         all tag names
+//	GET    /tags/{tag}                   object count of a tag
+//	POST   /tags/{tag}/objects           add objects to a tag  {"objects": [1, 2]}
+//	GET    /tags/{tag}/objects/{id}      whether an object has a tag
+//	PUT    /tags/{tag}/objects/{id}      add a tag to an object
+//	DELETE /tags/{tag}/objects/{id}      remove a tag from an object
+//	GET    /objects/{id}/tags            tags of an object in sorted order
+//	POST   /objects/{id}/tags            add tags to an object  {"tags": ["a", "b"]}
+//	POST   /batch                        apply a list of mutations atomically
+//	POST   /query                        evaluate an expression  {"expr": "...", "cursor": "...", "limit": 1000}
+//	                                     or by rank  {"expr": "...", "offset": 3600, "limit": 100}
+//	POST   /count                        count the result of an expression  {"expr": "..."}
+//	POST   /export                       stream a query result or tags as CSV, JSONL or roaring
+//	GET    /stats                        tag system statistics
+//	POST   /flush                        write modified tags to the store
+//	POST   /snapshot                     write a snapshot to the configured path
+//
+// Tag names are path-escaped in URLs. Errors are returned as
+// {"error": "..."} with a 4xx or 5xx status.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/export"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// Query result page sizes.
+const (
+	DefaultPageSize = 1000
+	MaxPageSize     = 100000
+)
+
+// maxBodySize limits the size of request bodies.
+const maxBodySize = 32 << 20
+
+// Server is an http.Handler serving the API of one tag system.
+type Server struct {
+	ts           *tagbox.TagSystem
+	snapshotPath string
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithSnapshotPath sets the file POST /v1/snapshot writes to. Without it
+// the endpoint is disabled; clients can never choose the path.
+func WithSnapshotPath(path string) Option {
+	return func(s *Server) {
+		s.snapshotPath = path
+	}
+}
+
+// New creates a Server for ts. The caller keeps ownership of ts and must
+// close it after the HTTP server has shut down.
+func New(ts *tagbox.TagSystem, opts ...Option) *Server {
+	s := &Server{ts: ts}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// httpError is an error with the HTTP status it is reported with.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+// errorf returns an error reported with status.
+func errorf(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// ServeHTTP routes a request to its handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.route(w, r); err != nil {
+		status := http.StatusInternalServerError
+		var herr *httpError
+		var perr *tagbox.ParseError
+		switch {
+		case errors.As(err, &herr):
+			status = herr.status
+		case errors.As(err, &perr), errors.Is(err, tagbox.ErrInvalidCursor):
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+	}
+}
+
+// route dispatches on the method and the escaped path segments.
+func (s *Server) route(w http.ResponseWriter, r *http.Request) error {
+	path := strings.Trim(r.URL.EscapedPath(), "/")
+	if path != "v1" && !strings.HasPrefix(path, "v1/") {
+		return errorf(http.StatusNotFound, "not found: %s", r.URL.Path)
+	}
+
+	var segs []string
+	for _, seg := range strings.Split(strings.TrimPrefix(path, "v1"), "/")[1:] {
+		seg, err := url.PathUnescape(seg)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "bad path: %v", err)
+		}
+		segs = append(segs, seg)
+	}
+
+	method := r.Method
+	switch {
+	case match(segs, "tags") && method == http.MethodGet:
+		return s.allTags(w)
+	case match(segs, "tags", "*") && method == http.MethodGet:
+		return s.tagCount(w, segs[1])
+	case match(segs, "tags", "*", "objects") && method == http.MethodPost:
+		return s.addObjects(w, r, segs[1])
+	case match(segs, "tags", "*", "objects", "*"):
+		return s.assignment(w, r, segs[1], segs[3])
+	case match(segs, "objects", "*", "tags") && method == http.MethodGet:
+		return s.objectTags(w, segs[1])
+	case match(segs, "objects", "*", "tags") && method == http.MethodPost:
+		return s.addTags(w, r, segs[1])
+	case match(segs, "batch") && method == http.MethodPost:
+		return s.batch(w, r)
+	case match(segs, "query") && method == http.MethodPost:
+		return s.query(w, r)
+	case match(segs, "count") && method == http.MethodPost:
+		return s.count(w, r)
+	case match(segs, "export") && method == http.MethodPost:
+		return s.export(w, r)
+	case match(segs, "stats") && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.ts.GetStats())
+		return nil
+	case match(segs, "flush") && method == http.MethodPost:
+		return s.flush(w)
+	case match(segs, "snapshot") && method == http.MethodPost:
+		return s.snapshot(w)
+	}
+
+	for _, pattern := range [][]string{
+		{"tags"}, {"tags", "*"}, {"tags", "*", "objects"}, {"objects", "*", "tags"},
+		{"batch"}, {"query"}, {"count"}, {"export"}, {"stats"}, {"flush"}, {"snapshot"},
+	} {
+		if match(segs, pattern...) {
+			return errorf(http.StatusMethodNotAllowed, "method %s not allowed", method)
+		}
+	}
+	return errorf(http.StatusNotFound, "not found: %s", r.URL.Path)
+}
+
+// match reports whether the path segments match pattern, where "*"
+// matches any single non-empty segment.
+func match(segs []string, pattern ...string) bool {
+	if len(segs) != len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p == "*" && segs[i] == "" || p != "*" && segs[i] != p {
+			return false
+		}
+	}
+	return true
+}
+
+// parseID parses an object ID path segment.
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, errorf(http.StatusBadRequest, "bad object ID %q", s)
+	}
+	return uint32(id), nil
+}
+
+// readJSON decodes a request body into v.
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "bad request body: %v", err)
+	}
+	return nil
+}
+
+// writeJSON writes v as the response body.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) allTags(w http.ResponseWriter) error {
+	writeJSON(w, http.StatusOK, map[string][]string{"tags": s.ts.GetAllTags()})
+	return nil
+}
+
+func (s *Server) tagCount(w http.ResponseWriter, tag string) error {
+	count, err := s.ts.GetTagCount(tag)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tag": tag, "count": count})
+	return nil
+}
+
+func (s *Server) addObjects(w http.ResponseWriter, r *http.Request, tag string) error {
+	var body struct {
+		Objects []uint32 `json:"objects"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+	if err := s.ts.BatchAddObjectsToTag(body.Objects, tag); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// assignment serves GET, PUT and DELETE of one object-tag assignment.
+func (s *Server) assignment(w http.ResponseWriter, r *http.Request, tag, idSeg string) error {
+	id, err := parseID(idSeg)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]bool{"has": s.ts.HasTag(id, tag)})
+		return nil
+	case http.MethodPut:
+		err = s.ts.AddTag(id, tag)
+	case http.MethodDelete:
+		err = s.ts.RemoveTag(id, tag)
+	default:
+		return errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) objectTags(w http.ResponseWriter, idSeg string) error {
+	id, err := parseID(idSeg)
+	if err != nil {
+		return err
+	}
+	tags, err := s.ts.GetObjectTags(id)
+	if err != nil {
+		return err
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	sort.Strings(tags)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"object": id, "tags": tags})
+	return nil
+}
+
+func (s *Server) addTags(w http.ResponseWriter, r *http.Request, idSeg string) error {
+	id, err := parseID(idSeg)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+	if err := s.ts.BatchAddTags(id, body.Tags); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Mutation is one entry of a POST /v1/batch request. Op is "add" or
+// "remove" with Object and Tag, "add_tags" with Object and Tags,
+// "add_objects" with Objects and Tag, "move" with Object, From and Tag,
+// or "require" and "require_not" with Object and Tag to check an
+// assignment.
+type Mutation struct {
+	Op      string   `json:"op"`
+	Object  uint32   `json:"object,omitempty"`
+	Objects []uint32 `json:"objects,omitempty"`
+	Tag     string   `json:"tag,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	From    string   `json:"from,omitempty"`
+}
+
+// batch applies mutations in order as one transaction: either all of them
+// are applied or, when one is invalid or a check fails, none of them.
+func (s *Server) batch(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Mutations []Mutation `json:"mutations"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+
+	tx := s.ts.Begin()
+	for i, m := range body.Mutations {
+		switch m.Op {
+		case "add":
+			tx.AddTag(m.Object, m.Tag)
+		case "remove":
+			tx.RemoveTag(m.Object, m.Tag)
+		case "add_tags":
+			tx.BatchAddTags(m.Object, m.Tags)
+		case "add_objects":
+			tx.BatchAddObjectsToTag(m.Objects, m.Tag)
+		case "move":
+			tx.MoveTag(m.Object, m.From, m.Tag)
+		case "require":
+			tx.Require(m.Object, m.Tag)
+		case "require_not":
+			tx.RequireNot(m.Object, m.Tag)
+		default:
+			return errorf(http.StatusBadRequest, "mutation %d: unknown op %q", i, m.Op)
+		}
+	}
+
+	var perr *tagbox.PreconditionError
+	if err := tx.Commit(); errors.As(err, &perr) {
+		verb := "does not have"
+		if perr.Has {
+			verb = "already has"
+		}
+		return errorf(http.StatusConflict, "mutation %d: object %d %s tag %s", perr.Op, perr.ObjectID, verb, perr.Tag)
+	} else if errors.Is(err, tagbox.ErrInvalidTxn) {
+		return errorf(http.StatusBadRequest, "%v", err)
+	} else if err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"applied": len(body.Mutations)})
+	return nil
+}
+
+// queryRequest is the body of POST /v1/query and POST /v1/count.
+type queryRequest struct {
+	Expr   string `json:"expr"`
+	Cursor string `json:"cursor,omitempty"` // Return the objects after this cursor
+	Offset uint64 `json:"offset,omitempty"` // Or skip this many objects
+	Limit  int    `json:"limit,omitempty"`  // Page size, DefaultPageSize when 0
+	Stream bool   `json:"stream,omitempty"` // Stream every object as NDJSON
+}
+
+// queryResponse is one page of a query result.
+type queryResponse struct {
+	Count   uint64   `json:"count"`          // Size of the whole result
+	Objects []uint32 `json:"objects"`        // Objects of this page in ID order
+	Next    string   `json:"next,omitempty"` // Pass as "cursor" for the next page
+}
+
+// query evaluates an expression and returns one page of the result, or
+// with "stream" set every object as a line of newline-delimited JSON.
+func (s *Server) query(w http.ResponseWriter, r *http.Request) error {
+	var req queryRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.Limit < 0 || req.Limit > MaxPageSize {
+		return errorf(http.StatusBadRequest, "limit must be between 0 and %d", MaxPageSize)
+	}
+	if req.Limit == 0 {
+		req.Limit = DefaultPageSize
+	}
+	if req.Cursor != "" && req.Offset != 0 {
+		return errorf(http.StatusBadRequest, "cursor and offset are exclusive")
+	}
+
+	result, err := s.ts.QueryExpr(req.Expr)
+	if err != nil {
+		return err
+	}
+
+	if req.Stream {
+		it, err := tagbox.IterateAfter(result, req.Cursor)
+		if err != nil {
+			return err
+		}
+		if req.Offset >= result.GetCardinality() {
+			it = tagbox.Iterate(roaring.NewBitmap())
+		} else if req.Offset != 0 {
+			first, err := result.Select(uint32(req.Offset))
+			if err != nil {
+				return err
+			}
+			it.Seek(first)
+		}
+		return streamIDs(w, it)
+	}
+
+	var page tagbox.Page
+	if req.Offset != 0 {
+		page, err = tagbox.PageAt(result, req.Offset, req.Limit)
+	} else {
+		page, err = tagbox.PageAfter(result, req.Cursor, req.Limit)
+	}
+	if err != nil {
+		return err
+	}
+	if page.Objects == nil {
+		page.Objects = []uint32{}
+	}
+
+	writeJSON(w, http.StatusOK, queryResponse{Count: page.Total, Objects: page.Objects, Next: page.Next})
+	return nil
+}
+
+// streamIDs writes one object ID per line, flushing every few thousand.
+func streamIDs(w http.ResponseWriter, it *tagbox.ObjectIterator) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	buf := make([]byte, 0, 64<<10)
+	for objectID, ok := it.Next(); ok; objectID, ok = it.Next() {
+		buf = strconv.AppendUint(buf, uint64(objectID), 10)
+		buf = append(buf, '\n')
+		if len(buf) > cap(buf)-16 {
+			if _, err := w.Write(buf); err != nil {
+				return nil // Client went away
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			buf = buf[:0]
+		}
+	}
+	w.Write(buf)
+	return nil
+}
+
+func (s *Server) count(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Expr string `json:"expr"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+
+	result, err := s.ts.QueryExpr(req.Expr)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"count": result.GetCardinality()})
+	return nil
+}
+
+// exportRequest is the body of POST /v1/export.
+type exportRequest struct {
+	Expr   string   `json:"expr,omitempty"`   // Export this query result
+	Tags   []string `json:"tags,omitempty"`   // Without expr, export these tags, or all
+	Format string   `json:"format,omitempty"` // csv, jsonl or roaring; csv when empty
+	Header bool     `json:"header,omitempty"` // Write a CSV header row
+	Keys   bool     `json:"keys,omitempty"`   // Add object keys
+}
+
+// export streams a query result, or without an expression the tags, in
+// the layouts of the export package. Errors after the status is sent are
+// logged and abort the connection.
+func (s *Server) export(w http.ResponseWriter, r *http.Request) error {
+	var req exportRequest
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	if req.Format == "" {
+		req.Format = "csv"
+	}
+	format, err := export.ParseFormat(req.Format)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+	if req.Keys && format == export.Roaring {
+		return errorf(http.StatusBadRequest, "%v", export.ErrKeysUnsupported)
+	}
+
+	opts := export.Options{Format: format, Header: req.Header, Tags: req.Tags}
+	if req.Keys {
+		opts.Keys = s.ts
+	}
+
+	var result *roaring.Bitmap
+	if req.Expr != "" {
+		if result, err = s.ts.QueryExpr(req.Expr); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.WriteHeader(http.StatusOK)
+	if result != nil {
+		_, err = export.Bitmap(r.Context(), w, result, opts)
+	} else {
+		_, err = export.Tags(r.Context(), w, s.ts, opts)
+	}
+	if err != nil {
+		// The status is sent; abort the connection so that the client
+		// sees a truncated body instead of a complete one
+		log.Printf("httpapi: export failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+func (s *Server) flush(w http.ResponseWriter) error {
+	stats, err := s.ts.Flush()
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"saved":   stats.Saved,
+		"deleted": stats.Deleted,
+		"bytes":   stats.Bytes,
+	})
+	return nil
+}
+
+func (s *Server) snapshot(w http.ResponseWriter) error {
+	if s.snapshotPath == "" {
+		return errorf(http.StatusNotFound, "snapshots are not configured")
+	}
+	if err := s.ts.SaveSnapshot(s.snapshotPath); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"path": s.snapshotPath})
+	return nil
+}
@@ -0,0 +1,372 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/internal/tagboxtest"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+func newTestServer(t *testing.T, opts ...Option) (*tagbox.TagSystem, *httptest.Server) {
+	t.Helper()
+
+	ts := tagboxtest.New(t)
+	srv := httptest.NewServer(New(ts, opts...))
+	t.Cleanup(srv.Close)
+
+	return ts, srv
+}
+
+// do sends a request and decodes a JSON response into out when it is not
+// nil, returning the status code.
+func do(t *testing.T, srv *httptest.Server, method, path, body string, out interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: bad response body: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// TestServer_Mutations tests the single and batch mutation endpoints
+func TestServer_Mutations(t *testing.T) {
+	ts, srv := newTestServer(t)
+
+	if status := do(t, srv, "PUT", "/v1/tags/vip/objects/1", "", nil); status != http.StatusNoContent {
+		t.Fatalf("PUT status = %d", status)
+	}
+	do(t, srv, "PUT", "/v1/tags/city%3Abeijing%2Fchaoyang/objects/1", "", nil)
+	do(t, srv, "POST", "/v1/objects/2/tags", `{"tags": ["vip", "new"]}`, nil)
+	do(t, srv, "POST", "/v1/tags/active/objects", `{"objects": [1, 2, 3]}`, nil)
+
+	var batch struct{ Applied int }
+	status := do(t, srv, "POST", "/v1/batch", `{"mutations": [
+		{"op": "add", "object": 3, "tag": "vip"},
+		{"op": "remove", "object": 2, "tag": "new"},
+		{"op": "add_tags", "object": 4, "tags": ["a", "b"]},
+		{"op": "add_objects", "objects": [5, 6], "tag": "a"}
+	]}`, &batch)
+	if status != http.StatusOK || batch.Applied != 4 {
+		t.Errorf("batch = %d %+v", status, batch)
+	}
+
+	if !ts.HasTag(1, "city:beijing/chaoyang") {
+		t.Error("escaped tag was not added")
+	}
+	if count, _ := ts.GetTagCount("vip"); count != 3 {
+		t.Errorf("vip count = %d, want 3", count)
+	}
+	if ts.HasTag(2, "new") || !ts.HasTag(6, "a") || !ts.HasTag(4, "b") {
+		t.Error("batch mutations were not applied")
+	}
+
+	do(t, srv, "DELETE", "/v1/tags/vip/objects/1", "", nil)
+	var has struct{ Has bool }
+	do(t, srv, "GET", "/v1/tags/vip/objects/1", "", &has)
+	if has.Has {
+		t.Error("DELETE did not remove the tag")
+	}
+
+	var tags struct{ Tags []string }
+	do(t, srv, "GET", "/v1/objects/2/tags", "", &tags)
+	if !reflect.DeepEqual(tags.Tags, []string{"active", "vip"}) {
+		t.Errorf("object tags = %v, want [active vip]", tags.Tags)
+	}
+
+	var count struct{ Count uint64 }
+	do(t, srv, "GET", "/v1/tags/active", "", &count)
+	if count.Count != 3 {
+		t.Errorf("tag count = %d, want 3", count.Count)
+	}
+}
+
+// TestServer_BatchValidation tests that an invalid batch applies nothing
+func TestServer_BatchValidation(t *testing.T) {
+	ts, srv := newTestServer(t)
+
+	status := do(t, srv, "POST", "/v1/batch", `{"mutations": [
+		{"op": "add", "object": 1, "tag": "vip"},
+		{"op": "drop", "tag": "vip"}
+	]}`, nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", status)
+	}
+	if ts.HasTag(1, "vip") {
+		t.Error("invalid batch was partially applied")
+	}
+
+	status = do(t, srv, "POST", "/v1/batch", `{"mutations": [
+		{"op": "add", "object": 1, "tag": "vip"},
+		{"op": "add", "object": 1, "tag": ""}
+	]}`, nil)
+	if status != http.StatusBadRequest || ts.HasTag(1, "vip") {
+		t.Errorf("batch with an empty tag = %d", status)
+	}
+}
+
+// TestServer_BatchTransaction tests moves and checks in a batch
+func TestServer_BatchTransaction(t *testing.T) {
+	ts, srv := newTestServer(t)
+	ts.AddTag(1, "plan:free")
+
+	move := `{"mutations": [
+		{"op": "require_not", "object": 1, "tag": "banned"},
+		{"op": "move", "object": 1, "from": "plan:free", "tag": "plan:premium"},
+		{"op": "add", "object": 1, "tag": "upgraded"}
+	]}`
+	if status := do(t, srv, "POST", "/v1/batch", move, nil); status != http.StatusOK {
+		t.Fatalf("move status = %d", status)
+	}
+	if ts.HasTag(1, "plan:free") || !ts.HasTag(1, "plan:premium") || !ts.HasTag(1, "upgraded") {
+		t.Error("move was not applied")
+	}
+
+	// The object no longer has plan:free, so nothing is applied
+	ts.RemoveTag(1, "upgraded")
+	var body struct{ Error string }
+	if status := do(t, srv, "POST", "/v1/batch", move, &body); status != http.StatusConflict {
+		t.Errorf("repeated move status = %d, want 409", status)
+	}
+	if !strings.Contains(body.Error, "mutation 1") || ts.HasTag(1, "upgraded") {
+		t.Errorf("failed move = %q, upgraded %v", body.Error, ts.HasTag(1, "upgraded"))
+	}
+}
+
+// TestServer_QueryPagination tests paging through a query result
+func TestServer_QueryPagination(t *testing.T) {
+	ts, srv := newTestServer(t)
+
+	var want []uint32
+	for id := uint32(0); id < 25; id++ {
+		ts.AddTag(id, "all")
+		if id%2 == 0 {
+			ts.AddTag(id, "even")
+		}
+		if id%2 == 1 {
+			want = append(want, id)
+		}
+	}
+
+	var got []uint32
+	body := `{"expr": "all AND NOT even", "limit": 5}`
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("pagination did not terminate")
+		}
+
+		var page queryResponse
+		if status := do(t, srv, "POST", "/v1/query", body, &page); status != http.StatusOK {
+			t.Fatalf("query status = %d", status)
+		}
+		if page.Count != uint64(len(want)) {
+			t.Errorf("count = %d, want %d", page.Count, len(want))
+		}
+		got = append(got, page.Objects...)
+		if page.Next == "" {
+			break
+		}
+
+		body = `{"expr": "all AND NOT even", "limit": 5, "cursor": "` + page.Next + `"}`
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged result = %v, want %v", got, want)
+	}
+
+	// Page 2 of 4 objects by rank
+	var page queryResponse
+	do(t, srv, "POST", "/v1/query", `{"expr": "all AND NOT even", "offset": 4, "limit": 4}`, &page)
+	if !reflect.DeepEqual(page.Objects, want[4:8]) || page.Next == "" {
+		t.Fatalf("offset page = %v next %q, want %v", page.Objects, page.Next, want[4:8])
+	}
+	var next queryResponse
+	do(t, srv, "POST", "/v1/query", `{"expr": "all AND NOT even", "limit": 4, "cursor": "`+page.Next+`"}`, &next)
+	if !reflect.DeepEqual(next.Objects, want[8:12]) {
+		t.Errorf("page after the offset page = %v, want %v", next.Objects, want[8:12])
+	}
+	var end queryResponse
+	do(t, srv, "POST", "/v1/query", `{"expr": "all AND NOT even", "offset": 12}`, &end)
+	if end.Objects == nil || len(end.Objects) != 0 || end.Next != "" {
+		t.Errorf("page past the end = %+v", end)
+	}
+
+	var count struct{ Count uint64 }
+	do(t, srv, "POST", "/v1/count", `{"expr": "even"}`, &count)
+	if count.Count != 13 {
+		t.Errorf("count = %d, want 13", count.Count)
+	}
+}
+
+// TestServer_QueryStream tests streaming a query result as NDJSON
+func TestServer_QueryStream(t *testing.T) {
+	ts, srv := newTestServer(t)
+
+	ids := make([]uint32, 20000)
+	for i := range ids {
+		ids[i] = uint32(i * 3)
+	}
+	ts.BatchAddObjectsToTag(ids, "many")
+
+	resp, err := srv.Client().Post(srv.URL+"/v1/query", "application/json",
+		strings.NewReader(`{"expr": "many", "offset": 10000, "stream": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	var got []uint32
+	for dec.More() {
+		var id uint32
+		if err := dec.Decode(&id); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, id)
+	}
+	if !reflect.DeepEqual(got, ids[10000:]) {
+		t.Errorf("streamed %d objects, want %d", len(got), len(ids)-10000)
+	}
+}
+
+// TestServer_Export tests exporting a query result and all tags
+func TestServer_Export(t *testing.T) {
+	ts, srv := newTestServer(t)
+	ts.BatchAddObjectsToTag([]uint32{1, 2}, "vip")
+	ts.AddTag(2, "new")
+
+	tests := []struct {
+		body, contentType, want string
+	}{
+		{`{"expr": "vip AND NOT new", "header": true}`, "text/csv", "object_id\n1\n"},
+		{`{"format": "jsonl"}`, "application/x-ndjson", `{"id":1,"tags":["vip"]}` + "\n" + `{"id":2,"tags":["new","vip"]}` + "\n"},
+		{`{"tags": ["new"]}`, "text/csv", "2,new\n"},
+	}
+	for _, tt := range tests {
+		resp, err := srv.Client().Post(srv.URL+"/v1/export", "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); ct != tt.contentType || string(body) != tt.want {
+			t.Errorf("export %s = %s %q, want %s %q", tt.body, ct, body, tt.contentType, tt.want)
+		}
+	}
+}
+
+// failingWriter is a ResponseWriter whose body writes fail
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// TestServer_ExportAbort tests that an export failing after the status was
+// sent aborts the response instead of ending it cleanly
+func TestServer_ExportAbort(t *testing.T) {
+	ts, _ := newTestServer(t)
+	ts.AddTag(1, "vip")
+
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("export panicked with %v, want http.ErrAbortHandler", err)
+		}
+	}()
+
+	req := httptest.NewRequest("POST", "/v1/export", strings.NewReader(`{"expr": "vip"}`))
+	New(ts).ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+}
+
+// TestServer_Errors tests the status codes of failed requests
+func TestServer_Errors(t *testing.T) {
+	_, srv := newTestServer(t)
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/v1/query", `{"expr": "a AND"}`, http.StatusBadRequest},
+		{"POST", "/v1/query", `{"expr": "a", "limit": -1}`, http.StatusBadRequest},
+		{"POST", "/v1/query", `{"expr": "a", "bogus": 1}`, http.StatusBadRequest},
+		{"POST", "/v1/query", `{"expr": "a", "cursor": "AQE", "offset": 1}`, http.StatusBadRequest},
+		{"POST", "/v1/query", `{"expr": "a", "cursor": "bogus"}`, http.StatusBadRequest},
+		{"POST", "/v1/query", `{"expr": "a", "cursor": "bogus", "stream": true}`, http.StatusBadRequest},
+		{"PUT", "/v1/tags/vip/objects/x", "", http.StatusBadRequest},
+		{"PUT", "/v1/tags/vip/objects/4294967296", "", http.StatusBadRequest},
+		{"GET", "/v1/query", "", http.StatusMethodNotAllowed},
+		{"PATCH", "/v1/tags/vip/objects/1", "", http.StatusMethodNotAllowed},
+		{"GET", "/v1/nothing", "", http.StatusNotFound},
+		{"GET", "/other", "", http.StatusNotFound},
+		{"POST", "/v1/snapshot", "", http.StatusNotFound},
+		{"POST", "/v1/export", `{"format": "xml"}`, http.StatusBadRequest},
+		{"POST", "/v1/export", `{"format": "roaring", "keys": true}`, http.StatusBadRequest},
+		{"POST", "/v1/export", `{"expr": "(a"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		var resp struct{ Error string }
+		status := do(t, srv, tt.method, tt.path, tt.body, &resp)
+		if status != tt.want || resp.Error == "" {
+			t.Errorf("%s %s = %d %q, want %d with an error", tt.method, tt.path, status, resp.Error, tt.want)
+		}
+	}
+}
+
+// TestServer_Admin tests the stats, flush and snapshot endpoints
+func TestServer_Admin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.snap")
+	ts, srv := newTestServer(t, WithSnapshotPath(path))
+
+	ts.AddTag(1, "vip")
+	ts.AddTag(2, "vip")
+
+	var stats tagbox.Stats
+	do(t, srv, "GET", "/v1/stats", "", &stats)
+	if stats.TotalTags != 1 || stats.UniqueObjects != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	var flushed struct{ Saved int }
+	do(t, srv, "POST", "/v1/flush", "", &flushed)
+	if flushed.Saved != 1 {
+		t.Errorf("flush saved %d tags, want 1", flushed.Saved)
+	}
+
+	if status := do(t, srv, "POST", "/v1/snapshot", "", nil); status != http.StatusOK {
+		t.Fatalf("snapshot status = %d", status)
+	}
+	ts.RemoveTag(1, "vip")
+	if err := ts.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if !ts.HasTag(1, "vip") {
+		t.Error("snapshot did not contain the tag")
+	}
+}
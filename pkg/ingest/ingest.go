@@ -0,0 +1,353 @@
+// Package ingest bulk-loads tag assignments into a tag system from CSV and
+// JSON Lines.
+//
+// The input is read as a stream. In the default mode assignments are
+// buffered per tag and loaded in batches by parallel workers, so memory
+// stays bounded by Options.MaxBuffered however large the input is. In
+// Replace mode the full contents of every tag in the input are collected
+// as compressed bitmaps first, and each tag is then swapped in with a
+// single ReplaceTag, so readers never see a partially loaded segment. Tags
+// are replaced independently, and a load error can leave some of them
+// replaced and others not:
+//
+//	f, _ := os.Open("segments.csv")
+//	stats, err := ingest.Import(ctx, ts, f, ingest.Options{
+//		Format:  ingest.CSV,
+//		Header:  true,
+//		Replace: true,
+//		OnError: ingest.Skip,
+//	})
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Defaults of the zero Options.
+const (
+	DefaultBatchSize        = 10000
+	DefaultMaxBuffered      = 1 << 20
+	DefaultProgressInterval = 100000
+)
+
+// maxRowErrors caps the row errors kept in Stats.
+const maxRowErrors = 100
+
+// ErrorPolicy is what Import does with a row it cannot parse.
+type ErrorPolicy int
+
+const (
+	// Abort stops the import at the first bad row.
+	Abort ErrorPolicy = iota
+
+	// Skip skips bad rows, up to Options.MaxErrors.
+	Skip
+)
+
+// Loader is the destination of an import. tagbox.TagSystem and the gRPC
+// client implement it.
+type Loader interface {
+	BatchAddObjectsToTag(objectIDs []uint32, tag string) error
+}
+
+// Replacer is a Loader that can replace the contents of a tag atomically,
+// as tagbox.TagSystem does. Replace mode requires it.
+type Replacer interface {
+	Loader
+	ReplaceTag(tag string, objectIDs []uint32) error
+}
+
+// Options configures an import. The zero value reads object_id,tag CSV
+// without a header and aborts on the first bad row.
+type Options struct {
+	Format Format
+	Header bool // Skip the first row of CSV; WideCSV always has a header
+	Comma  rune // CSV field separator, ',' when 0
+
+	// Replace sets every tag in the input to exactly the objects the input
+	// assigns it, instead of adding to it. Tags absent from the input are
+	// left alone. Nothing is replaced unless the whole input was read.
+	// Each tag is replaced on its own, in parallel and in no particular
+	// order, so if loading one fails the import stops with some tags
+	// already replaced and the rest unchanged.
+	Replace bool
+
+	OnError   ErrorPolicy
+	MaxErrors int // With Skip, abort after this many bad rows; 0 for no limit
+
+	Workers     int // Parallel loaders, GOMAXPROCS when 0
+	BatchSize   int // Objects per load of a tag, DefaultBatchSize when 0
+	MaxBuffered int // Objects buffered across all tags, DefaultMaxBuffered when 0
+
+	// Progress, when set, is called every ProgressInterval rows and once
+	// at the end, from the goroutine that called Import.
+	Progress         func(Stats)
+	ProgressInterval int // DefaultProgressInterval when 0
+}
+
+// Stats describes the progress or outcome of an import.
+type Stats struct {
+	Rows        int64         // Rows read, including skipped ones
+	Skipped     int64         // Bad rows skipped
+	Assignments int64         // Object-tag assignments loaded so far
+	Tags        int           // Distinct tags in the input so far
+	Elapsed     time.Duration // Time since the import started
+	Errors      []*RowError   // The first bad rows
+}
+
+// batch is a load of objects into one tag.
+type batch struct {
+	tag       string
+	objectIDs []uint32
+	replace   bool
+}
+
+// importer is the state of one Import call.
+type importer struct {
+	dst   Loader
+	opts  Options
+	start time.Time
+
+	// Per-tag buffers in add mode and collected contents in Replace mode
+	buffers  map[string][]uint32
+	contents map[string]*roaring.Bitmap
+	buffered int
+
+	stats Stats
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	batches chan batch
+	wg      sync.WaitGroup
+
+	// Assignments loaded and the first load error, set by the workers
+	mu     sync.Mutex
+	loaded int64
+	err    error
+}
+
+// Import reads assignments from r and loads them into dst. It returns the
+// final statistics along with the first error, which is a *RowError when
+// a bad row stopped the import. Unless in Replace mode, rows read before
+// an error may have been loaded.
+func Import(ctx context.Context, dst Loader, r io.Reader, opts Options) (Stats, error) {
+	if opts.Replace {
+		if _, ok := dst.(Replacer); !ok {
+			return Stats{}, errors.New("ingest: Replace mode requires a destination with ReplaceTag")
+		}
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.MaxBuffered <= 0 {
+		opts.MaxBuffered = DefaultMaxBuffered
+	}
+	if opts.ProgressInterval <= 0 {
+		opts.ProgressInterval = DefaultProgressInterval
+	}
+
+	rows, err := newRowReader(r, opts)
+	if err != nil {
+		return Stats{}, fmt.Errorf("ingest: %w", err)
+	}
+
+	imp := &importer{
+		dst:      dst,
+		opts:     opts,
+		start:    time.Now(),
+		buffers:  make(map[string][]uint32),
+		contents: make(map[string]*roaring.Bitmap),
+		batches:  make(chan batch, opts.Workers),
+	}
+	imp.ctx, imp.cancel = context.WithCancel(ctx)
+	defer imp.cancel()
+
+	for i := 0; i < opts.Workers; i++ {
+		imp.wg.Add(1)
+		go imp.worker()
+	}
+
+	err = imp.read(rows)
+	if err == nil {
+		err = imp.drain()
+	}
+	close(imp.batches)
+	imp.wg.Wait()
+
+	if imp.err != nil {
+		err = imp.err
+	}
+	stats := imp.progress()
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+	return stats, err
+}
+
+// read parses the input into buffers, dispatching full ones.
+func (imp *importer) read(rows rowReader) error {
+	for {
+		if imp.stats.Rows%1024 == 0 {
+			if err := imp.ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if imp.opts.Progress != nil && imp.stats.Rows > 0 && imp.stats.Rows%int64(imp.opts.ProgressInterval) == 0 {
+			imp.opts.Progress(imp.progress())
+		}
+
+		objectID, tags, err := rows.next()
+		if err == io.EOF {
+			return nil
+		}
+
+		var rerr *RowError
+		if errors.As(err, &rerr) {
+			imp.stats.Rows++
+			if imp.opts.OnError == Abort {
+				return rerr
+			}
+			imp.stats.Skipped++
+			if len(imp.stats.Errors) < maxRowErrors {
+				imp.stats.Errors = append(imp.stats.Errors, rerr)
+			}
+			if imp.opts.MaxErrors > 0 && imp.stats.Skipped > int64(imp.opts.MaxErrors) {
+				return fmt.Errorf("ingest: more than %d bad rows, last %w", imp.opts.MaxErrors, rerr)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("ingest: %w", err)
+		}
+
+		imp.stats.Rows++
+		for _, tag := range tags {
+			if err := imp.add(objectID, tag); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// add buffers an assignment.
+func (imp *importer) add(objectID uint32, tag string) error {
+	if imp.opts.Replace {
+		bitmap, exists := imp.contents[tag]
+		if !exists {
+			bitmap = roaring.NewBitmap()
+			imp.contents[tag] = bitmap
+		}
+		bitmap.Add(objectID)
+		return nil
+	}
+
+	buffer, exists := imp.buffers[tag]
+	if !exists {
+		buffer = make([]uint32, 0, 64)
+	}
+	imp.buffers[tag] = append(buffer, objectID)
+	imp.buffered++
+
+	if len(imp.buffers[tag]) >= imp.opts.BatchSize {
+		return imp.dispatch(tag)
+	}
+	if imp.buffered >= imp.opts.MaxBuffered {
+		for tag := range imp.buffers {
+			if err := imp.dispatch(tag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dispatch sends the buffer of a tag to the workers. The tag keeps an
+// empty entry so that it is still counted.
+func (imp *importer) dispatch(tag string) error {
+	buffer := imp.buffers[tag]
+	if len(buffer) == 0 {
+		return nil
+	}
+	imp.buffers[tag] = buffer[:0:0]
+	imp.buffered -= len(buffer)
+
+	return imp.send(batch{tag: tag, objectIDs: buffer})
+}
+
+// drain sends what is left once the input has been read: the remaining
+// buffers, or in Replace mode the contents of every tag. The replaces are
+// separate batches, so a failure cancels the ones not yet loaded but does
+// not undo those already applied.
+func (imp *importer) drain() error {
+	for tag := range imp.buffers {
+		if err := imp.dispatch(tag); err != nil {
+			return err
+		}
+	}
+
+	for tag, bitmap := range imp.contents {
+		if err := imp.send(batch{tag: tag, objectIDs: bitmap.ToArray(), replace: true}); err != nil {
+			return err
+		}
+		imp.contents[tag] = nil // Keep counting the tag
+	}
+	return nil
+}
+
+func (imp *importer) send(b batch) error {
+	select {
+	case imp.batches <- b:
+		return nil
+	case <-imp.ctx.Done():
+		return imp.ctx.Err()
+	}
+}
+
+// worker loads batches until the channel is closed, stopping the import at
+// the first failure.
+func (imp *importer) worker() {
+	defer imp.wg.Done()
+
+	for b := range imp.batches {
+		if imp.ctx.Err() != nil {
+			continue
+		}
+
+		var err error
+		if b.replace {
+			err = imp.dst.(Replacer).ReplaceTag(b.tag, b.objectIDs)
+		} else {
+			err = imp.dst.BatchAddObjectsToTag(b.objectIDs, b.tag)
+		}
+		imp.mu.Lock()
+		if err == nil {
+			imp.loaded += int64(len(b.objectIDs))
+		} else if imp.err == nil {
+			imp.err = fmt.Errorf("ingest: load tag %s: %w", b.tag, err)
+			imp.cancel()
+		}
+		imp.mu.Unlock()
+	}
+}
+
+// progress returns the current statistics.
+func (imp *importer) progress() Stats {
+	stats := imp.stats
+	imp.mu.Lock()
+	stats.Assignments = imp.loaded
+	imp.mu.Unlock()
+	stats.Tags = len(imp.buffers) + len(imp.contents)
+	stats.Elapsed = time.Since(imp.start)
+	return stats
+}
@@ -0,0 +1,198 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/internal/tagboxtest"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// checkTag compares the objects of a tag
+func checkTag(t *testing.T, ts *tagbox.TagSystem, tag string, want ...uint32) {
+	t.Helper()
+
+	result, err := ts.Query(tag)
+	if err != nil {
+		t.Fatalf("query %s: %v", tag, err)
+	}
+	if got := result.ToArray(); !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+		t.Errorf("tag %s = %v, want %v", tag, got, want)
+	}
+}
+
+// TestImport_Formats tests every input format
+func TestImport_Formats(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  Options
+		input string
+	}{
+		{"csv", Options{Format: CSV, Header: true},
+			"object_id,tag\n1,vip\n2,vip\n2,city:beijing\n3, \"city:shanghai\"\n"},
+		{"wide", Options{Format: WideCSV},
+			"id,vip,city\n1,1,\n2,yes,beijing \n3,0,shanghai\n"},
+		{"jsonl", Options{Format: JSONL},
+			`{"id": 1, "tags": ["vip"]}` + "\n\n" + `{"id": 2, "tags": ["vip", "city:beijing"]}` + "\n" + `{"id": 3, "tags": ["city:shanghai"]}`},
+		{"tsv", Options{Format: CSV, Comma: '\t'},
+			"1\tvip\n2\tvip\n2\tcity:beijing\n3\tcity:shanghai\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := tagboxtest.New(t)
+
+			stats, err := Import(context.Background(), ts, strings.NewReader(tt.input), tt.opts)
+			if err != nil {
+				t.Fatalf("import failed: %v", err)
+			}
+			if stats.Rows != 3 && stats.Rows != 4 || stats.Assignments != 4 || stats.Tags != 3 {
+				t.Errorf("stats = %+v", stats)
+			}
+
+			checkTag(t, ts, "vip", 1, 2)
+			checkTag(t, ts, "city:beijing", 2)
+			checkTag(t, ts, "city:shanghai", 3)
+		})
+	}
+}
+
+// TestImport_Batching tests loading a large input in many small batches
+func TestImport_Batching(t *testing.T) {
+	ts := tagboxtest.New(t)
+
+	var input strings.Builder
+	for i := 0; i < 10000; i++ {
+		input.WriteString([]string{"1", "2", "3"}[i%3])
+		input.WriteString(strings.Repeat("0", i%4))
+		input.WriteString(",t")
+		input.WriteString([]string{"a", "b", "c", "d", "e"}[i%5])
+		input.WriteString("\n")
+	}
+
+	var calls int
+	stats, err := Import(context.Background(), ts, strings.NewReader(input.String()), Options{
+		Workers:          4,
+		BatchSize:        100,
+		MaxBuffered:      250,
+		ProgressInterval: 1000,
+		Progress:         func(Stats) { calls++ },
+	})
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if stats.Rows != 10000 || stats.Assignments != 10000 || stats.Tags != 5 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if calls != 11 { // Every 1000 rows and at the end
+		t.Errorf("progress called %d times, want 11", calls)
+	}
+	if count, _ := ts.GetTagCount("ta"); count != 12 {
+		t.Errorf("ta has %d objects, want 12", count)
+	}
+}
+
+// TestImport_BadRows tests the error policies
+func TestImport_BadRows(t *testing.T) {
+	input := "1,vip\nx,vip\n2\n3,\n4,\"vip\n5,vip\n"
+
+	ts := tagboxtest.New(t)
+	_, err := Import(context.Background(), ts, strings.NewReader(input), Options{})
+	var rerr *RowError
+	if !errors.As(err, &rerr) || rerr.Line != 2 {
+		t.Fatalf("Abort error = %v, want a *RowError at line 2", err)
+	}
+
+	ts = tagboxtest.New(t)
+	stats, err := Import(context.Background(), ts, strings.NewReader(input), Options{OnError: Skip})
+	if err != nil {
+		t.Fatalf("Skip import failed: %v", err)
+	}
+	var lines []int64
+	for _, rerr := range stats.Errors {
+		lines = append(lines, rerr.Line)
+	}
+	if stats.Skipped != 4 || !reflect.DeepEqual(lines, []int64{2, 3, 4, 5}) {
+		t.Errorf("Skip stats = %+v, lines %v", stats, lines)
+	}
+	checkTag(t, ts, "vip", 1)
+
+	ts = tagboxtest.New(t)
+	_, err = Import(context.Background(), ts, strings.NewReader(input), Options{OnError: Skip, MaxErrors: 2})
+	if !errors.As(err, &rerr) || rerr.Line != 4 {
+		t.Errorf("MaxErrors error = %v, want a *RowError at line 4", err)
+	}
+
+	long := `{"id": 1, "tags": ["vip"]}` + "\n" + `{"id": 2, "tags": ["` + strings.Repeat("a", maxLineLen) + `"]}` + "\n" + `{"id": 3, "tags": ["vip"]}`
+	ts = tagboxtest.New(t)
+	stats, err = Import(context.Background(), ts, strings.NewReader(long), Options{Format: JSONL, OnError: Skip})
+	if err != nil {
+		t.Fatalf("Skip import of a long line failed: %v", err)
+	}
+	if stats.Skipped != 1 || stats.Errors[0].Line != 2 {
+		t.Errorf("long line stats = %+v", stats)
+	}
+	checkTag(t, ts, "vip", 1, 3)
+
+	_, err = Import(context.Background(), ts, strings.NewReader("id\n1\n"), Options{Format: WideCSV})
+	if err == nil {
+		t.Error("wide CSV without tag columns was accepted")
+	}
+}
+
+// TestImport_Replace tests that Replace mode swaps tag contents and leaves
+// everything alone when the input is bad
+func TestImport_Replace(t *testing.T) {
+	ts := tagboxtest.New(t)
+	ts.BatchAddObjectsToTag([]uint32{1, 2, 3}, "segment")
+	ts.BatchAddObjectsToTag([]uint32{1, 9}, "other")
+
+	_, err := Import(context.Background(), ts, strings.NewReader("2,segment\n4,segment\nx,segment\n"), Options{Replace: true})
+	if err == nil {
+		t.Fatal("bad input was accepted")
+	}
+	checkTag(t, ts, "segment", 1, 2, 3)
+
+	stats, err := Import(context.Background(), ts, strings.NewReader("2,segment\n4,segment\n4,segment\n5,fresh\n"), Options{Replace: true})
+	if err != nil {
+		t.Fatalf("replace failed: %v", err)
+	}
+	if stats.Assignments != 3 || stats.Tags != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+	checkTag(t, ts, "segment", 2, 4)
+	checkTag(t, ts, "fresh", 5)
+	checkTag(t, ts, "other", 1, 9)
+
+	type addOnly struct{ Loader }
+	_, err = Import(context.Background(), addOnly{ts}, strings.NewReader(""), Options{Replace: true})
+	if err == nil {
+		t.Error("Replace mode accepted a destination without ReplaceTag")
+	}
+}
+
+// failingLoader fails every load
+type failingLoader struct{}
+
+func (failingLoader) BatchAddObjectsToTag([]uint32, string) error {
+	return errors.New("store unavailable")
+}
+
+// TestImport_LoadError tests that a failed load stops the import
+func TestImport_LoadError(t *testing.T) {
+	input := strings.Repeat("1,a\n2,b\n", 1000)
+
+	_, err := Import(context.Background(), failingLoader{}, strings.NewReader(input), Options{BatchSize: 10})
+	if err == nil || !strings.Contains(err.Error(), "store unavailable") {
+		t.Errorf("error = %v, want the load error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Import(ctx, tagboxtest.New(t), strings.NewReader(input), Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled import error = %v", err)
+	}
+}
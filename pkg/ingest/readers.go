@@ -0,0 +1,291 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// Format is the layout of the input.
+type Format int
+
+const (
+	// CSV has one assignment per row: object_id,tag.
+	CSV Format = iota
+
+	// WideCSV has a header row naming an ID column followed by one column
+	// per tag, and one object per row. A cell of 1, true, yes, y or x
+	// assigns the column's tag; an empty cell or 0, false, no or n does
+	// not; any other value assigns the namespaced tag column:value.
+	WideCSV
+
+	// JSONL has one object per line: {"id": 1, "tags": ["a", "b"]}.
+	// Lines longer than 1 MiB are bad rows.
+	JSONL
+)
+
+// ParseFormat parses "csv", "wide" or "jsonl".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "csv":
+		return CSV, nil
+	case "wide", "widecsv":
+		return WideCSV, nil
+	case "jsonl", "ndjson":
+		return JSONL, nil
+	}
+	return 0, fmt.Errorf("unknown format %q", s)
+}
+
+func (f Format) String() string {
+	switch f {
+	case CSV:
+		return "csv"
+	case WideCSV:
+		return "wide"
+	case JSONL:
+		return "jsonl"
+	}
+	return "Format(" + strconv.Itoa(int(f)) + ")"
+}
+
+// RowError is a row that could not be parsed.
+type RowError struct {
+	Line int64 // Line number in the input, starting at 1
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// rowReader reads objects and their tags from the input. next returns a
+// *RowError for a bad row, after which reading can go on, and io.EOF at
+// the end of the input; any other error is fatal. The tags are only valid
+// until the next call.
+type rowReader interface {
+	next() (objectID uint32, tags []string, err error)
+}
+
+func newRowReader(r io.Reader, opts Options) (rowReader, error) {
+	switch opts.Format {
+	case CSV, WideCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		cr.TrimLeadingSpace = true
+		if opts.Comma != 0 {
+			cr.Comma = opts.Comma
+		}
+
+		if opts.Format == CSV {
+			return &csvReader{r: cr, header: opts.Header}, nil
+		}
+		return newWideReader(cr)
+	case JSONL:
+		return &jsonlReader{r: bufio.NewReaderSize(r, 64<<10)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %v", opts.Format)
+}
+
+// parseID parses an object ID field.
+func parseID(field string) (uint32, error) {
+	id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid object ID %q", field)
+	}
+	return uint32(id), nil
+}
+
+// readCSV reads a record, turning parse errors into row errors.
+func readCSV(r *csv.Reader) ([]string, int64, error) {
+	record, err := r.Read()
+	if err != nil {
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return nil, int64(perr.StartLine), &RowError{Line: int64(perr.StartLine), Err: perr.Err}
+		}
+		return nil, 0, err
+	}
+
+	line, _ := r.FieldPos(0)
+	return record, int64(line), nil
+}
+
+// csvReader reads object_id,tag rows.
+type csvReader struct {
+	r      *csv.Reader
+	header bool
+	tags   [1]string
+}
+
+func (c *csvReader) next() (uint32, []string, error) {
+	if c.header {
+		c.header = false
+		if _, _, err := readCSV(c.r); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	record, line, err := readCSV(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(record) != 2 {
+		return 0, nil, &RowError{Line: line, Err: fmt.Errorf("expected 2 fields, found %d", len(record))}
+	}
+
+	id, err := parseID(record[0])
+	if err != nil {
+		return 0, nil, &RowError{Line: line, Err: err}
+	}
+	if record[1] == "" {
+		return 0, nil, &RowError{Line: line, Err: errors.New("empty tag")}
+	}
+
+	c.tags[0] = record[1]
+	return id, c.tags[:], nil
+}
+
+// wideReader reads rows of one column per tag.
+type wideReader struct {
+	r       *csv.Reader
+	columns []string
+	tags    []string
+}
+
+func newWideReader(r *csv.Reader) (*wideReader, error) {
+	header, _, err := readCSV(r)
+	if err == io.EOF {
+		return nil, errors.New("missing header row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	if len(header) < 2 {
+		return nil, errors.New("header: expected an ID column and at least one tag column")
+	}
+
+	columns := make([]string, len(header)-1)
+	for i, column := range header[1:] {
+		if column == "" {
+			return nil, fmt.Errorf("header: column %d has no name", i+2)
+		}
+		columns[i] = column
+	}
+	return &wideReader{r: r, columns: columns}, nil
+}
+
+func (w *wideReader) next() (uint32, []string, error) {
+	record, line, err := readCSV(w.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(record) != len(w.columns)+1 {
+		return 0, nil, &RowError{Line: line, Err: fmt.Errorf("expected %d fields, found %d", len(w.columns)+1, len(record))}
+	}
+
+	id, err := parseID(record[0])
+	if err != nil {
+		return 0, nil, &RowError{Line: line, Err: err}
+	}
+
+	w.tags = w.tags[:0]
+	for i, cell := range record[1:] {
+		value := strings.TrimSpace(cell)
+		switch strings.ToLower(value) {
+		case "", "0", "false", "no", "n":
+		case "1", "true", "yes", "y", "x":
+			w.tags = append(w.tags, w.columns[i])
+		default:
+			w.tags = append(w.tags, w.columns[i]+tagbox.DimensionSeparator+value)
+		}
+	}
+	return id, w.tags, nil
+}
+
+// maxLineLen caps a JSONL line, so that input without newlines cannot
+// exhaust memory.
+const maxLineLen = 1 << 20
+
+// jsonlReader reads one JSON object per line.
+type jsonlReader struct {
+	r    *bufio.Reader
+	buf  []byte
+	line int64
+}
+
+// jsonlRow is a JSONL line.
+type jsonlRow struct {
+	ID   *json.Number `json:"id"`
+	Tags []string     `json:"tags"`
+}
+
+func (j *jsonlReader) next() (uint32, []string, error) {
+	for {
+		buf, long, err := j.readLine()
+		if err != nil && (err != io.EOF || len(buf) == 0 && !long) {
+			return 0, nil, err
+		}
+		j.line++
+		if long {
+			return 0, nil, &RowError{Line: j.line, Err: fmt.Errorf("line longer than %d bytes", maxLineLen)}
+		}
+
+		buf = bytes.TrimSpace(buf)
+		if len(buf) == 0 {
+			continue // Blank lines are ignored
+		}
+
+		var row jsonlRow
+		if err := json.Unmarshal(buf, &row); err != nil {
+			return 0, nil, &RowError{Line: j.line, Err: err}
+		}
+		if row.ID == nil {
+			return 0, nil, &RowError{Line: j.line, Err: errors.New("missing id")}
+		}
+		id, err := parseID(row.ID.String())
+		if err != nil {
+			return 0, nil, &RowError{Line: j.line, Err: err}
+		}
+		for _, tag := range row.Tags {
+			if tag == "" {
+				return 0, nil, &RowError{Line: j.line, Err: errors.New("empty tag")}
+			}
+		}
+
+		return id, row.Tags, nil
+	}
+}
+
+// readLine reads a line, reporting it as long and skipping the rest of it
+// once it exceeds maxLineLen.
+func (j *jsonlReader) readLine() ([]byte, bool, error) {
+	j.buf = j.buf[:0]
+	for {
+		chunk, err := j.r.ReadSlice('\n')
+		if len(j.buf)+len(chunk) > maxLineLen {
+			for err == bufio.ErrBufferFull {
+				_, err = j.r.ReadSlice('\n')
+			}
+			return nil, true, err
+		}
+
+		j.buf = append(j.buf, chunk...)
+		if err != bufio.ErrBufferFull {
+			return j.buf, false, err
+		}
+	}
+}
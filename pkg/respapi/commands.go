@@ -0,0 +1,378 @@
+package respapi
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// command describes a command by the number of arguments it takes after
+// its name, with max -1 for no limit, and its implementation.
+type command struct {
+	min, max int
+	run      func(s *Server, sess *session, args []string)
+}
+
+// defaultScanCount is the page size of TAG.SCAN without COUNT.
+const defaultScanCount = 1000
+
+var commands = map[string]command{
+	"PING":    {0, 1, cmdPing},
+	"ECHO":    {1, 1, cmdEcho},
+	"HELLO":   {0, -1, cmdHello},
+	"SELECT":  {1, 1, cmdSelect},
+	"CLIENT":  {1, -1, cmdClient},
+	"COMMAND": {0, -1, cmdCommand},
+	"QUIT":    {0, 0, cmdQuit},
+
+	"TAG.ADD":     {2, -1, cmdAdd},
+	"TAG.REM":     {2, -1, cmdRem},
+	"TAG.MADD":    {2, -1, cmdMAdd},
+	"TAG.HAS":     {2, 2, cmdHas},
+	"TAG.OBJTAGS": {1, 1, cmdObjTags},
+	"TAG.TAGS":    {0, 0, cmdTags},
+	"TAG.CARD":    {1, 1, cmdCard},
+	"TAG.QUERY":   {1, 3, cmdQuery},
+	"TAG.SCAN":    {2, 4, cmdScan},
+	"TAG.COUNT":   {1, 1, cmdCount},
+	"TAG.STATS":   {0, 0, cmdStats},
+	"TAG.SAVE":    {0, 0, cmdSave},
+}
+
+// execute runs one command and writes its reply.
+func (s *Server) execute(sess *session, args []string) {
+	name := strings.ToUpper(args[0])
+	cmd, exists := commands[name]
+	if !exists {
+		sess.w.error("ERR unknown command '" + args[0] + "'")
+		return
+	}
+
+	n := len(args) - 1
+	if n < cmd.min || (cmd.max >= 0 && n > cmd.max) {
+		sess.w.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return
+	}
+
+	cmd.run(s, sess, args[1:])
+}
+
+// parseObjectID parses an object ID argument, writing an error reply when
+// it is invalid.
+func parseObjectID(sess *session, arg string) (uint32, bool) {
+	id, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		sess.w.error("ERR invalid object ID '" + arg + "'")
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// replyError writes an error reply for a tag system error.
+func replyError(sess *session, err error) {
+	var perr *tagbox.ParseError
+	if errors.As(err, &perr) {
+		sess.w.error("ERR syntax error: " + err.Error())
+		return
+	}
+	sess.w.error("ERR " + err.Error())
+}
+
+func cmdPing(s *Server, sess *session, args []string) {
+	if len(args) == 0 {
+		sess.w.simple("PONG")
+		return
+	}
+	sess.w.bulk(args[0])
+}
+
+func cmdEcho(s *Server, sess *session, args []string) {
+	sess.w.bulk(args[0])
+}
+
+// cmdHello switches the protocol version and describes the server.
+// Authentication is not supported.
+func cmdHello(s *Server, sess *session, args []string) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(args[0])
+		if err != nil {
+			sess.w.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != 2 && proto != 3 {
+			sess.w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		for i := 1; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "SETNAME":
+				i++
+			case "AUTH":
+				sess.w.error("ERR AUTH is not supported")
+				return
+			default:
+				sess.w.error("ERR syntax error in HELLO option '" + args[i] + "'")
+				return
+			}
+		}
+		sess.w.proto = proto
+	}
+
+	sess.w.mapHeader(4)
+	sess.w.bulk("server")
+	sess.w.bulk("tagbox")
+	sess.w.bulk("proto")
+	sess.w.int(int64(sess.w.proto))
+	sess.w.bulk("mode")
+	sess.w.bulk("standalone")
+	sess.w.bulk("modules")
+	sess.w.array(0)
+}
+
+// cmdSelect accepts only database 0, which clients may select on connect.
+func cmdSelect(s *Server, sess *session, args []string) {
+	if args[0] != "0" {
+		sess.w.error("ERR DB index is out of range")
+		return
+	}
+	sess.w.simple("OK")
+}
+
+// cmdClient accepts the connection metadata clients send on connect.
+func cmdClient(s *Server, sess *session, args []string) {
+	switch strings.ToUpper(args[0]) {
+	case "SETNAME", "SETINFO":
+		sess.w.simple("OK")
+	default:
+		sess.w.error("ERR unknown subcommand '" + args[0] + "'")
+	}
+}
+
+// cmdCommand replies with an empty command table, which makes clients
+// that query it fall back to their defaults.
+func cmdCommand(s *Server, sess *session, args []string) {
+	sess.w.array(0)
+}
+
+func cmdQuit(s *Server, sess *session, args []string) {
+	sess.w.simple("OK")
+	sess.quit = true
+}
+
+func cmdAdd(s *Server, sess *session, args []string) {
+	id, ok := parseObjectID(sess, args[0])
+	if !ok {
+		return
+	}
+
+	var err error
+	if len(args) == 2 {
+		err = s.ts.AddTag(id, args[1])
+	} else {
+		err = s.ts.BatchAddTags(id, args[1:])
+	}
+	if err != nil {
+		replyError(sess, err)
+		return
+	}
+	sess.w.simple("OK")
+}
+
+func cmdRem(s *Server, sess *session, args []string) {
+	id, ok := parseObjectID(sess, args[0])
+	if !ok {
+		return
+	}
+
+	for _, tag := range args[1:] {
+		if err := s.ts.RemoveTag(id, tag); err != nil {
+			replyError(sess, err)
+			return
+		}
+	}
+	sess.w.simple("OK")
+}
+
+func cmdMAdd(s *Server, sess *session, args []string) {
+	ids := make([]uint32, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, ok := parseObjectID(sess, arg)
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	if err := s.ts.BatchAddObjectsToTag(ids, args[0]); err != nil {
+		replyError(sess, err)
+		return
+	}
+	sess.w.simple("OK")
+}
+
+func cmdHas(s *Server, sess *session, args []string) {
+	id, ok := parseObjectID(sess, args[0])
+	if !ok {
+		return
+	}
+	sess.w.bool(s.ts.HasTag(id, args[1]))
+}
+
+func cmdObjTags(s *Server, sess *session, args []string) {
+	id, ok := parseObjectID(sess, args[0])
+	if !ok {
+		return
+	}
+
+	tags, err := s.ts.GetObjectTags(id)
+	if err != nil {
+		replyError(sess, err)
+		return
+	}
+	sort.Strings(tags)
+	sess.w.strings(tags)
+}
+
+func cmdTags(s *Server, sess *session, args []string) {
+	tags := s.ts.GetAllTags()
+	sort.Strings(tags)
+	sess.w.strings(tags)
+}
+
+func cmdCard(s *Server, sess *session, args []string) {
+	count, err := s.ts.GetTagCount(args[0])
+	if err != nil {
+		replyError(sess, err)
+		return
+	}
+	sess.w.uint(count)
+}
+
+// cmdQuery replies with the objects matching an expression in ID order,
+// at most LIMIT of them. TAG.SCAN pages through a large result.
+func cmdQuery(s *Server, sess *session, args []string) {
+	limit := int64(math.MaxInt64)
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) || strings.ToUpper(args[i]) != "LIMIT" {
+			sess.w.error("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n < 0 {
+			sess.w.error("ERR LIMIT must be a non-negative integer")
+			return
+		}
+		limit = n
+	}
+
+	result, err := s.ts.QueryExpr(args[0])
+	if err != nil {
+		replyError(sess, err)
+		return
+	}
+
+	// RESP needs the length of the reply up front
+	count := int64(result.GetCardinality())
+	if count > limit {
+		count = limit
+	}
+
+	sess.w.array(int(count))
+	for it := result.Iterator(); count > 0; count-- {
+		sess.w.int(int64(it.Next()))
+	}
+}
+
+// cmdScan replies with one page of the objects matching an expression, as
+// SCAN does: the cursor of the next page, "0" after the last one, and the
+// objects. Paging starts with cursor "0".
+func cmdScan(s *Server, sess *session, args []string) {
+	limit := defaultScanCount
+	if len(args) > 2 {
+		if len(args) != 4 || strings.ToUpper(args[2]) != "COUNT" {
+			sess.w.error("ERR syntax error")
+			return
+		}
+		n, err := strconv.Atoi(args[3])
+		if err != nil || n <= 0 {
+			sess.w.error("ERR COUNT must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	cursor := args[1]
+	if cursor == "0" {
+		cursor = ""
+	}
+
+	result, err := s.ts.QueryExpr(args[0])
+	if err != nil {
+		replyError(sess, err)
+		return
+	}
+	page, err := tagbox.PageAfter(result, cursor, limit)
+	if errors.Is(err, tagbox.ErrInvalidCursor) {
+		sess.w.error("ERR invalid cursor")
+		return
+	} else if err != nil {
+		replyError(sess, err)
+		return
+	}
+
+	next := page.Next
+	if next == "" {
+		next = "0"
+	}
+	sess.w.array(2)
+	sess.w.bulk(next)
+	sess.w.array(len(page.Objects))
+	for _, objectID := range page.Objects {
+		sess.w.int(int64(objectID))
+	}
+}
+
+func cmdCount(s *Server, sess *session, args []string) {
+	result, err := s.ts.QueryExpr(args[0])
+	if err != nil {
+		replyError(sess, err)
+		return
+	}
+	sess.w.uint(result.GetCardinality())
+}
+
+func cmdStats(s *Server, sess *session, args []string) {
+	stats := s.ts.GetStats()
+
+	sess.w.mapHeader(9)
+	sess.w.bulk("total_tags")
+	sess.w.int(int64(stats.TotalTags))
+	sess.w.bulk("total_objects")
+	sess.w.uint(stats.TotalObjects)
+	sess.w.bulk("unique_objects")
+	sess.w.uint(stats.UniqueObjects)
+	sess.w.bulk("memory_usage")
+	sess.w.uint(stats.MemoryUsage)
+	sess.w.bulk("largest_tag")
+	sess.w.bulk(stats.LargestTag)
+	sess.w.bulk("largest_tag_size")
+	sess.w.uint(stats.LargestTagSize)
+	sess.w.bulk("dirty_tags")
+	sess.w.int(int64(stats.DirtyTags))
+	sess.w.bulk("expiring")
+	sess.w.uint(stats.Expiring)
+	sess.w.bulk("attrs")
+	sess.w.int(int64(stats.Attrs))
+}
+
+func cmdSave(s *Server, sess *session, args []string) {
+	if _, err := s.ts.Flush(); err != nil {
+		replyError(sess, err)
+		return
+	}
+	sess.w.simple("OK")
+}
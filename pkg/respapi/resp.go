@@ -0,0 +1,257 @@
+package respapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Request size limits.
+const (
+	maxArgs    = 1 << 20
+	maxBulkLen = 64 << 20
+	maxInline  = 64 << 10
+)
+
+// errProtocol is wrapped by errors in the request stream. The connection
+// is closed after replying with it, as Redis does.
+var errProtocol = errors.New("Protocol error")
+
+// readCommand reads one command, either as a RESP array of bulk strings as
+// sent by clients, or as an inline line of space-separated words as typed
+// into a plain TCP connection. It returns nil args for an empty line.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		return readInline(r)
+	}
+
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	if n <= 0 {
+		return nil, nil // Empty or null array, skipped as Redis does
+	}
+
+	// The length is not trusted for preallocation
+	capacity := n
+	if capacity > 64 {
+		capacity = 64
+	}
+	args := make([]string, 0, capacity)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated", errProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+// readLine reads a CRLF- or LF-terminated line without the terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w: too big line", errProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// readInline reads an inline command. Words are separated by spaces and
+// may be quoted with double quotes, which support backslash escapes, or
+// with single quotes.
+func readInline(r *bufio.Reader) ([]string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxInline {
+			return nil, fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	return splitInline(strings.TrimRight(string(line), "\r\n"))
+}
+
+// splitInline splits an inline command into words.
+func splitInline(line string) ([]string, error) {
+	var args []string
+	for i := 0; ; {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var word strings.Builder
+		switch line[i] {
+		case '"':
+			for i++; ; i++ {
+				if i == len(line) {
+					return nil, fmt.Errorf("%w: unbalanced quotes in request", errProtocol)
+				}
+				if line[i] == '"' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						word.WriteByte('\n')
+					case 't':
+						word.WriteByte('\t')
+					default:
+						word.WriteByte(line[i])
+					}
+					continue
+				}
+				word.WriteByte(line[i])
+			}
+		case '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unbalanced quotes in request", errProtocol)
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 2
+		default:
+			start := i
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				i++
+			}
+			word.WriteString(line[start:i])
+		}
+
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, fmt.Errorf("%w: closing quote must be followed by a space", errProtocol)
+		}
+		args = append(args, word.String())
+	}
+}
+
+// writer encodes replies in RESP2 or, after HELLO 3, RESP3. Aggregate
+// types RESP2 lacks are sent as flat arrays.
+type writer struct {
+	*bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+// error writes an error reply. msg should start with an error code such
+// as ERR or WRONGTYPE.
+func (w *writer) error(msg string) {
+	w.WriteByte('-')
+	w.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+	w.WriteString("\r\n")
+}
+
+func (w *writer) int(n int64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString("\r\n")
+}
+
+func (w *writer) uint(n uint64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatUint(n, 10))
+	w.WriteString("\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(s)))
+	w.WriteString("\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.WriteString("_\r\n")
+	} else {
+		w.WriteString("$-1\r\n")
+	}
+}
+
+func (w *writer) bool(b bool) {
+	switch {
+	case w.proto == 3 && b:
+		w.WriteString("#t\r\n")
+	case w.proto == 3:
+		w.WriteString("#f\r\n")
+	case b:
+		w.int(1)
+	default:
+		w.int(0)
+	}
+}
+
+func (w *writer) header(kind byte, n int) {
+	w.WriteByte(kind)
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
+
+func (w *writer) array(n int) { w.header('*', n) }
+
+// mapHeader starts a map of n key-value pairs.
+func (w *writer) mapHeader(n int) {
+	if w.proto == 3 {
+		w.header('%', n)
+	} else {
+		w.array(2 * n)
+	}
+}
+
+func (w *writer) strings(ss []string) {
+	w.array(len(ss))
+	for _, s := range ss {
+		w.bulk(s)
+	}
+}
@@ -0,0 +1,272 @@
+package respapi
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/internal/tagboxtest"
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+func newTestServer(t *testing.T) (*tagbox.TagSystem, string) {
+	t.Helper()
+
+	ts := tagboxtest.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(ts)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return ts, l.Addr().String()
+}
+
+// exchange writes raw requests and reads back exactly len(want) bytes.
+func exchange(t *testing.T, conn net.Conn, r *bufio.Reader, request, want string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("%q: %v after %q", request, err, got)
+	}
+	if string(got) != want {
+		t.Errorf("%q replied %q, want %q", request, got, want)
+	}
+}
+
+// TestServer_PlainTCP tests inline and multibulk commands over a plain
+// TCP connection
+func TestServer_PlainTCP(t *testing.T) {
+	ts, addr := newTestServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	exchange(t, conn, r, "PING\r\n", "+PONG\r\n")
+	exchange(t, conn, r, "\r\n", "") // Empty lines are ignored
+	exchange(t, conn, r, "TAG.ADD 1 vip\n", "+OK\r\n")
+	exchange(t, conn, r, `tag.add 2 vip "big spender" 'a b'`+"\r\n", "+OK\r\n")
+	exchange(t, conn, r, "*3\r\n$8\r\nTAG.MADD\r\n$4\r\nmale\r\n$1\r\n2\r\n", "+OK\r\n")
+
+	// Pipelined commands are answered in order
+	exchange(t, conn, r, "TAG.HAS 1 vip\r\nTAG.HAS 1 male\r\nTAG.CARD vip\r\n", ":1\r\n:0\r\n:2\r\n")
+
+	exchange(t, conn, r, `TAG.QUERY "vip AND \"big spender\""`+"\r\n", "*1\r\n:2\r\n")
+	exchange(t, conn, r, "TAG.COUNT vip\r\n", ":2\r\n")
+	exchange(t, conn, r, "TAG.OBJTAGS 2\r\n", "*4\r\n$3\r\na b\r\n$11\r\nbig spender\r\n$4\r\nmale\r\n$3\r\nvip\r\n")
+	exchange(t, conn, r, "TAG.REM 2 vip male\r\n", "+OK\r\n")
+	exchange(t, conn, r, "TAG.OBJTAGS 9\r\n", "*0\r\n")
+
+	if ts.HasTag(2, "vip") || !ts.HasTag(2, "big spender") {
+		t.Error("commands were not applied to the tag system")
+	}
+
+	exchange(t, conn, r, "QUIT\r\n", "+OK\r\n")
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after QUIT: %v", err)
+	}
+}
+
+// TestServer_QueryPaging tests LIMIT and TAG.SCAN
+func TestServer_QueryPaging(t *testing.T) {
+	ts, addr := newTestServer(t)
+	ts.BatchAddObjectsToTag([]uint32{1, 5, 9, 12, 4294967295}, "t")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	exchange(t, conn, r, "TAG.QUERY t LIMIT 2\r\n", "*2\r\n:1\r\n:5\r\n")
+	exchange(t, conn, r, "TAG.QUERY t limit 0\r\n", "*0\r\n")
+	exchange(t, conn, r, "TAG.QUERY t AFTER 5\r\n", "-ERR syntax error\r\n")
+
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	defer rdb.Close()
+
+	var got []int64
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("TAG.SCAN did not terminate")
+		}
+		reply, err := rdb.Do(context.Background(), "TAG.SCAN", "t", cursor, "COUNT", 2).Slice()
+		if err != nil || len(reply) != 2 {
+			t.Fatalf("TAG.SCAN %s = %v, %v", cursor, reply, err)
+		}
+		cursor = reply[0].(string)
+		for _, id := range reply[1].([]interface{}) {
+			got = append(got, id.(int64))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if want := []int64{1, 5, 9, 12, 4294967295}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %v, want %v", got, want)
+	}
+
+	exchange(t, conn, r, "TAG.SCAN t bogus\r\n", "-ERR invalid cursor\r\n")
+	exchange(t, conn, r, "TAG.SCAN t 0 COUNT 0\r\n", "-ERR COUNT must be a positive integer\r\n")
+}
+
+// TestServer_Errors tests error replies and protocol errors
+func TestServer_Errors(t *testing.T) {
+	_, addr := newTestServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	exchange(t, conn, r, "NOPE\r\n", "-ERR unknown command 'NOPE'\r\n")
+	exchange(t, conn, r, "TAG.ADD 1\r\n", "-ERR wrong number of arguments for 'tag.add' command\r\n")
+	exchange(t, conn, r, "TAG.ADD x vip\r\n", "-ERR invalid object ID 'x'\r\n")
+	exchange(t, conn, r, "TAG.QUERY t LIMIT\r\n", "-ERR syntax error\r\n")
+	exchange(t, conn, r, "TAG.COUNT \"a AND\"\r\n", "-ERR syntax error: parse error at position 5: expected tag, ALL, NONE or \"(\", found end of expression\r\n")
+	exchange(t, conn, r, "HELLO 4\r\n", "-NOPROTO unsupported protocol version\r\n")
+
+	// Protocol errors close the connection
+	exchange(t, conn, r, "*1\r\n+PING\r\n", "-ERR Protocol error: expected '$', got '+'\r\n")
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after a protocol error: %v", err)
+	}
+
+	// Empty and null arrays are skipped; oversized ones are refused
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+
+	exchange(t, conn, r, "*-1\r\n*0\r\n*-5\r\nPING\r\n", "+PONG\r\n")
+	exchange(t, conn, r, "*2000000\r\n", "-ERR Protocol error: invalid multibulk length\r\n")
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after an oversized array: %v", err)
+	}
+}
+
+// TestServer_RedisClient tests the commands through a Redis client
+// library in both protocol versions
+func TestServer_RedisClient(t *testing.T) {
+	for _, proto := range []int{2, 3} {
+		ts, addr := newTestServer(t)
+		ctx := context.Background()
+
+		rdb := redis.NewClient(&redis.Options{Addr: addr, Protocol: proto})
+		defer rdb.Close()
+
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			t.Fatalf("RESP%d: %v", proto, err)
+		}
+		if err := rdb.Do(ctx, "TAG.ADD", 1, "vip", "city:beijing").Err(); err != nil {
+			t.Fatalf("RESP%d: %v", proto, err)
+		}
+		rdb.Do(ctx, "TAG.MADD", "vip", 2, 3)
+
+		ids, err := rdb.Do(ctx, "TAG.QUERY", "vip AND NOT city:*").Int64Slice()
+		if err != nil || !reflect.DeepEqual(ids, []int64{2, 3}) {
+			t.Errorf("RESP%d TAG.QUERY = %v, %v", proto, ids, err)
+		}
+
+		tags, err := rdb.Do(ctx, "TAG.OBJTAGS", 1).StringSlice()
+		if err != nil || !reflect.DeepEqual(tags, []string{"city:beijing", "vip"}) {
+			t.Errorf("RESP%d TAG.OBJTAGS = %v, %v", proto, tags, err)
+		}
+
+		has, err := rdb.Do(ctx, "TAG.HAS", 3, "vip").Bool()
+		if err != nil || !has {
+			t.Errorf("RESP%d TAG.HAS = %v, %v", proto, has, err)
+		}
+
+		if count, err := rdb.Do(ctx, "TAG.COUNT", "vip").Int(); err != nil || count != 3 {
+			t.Errorf("RESP%d TAG.COUNT = %d, %v", proto, count, err)
+		}
+
+		stats, err := rdb.Do(ctx, "TAG.STATS").Result()
+		if err != nil {
+			t.Fatalf("RESP%d TAG.STATS: %v", proto, err)
+		}
+		switch v := stats.(type) {
+		case map[interface{}]interface{}:
+			if v["total_tags"] != int64(2) {
+				t.Errorf("RESP3 TAG.STATS = %v", v)
+			}
+		case []interface{}:
+			if proto != 2 || len(v) != 18 || v[0] != "total_tags" || v[1] != int64(2) {
+				t.Errorf("RESP2 TAG.STATS = %v", v)
+			}
+		default:
+			t.Errorf("RESP%d TAG.STATS returned %T", proto, stats)
+		}
+
+		err = rdb.Do(ctx, "TAG.QUERY", "vip AND").Err()
+		if err == nil || !strings.HasPrefix(err.Error(), "ERR syntax error") {
+			t.Errorf("RESP%d bad query error = %v", proto, err)
+		}
+
+		if count, _ := ts.GetTagCount("vip"); count != 3 {
+			t.Errorf("RESP%d vip count = %d, want 3", proto, count)
+		}
+	}
+}
+
+// TestServer_Shutdown tests that Shutdown closes idle connections and
+// stops Serve
+func TestServer_Shutdown(t *testing.T) {
+	ts := tagboxtest.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(ts)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	exchange(t, conn, r, "PING\r\n", "+PONG\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("idle connection still open after Shutdown: %v", err)
+	}
+}
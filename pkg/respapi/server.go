@@ -0,0 +1,227 @@
+// Package respapi serves a tagbox.TagSystem over the Redis protocol
+// (RESP2, and RESP3 after HELLO 3), so redis-cli and Redis client
+// libraries can use it without a custom SDK.
+//
+// Commands:
+//
+//	TAG.ADD object tag [tag ...]           add tags to an object
+//	TAG.REM object tag [tag ...]           remove tags from an object
+//	TAG.MADD tag object [object ...]       add objects to a tag
+//	TAG.HAS object tag                     whether an object has a tag
+//	TAG.OBJTAGS object                     tags of an object, sorted
+//	TAG.TAGS                               all tags, sorted
+//	TAG.CARD tag                           object count of a tag
+//	TAG.QUERY expr [LIMIT count]           objects matching an expression
+//	TAG.SCAN expr cursor [COUNT count]     one page of them, like SCAN
+//	TAG.COUNT expr                         count of objects matching an expression
+//	TAG.STATS                              tag system statistics
+//	TAG.SAVE                               write modified tags to the store
+//
+// along with PING, ECHO, HELLO, SELECT 0, CLIENT SETNAME/SETINFO, COMMAND
+// and QUIT for client compatibility. Commands can also be typed inline
+// into a plain TCP connection:
+//
+//	$ nc localhost 6380
+//	TAG.QUERY "vip AND NOT churned"
+package respapi
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gongvirgil/roaring-tags/roaring-tags/pkg/tagbox"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown or Close.
+var ErrServerClosed = errors.New("respapi: server closed")
+
+// Server serves the commands of one tag system.
+type Server struct {
+	ts *tagbox.TagSystem
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closing   bool
+	wg        sync.WaitGroup // Running connection handlers
+}
+
+// NewServer creates a Server for ts. The caller keeps ownership of ts and
+// must close it after the server has shut down.
+func NewServer(ts *tagbox.TagSystem) *Server {
+	return &Server{
+		ts:        ts,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is shut down, and
+// always returns a non-nil error.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections and lets every connection finish
+// the command it is executing before closing it. Connections still open
+// when ctx is done are closed immediately.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	// Wake up connections waiting for their next command
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes every open connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	return nil
+}
+
+// session is the state of one connection.
+type session struct {
+	r    *bufio.Reader
+	w    *writer
+	quit bool
+}
+
+// serveConn runs the command loop of one connection.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		// A panic ends only its connection, as in net/http
+		if err := recover(); err != nil {
+			log.Printf("respapi: panic serving %v: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+		}
+
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	sess := &session{
+		r: bufio.NewReader(conn),
+		w: &writer{Writer: bufio.NewWriter(conn), proto: 2},
+	}
+
+	for !sess.quit {
+		args, err := readCommand(sess.r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				sess.w.error("ERR " + err.Error())
+				sess.w.Flush()
+			}
+			return
+		}
+
+		if len(args) > 0 {
+			s.execute(sess, args)
+		}
+
+		// Pipelined commands are answered together
+		if sess.r.Buffered() == 0 || sess.quit {
+			if err := sess.w.Flush(); err != nil {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		closing := s.closing
+		s.mu.Unlock()
+		if closing {
+			sess.w.Flush()
+			return
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package tagbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Metadata entries that hold the numeric attributes: the list of
+// attribute names, and one bit-sliced index per attribute.
+const (
+	attrsMetaName  = "attrs"
+	attrMetaPrefix = "attr:"
+)
+
+// ErrAttrOverflow is returned by AttrSum when the sum of the attribute
+// values does not fit in a uint64.
+var ErrAttrOverflow = errors.New("attribute sum overflows uint64")
+
+// CompareOp is a comparison between a numeric attribute and a value.
+type CompareOp string
+
+// Comparison operators for Compare and QueryAttr.
+const (
+	CmpEQ CompareOp = "="
+	CmpNE CompareOp = "!="
+	CmpLT CompareOp = "<"
+	CmpLE CompareOp = "<="
+	CmpGT CompareOp = ">"
+	CmpGE CompareOp = ">="
+)
+
+// bsi is a bit-sliced index of a numeric attribute: slice i holds the
+// objects whose value has bit i set, and exists holds every object that
+// has a value. Callers must hold the TagSystem lock.
+type bsi struct {
+	exists *roaring.Bitmap
+	slices []*roaring.Bitmap
+}
+
+// newBSI creates an empty index.
+func newBSI() *bsi {
+	return &bsi{exists: roaring.NewBitmap()}
+}
+
+// set stores the value of an object and reports whether it changed.
+func (b *bsi) set(objectID uint32, value uint64) bool {
+	if old, ok := b.get(objectID); ok && old == value {
+		return false
+	}
+
+	for len(b.slices) < bits.Len64(value) {
+		b.slices = append(b.slices, roaring.NewBitmap())
+	}
+	for i, slice := range b.slices {
+		if value&(1<<uint(i)) != 0 {
+			slice.Add(objectID)
+		} else {
+			slice.Remove(objectID)
+		}
+	}
+	b.exists.Add(objectID)
+
+	return true
+}
+
+// get returns the value of an object.
+func (b *bsi) get(objectID uint32) (uint64, bool) {
+	if !b.exists.Contains(objectID) {
+		return 0, false
+	}
+
+	var value uint64
+	for i, slice := range b.slices {
+		if slice.Contains(objectID) {
+			value |= 1 << uint(i)
+		}
+	}
+
+	return value, true
+}
+
+// remove drops the value of an object and reports whether it had one.
+func (b *bsi) remove(objectID uint32) bool {
+	if !b.exists.CheckedRemove(objectID) {
+		return false
+	}
+
+	for _, slice := range b.slices {
+		slice.Remove(objectID)
+	}
+
+	return true
+}
+
+// compare returns the objects of filter whose value is less than, equal
+// to and greater than value. A nil filter means every object with a value.
+func (b *bsi) compare(value uint64, filter *roaring.Bitmap) (lt, eq, gt *roaring.Bitmap) {
+	eq = b.exists.Clone()
+	if filter != nil {
+		eq.And(filter)
+	}
+	lt, gt = roaring.NewBitmap(), roaring.NewBitmap()
+
+	// Every stored value is smaller than a value with a higher bit set
+	if bits.Len64(value) > len(b.slices) {
+		return eq, roaring.NewBitmap(), gt
+	}
+
+	// Walk from the most significant bit, moving objects out of eq at the
+	// first bit where they differ from value
+	for i := len(b.slices) - 1; i >= 0 && !eq.IsEmpty(); i-- {
+		if value&(1<<uint(i)) != 0 {
+			lt.Or(roaring.AndNot(eq, b.slices[i]))
+			eq.And(b.slices[i])
+		} else {
+			gt.Or(roaring.And(eq, b.slices[i]))
+			eq.AndNot(b.slices[i])
+		}
+	}
+
+	return lt, eq, gt
+}
+
+// query returns the objects of filter whose value satisfies op.
+func (b *bsi) query(op CompareOp, value uint64, filter *roaring.Bitmap) (*roaring.Bitmap, error) {
+	lt, eq, gt := b.compare(value, filter)
+	switch op {
+	case CmpEQ:
+		return eq, nil
+	case CmpNE:
+		lt.Or(gt)
+		return lt, nil
+	case CmpLT:
+		return lt, nil
+	case CmpLE:
+		lt.Or(eq)
+		return lt, nil
+	case CmpGT:
+		return gt, nil
+	case CmpGE:
+		gt.Or(eq)
+		return gt, nil
+	default:
+		return nil, fmt.Errorf("unknown comparison: %q", op)
+	}
+}
+
+// between returns the objects of filter whose value is in [low, high].
+func (b *bsi) between(low, high uint64, filter *roaring.Bitmap) *roaring.Bitmap {
+	if low > high {
+		return roaring.NewBitmap()
+	}
+
+	_, eq, gt := b.compare(low, filter)
+	gt.Or(eq)
+	lt, eq, _ := b.compare(high, gt)
+	lt.Or(eq)
+
+	return lt
+}
+
+// topK returns the k objects of filter with the largest values. Ties at
+// the k-th value are broken in favor of the lowest object IDs.
+func (b *bsi) topK(k int, filter *roaring.Bitmap) *roaring.Bitmap {
+	candidates := b.exists.Clone()
+	if filter != nil {
+		candidates.And(filter)
+	}
+	if k <= 0 {
+		return roaring.NewBitmap()
+	}
+	if candidates.GetCardinality() <= uint64(k) {
+		return candidates
+	}
+
+	// top holds objects known to be in the result, candidates those
+	// whose rank is still undecided
+	top := roaring.NewBitmap()
+	for i := len(b.slices) - 1; i >= 0; i-- {
+		high := roaring.Or(top, roaring.And(candidates, b.slices[i]))
+		switch n := high.GetCardinality(); {
+		case n > uint64(k):
+			candidates.And(b.slices[i])
+		case n < uint64(k):
+			top = high
+			candidates.AndNot(b.slices[i])
+		default:
+			return high
+		}
+	}
+
+	// The remaining candidates share one value; fill up in ID order
+	it := candidates.Iterator()
+	for top.GetCardinality() < uint64(k) && it.HasNext() {
+		top.Add(it.Next())
+	}
+
+	return top
+}
+
+// sum returns the sum of the values of the objects of filter and how many
+// of them have a value. ok is false if the sum overflows uint64.
+func (b *bsi) sum(filter *roaring.Bitmap) (sum, count uint64, ok bool) {
+	if filter == nil {
+		filter = b.exists
+	}
+
+	for i, slice := range b.slices {
+		n := slice.AndCardinality(filter)
+		if n == 0 {
+			continue
+		}
+		if bits.Len64(n)+i > 64 {
+			return 0, 0, false
+		}
+
+		var carry uint64
+		if sum, carry = bits.Add64(sum, n<<uint(i), 0); carry != 0 {
+			return 0, 0, false
+		}
+	}
+
+	return sum, b.exists.AndCardinality(filter), true
+}
+
+// mean returns the average value of the objects of filter that have a
+// value, or 0 when none has one. Unlike sum it cannot overflow.
+func (b *bsi) mean(filter *roaring.Bitmap) float64 {
+	if filter == nil {
+		filter = b.exists
+	}
+
+	count := b.exists.AndCardinality(filter)
+	if count == 0 {
+		return 0
+	}
+
+	var sum float64
+	for i, slice := range b.slices {
+		sum += math.Ldexp(float64(slice.AndCardinality(filter)), i)
+	}
+
+	return sum / float64(count)
+}
+
+// encode serializes the index as the slice count followed by the
+// uvarint-prefixed portable bitmaps of exists and of every slice.
+func (b *bsi) encode() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(b.slices)))
+	for _, bitmap := range append([]*roaring.Bitmap{b.exists}, b.slices...) {
+		data, err := serializeBitmap(bitmap)
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(data)))
+		buf = append(buf, data...)
+	}
+
+	return buf, nil
+}
+
+// decodeBSI parses an index written by encode.
+func decodeBSI(buf []byte) (*bsi, error) {
+	r := bytes.NewReader(buf)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > 64 {
+		return nil, fmt.Errorf("bit-sliced index has %d slices", count)
+	}
+
+	bitmaps := make([]*roaring.Bitmap, count+1)
+	for i := range bitmaps {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(r.Len()) {
+			return nil, fmt.Errorf("bit-sliced index truncated")
+		}
+		data := make([]byte, size)
+		r.Read(data)
+
+		bitmaps[i] = roaring.NewBitmap()
+		if _, err := bitmaps[i].ReadFrom(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &bsi{exists: bitmaps[0], slices: bitmaps[1:]}, nil
+}
+
+// encodeNames serializes a list of names as the count followed by the
+// uvarint-prefixed names.
+func encodeNames(names []string) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(names)))
+	for _, name := range names {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+
+	return buf
+}
+
+// decodeNames parses a list written by encodeNames.
+func decodeNames(buf []byte) ([]string, error) {
+	r := bytes.NewReader(buf)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("name list truncated")
+	}
+
+	names := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(r.Len()) {
+			return nil, fmt.Errorf("name list truncated")
+		}
+		name := make([]byte, size)
+		r.Read(name)
+		names = append(names, string(name))
+	}
+
+	return names, nil
+}
+
+// attrDep is the cache dependency key of an attribute. The NUL byte keeps
+// it apart from tag names.
+func attrDep(attr string) string {
+	return "\x00" + attr
+}
+
+// SetAttr sets a numeric attribute of an object, such as its age.
+func (ts *TagSystem) SetAttr(objectID uint32, attr string, value uint64) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if index, exists := ts.attrs[attr]; exists {
+		if old, ok := index.get(objectID); ok && old == value {
+			return nil // Unchanged
+		}
+	}
+
+	if err := ts.logLocked(walRecord{op: walSetAttr, tags: []string{attr}, ids: []uint32{objectID}, value: value}); err != nil {
+		return err
+	}
+
+	ts.setAttrLocked(objectID, attr, value)
+
+	return nil
+}
+
+// setAttrLocked sets a numeric attribute of an object.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) setAttrLocked(objectID uint32, attr string, value uint64) {
+	index, exists := ts.attrs[attr]
+	if !exists {
+		index = newBSI()
+		ts.attrs[attr] = index
+	}
+
+	if index.set(objectID, value) {
+		ts.invalidateLocked(ts.allObjects.CheckedAdd(objectID))
+		ts.attrChangedLocked(attr)
+	}
+}
+
+// DeleteAttr removes a numeric attribute from an object.
+func (ts *TagSystem) DeleteAttr(objectID uint32, attr string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	index, exists := ts.attrs[attr]
+	if !exists || !index.exists.Contains(objectID) {
+		return nil // Nothing to remove
+	}
+
+	if err := ts.logLocked(walRecord{op: walDeleteAttr, tags: []string{attr}, ids: []uint32{objectID}}); err != nil {
+		return err
+	}
+
+	ts.deleteAttrLocked(objectID, attr)
+
+	return nil
+}
+
+// deleteAttrLocked removes a numeric attribute from an object, and the
+// attribute itself with its last value.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) deleteAttrLocked(objectID uint32, attr string) {
+	index, exists := ts.attrs[attr]
+	if !exists || !index.remove(objectID) {
+		return
+	}
+
+	if index.exists.IsEmpty() {
+		delete(ts.attrs, attr)
+	}
+	ts.attrChangedLocked(attr)
+}
+
+// attrChangedLocked drops the cached results that read the attribute,
+// marks it dirty for the next flush and triggers the save worker.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) attrChangedLocked(attr string) {
+	if ts.cache != nil {
+		ts.cache.invalidateTags(attrDep(attr))
+	}
+	ts.attrsDirty[attr] = struct{}{}
+	ts.triggerSaveLocked()
+}
+
+// GetAttr returns the value of a numeric attribute of an object.
+func (ts *TagSystem) GetAttr(objectID uint32, attr string) (uint64, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	index, exists := ts.attrs[attr]
+	if !exists {
+		return 0, false
+	}
+
+	return index.get(objectID)
+}
+
+// GetAllAttrs returns the names of all numeric attributes in sorted order.
+func (ts *TagSystem) GetAllAttrs() []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.attrNamesLocked()
+}
+
+// attrNamesLocked returns the names of all attributes in sorted order.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) attrNamesLocked() []string {
+	names := make([]string, 0, len(ts.attrs))
+	for attr := range ts.attrs {
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// QueryAttr returns the objects whose attribute value compares to value
+// as op requests. Objects without the attribute never match.
+func (ts *TagSystem) QueryAttr(attr string, op CompareOp, value uint64) (*roaring.Bitmap, error) {
+	return ts.Eval(Compare(attr, op, value))
+}
+
+// QueryAttrRange returns the objects whose attribute value is between low
+// and high, inclusive.
+func (ts *TagSystem) QueryAttrRange(attr string, low, high uint64) (*roaring.Bitmap, error) {
+	return ts.Eval(Between(attr, low, high))
+}
+
+// AttrTopK returns the k objects with the largest attribute values among
+// filter, typically the result of a query. A nil filter considers every
+// object with the attribute.
+func (ts *TagSystem) AttrTopK(attr string, k int, filter *roaring.Bitmap) (*roaring.Bitmap, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	index, exists := ts.attrs[attr]
+	if !exists {
+		return roaring.NewBitmap(), nil
+	}
+
+	return index.topK(k, filter), nil
+}
+
+// AttrSum returns the sum of the attribute values of the objects in
+// filter and how many of them have the attribute. A nil filter sums over
+// every object with the attribute. It fails with ErrAttrOverflow if the
+// sum does not fit in a uint64.
+func (ts *TagSystem) AttrSum(attr string, filter *roaring.Bitmap) (sum, count uint64, err error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	index, exists := ts.attrs[attr]
+	if !exists {
+		return 0, 0, nil
+	}
+
+	sum, count, ok := index.sum(filter)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %s", ErrAttrOverflow, attr)
+	}
+
+	return sum, count, nil
+}
+
+// AttrAvg returns the average attribute value of the objects in filter
+// that have the attribute, or 0 when none has it. It is computed in
+// floating point, so it works even when AttrSum overflows.
+func (ts *TagSystem) AttrAvg(attr string, filter *roaring.Bitmap) (float64, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	index, exists := ts.attrs[attr]
+	if !exists {
+		return 0, nil
+	}
+
+	return index.mean(filter), nil
+}
+
+// execAttrLocked evaluates a comparison of an attribute.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) execAttrLocked(n *attrNode) (*roaring.Bitmap, error) {
+	index, exists := ts.attrs[n.name]
+	if !exists {
+		return roaring.NewBitmap(), nil
+	}
+
+	if n.op == opBetween {
+		return index.between(n.low, n.high, nil), nil
+	}
+	return index.query(n.op, n.low, nil)
+}
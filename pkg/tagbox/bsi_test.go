@@ -0,0 +1,357 @@
+package tagbox
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// TestBSI_Compare tests the bit-sliced index against a plain map
+func TestBSI_Compare(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	index := newBSI()
+	values := make(map[uint32]uint64)
+	for i := 0; i < 2000; i++ {
+		id := uint32(rng.Intn(1000))
+		value := uint64(rng.Intn(200))
+		index.set(id, value)
+		values[id] = value
+	}
+	for id := uint32(0); id < 1000; id += 7 {
+		index.remove(id)
+		delete(values, id)
+	}
+
+	match := func(pred func(uint64) bool) []uint32 {
+		ids := []uint32{}
+		for id, value := range values {
+			if pred(value) {
+				ids = append(ids, id)
+			}
+		}
+		return roaring.BitmapOf(ids...).ToArray()
+	}
+
+	for _, v := range []uint64{0, 1, 63, 100, 199, 200, 1 << 20} {
+		tests := []struct {
+			op   CompareOp
+			pred func(uint64) bool
+		}{
+			{CmpEQ, func(x uint64) bool { return x == v }},
+			{CmpNE, func(x uint64) bool { return x != v }},
+			{CmpLT, func(x uint64) bool { return x < v }},
+			{CmpLE, func(x uint64) bool { return x <= v }},
+			{CmpGT, func(x uint64) bool { return x > v }},
+			{CmpGE, func(x uint64) bool { return x >= v }},
+		}
+		for _, tt := range tests {
+			result, err := index.query(tt.op, v, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := result.ToArray(), match(tt.pred); !reflect.DeepEqual(got, want) {
+				t.Errorf("value %s %d: got %d objects, want %d", tt.op, v, len(got), len(want))
+			}
+		}
+	}
+
+	got := index.between(50, 120, nil).ToArray()
+	if want := match(func(x uint64) bool { return x >= 50 && x <= 120 }); !reflect.DeepEqual(got, want) {
+		t.Errorf("BETWEEN 50 AND 120: got %d objects, want %d", len(got), len(want))
+	}
+
+	var wantSum uint64
+	for _, value := range values {
+		wantSum += value
+	}
+	if sum, count, ok := index.sum(nil); !ok || sum != wantSum || count != uint64(len(values)) {
+		t.Errorf("sum = %d over %d (ok %v), want %d over %d", sum, count, ok, wantSum, len(values))
+	}
+}
+
+// TestBSI_TopK tests selecting the largest values
+func TestBSI_TopK(t *testing.T) {
+	index := newBSI()
+	for id, value := range []uint64{5, 9, 1, 9, 7, 3, 9} {
+		index.set(uint32(id), value)
+	}
+
+	tests := []struct {
+		k      int
+		filter *roaring.Bitmap
+		want   []uint32
+	}{
+		{1, nil, []uint32{1}}, // Ties go to the lowest ID
+		{3, nil, []uint32{1, 3, 6}},
+		{4, nil, []uint32{1, 3, 4, 6}},
+		{2, roaring.BitmapOf(0, 2, 5), []uint32{0, 5}},
+		{10, roaring.BitmapOf(2, 99), []uint32{2}},
+		{0, nil, []uint32{}},
+	}
+	for _, tt := range tests {
+		if got := index.topK(tt.k, tt.filter).ToArray(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("topK(%d, %v) = %v, want %v", tt.k, tt.filter, got, tt.want)
+		}
+	}
+}
+
+// TestTagSystem_Attrs tests attributes through the public API and queries
+func TestTagSystem_Attrs(t *testing.T) {
+	ts := newMemoryTagSystem(t)
+
+	for id, age := range []uint64{15, 18, 25, 30, 31, 45} {
+		ts.SetAttr(uint32(id), "age", age)
+		ts.SetAttr(uint32(id), "spend", uint64(id)*100)
+	}
+	ts.AddTag(2, "vip")
+	ts.AddTag(5, "vip")
+	ts.DeleteAttr(0, "spend")
+
+	if age, ok := ts.GetAttr(3, "age"); !ok || age != 30 {
+		t.Errorf("GetAttr = %d, %v, want 30", age, ok)
+	}
+	if _, ok := ts.GetAttr(0, "spend"); ok {
+		t.Error("spend of object 0 should be deleted")
+	}
+	if attrs := ts.GetAllAttrs(); !reflect.DeepEqual(attrs, []string{"age", "spend"}) {
+		t.Errorf("GetAllAttrs = %v", attrs)
+	}
+
+	tests := []struct {
+		expr string
+		want []uint32
+	}{
+		{"age BETWEEN 18 AND 30", []uint32{1, 2, 3}},
+		{"age BETWEEN 18 AND 30 AND vip", []uint32{2}},
+		{"vip AND spend >= 300", []uint32{5}},
+		{"age < 18 OR age > 40", []uint32{0, 5}},
+		{"height = 180", []uint32{}},
+	}
+	for _, tt := range tests {
+		result, err := ts.QueryExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := result.ToArray(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	adults, _ := ts.QueryAttr("age", CmpGE, 18)
+	if avg, _ := ts.AttrAvg("age", adults); avg != 29.8 {
+		t.Errorf("average adult age = %v, want 29.8", avg)
+	}
+	if sum, count, _ := ts.AttrSum("spend", nil); sum != 1500 || count != 5 {
+		t.Errorf("AttrSum = %d over %d, want 1500 over 5", sum, count)
+	}
+	if top, _ := ts.AttrTopK("spend", 2, adults); !reflect.DeepEqual(top.ToArray(), []uint32{4, 5}) {
+		t.Errorf("AttrTopK = %v, want [4 5]", top.ToArray())
+	}
+}
+
+// TestTagSystem_AttrSumOverflow tests that a sum beyond uint64 is an error
+// while the average stays exact
+func TestTagSystem_AttrSumOverflow(t *testing.T) {
+	ts := newMemoryTagSystem(t)
+
+	ts.SetAttr(1, "bytes", 1<<63)
+	if sum, _, err := ts.AttrSum("bytes", nil); err != nil || sum != 1<<63 {
+		t.Errorf("AttrSum = %d, %v, want 2^63", sum, err)
+	}
+
+	ts.SetAttr(2, "bytes", 1<<63)
+	if _, _, err := ts.AttrSum("bytes", nil); !errors.Is(err, ErrAttrOverflow) {
+		t.Errorf("AttrSum error = %v, want ErrAttrOverflow", err)
+	}
+	if avg, _ := ts.AttrAvg("bytes", nil); avg != math.Ldexp(1, 63) {
+		t.Errorf("AttrAvg = %v, want 2^63", avg)
+	}
+
+	ts.SetAttr(3, "n", math.MaxUint64)
+	ts.SetAttr(4, "n", 1)
+	if _, _, err := ts.AttrSum("n", nil); !errors.Is(err, ErrAttrOverflow) {
+		t.Errorf("AttrSum error = %v, want ErrAttrOverflow", err)
+	}
+	if sum, count, err := ts.AttrSum("n", roaring.BitmapOf(4)); err != nil || sum != 1 || count != 1 {
+		t.Errorf("filtered AttrSum = %d over %d, %v, want 1 over 1", sum, count, err)
+	}
+}
+
+// TestTagSystem_AttrDropped tests that removing the last value of an
+// attribute drops it, also from the store
+func TestTagSystem_AttrDropped(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.SetAttr(1, "age", 20)
+	ts.SetAttr(1, "spend", 300)
+	if err := ts.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	ts.DeleteAttr(1, "spend")
+	if attrs := ts.GetAllAttrs(); !reflect.DeepEqual(attrs, []string{"age"}) {
+		t.Errorf("GetAllAttrs = %v, want [age]", attrs)
+	}
+	if stats := ts.GetStats(); stats.Attrs != 1 {
+		t.Errorf("Stats.Attrs = %d, want 1", stats.Attrs)
+	}
+	if _, err := ts.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts2.Close()
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	if attrs := ts2.GetAllAttrs(); !reflect.DeepEqual(attrs, []string{"age"}) {
+		t.Errorf("GetAllAttrs after reload = %v, want [age]", attrs)
+	}
+}
+
+// TestTagSystem_AttrUniverse tests that objects with attributes but no
+// tags are known to NOT and ALL
+func TestTagSystem_AttrUniverse(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.CacheResults = true
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.AddTag(1, "vip")
+	ts.AddTag(2, "male")
+	if result, _ := ts.QueryExpr("NOT vip"); !reflect.DeepEqual(result.ToArray(), []uint32{2}) {
+		t.Fatalf("NOT vip = %v, want [2]", result.ToArray())
+	}
+
+	ts.SetAttr(3, "age", 40)
+	for _, expr := range []string{"NOT vip", "ALL AND NOT male AND NOT vip"} {
+		result, _ := ts.QueryExpr(expr)
+		if !result.Contains(3) {
+			t.Errorf("%s = %v, want it to include object 3", expr, result.ToArray())
+		}
+	}
+	if stats := ts.GetStats(); stats.UniqueObjects != 3 {
+		t.Errorf("UniqueObjects = %d, want 3", stats.UniqueObjects)
+	}
+
+	if err := ts.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	config.CacheResults = false
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts2.Close()
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	if result, _ := ts2.QueryExpr("NOT vip"); !reflect.DeepEqual(result.ToArray(), []uint32{2, 3}) {
+		t.Errorf("NOT vip after reload = %v, want [2 3]", result.ToArray())
+	}
+}
+
+// TestTagSystem_AttrsCache tests that attribute changes invalidate cached queries
+func TestTagSystem_AttrsCache(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.CacheResults = true
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.SetAttr(1, "age", 20)
+	if result, _ := ts.QueryExpr("age > 18"); result.GetCardinality() != 1 {
+		t.Fatalf("expected 1 object, got %d", result.GetCardinality())
+	}
+
+	ts.SetAttr(1, "age", 10)
+	if result, _ := ts.QueryExpr("age > 18"); !result.IsEmpty() {
+		t.Errorf("expected the change to invalidate the cached result, got %v", result.ToArray())
+	}
+}
+
+// TestTagSystem_AttrsPersistence tests attributes in the store, snapshots and the log
+func TestTagSystem_AttrsPersistence(t *testing.T) {
+	_, client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	config := DefaultConfig()
+	config.RedisAddr = client.Options().Addr
+	config.AutoSave = false
+
+	ts1, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	ts1.SetAttr(1, "age", 42)
+	ts1.SetAttr(1<<20, "age", 7)
+	ts1.AddTag(1, "vip")
+	ts1.Close()
+
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create second TagSystem: %v", err)
+	}
+	defer ts2.Close()
+
+	if err := ts2.RecoverFromRedis(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	if tags := ts2.GetAllTags(); !reflect.DeepEqual(tags, []string{"vip"}) {
+		t.Errorf("attributes must not be loaded as tags, got %v", tags)
+	}
+	if age, ok := ts2.GetAttr(1<<20, "age"); !ok || age != 7 {
+		t.Errorf("age after recovery = %d, %v, want 7", age, ok)
+	}
+
+	path := filepath.Join(t.TempDir(), "tags.snap")
+	if err := ts2.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	walDir := filepath.Join(t.TempDir(), "wal")
+	ts3 := newWALTagSystem(t, walDir, NewMemoryStore())
+	if err := ts3.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	ts3.SetAttr(2, "age", 19)
+	ts3.DeleteAttr(1, "age")
+	crash(t, ts3)
+
+	ts4 := newWALTagSystem(t, walDir, NewMemoryStore())
+	defer ts4.Close()
+	if err := ts4.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	result, _ := ts4.QueryAttr("age", CmpGE, 0)
+	if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{2, 1 << 20}) {
+		t.Errorf("objects with an age after replay = %v, want [2 %d]", got, 1<<20)
+	}
+}
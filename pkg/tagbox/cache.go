@@ -0,0 +1,304 @@
+package tagbox
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// CacheStats represents statistics about the query result cache.
+type CacheStats struct {
+	Hits          uint64 // Lookups answered from the cache
+	Misses        uint64 // Lookups that had to evaluate the query
+	Evictions     uint64 // Entries dropped to stay within the budget
+	Invalidations uint64 // Entries dropped because a tag they depend on changed
+	Entries       int    // Number of cached results
+	MemoryUsage   uint64 // Total size of the cached bitmaps in bytes
+}
+
+// queryCache is a bounded LRU cache of query results keyed by the
+// normalized query. Every entry records the tags it was computed from,
+// so a mutation of a tag drops exactly the entries that read it.
+type queryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   uint64
+
+	lru     *list.List               // Front is the most recently used entry
+	entries map[string]*list.Element // Normalized query -> element of lru
+
+	// Reverse dependency index
+	byTag    map[string]map[*cacheEntry]struct{} // Tag -> entries reading it
+	universe map[*cacheEntry]struct{}            // Entries reading allObjects
+
+	stats CacheStats
+}
+
+// cacheEntry is a cached query result.
+type cacheEntry struct {
+	key      string
+	result   *roaring.Bitmap
+	size     uint64
+	tags     []string
+	universe bool
+}
+
+// newQueryCache creates a cache holding at most maxEntries results and
+// maxBytes bytes of bitmaps. A zero limit means unlimited.
+func newQueryCache(maxEntries int, maxBytes uint64) *queryCache {
+	return &queryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		byTag:      make(map[string]map[*cacheEntry]struct{}),
+		universe:   make(map[*cacheEntry]struct{}),
+	}
+}
+
+// get returns a copy of the cached result for key.
+func (c *queryCache) get(key string) (*roaring.Bitmap, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+
+	return elem.Value.(*cacheEntry).result.Clone(), true
+}
+
+// put stores a copy of result for key, recording which tags it was
+// computed from and whether it depends on the set of all objects.
+func (c *queryCache) put(key string, result *roaring.Bitmap, tags []string, universe bool) {
+	entry := &cacheEntry{
+		key:      key,
+		result:   result.Clone(),
+		size:     result.GetSizeInBytes(),
+		tags:     tags,
+		universe: universe,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxBytes > 0 && entry.size > c.maxBytes {
+		return // Would evict everything else and still not fit
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	c.stats.MemoryUsage += entry.size
+	for _, tag := range tags {
+		deps, ok := c.byTag[tag]
+		if !ok {
+			deps = make(map[*cacheEntry]struct{})
+			c.byTag[tag] = deps
+		}
+		deps[entry] = struct{}{}
+	}
+	if universe {
+		c.universe[entry] = struct{}{}
+	}
+
+	for c.lru.Len() > 1 && c.overBudgetLocked() {
+		c.removeLocked(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// overBudgetLocked reports whether the cache exceeds any of its limits.
+// Caller must hold c.mu.
+func (c *queryCache) overBudgetLocked() bool {
+	return (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) ||
+		(c.maxBytes > 0 && c.stats.MemoryUsage > c.maxBytes)
+}
+
+// invalidateTags drops every entry computed from any of the tags.
+func (c *queryCache) invalidateTags(tags ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tag := range tags {
+		for entry := range c.byTag[tag] {
+			c.removeLocked(c.entries[entry.key])
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// invalidateUniverse drops every entry that depends on the set of all
+// objects, i.e. queries using NOT or ALL.
+func (c *queryCache) invalidateUniverse() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for entry := range c.universe {
+		c.removeLocked(c.entries[entry.key])
+		c.stats.Invalidations++
+	}
+}
+
+// purge drops every entry.
+func (c *queryCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Invalidations += uint64(c.lru.Len())
+	c.stats.MemoryUsage = 0
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.byTag = make(map[string]map[*cacheEntry]struct{})
+	c.universe = make(map[*cacheEntry]struct{})
+}
+
+// removeLocked unlinks an entry from the LRU list and all indexes.
+// Caller must hold c.mu.
+func (c *queryCache) removeLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.MemoryUsage -= entry.size
+
+	for _, tag := range entry.tags {
+		deps := c.byTag[tag]
+		delete(deps, entry)
+		if len(deps) == 0 {
+			delete(c.byTag, tag)
+		}
+	}
+	delete(c.universe, entry)
+}
+
+// getStats returns a copy of the cache statistics.
+func (c *queryCache) getStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// cacheKey returns the normalized form of a planned query tree. Operands
+// of the commutative operators are sorted, so `a AND b` and `b AND a`
+// share a cache entry.
+func cacheKey(node Node) string {
+	switch n := node.(type) {
+	case *andNode:
+		return sortedJoin(n.children, "AND")
+	case *orNode:
+		return sortedJoin(n.children, "OR")
+	case *xorNode:
+		return sortedJoin(n.children, "XOR")
+	case *notNode:
+		return "NOT (" + cacheKey(n.child) + ")"
+	default:
+		return node.String()
+	}
+}
+
+// sortedJoin renders the normalized children of an operator in sorted order.
+func sortedJoin(children []Node, op string) string {
+	keys := make([]string, len(children))
+	for i, child := range children {
+		keys[i] = "(" + cacheKey(child) + ")"
+	}
+	sort.Strings(keys)
+
+	key := keys[0]
+	for _, k := range keys[1:] {
+		key += " " + op + " " + k
+	}
+	return key
+}
+
+// queryDeps returns the tags a query tree reads and whether it reads the
+// set of all objects. Dimensions and attributes are recorded by their
+// dimensionDep and attrDep keys.
+func queryDeps(node Node) (tags []string, universe bool) {
+	seen := make(map[string]struct{})
+
+	var walk func(Node)
+	walk = func(node Node) {
+		switch n := node.(type) {
+		case *tagNode:
+			if _, ok := seen[n.name]; !ok {
+				seen[n.name] = struct{}{}
+				tags = append(tags, n.name)
+			}
+		case *dimensionNode:
+			dep := dimensionDep(n.name)
+			if _, ok := seen[dep]; !ok {
+				seen[dep] = struct{}{}
+				tags = append(tags, dep)
+			}
+		case *attrNode:
+			dep := attrDep(n.name)
+			if _, ok := seen[dep]; !ok {
+				seen[dep] = struct{}{}
+				tags = append(tags, dep)
+			}
+		case *andNode:
+			for _, child := range n.children {
+				walk(child)
+			}
+		case *orNode:
+			for _, child := range n.children {
+				walk(child)
+			}
+		case *xorNode:
+			for _, child := range n.children {
+				walk(child)
+			}
+		case *notNode:
+			universe = true
+			walk(n.child)
+		case *allNode:
+			universe = true
+		}
+	}
+	walk(node)
+
+	return tags, universe
+}
+
+// CacheStats returns statistics about the query result cache.
+// All counters are zero when Config.CacheResults is disabled.
+func (ts *TagSystem) CacheStats() CacheStats {
+	if ts.cache == nil {
+		return CacheStats{}
+	}
+	return ts.cache.getStats()
+}
+
+// invalidateLocked drops the cached results that depend on the tags, and
+// on the set of all objects when universeChanged is set.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) invalidateLocked(universeChanged bool, tags ...string) {
+	if ts.cache == nil {
+		return
+	}
+
+	ts.cache.invalidateTags(tags...)
+	for _, tag := range tags {
+		if dimension, _, ok := SplitTag(tag); ok {
+			ts.cache.invalidateTags(dimensionDep(dimension))
+		}
+		if ts.hier != nil {
+			ts.cache.invalidateTags(TagAncestors(tag)...)
+		}
+	}
+	if universeChanged {
+		ts.cache.invalidateUniverse()
+	}
+}
@@ -0,0 +1,140 @@
+package tagbox
+
+import (
+	"testing"
+)
+
+// newCachedTagSystem creates a TagSystem with the query result cache enabled
+func newCachedTagSystem(t testing.TB, maxEntries int, maxBytes uint64) *TagSystem {
+	t.Helper()
+
+	_, client, cleanup := setupTestRedis(t)
+
+	config := DefaultConfig()
+	config.RedisAddr = client.Options().Addr
+	config.AutoSave = false
+	config.CacheResults = true
+	config.CacheMaxEntries = maxEntries
+	config.CacheMaxBytes = maxBytes
+
+	ts, err := New(config)
+	if err != nil {
+		cleanup()
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+
+	t.Cleanup(func() {
+		ts.Close()
+		cleanup()
+	})
+
+	return ts
+}
+
+// TestTagSystem_CacheHitsAndMisses tests that repeated queries are served from the cache
+func TestTagSystem_CacheHitsAndMisses(t *testing.T) {
+	ts := newCachedTagSystem(t, 100, 0)
+
+	ts.BatchAddTags(1, []string{"vip", "male"})
+	ts.BatchAddTags(2, []string{"vip", "female"})
+
+	for i := 0; i < 3; i++ {
+		result, err := ts.QueryExpr("vip AND male")
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		if result.GetCardinality() != 1 {
+			t.Fatalf("expected 1 object, got %d", result.GetCardinality())
+		}
+		// Callers own their copy
+		result.Add(99)
+	}
+
+	// Operand order does not matter for the cache key
+	ts.QueryExpr("male AND vip")
+
+	stats := ts.CacheStats()
+	if stats.Misses != 1 || stats.Hits != 3 {
+		t.Errorf("expected 1 miss and 3 hits, got %+v", stats)
+	}
+	if stats.Entries != 1 || stats.MemoryUsage == 0 {
+		t.Errorf("expected 1 entry with non-zero memory, got %+v", stats)
+	}
+}
+
+// TestTagSystem_CacheInvalidation tests that mutations drop exactly the dependent entries
+func TestTagSystem_CacheInvalidation(t *testing.T) {
+	ts := newCachedTagSystem(t, 100, 0)
+
+	ts.BatchAddTags(1, []string{"vip", "male"})
+	ts.BatchAddTags(2, []string{"new_user"})
+	ts.BatchAddTags(3, []string{"churned", "female"})
+
+	ts.QueryExpr("vip AND male")
+	ts.QueryExpr("new_user OR churned")
+	ts.QueryExpr("NOT churned AND female")
+
+	// Touches vip only
+	ts.AddTag(2, "vip")
+	if stats := ts.CacheStats(); stats.Entries != 2 || stats.Invalidations != 1 {
+		t.Errorf("expected 2 entries after changing vip, got %+v", stats)
+	}
+
+	// Re-adding an existing assignment changes nothing
+	ts.AddTag(2, "vip")
+	if stats := ts.CacheStats(); stats.Invalidations != 1 {
+		t.Errorf("no-op add should not invalidate, got %+v", stats)
+	}
+
+	// A new object changes the universe used by NOT
+	ts.AddTag(4, "male")
+	if stats := ts.CacheStats(); stats.Entries != 1 {
+		t.Errorf("expected only the OR query to remain cached, got %+v", stats)
+	}
+
+	result, _ := ts.QueryExpr("new_user OR churned")
+	if result.GetCardinality() != 2 {
+		t.Errorf("expected 2 objects, got %d", result.GetCardinality())
+	}
+
+	ts.RemoveTag(2, "new_user")
+	result, _ = ts.QueryExpr("new_user OR churned")
+	if result.GetCardinality() != 1 {
+		t.Errorf("expected 1 object after removal, got %d", result.GetCardinality())
+	}
+
+	ts.BatchAddObjectsToTag([]uint32{5, 6}, "churned")
+	result, _ = ts.QueryExpr("new_user OR churned")
+	if result.GetCardinality() != 3 {
+		t.Errorf("expected 3 objects after batch add, got %d", result.GetCardinality())
+	}
+}
+
+// TestTagSystem_CacheEviction tests the entry and memory budgets
+func TestTagSystem_CacheEviction(t *testing.T) {
+	ts := newCachedTagSystem(t, 2, 0)
+
+	ts.BatchAddTags(1, []string{"a", "b", "c"})
+
+	ts.QueryExpr("a AND b")
+	ts.QueryExpr("a AND c")
+	ts.QueryExpr("a AND b") // Refresh a AND b
+	ts.QueryExpr("b AND c") // Evicts a AND c
+
+	stats := ts.CacheStats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("expected 2 entries and 1 eviction, got %+v", stats)
+	}
+
+	ts.QueryExpr("a AND b")
+	if got := ts.CacheStats().Hits; got != 2 {
+		t.Errorf("expected a AND b to stay cached, got %d hits", got)
+	}
+
+	small := newCachedTagSystem(t, 0, 1)
+	small.BatchAddTags(1, []string{"a", "b"})
+	small.QueryExpr("a AND b")
+	if stats := small.CacheStats(); stats.Entries != 0 {
+		t.Errorf("results over the memory budget should not be cached, got %+v", stats)
+	}
+}
@@ -11,18 +11,36 @@ type Config struct {
 
 	// Tag storage
 	KeyPrefix string // Redis key prefix for tags, e.g., "tags:"
+	Store     Store  // Store overrides Redis, e.g., NewMemoryStore() or NewFileStore(dir)
 
 	// Persistence
-	AutoSave bool          // AutoSave automatically saves tags to Redis after modifications
+	AutoSave bool          // AutoSave automatically saves tags to the store after modifications
 	SaveChan chan struct{} // Internal channel for triggering saves
+	ReadOnly bool          // ReadOnly never writes to the store, not even on Close
+
+	// Write-ahead log
+	WALDir          string        // WALDir enables the write-ahead log in this directory
+	WALSync         SyncPolicy    // WALSync controls when the log is fsynced
+	WALSyncInterval time.Duration // WALSyncInterval is the fsync interval for SyncInterval
 
 	// Performance tuning
 	EnableSnapshot    bool          // EnableSnapshot enables periodic snapshot to disk
 	SnapshotPath      string        // SnapshotPath is the file path for snapshots
 	SnapshotInterval  time.Duration // SnapshotInterval is the interval between snapshots
+	MmapSnapshot      bool          // MmapSnapshot makes LoadSnapshot map the file instead of copying it
+
+	// Namespaces
+	ExclusiveDimensions []string // ExclusiveDimensions lists the dimensions an object may carry only one value of
+	TagHierarchy        bool     // TagHierarchy makes a query for a tag also match its "/"-separated descendants
+
+	// Expiration
+	ExpiryResolution time.Duration // ExpiryResolution is the TTL bucket width and the reaper interval
 
 	// Query optimization
-	CacheResults bool // CacheResults enables query result caching
+	ReverseIndex    bool   // ReverseIndex keeps an object-to-tags index for GetObjectTags
+	CacheResults    bool   // CacheResults enables query result caching
+	CacheMaxEntries int    // CacheMaxEntries limits the number of cached results (0 = unlimited)
+	CacheMaxBytes   uint64 // CacheMaxBytes limits the memory used by cached results (0 = unlimited)
 }
 
 // DefaultConfig returns a default configuration.
@@ -34,10 +52,15 @@ func DefaultConfig() Config {
 		KeyPrefix:        "tags:",
 		AutoSave:         true,
 		SaveChan:         make(chan struct{}, 100),
+		WALSync:          SyncInterval,
+		WALSyncInterval:  time.Second,
 		EnableSnapshot:   false,
 		SnapshotPath:     "",
 		SnapshotInterval: 5 * time.Minute,
+		ExpiryResolution: time.Second,
 		CacheResults:     false,
+		CacheMaxEntries:  1000,
+		CacheMaxBytes:    64 << 20,
 	}
 }
 
@@ -45,8 +68,13 @@ func DefaultConfig() Config {
 type Stats struct {
 	TotalTags      int     // Total number of tags
 	TotalObjects   uint64  // Total number of tagged objects (with duplicates)
-	UniqueObjects  uint64  // Total number of unique objects across all tags
+	UniqueObjects  uint64  // Total number of unique objects across all tags and attributes
 	MemoryUsage    uint64  // Total memory usage in bytes
 	LargestTag     string  // The tag with the most objects
 	LargestTagSize uint64  // Number of objects in the largest tag
+	DirtyTags      int     // Number of tags modified since the last flush
+	ObjectKeys     int     // Number of external object keys in the dictionary
+	ReverseMemory  uint64  // Estimated memory used by the reverse index (0 when disabled)
+	Expiring       uint64  // Number of object-tag assignments with a TTL
+	Attrs          int     // Number of numeric attributes
 }
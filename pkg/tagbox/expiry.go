@@ -0,0 +1,486 @@
+package tagbox
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// expiryMetaName is the metadata entry that holds the assignment deadlines.
+const expiryMetaName = "expiry"
+
+// expiry indexes the object-tag assignments that have a TTL by deadline.
+// Deadlines are rounded up to the end of a bucket of the configured
+// resolution, so assignments expiring close together share one bitmap and
+// expire at most one resolution late, never early. The bucket of every
+// assignment is also recorded by object, so looking up or clearing a
+// deadline, as every RemoveTag does, never scans the buckets. That map
+// costs a few tens of bytes per assignment with a TTL, much more than the
+// bitmaps, so TTLs suit up to some millions of assignments. The bucket
+// ends are queued earliest first, so the reaper finds the due buckets
+// without scanning the others.
+// Callers must hold the TagSystem lock.
+type expiry struct {
+	resolution int64                                // Bucket width in nanoseconds
+	tags       map[string]map[int64]*roaring.Bitmap // Tag -> bucket end (Unix ns) -> objects
+	deadlines  map[string]map[uint32]int64          // Tag -> object -> bucket end
+	queue      expiryQueue                          // Buckets by end; may hold buckets since emptied
+}
+
+// expiryEntry is a bucket of a tag waiting in the queue.
+type expiryEntry struct {
+	end int64
+	tag string
+}
+
+// expiryQueue is a min-heap of bucket ends.
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].end < q[j].end }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiryEntry)) }
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// newExpiry creates an empty expiry index.
+func newExpiry(resolution time.Duration) *expiry {
+	return &expiry{
+		resolution: int64(resolution),
+		tags:       make(map[string]map[int64]*roaring.Bitmap),
+		deadlines:  make(map[string]map[uint32]int64),
+	}
+}
+
+// bucket returns the end of the bucket a deadline falls into.
+func (e *expiry) bucket(deadline int64) int64 {
+	if rem := deadline % e.resolution; rem != 0 {
+		deadline += e.resolution - rem
+	}
+	return deadline
+}
+
+// set records that the assignment of tag to objectID expires at deadline,
+// replacing any earlier deadline.
+func (e *expiry) set(objectID uint32, tag string, deadline int64) {
+	e.clear(objectID, tag)
+
+	buckets, exists := e.tags[tag]
+	if !exists {
+		buckets = make(map[int64]*roaring.Bitmap)
+		e.tags[tag] = buckets
+	}
+
+	bucket := e.bucket(deadline)
+	bitmap, exists := buckets[bucket]
+	if !exists {
+		bitmap = roaring.NewBitmap()
+		buckets[bucket] = bitmap
+		heap.Push(&e.queue, expiryEntry{end: bucket, tag: tag})
+	}
+	bitmap.Add(objectID)
+
+	deadlines, exists := e.deadlines[tag]
+	if !exists {
+		deadlines = make(map[uint32]int64)
+		e.deadlines[tag] = deadlines
+	}
+	deadlines[objectID] = bucket
+}
+
+// clear forgets the deadline of an assignment and reports whether it had
+// one.
+func (e *expiry) clear(objectID uint32, tag string) bool {
+	deadlines := e.deadlines[tag]
+	bucket, exists := deadlines[objectID]
+	if !exists {
+		return false
+	}
+	delete(deadlines, objectID)
+	if len(deadlines) == 0 {
+		delete(e.deadlines, tag)
+	}
+
+	buckets := e.tags[tag]
+	bitmap := buckets[bucket]
+	bitmap.Remove(objectID)
+	if bitmap.IsEmpty() {
+		delete(buckets, bucket)
+		if len(buckets) == 0 {
+			delete(e.tags, tag)
+		}
+	}
+
+	return true
+}
+
+// copy gives the assignments of to the deadlines the objects have under
+// from, and reports whether any object had one.
+func (e *expiry) copy(objects *roaring.Bitmap, from, to string) bool {
+	copied := false
+	for bucket, bitmap := range e.tags[from] {
+		it := roaring.And(bitmap, objects).Iterator()
+		for it.HasNext() {
+			e.set(it.Next(), to, bucket)
+			copied = true
+		}
+	}
+
+	return copied
+}
+
+// rename moves every deadline of from to to, which must have none.
+func (e *expiry) rename(from, to string) bool {
+	buckets, exists := e.tags[from]
+	if !exists {
+		return false
+	}
+
+	delete(e.tags, from)
+	e.tags[to] = buckets
+	e.deadlines[to] = e.deadlines[from]
+	delete(e.deadlines, from)
+	for bucket := range buckets {
+		heap.Push(&e.queue, expiryEntry{end: bucket, tag: to})
+	}
+	return true
+}
+
+// drop forgets every deadline of a tag and reports whether it had any.
+func (e *expiry) drop(tag string) bool {
+	_, exists := e.tags[tag]
+	delete(e.tags, tag)
+	delete(e.deadlines, tag)
+	return exists
+}
+
+// deadline returns the end of the bucket the assignment expires in.
+func (e *expiry) deadline(objectID uint32, tag string) (int64, bool) {
+	bucket, exists := e.deadlines[tag][objectID]
+	return bucket, exists
+}
+
+// next returns the end of the earliest queued bucket.
+func (e *expiry) next() (int64, bool) {
+	if len(e.queue) == 0 {
+		return 0, false
+	}
+	return e.queue[0].end, true
+}
+
+// popDue dequeues the buckets that ended at or before now and returns
+// those still holding objects, by tag. The buckets stay in place until
+// take removes them.
+func (e *expiry) popDue(now int64) map[string][]int64 {
+	due := make(map[string][]int64)
+	for len(e.queue) > 0 && e.queue[0].end <= now {
+		entry := heap.Pop(&e.queue).(expiryEntry)
+		if _, exists := e.tags[entry.tag][entry.end]; exists {
+			due[entry.tag] = append(due[entry.tag], entry.end)
+		}
+	}
+
+	return due
+}
+
+// requeue puts back buckets returned by popDue that were not taken.
+func (e *expiry) requeue(tag string, ends []int64) {
+	for _, end := range ends {
+		heap.Push(&e.queue, expiryEntry{end: end, tag: tag})
+	}
+}
+
+// objects returns the objects of the given buckets of tag.
+func (e *expiry) objects(tag string, ends []int64) *roaring.Bitmap {
+	objects := roaring.NewBitmap()
+	for _, end := range ends {
+		if bitmap, exists := e.tags[tag][end]; exists {
+			objects.Or(bitmap)
+		}
+	}
+
+	return objects
+}
+
+// take removes the given buckets of tag and the deadlines in them.
+func (e *expiry) take(tag string, ends []int64) {
+	buckets, deadlines := e.tags[tag], e.deadlines[tag]
+	for _, end := range ends {
+		bitmap, exists := buckets[end]
+		if !exists {
+			continue // Listed twice
+		}
+		it := bitmap.Iterator()
+		for it.HasNext() {
+			delete(deadlines, it.Next())
+		}
+		delete(buckets, end)
+	}
+
+	if len(buckets) == 0 {
+		delete(e.tags, tag)
+		delete(e.deadlines, tag)
+	}
+}
+
+// count returns the number of assignments with a deadline.
+func (e *expiry) count() uint64 {
+	var count uint64
+	for _, deadlines := range e.deadlines {
+		count += uint64(len(deadlines))
+	}
+
+	return count
+}
+
+// encode serializes the index as the tag count followed, for every tag, by
+// the uvarint-prefixed tag name, the bucket count and, for every bucket,
+// its varint end and the uvarint-prefixed portable bitmap.
+func (e *expiry) encode() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(e.tags)))
+	for tag, buckets := range e.tags {
+		buf = binary.AppendUvarint(buf, uint64(len(tag)))
+		buf = append(buf, tag...)
+		buf = binary.AppendUvarint(buf, uint64(len(buckets)))
+		for bucket, bitmap := range buckets {
+			data, err := serializeBitmap(bitmap)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s: %w", tag, err)
+			}
+
+			buf = binary.AppendVarint(buf, bucket)
+			buf = binary.AppendUvarint(buf, uint64(len(data)))
+			buf = append(buf, data...)
+		}
+	}
+
+	return buf, nil
+}
+
+// decodeExpiry parses an index written by encode.
+func decodeExpiry(buf []byte, resolution time.Duration) (*expiry, error) {
+	r := bytes.NewReader(buf)
+	readBytes := func() ([]byte, error) {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(r.Len()) {
+			return nil, fmt.Errorf("expiry index truncated")
+		}
+		data := make([]byte, size)
+		r.Read(data)
+		return data, nil
+	}
+
+	e := newExpiry(resolution)
+	tagCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < tagCount; i++ {
+		tag, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		bucketCount, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+
+		buckets := make(map[int64]*roaring.Bitmap)
+		deadlines := make(map[uint32]int64)
+		for j := uint64(0); j < bucketCount; j++ {
+			bucket, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			data, err := readBytes()
+			if err != nil {
+				return nil, err
+			}
+
+			bitmap := roaring.NewBitmap()
+			if _, err := bitmap.ReadFrom(bytes.NewReader(data)); err != nil {
+				return nil, fmt.Errorf("tag %s: %w", tag, err)
+			}
+			buckets[bucket] = bitmap
+			e.queue = append(e.queue, expiryEntry{end: bucket, tag: string(tag)})
+			it := bitmap.Iterator()
+			for it.HasNext() {
+				deadlines[it.Next()] = bucket
+			}
+		}
+		if len(buckets) > 0 {
+			e.tags[string(tag)] = buckets
+			e.deadlines[string(tag)] = deadlines
+		}
+	}
+
+	heap.Init(&e.queue)
+
+	return e, nil
+}
+
+// AddTagWithTTL adds a tag to an object for the given duration. Adding
+// the tag again with a TTL replaces the deadline; AddTag leaves an
+// existing deadline in place and RemoveTag clears it.
+//
+// A background reaper removes expired assignments at most one
+// Config.ExpiryResolution after their deadline, logging and persisting
+// the removals like any other change.
+func (ts *TagSystem) AddTagWithTTL(objectID uint32, tag string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	deadline := time.Now().Add(ttl).UnixNano()
+	if err := ts.logLocked(walRecord{op: walAddTTL, tags: []string{tag}, ids: []uint32{objectID}, deadline: deadline}); err != nil {
+		return err
+	}
+
+	ts.addWithTTLLocked(objectID, tag, deadline)
+
+	return nil
+}
+
+// addWithTTLLocked adds a tag to an object and records its deadline.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) addWithTTLLocked(objectID uint32, tag string, deadline int64) {
+	ts.addLocked(objectID, tag)
+	ts.expiry.set(objectID, tag, deadline)
+	ts.expiryDirty = true
+	ts.startReaperLocked()
+}
+
+// GetTagExpiry returns when the assignment of tag to objectID expires.
+// ok is false when the assignment does not exist or has no TTL. The time
+// is rounded up to Config.ExpiryResolution.
+func (ts *TagSystem) GetTagExpiry(objectID uint32, tag string) (time.Time, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	deadline, ok := ts.expiry.deadline(objectID, tag)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, deadline), true
+}
+
+// ReapExpired removes the assignments whose deadline has passed and
+// returns how many were removed. The reaper calls it every
+// Config.ExpiryResolution.
+func (ts *TagSystem) ReapExpired() (int, error) {
+	now := time.Now().UnixNano()
+
+	// Most runs find nothing due, which the read lock is enough to see
+	ts.mu.RLock()
+	next, queued := ts.expiry.next()
+	ts.mu.RUnlock()
+	if !queued || next > now {
+		return 0, nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	due := ts.expiry.popDue(now)
+	removed := 0
+	for tag, ends := range due {
+		// Only objects that still have the tag are logged and removed.
+		// The deadlines are dropped once the removal is logged, so a
+		// failed append leaves them for the next run.
+		objects := ts.expiry.objects(tag, ends)
+		if bitmap, exists := ts.tags[tag]; exists {
+			objects.And(bitmap)
+		} else {
+			objects.Clear()
+		}
+
+		ids := objects.ToArray()
+		if len(ids) > 0 {
+			if err := ts.logLocked(walRecord{op: walRemove, tags: []string{tag}, ids: ids}); err != nil {
+				for tag, ends := range due {
+					ts.expiry.requeue(tag, ends)
+				}
+				return removed, err
+			}
+		}
+
+		ts.expiry.take(tag, ends)
+		delete(due, tag)
+		ts.expiryDirty = true
+		for _, objectID := range ids {
+			ts.removeLocked(objectID, tag)
+		}
+		removed += len(ids)
+	}
+
+	return removed, nil
+}
+
+// setExpiryLocked replaces the deadlines with loaded ones.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) setExpiryLocked(deadlines *expiry) {
+	ts.expiry = deadlines
+	if len(deadlines.tags) > 0 {
+		ts.startReaperLocked()
+	}
+}
+
+// startReaperLocked starts the background reaper unless it is running.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) startReaperLocked() {
+	if ts.reaping {
+		return
+	}
+	ts.reaping = true
+
+	go func() {
+		defer close(ts.reaperStopped)
+
+		ticker := time.NewTicker(ts.config.ExpiryResolution)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ts.reaperDone:
+				return
+			case <-ticker.C:
+				if _, err := ts.ReapExpired(); err != nil {
+					ts.mu.Lock()
+					if ts.reapErr == nil {
+						ts.reapErr = err
+					}
+					ts.mu.Unlock()
+				}
+			}
+		}
+	}()
+}
+
+// stopReaper stops the background reaper and waits for it to exit.
+func (ts *TagSystem) stopReaper() {
+	close(ts.reaperDone)
+
+	ts.mu.RLock()
+	reaping := ts.reaping
+	ts.mu.RUnlock()
+
+	if reaping {
+		<-ts.reaperStopped
+	}
+}
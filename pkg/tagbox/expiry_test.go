@@ -0,0 +1,231 @@
+package tagbox
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newExpiryTagSystem creates a TagSystem with a fine expiry resolution on the given store
+func newExpiryTagSystem(t *testing.T, store Store) *TagSystem {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+	config.ExpiryResolution = 10 * time.Millisecond
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	t.Cleanup(func() { ts.Close() })
+
+	return ts
+}
+
+// TestTagSystem_AddTagWithTTL tests that the reaper removes expired assignments
+func TestTagSystem_AddTagWithTTL(t *testing.T) {
+	ts := newExpiryTagSystem(t, NewMemoryStore())
+
+	ts.AddTagWithTTL(1, "viewed_promo", 30*time.Millisecond)
+	ts.AddTagWithTTL(2, "viewed_promo", time.Hour)
+	ts.AddTag(3, "viewed_promo")
+
+	if _, ok := ts.GetTagExpiry(1, "viewed_promo"); !ok {
+		t.Fatal("expected object 1 to have an expiry")
+	}
+	if _, ok := ts.GetTagExpiry(3, "viewed_promo"); ok {
+		t.Error("object 3 was tagged without a TTL")
+	}
+	if stats := ts.GetStats(); stats.Expiring != 2 {
+		t.Errorf("expected 2 expiring assignments, got %d", stats.Expiring)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for ts.HasTag(1, "viewed_promo") {
+		if time.Now().After(deadline) {
+			t.Fatal("object 1 was never reaped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if !ts.HasTag(2, "viewed_promo") || !ts.HasTag(3, "viewed_promo") {
+		t.Error("only the expired assignment should be removed")
+	}
+	if stats := ts.GetStats(); stats.Expiring != 1 {
+		t.Errorf("expected 1 expiring assignment, got %d", stats.Expiring)
+	}
+}
+
+// TestTagSystem_TTLReplaceAndClear tests replacing and clearing deadlines
+func TestTagSystem_TTLReplaceAndClear(t *testing.T) {
+	ts := newExpiryTagSystem(t, NewMemoryStore())
+
+	ts.AddTagWithTTL(1, "trial", time.Minute)
+	ts.AddTagWithTTL(1, "trial", time.Hour)
+	expires, ok := ts.GetTagExpiry(1, "trial")
+	if !ok || time.Until(expires) < 59*time.Minute {
+		t.Errorf("expected the deadline to move an hour out, got %v", expires)
+	}
+
+	// A plain AddTag keeps the deadline
+	ts.AddTag(1, "trial")
+	if _, ok := ts.GetTagExpiry(1, "trial"); !ok {
+		t.Error("AddTag should keep the existing deadline")
+	}
+
+	// Removing the tag clears it, so a later permanent tag is not reaped
+	ts.RemoveTag(1, "trial")
+	if _, ok := ts.GetTagExpiry(1, "trial"); ok {
+		t.Error("RemoveTag should clear the deadline")
+	}
+
+	if err := ts.AddTagWithTTL(1, "trial", 0); err == nil {
+		t.Error("expected an error for a zero TTL")
+	}
+}
+
+// TestTagSystem_TTLPersistence tests that deadlines survive recovery and snapshots
+func TestTagSystem_TTLPersistence(t *testing.T) {
+	store := NewMemoryStore()
+	path := filepath.Join(t.TempDir(), "tags.snap")
+
+	ts1 := newExpiryTagSystem(t, store)
+	ts1.AddTagWithTTL(1, "viewed_promo", time.Hour)
+	want, _ := ts1.GetTagExpiry(1, "viewed_promo")
+	if _, err := ts1.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	ts2 := newExpiryTagSystem(t, store)
+	if err := ts2.RecoverFromRedis(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	if got, ok := ts2.GetTagExpiry(1, "viewed_promo"); !ok || !got.Equal(want) {
+		t.Errorf("expiry after recovery = %v, %v, want %v", got, ok, want)
+	}
+
+	ts3 := newExpiryTagSystem(t, NewMemoryStore())
+	if err := ts3.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	if got, ok := ts3.GetTagExpiry(1, "viewed_promo"); !ok || !got.Equal(want) {
+		t.Errorf("expiry after loading the snapshot = %v, %v, want %v", got, ok, want)
+	}
+}
+
+// TestTagSystem_TTLWAL tests that deadlines and reaped removals are logged
+func TestTagSystem_TTLWAL(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.WALDir = t.TempDir()
+	config.WALSync = SyncAlways
+	config.ExpiryResolution = 10 * time.Millisecond
+
+	ts1, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	ts1.AddTagWithTTL(1, "viewed_promo", time.Hour)
+	ts1.AddTagWithTTL(2, "viewed_promo", time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for ts1.HasTag(2, "viewed_promo") {
+		if time.Now().After(deadline) {
+			t.Fatal("object 2 was never reaped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	crash(t, ts1)
+
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create second TagSystem: %v", err)
+	}
+	defer ts2.Close()
+
+	if _, err := ts2.ReplayWAL(); err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if _, ok := ts2.GetTagExpiry(1, "viewed_promo"); !ok {
+		t.Error("expected the deadline of object 1 to be replayed")
+	}
+	if ts2.HasTag(2, "viewed_promo") {
+		t.Error("expected the reaped removal to be replayed")
+	}
+}
+
+// TestTagSystem_ReapLogFailure tests that deadlines survive a failed
+// append to the log
+func TestTagSystem_ReapLogFailure(t *testing.T) {
+	ts := newWALTagSystem(t, t.TempDir(), NewMemoryStore())
+	ts.AddTag(1, "vip")
+	ts.AddTag(2, "trial")
+
+	past := time.Now().Add(-time.Hour).UnixNano()
+	ts.mu.Lock()
+	ts.expiry.set(1, "vip", past)
+	ts.expiry.set(2, "trial", past)
+	ts.mu.Unlock()
+
+	crash(t, ts) // Appends fail from now on
+
+	if _, err := ts.ReapExpired(); err == nil {
+		t.Fatal("reaping succeeded without a log")
+	}
+	if count := ts.expiry.count(); count != 2 {
+		t.Errorf("expected both deadlines to be kept, got %d", count)
+	}
+	if due := ts.expiry.popDue(time.Now().UnixNano()); len(due) != 2 {
+		t.Errorf("expected both buckets to be queued again, got %v", due)
+	}
+	if !ts.HasTag(1, "vip") || !ts.HasTag(2, "trial") {
+		t.Error("an assignment was removed without being logged")
+	}
+}
+
+// TestExpiry_Deadlines tests that the deadlines recorded by object and
+// the queue of bucket ends track the buckets
+func TestExpiry_Deadlines(t *testing.T) {
+	e := newExpiry(time.Second)
+	second := int64(time.Second)
+	e.set(1, "vip", 1*second)
+	e.set(2, "vip", 5*second)
+	e.set(1, "vip", 9*second) // Moves 1 to a later bucket
+
+	if deadline, ok := e.deadline(1, "vip"); !ok || deadline != 9*second {
+		t.Errorf("deadline of 1 = %d, %v, want %d", deadline, ok, 9*second)
+	}
+	if _, ok := e.deadline(3, "vip"); ok {
+		t.Error("object without a deadline has one")
+	}
+	if e.clear(3, "vip") || e.clear(1, "other") {
+		t.Error("cleared a deadline that does not exist")
+	}
+
+	e.rename("vip", "premium")
+	due := e.popDue(5 * second)
+	if !reflect.DeepEqual(due, map[string][]int64{"premium": {5 * second}}) {
+		t.Errorf("due buckets = %v, want premium at 5s", due)
+	}
+	e.take("premium", due["premium"])
+	if got := e.deadlines["premium"]; len(got) != 1 || got[1] != 9*second || e.count() != 1 {
+		t.Errorf("deadlines after take = %v, count %d, want only 1", got, e.count())
+	}
+	if next, ok := e.next(); !ok || next != 9*second {
+		t.Errorf("next bucket = %d, %v, want %d", next, ok, 9*second)
+	}
+
+	if !e.clear(1, "premium") {
+		t.Error("clear missed the deadline of 1")
+	}
+	if len(e.tags) != 0 || len(e.deadlines) != 0 {
+		t.Errorf("index not empty after clearing everything: %v %v", e.tags, e.deadlines)
+	}
+}
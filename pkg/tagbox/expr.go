@@ -0,0 +1,642 @@
+package tagbox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Node is a node of a query tree.
+//
+// Trees are built with the Tag, Dimension, Compare, Between, And, Or, Xor,
+// Not, All and Empty constructors or parsed from a string by ParseQuery, and evaluated by
+// TagSystem.Eval. The String method returns the expression in a form that
+// ParseQuery accepts and that evaluates to the same result.
+type Node interface {
+	String() string
+	isNode()
+}
+
+// tagNode matches the objects carrying a single tag.
+type tagNode struct {
+	name string
+}
+
+// andNode intersects its children.
+type andNode struct {
+	children []Node
+}
+
+// orNode unions its children.
+type orNode struct {
+	children []Node
+}
+
+// xorNode keeps the objects found in an odd number of its children.
+type xorNode struct {
+	children []Node
+}
+
+// notNode complements its child against all known objects.
+type notNode struct {
+	child Node
+}
+
+// dimensionNode matches the objects carrying any value of a dimension.
+type dimensionNode struct {
+	name string
+}
+
+// attrNode matches the objects whose numeric attribute compares to low
+// as op requests, or for opBetween lies between low and high.
+type attrNode struct {
+	name      string
+	op        CompareOp
+	low, high uint64
+}
+
+// opBetween is the operator of an inclusive range comparison.
+const opBetween CompareOp = "BETWEEN"
+
+// allNode matches every known object.
+type allNode struct{}
+
+// emptyNode matches no object.
+type emptyNode struct{}
+
+func (n *tagNode) String() string       { return quoteTag(n.name) }
+func (n *dimensionNode) String() string { return quoteTag(n.name) + DimensionSeparator + "*" }
+func (n *attrNode) String() string      { return n.format() }
+func (n *andNode) String() string       { return joinNodes(n.children, "AND") }
+func (n *orNode) String() string        { return joinNodes(n.children, "OR") }
+func (n *xorNode) String() string       { return joinNodes(n.children, "XOR") }
+func (n *notNode) String() string       { return "NOT " + wrapNode(n.child) }
+func (n *allNode) String() string       { return "ALL" }
+func (n *emptyNode) String() string     { return "NONE" }
+
+func (*tagNode) isNode()       {}
+func (*dimensionNode) isNode() {}
+func (*attrNode) isNode()      {}
+func (*andNode) isNode()       {}
+func (*orNode) isNode()        {}
+func (*xorNode) isNode()       {}
+func (*notNode) isNode()       {}
+func (*allNode) isNode()       {}
+func (*emptyNode) isNode()     {}
+
+// Tag returns a node matching the objects that carry the tag.
+func Tag(name string) Node {
+	return &tagNode{name: name}
+}
+
+// Tags returns one Tag node per name, for use with And, Or and Xor.
+func Tags(names ...string) []Node {
+	nodes := make([]Node, len(names))
+	for i, name := range names {
+		nodes[i] = Tag(name)
+	}
+	return nodes
+}
+
+// Dimension returns a node matching the objects that carry any value of a
+// dimension, that is any tag of the form "dimension:value".
+func Dimension(name string) Node {
+	return &dimensionNode{name: name}
+}
+
+// Compare returns a node matching the objects whose numeric attribute
+// compares to value as op requests. Objects without the attribute never
+// match.
+func Compare(attr string, op CompareOp, value uint64) Node {
+	return &attrNode{name: attr, op: op, low: value}
+}
+
+// Between returns a node matching the objects whose numeric attribute is
+// between low and high, inclusive.
+func Between(attr string, low, high uint64) Node {
+	return &attrNode{name: attr, op: opBetween, low: low, high: high}
+}
+
+// format renders an attribute comparison.
+func (n *attrNode) format() string {
+	if n.op == opBetween {
+		return fmt.Sprintf("%s BETWEEN %d AND %d", quoteTag(n.name), n.low, n.high)
+	}
+	return fmt.Sprintf("%s %s %d", quoteTag(n.name), n.op, n.low)
+}
+
+// And returns a node matching the objects matched by every child.
+// And() with no children matches all objects.
+func And(children ...Node) Node {
+	switch len(children) {
+	case 0:
+		return All()
+	case 1:
+		return children[0]
+	}
+	return &andNode{children: children}
+}
+
+// Or returns a node matching the objects matched by any child.
+// Or() with no children matches nothing.
+func Or(children ...Node) Node {
+	switch len(children) {
+	case 0:
+		return Empty()
+	case 1:
+		return children[0]
+	}
+	return &orNode{children: children}
+}
+
+// Xor returns a node matching the objects matched by an odd number of
+// children. Xor() with no children matches nothing.
+func Xor(children ...Node) Node {
+	switch len(children) {
+	case 0:
+		return Empty()
+	case 1:
+		return children[0]
+	}
+	return &xorNode{children: children}
+}
+
+// Not returns a node matching all known objects not matched by child.
+func Not(child Node) Node {
+	return &notNode{child: child}
+}
+
+// All returns a node matching every object that carries at least one tag.
+func All() Node {
+	return &allNode{}
+}
+
+// Empty returns a node matching no object.
+func Empty() Node {
+	return &emptyNode{}
+}
+
+// joinNodes renders children separated by an operator keyword.
+func joinNodes(children []Node, op string) string {
+	parts := make([]string, len(children))
+	for i, child := range children {
+		parts[i] = wrapNode(child)
+	}
+	return strings.Join(parts, " "+op+" ")
+}
+
+// wrapNode renders a child, adding parentheses around binary operators
+// so the printed form never depends on operator precedence.
+func wrapNode(n Node) string {
+	switch n.(type) {
+	case *andNode, *orNode, *xorNode:
+		return "(" + n.String() + ")"
+	default:
+		return n.String()
+	}
+}
+
+// quoteTag returns the tag as it must be written in an expression:
+// bare when it is a plain word, double-quoted otherwise.
+func quoteTag(tag string) string {
+	bare := tag != "" && !isKeyword(tag) && !strings.HasSuffix(tag, DimensionSeparator+"*")
+	for _, r := range tag {
+		if !isWordRune(r) {
+			bare = false
+			break
+		}
+	}
+	if bare {
+		return tag
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(tag); i++ {
+		if tag[i] == '"' || tag[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(tag[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// ParseError describes a syntax error in a query expression.
+type ParseError struct {
+	Pos int    // Byte offset in the expression where the error was found
+	Msg string // Description of the problem
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at position %d: %s", e.Pos, e.Msg)
+}
+
+// ParseQuery parses a boolean query expression.
+//
+// The language has the operators NOT, AND, XOR and OR (in decreasing
+// precedence, case-insensitive), parentheses for grouping, and the
+// constants ALL (every known object) and NONE. Tags are written as bare
+// words or as single- or double-quoted strings when they contain spaces,
+// parentheses or quotes, or collide with a keyword. A dimension name
+// followed by ":*" matches any value of the dimension, and numeric
+// attributes are compared with =, !=, <, <=, > and >= or BETWEEN, with
+// spaces around the operator:
+//
+//	(vip AND male) OR (new_user AND NOT churned)
+//	"city:new york" XOR 'and'
+//	city:* AND NOT gender:*
+//	age BETWEEN 18 AND 30 AND vip AND spend >= 1000
+//
+// Parentheses and NOT operators nest at most 256 levels deep; deeper
+// expressions are rejected with a ParseError.
+func ParseQuery(expr string) (Node, error) {
+	p := &parser{lex: lexer{input: expr}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+
+	return node, nil
+}
+
+// tokenKind identifies the type of a lexical token.
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokTag
+	tokDimension
+	tokAnd
+	tokOr
+	tokXor
+	tokNot
+	tokAll
+	tokNone
+	tokBetween
+	tokCompare
+	tokLParen
+	tokRParen
+)
+
+// token is a lexical token together with its position in the input.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokTag:
+		return fmt.Sprintf("tag %q", t.text)
+	case tokDimension:
+		return fmt.Sprintf("dimension %q", t.text)
+	case tokLParen:
+		return `"("`
+	case tokRParen:
+		return `")"`
+	default:
+		return strings.ToUpper(t.text)
+	}
+}
+
+// lexer splits an expression into tokens.
+type lexer struct {
+	input string
+	pos   int
+}
+
+// next returns the next token of the input.
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) && isSpace(l.input[l.pos]) {
+		l.pos++
+	}
+
+	start := l.pos
+	if start >= len(l.input) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	switch c := l.input[start]; c {
+	case '(':
+		l.pos++
+		return token{kind: tokLParen, text: "(", pos: start}, nil
+	case ')':
+		l.pos++
+		return token{kind: tokRParen, text: ")", pos: start}, nil
+	case '"', '\'':
+		return l.quoted(c)
+	}
+
+	for l.pos < len(l.input) {
+		r := rune(l.input[l.pos])
+		if isSpace(l.input[l.pos]) || r == '(' || r == ')' || r == '"' || r == '\'' {
+			break
+		}
+		l.pos++
+	}
+
+	word := l.input[start:l.pos]
+	switch strings.ToUpper(word) {
+	case "AND":
+		return token{kind: tokAnd, text: word, pos: start}, nil
+	case "OR":
+		return token{kind: tokOr, text: word, pos: start}, nil
+	case "XOR":
+		return token{kind: tokXor, text: word, pos: start}, nil
+	case "NOT":
+		return token{kind: tokNot, text: word, pos: start}, nil
+	case "ALL":
+		return token{kind: tokAll, text: word, pos: start}, nil
+	case "NONE":
+		return token{kind: tokNone, text: word, pos: start}, nil
+	case "BETWEEN":
+		return token{kind: tokBetween, text: word, pos: start}, nil
+	}
+	if isCompareOp(word) {
+		return token{kind: tokCompare, text: word, pos: start}, nil
+	}
+
+	if suffix := DimensionSeparator + "*"; len(word) > len(suffix) && strings.HasSuffix(word, suffix) {
+		return token{kind: tokDimension, text: strings.TrimSuffix(word, suffix), pos: start}, nil
+	}
+
+	return token{kind: tokTag, text: word, pos: start}, nil
+}
+
+// quoted scans a quoted tag name. Backslash escapes the next character.
+func (l *lexer) quoted(quote byte) (token, error) {
+	start := l.pos
+	l.pos++
+
+	var sb strings.Builder
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		switch {
+		case c == '\\':
+			if l.pos+1 >= len(l.input) {
+				return token{}, &ParseError{Pos: l.pos, Msg: "unterminated escape sequence"}
+			}
+			sb.WriteByte(l.input[l.pos+1])
+			l.pos += 2
+		case c == quote:
+			l.pos++
+			// A quoted dimension name is followed by ":*"
+			if suffix := DimensionSeparator + "*"; strings.HasPrefix(l.input[l.pos:], suffix) {
+				l.pos += len(suffix)
+				return token{kind: tokDimension, text: sb.String(), pos: start}, nil
+			}
+			return token{kind: tokTag, text: sb.String(), pos: start}, nil
+		default:
+			sb.WriteByte(c)
+			l.pos++
+		}
+	}
+
+	return token{}, &ParseError{Pos: start, Msg: "unterminated quoted tag"}
+}
+
+// maxQueryDepth bounds the nesting of parentheses and NOT operators in a
+// query expression, so a hostile expression cannot exhaust the stack.
+const maxQueryDepth = 256
+
+// parser is a recursive-descent parser over the lexer's tokens.
+type parser struct {
+	lex   lexer
+	tok   token
+	depth int // Nesting of the expression being parsed
+}
+
+// advance moves to the next token.
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &ParseError{Pos: p.tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// nest enters a nested expression at the current token. Every successful
+// call must be paired with a call to unnest.
+func (p *parser) nest() error {
+	if p.depth >= maxQueryDepth {
+		return p.errorf("expression nested deeper than %d levels", maxQueryDepth)
+	}
+	p.depth++
+	return nil
+}
+
+// unnest leaves a nested expression.
+func (p *parser) unnest() {
+	p.depth--
+}
+
+// parseOr parses: xor { OR xor }
+func (p *parser) parseOr() (Node, error) {
+	return p.parseBinary(tokOr, p.parseXor, Or)
+}
+
+// parseXor parses: and { XOR and }
+func (p *parser) parseXor() (Node, error) {
+	return p.parseBinary(tokXor, p.parseAnd, Xor)
+}
+
+// parseAnd parses: unary { AND unary }
+func (p *parser) parseAnd() (Node, error) {
+	return p.parseBinary(tokAnd, p.parseUnary, And)
+}
+
+// parseBinary parses a chain of operands joined by the operator kind op
+// into a single n-ary node.
+func (p *parser) parseBinary(op tokenKind, operand func() (Node, error), build func(...Node) Node) (Node, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []Node{first}
+	for p.tok.kind == op {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+
+	return build(children...), nil
+}
+
+// parseUnary parses: NOT unary | primary
+func (p *parser) parseUnary() (Node, error) {
+	if p.tok.kind != tokNot {
+		return p.parsePrimary()
+	}
+
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	defer p.unnest()
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	child, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	return Not(child), nil
+}
+
+// parsePrimary parses: tag [comparison] | dimension | ALL | NONE | "(" or ")"
+func (p *parser) parsePrimary() (Node, error) {
+	switch p.tok.kind {
+	case tokTag:
+		name := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokCompare && p.tok.kind != tokBetween {
+			return Tag(name), nil
+		}
+		return p.parseComparison(name)
+
+	case tokDimension, tokAll, tokNone:
+		var node Node
+		switch p.tok.kind {
+		case tokDimension:
+			node = Dimension(p.tok.text)
+		case tokAll:
+			node = All()
+		case tokNone:
+			node = Empty()
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		return node, nil
+
+	case tokLParen:
+		open := p.tok.pos
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer p.unnest()
+
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind != tokRParen {
+			return nil, &ParseError{Pos: open, Msg: "unclosed parenthesis"}
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		return node, nil
+
+	default:
+		return nil, p.errorf("expected tag, ALL, NONE or \"(\", found %s", p.tok)
+	}
+}
+
+// parseComparison parses the rest of: attr op number |
+// attr BETWEEN number AND number
+func (p *parser) parseComparison(attr string) (Node, error) {
+	if p.tok.kind == tokCompare {
+		op := CompareOp(p.tok.text)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		value, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		return Compare(attr, op, value), nil
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	low, err := p.parseNumber()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokAnd {
+		return nil, p.errorf("expected AND in BETWEEN, found %s", p.tok)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	high, err := p.parseNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	return Between(attr, low, high), nil
+}
+
+// parseNumber parses an unsigned integer operand of a comparison.
+func (p *parser) parseNumber() (uint64, error) {
+	if p.tok.kind != tokTag {
+		return 0, p.errorf("expected number, found %s", p.tok)
+	}
+	value, err := strconv.ParseUint(p.tok.text, 10, 64)
+	if err != nil {
+		return 0, p.errorf("expected number, found %s", p.tok)
+	}
+
+	return value, p.advance()
+}
+
+// isKeyword reports whether word is an operator keyword or comparison.
+func isKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "AND", "OR", "XOR", "NOT", "ALL", "NONE", "BETWEEN":
+		return true
+	}
+	return isCompareOp(word)
+}
+
+// isCompareOp reports whether word is a comparison operator.
+func isCompareOp(word string) bool {
+	switch CompareOp(word) {
+	case CmpEQ, CmpNE, CmpLT, CmpLE, CmpGT, CmpGE:
+		return true
+	}
+	return false
+}
+
+// isWordRune reports whether r may appear in an unquoted tag.
+func isWordRune(r rune) bool {
+	return r > ' ' && r != '(' && r != ')' && r != '"' && r != '\'' && r != '\\' && r != 0x7f
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
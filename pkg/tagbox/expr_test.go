@@ -0,0 +1,248 @@
+package tagbox
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestTagSystem creates a TagSystem backed by miniredis with AutoSave disabled
+func newTestTagSystem(t testing.TB) *TagSystem {
+	t.Helper()
+
+	_, client, cleanup := setupTestRedis(t)
+
+	config := DefaultConfig()
+	config.RedisAddr = client.Options().Addr
+	config.AutoSave = false
+
+	ts, err := New(config)
+	if err != nil {
+		cleanup()
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+
+	t.Cleanup(func() {
+		ts.Close()
+		cleanup()
+	})
+
+	return ts
+}
+
+// TestParseQuery tests parsing expressions and printing them back
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"vip", "vip"},
+		{"vip and male", "vip AND male"},
+		{"a OR b AND c", "a OR (b AND c)"},
+		{"a XOR b OR c", "(a XOR b) OR c"},
+		{"NOT a AND b", "NOT a AND b"},
+		{"NOT (a OR b)", "NOT (a OR b)"},
+		{"(vip AND male) OR (new_user AND NOT churned)", "(vip AND male) OR (new_user AND NOT churned)"},
+		{`"city:new york" AND 'and'`, `"city:new york" AND "and"`},
+		{`"say \"hi\""`, `"say \"hi\""`},
+		{"((a))", "a"},
+		{"city:* AND NOT gender:*", "city:* AND NOT gender:*"},
+		{`"new city":* OR 'all':*`, `"new city":* OR "all":*`},
+		{`"city:*"`, `"city:*"`},
+		{"age between 18 and 30 AND vip", "age BETWEEN 18 AND 30 AND vip"},
+		{"spend >= 1000 OR NOT age != 7", "spend >= 1000 OR NOT age != 7"},
+		{`">=" AND 'between'`, `">=" AND "between"`},
+	}
+
+	for _, tt := range tests {
+		node, err := ParseQuery(tt.expr)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := node.String(); got != tt.want {
+			t.Errorf("ParseQuery(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+
+		// The printed form must parse back to the same expression
+		again, err := ParseQuery(node.String())
+		if err != nil || again.String() != tt.want {
+			t.Errorf("round trip of %q failed: %v", tt.want, err)
+		}
+	}
+}
+
+// TestParseQuery_Errors tests that parse errors report their position
+func TestParseQuery_Errors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{"", 0},
+		{"vip AND", 7},
+		{"vip male", 4},
+		{"(vip OR male", 0},
+		{"vip)", 3},
+		{`"vip`, 0},
+		{"NOT", 3},
+		{"age >= x", 7},
+		{"age BETWEEN 1 OR 2", 14},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseQuery(tt.expr)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("ParseQuery(%q): expected ParseError, got %v", tt.expr, err)
+			continue
+		}
+		if perr.Pos != tt.pos {
+			t.Errorf("ParseQuery(%q): error at %d, want %d (%v)", tt.expr, perr.Pos, tt.pos, perr)
+		}
+	}
+}
+
+// TestParseQuery_Depth tests that nesting is limited
+func TestParseQuery_Depth(t *testing.T) {
+	nested := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + "vip" + strings.Repeat(close, n)
+	}
+
+	for _, expr := range []string{
+		nested("(", ")", maxQueryDepth),
+		nested("NOT ", "", maxQueryDepth),
+		nested("(NOT ", ")", maxQueryDepth/2),
+		strings.Repeat("(a) AND ", 1000) + "b",
+	} {
+		if _, err := ParseQuery(expr); err != nil {
+			t.Errorf("ParseQuery(%.20q...) failed: %v", expr, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		expr string
+		pos  int
+	}{
+		{nested("(", ")", maxQueryDepth+1), maxQueryDepth},
+		{nested("NOT ", "", maxQueryDepth+1), 4 * maxQueryDepth},
+		{nested("(", ")", 1000000), maxQueryDepth},
+	} {
+		_, err := ParseQuery(tt.expr)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Pos != tt.pos {
+			t.Errorf("ParseQuery(%.20q...) = %v, want a ParseError at %d", tt.expr, err, tt.pos)
+		}
+	}
+}
+
+// TestTagSystem_QueryExpr tests evaluating expressions
+func TestTagSystem_QueryExpr(t *testing.T) {
+	ts := newTestTagSystem(t)
+
+	ts.BatchAddTags(1, []string{"vip", "male"})
+	ts.BatchAddTags(2, []string{"vip", "female"})
+	ts.BatchAddTags(3, []string{"new_user", "male"})
+	ts.BatchAddTags(4, []string{"new_user", "churned"})
+	ts.BatchAddTags(5, []string{"regular"})
+
+	tests := []struct {
+		expr string
+		want []uint32
+	}{
+		{"vip", []uint32{1, 2}},
+		{"(vip AND male) OR (new_user AND NOT churned)", []uint32{1, 3}},
+		{"vip XOR male", []uint32{2, 3}},
+		{"NOT (vip OR new_user)", []uint32{5}},
+		{"missing OR regular", []uint32{5}},
+		{"vip AND missing", []uint32{}},
+	}
+
+	for _, tt := range tests {
+		result, err := ts.QueryExpr(tt.expr)
+		if err != nil {
+			t.Errorf("QueryExpr(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := result.ToArray(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("QueryExpr(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	if _, err := ts.QueryExpr("vip AND (male"); err == nil {
+		t.Error("expected parse error for unbalanced expression")
+	}
+}
+
+// TestTagSystem_Eval tests evaluating programmatically built query trees
+func TestTagSystem_Eval(t *testing.T) {
+	ts := newTestTagSystem(t)
+
+	ts.BatchAddTags(1, []string{"vip", "male"})
+	ts.BatchAddTags(2, []string{"vip", "female"})
+	ts.BatchAddTags(3, []string{"new_user", "male"})
+	ts.BatchAddTags(4, []string{"new_user", "churned"})
+
+	tests := []struct {
+		node Node
+		want []uint32
+	}{
+		{Or(And(Tag("vip"), Tag("male")), And(Tag("new_user"), Not(Tag("churned")))), []uint32{1, 3}},
+		{Xor(Tags("vip", "male", "new_user")...), []uint32{2, 4}},
+		{Not(Or(Tags("vip", "churned")...)), []uint32{3}},
+		{All(), []uint32{1, 2, 3, 4}},
+		{Empty(), []uint32{}},
+		{And(), []uint32{1, 2, 3, 4}},
+		{Or(), []uint32{}},
+	}
+
+	for _, tt := range tests {
+		result, err := ts.Eval(tt.node)
+		if err != nil {
+			t.Errorf("Eval(%s) failed: %v", tt.node, err)
+			continue
+		}
+		if got := result.ToArray(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Eval(%s) = %v, want %v", tt.node, got, tt.want)
+		}
+
+		// Printed trees must evaluate to the same result when parsed
+		parsed, err := ts.QueryExpr(tt.node.String())
+		if err != nil {
+			t.Errorf("QueryExpr(%s) failed: %v", tt.node, err)
+			continue
+		}
+		if !parsed.Equals(result) {
+			t.Errorf("QueryExpr(%s) = %v, want %v", tt.node, parsed.ToArray(), tt.want)
+		}
+	}
+
+	if _, err := ts.Eval(nil); err == nil {
+		t.Error("expected error for nil node")
+	}
+}
+
+// TestTagSystem_ComplexQueryNot tests NOT groups with several tags
+func TestTagSystem_ComplexQueryNot(t *testing.T) {
+	ts := newTestTagSystem(t)
+
+	ts.BatchAddTags(1, []string{"vip", "male"})
+	ts.BatchAddTags(2, []string{"vip", "churned"})
+	ts.BatchAddTags(3, []string{"vip", "banned"})
+
+	result, err := ts.ComplexQuery([]QueryOp{
+		{Type: OpAnd, Tags: []string{"vip"}},
+		{Type: OpNot, Tags: []string{"churned", "banned"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to execute complex query: %v", err)
+	}
+
+	if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{1}) {
+		t.Errorf("expected [1], got %v", got)
+	}
+
+	if _, err := ts.ComplexQuery([]QueryOp{{Type: "NAND", Tags: []string{"vip"}}}); err == nil {
+		t.Error("expected error for unknown operation")
+	}
+}
@@ -0,0 +1,363 @@
+package tagbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// File name extensions of tags and metadata saved by FileStore.
+const (
+	fileStoreExt     = ".bitmap"
+	fileStoreMetaExt = ".meta"
+)
+
+// fileStoreJournal is the file that lists the renames and removals of a
+// batch that is being applied, and fileStoreBatchPattern names the
+// files it renames into place. Their suffix is never produced by path or
+// metaPath, so no tag or metadata file can match it.
+const (
+	fileStoreJournal      = "batch.journal"
+	fileStoreBatchPattern = "*.batch-tmp"
+)
+
+// FileStore is a Store that keeps one file per tag in a local directory.
+//
+// Tag names are escaped into file names, so any tag can be stored. Each
+// save writes a temporary file and renames it into place, so a crash never
+// leaves a partially written tag behind. WriteBatch writes every file of a
+// batch first and commits it with a journal, which NewFileStore finishes
+// applying after a crash, so a batch is persisted entirely or not at all.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex // Serializes batches
+}
+
+// NewFileStore creates a store in dir, creating the directory if needed,
+// and completes a batch interrupted by a crash.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create store directory: %w", err)
+	}
+
+	s := &FileStore{dir: dir}
+	if err := s.applyJournal(); err != nil {
+		return nil, fmt.Errorf("apply batch journal: %w", err)
+	}
+
+	// Files of batches that were never committed
+	leftovers, err := filepath.Glob(filepath.Join(dir, fileStoreBatchPattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+
+	return s, nil
+}
+
+// path returns the file that holds tag.
+func (s *FileStore) path(tag string) string {
+	return filepath.Join(s.dir, url.QueryEscape(tag)+fileStoreExt)
+}
+
+// metaPath returns the file that holds a metadata entry.
+func (s *FileStore) metaPath(name string) string {
+	return filepath.Join(s.dir, url.QueryEscape(name)+fileStoreMetaExt)
+}
+
+// LoadAll reads every tag file in the directory.
+func (s *FileStore) LoadAll(ctx context.Context) (map[string][]byte, error) {
+	names, err := s.ListTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string][]byte, len(names))
+	var errs []error
+	for _, tag := range names {
+		data, err := s.LoadTag(ctx, tag)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
+			continue
+		}
+		tags[tag] = data
+	}
+
+	if len(errs) > 0 {
+		return tags, fmt.Errorf("load completed with %d errors: %v", len(errs), errs)
+	}
+
+	return tags, nil
+}
+
+// LoadTag reads a tag file.
+func (s *FileStore) LoadTag(ctx context.Context, tag string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(tag))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrTagNotFound
+	}
+
+	return data, err
+}
+
+// SaveTag atomically replaces a tag file.
+func (s *FileStore) SaveTag(ctx context.Context, tag string, data []byte) error {
+	return WriteFileAtomic(s.path(tag), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// DeleteTag removes a tag file.
+func (s *FileStore) DeleteTag(ctx context.Context, tag string) error {
+	err := os.Remove(s.path(tag))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// ListTags returns the sorted names of all tag files in the directory.
+func (s *FileStore) ListTags(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, fileStoreExt) {
+			continue
+		}
+
+		tag, err := url.QueryUnescape(strings.TrimSuffix(name, fileStoreExt))
+		if err != nil {
+			continue // Not written by FileStore
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return tags, nil
+}
+
+// LoadMeta reads a metadata file.
+func (s *FileStore) LoadMeta(ctx context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(s.metaPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrMetaNotFound
+	}
+
+	return data, err
+}
+
+// SaveMeta atomically replaces a metadata file.
+func (s *FileStore) SaveMeta(ctx context.Context, name string, data []byte) error {
+	return WriteFileAtomic(s.metaPath(name), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteBatch saves and deletes tags as one unit. The tag files are written
+// to temporary files, then a journal listing them and the tags to delete
+// is written atomically, which commits the batch, and finally the journal
+// is applied and removed. Readers may observe a batch partially applied,
+// but a crash never persists only part of it.
+func (s *FileStore) WriteBatch(ctx context.Context, saves map[string][]byte, deletes []string) error {
+	return s.WriteBatchWithMeta(ctx, saves, deletes, nil)
+}
+
+// WriteBatchWithMeta is WriteBatch that also replaces the metadata files
+// in meta as part of the batch.
+func (s *FileStore) WriteBatchWithMeta(ctx context.Context, saves map[string][]byte, deletes []string, meta map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.logBatch(saves, deletes, meta); err != nil {
+		return err
+	}
+
+	return s.applyJournal()
+}
+
+// logBatch writes the files of a batch and commits it to the journal.
+// Caller must hold s.mu.
+func (s *FileStore) logBatch(saves map[string][]byte, deletes []string, meta map[string][]byte) error {
+	var journal bytes.Buffer
+	var written []string
+	fail := func(err error) error {
+		for _, name := range written {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+		return err
+	}
+
+	// stage writes data to a temporary file that the journal renames to
+	// path
+	stage := func(path string, data []byte) error {
+		f, err := os.CreateTemp(s.dir, fileStoreBatchPattern)
+		if err != nil {
+			return err
+		}
+		written = append(written, filepath.Base(f.Name()))
+
+		_, err = f.Write(data)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&journal, "save %s %s\n", filepath.Base(f.Name()), filepath.Base(path))
+		return nil
+	}
+
+	for tag, data := range saves {
+		if err := stage(s.path(tag), data); err != nil {
+			return fail(fmt.Errorf("tag %s: %w", tag, err))
+		}
+	}
+	for name, data := range meta {
+		if err := stage(s.metaPath(name), data); err != nil {
+			return fail(fmt.Errorf("metadata %s: %w", name, err))
+		}
+	}
+	for _, tag := range deletes {
+		fmt.Fprintf(&journal, "delete %s\n", filepath.Base(s.path(tag)))
+	}
+
+	err := WriteFileAtomic(filepath.Join(s.dir, fileStoreJournal), func(w io.Writer) error {
+		_, err := journal.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	return nil
+}
+
+// applyJournal applies the committed batch, if any, and removes the
+// journal. Applying a journal again is harmless, as the renames already
+// done are skipped.
+func (s *FileStore) applyJournal() error {
+	path := filepath.Join(s.dir, fileStoreJournal)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid journal entry %q", scanner.Text())
+		}
+		for _, name := range fields[1:] {
+			if name != filepath.Base(name) {
+				return fmt.Errorf("invalid journal entry %q", scanner.Text())
+			}
+		}
+
+		switch {
+		case len(fields) == 3 && fields[0] == "save":
+			err := os.Rename(filepath.Join(s.dir, fields[1]), filepath.Join(s.dir, fields[2]))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		case len(fields) == 2 && fields[0] == "delete":
+			err := os.Remove(filepath.Join(s.dir, fields[1]))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid journal entry %q", scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	return syncDir(s.dir)
+}
+
+// Close is a no-op; files are closed after every operation.
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// WriteFileAtomic replaces path with the output of write. The data goes to
+// a temporary file in the same directory, which is synced and renamed into
+// place, so readers see either the old or the new file and never a torn one.
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable. Windows cannot sync directories
+// and doesn't need to.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,183 @@
+package tagbox
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// HierarchySeparator separates the levels of a hierarchical tag, as in
+// "asia/china/beijing".
+const HierarchySeparator = "/"
+
+// TagAncestors returns the proper ancestors of a hierarchical tag from the
+// root down: "asia" and "asia/china" for "asia/china/beijing".
+func TagAncestors(tag string) []string {
+	var ancestors []string
+	for start := 0; ; {
+		i := strings.Index(tag[start:], HierarchySeparator)
+		if i < 0 {
+			return ancestors
+		}
+
+		end := start + i
+		if end > 0 {
+			ancestors = append(ancestors, tag[:end])
+		}
+		start = end + len(HierarchySeparator)
+	}
+}
+
+// hierarchy keeps a roll-up bitmap for every path that has descendant
+// tags, so a query for a parent does not have to union its subtree.
+// Callers must hold the TagSystem lock.
+type hierarchy struct {
+	members map[string]map[string]struct{} // Path -> tags at or below it
+	rollups map[string]*roaring.Bitmap     // Path -> union of its members
+}
+
+// newHierarchy creates an empty hierarchy.
+func newHierarchy() *hierarchy {
+	return &hierarchy{
+		members: make(map[string]map[string]struct{}),
+		rollups: make(map[string]*roaring.Bitmap),
+	}
+}
+
+// paths returns the ancestors of tag followed by the tag itself.
+func (h *hierarchy) paths(tag string) []string {
+	return append(TagAncestors(tag), tag)
+}
+
+// insert registers a tag that was created or whose bitmap was replaced.
+func (h *hierarchy) insert(tag string, tags map[string]*roaring.Bitmap, replaced bool) {
+	for _, path := range h.paths(tag) {
+		members, exists := h.members[path]
+		if !exists {
+			members = make(map[string]struct{})
+			h.members[path] = members
+		}
+		members[tag] = struct{}{}
+	}
+
+	for _, path := range h.paths(tag) {
+		rollup, exists := h.rollups[path]
+		switch {
+		case path == tag && !exists:
+			// The tag has no descendants
+		case !exists || replaced:
+			h.rollups[path] = h.union(path, tags)
+		default:
+			rollup.Or(tags[tag])
+		}
+	}
+}
+
+// delete unregisters a tag that was dropped, along with the roll-ups of
+// paths left without descendants.
+func (h *hierarchy) delete(tag string) {
+	for _, path := range h.paths(tag) {
+		members := h.members[path]
+		delete(members, tag)
+		if len(members) == 0 {
+			delete(h.members, path)
+		}
+
+		if _, self := members[path]; len(members) == 0 || (len(members) == 1 && self) {
+			delete(h.rollups, path)
+		}
+	}
+}
+
+// refresh recomputes the roll-ups along the path of a tag whose objects
+// were dropped or moved in bulk.
+func (h *hierarchy) refresh(tag string, tags map[string]*roaring.Bitmap) {
+	for _, path := range h.paths(tag) {
+		if _, exists := h.rollups[path]; exists {
+			h.rollups[path] = h.union(path, tags)
+		}
+	}
+}
+
+// add records that objectIDs were added to tag.
+func (h *hierarchy) add(objectIDs []uint32, tag string) {
+	for _, path := range h.paths(tag) {
+		if rollup, exists := h.rollups[path]; exists {
+			rollup.AddMany(objectIDs)
+		}
+	}
+}
+
+// remove records that objectID was removed from tag. The object stays in
+// a roll-up while another tag of the subtree still has it.
+func (h *hierarchy) remove(objectID uint32, tag string, tags map[string]*roaring.Bitmap) {
+	for _, path := range h.paths(tag) {
+		rollup, exists := h.rollups[path]
+		if !exists || h.contains(path, objectID, tags) {
+			continue
+		}
+		rollup.Remove(objectID)
+	}
+}
+
+// contains reports whether any tag at or below path has objectID.
+func (h *hierarchy) contains(path string, objectID uint32, tags map[string]*roaring.Bitmap) bool {
+	for member := range h.members[path] {
+		if tags[member].Contains(objectID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// union computes the roll-up of path from the bitmaps of its members.
+func (h *hierarchy) union(path string, tags map[string]*roaring.Bitmap) *roaring.Bitmap {
+	bitmaps := make([]*roaring.Bitmap, 0, len(h.members[path]))
+	for member := range h.members[path] {
+		bitmaps = append(bitmaps, tags[member])
+	}
+
+	return roaring.FastOr(bitmaps...)
+}
+
+// queryBitmapLocked returns the bitmap a query for tag matches: the
+// roll-up of its subtree when hierarchical tags are enabled and the tag
+// has descendants, and the tag's own bitmap otherwise.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) queryBitmapLocked(tag string) (*roaring.Bitmap, bool) {
+	if ts.hier != nil {
+		if rollup, exists := ts.hier.rollups[tag]; exists {
+			return rollup, true
+		}
+	}
+
+	bitmap, exists := ts.tags[tag]
+	return bitmap, exists
+}
+
+// GetObjectTagsWithAncestors returns the tags of an object together with
+// all their ancestors, in sorted order.
+func (ts *TagSystem) GetObjectTagsWithAncestors(objectID uint32) ([]string, error) {
+	tags, err := ts.GetObjectTags(objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		seen[tag] = struct{}{}
+		for _, ancestor := range TagAncestors(tag) {
+			seen[ancestor] = struct{}{}
+		}
+	}
+
+	all := make([]string, 0, len(seen))
+	for tag := range seen {
+		all = append(all, tag)
+	}
+	sort.Strings(all)
+
+	return all, nil
+}
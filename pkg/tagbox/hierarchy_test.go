@@ -0,0 +1,164 @@
+package tagbox
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newHierarchyTagSystem creates a TagSystem with hierarchical tags on the given store
+func newHierarchyTagSystem(t *testing.T, store Store) *TagSystem {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+	config.TagHierarchy = true
+	config.CacheResults = true
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	t.Cleanup(func() { ts.Close() })
+
+	return ts
+}
+
+// TestTagAncestors tests splitting hierarchical tags
+func TestTagAncestors(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want []string
+	}{
+		{"asia/china/beijing", []string{"asia", "asia/china"}},
+		{"asia", nil},
+		{"/root/leaf", []string{"/root"}},
+	}
+
+	for _, tt := range tests {
+		if got := TagAncestors(tt.tag); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("TagAncestors(%q) = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+}
+
+// TestTagSystem_Hierarchy tests that queries for a parent match its subtree
+func TestTagSystem_Hierarchy(t *testing.T) {
+	ts := newHierarchyTagSystem(t, NewMemoryStore())
+
+	ts.AddTag(1, "asia/china/beijing")
+	ts.BatchAddObjectsToTag([]uint32{2, 3}, "asia/china/shanghai")
+	ts.BatchAddTags(4, []string{"asia/japan", "vip"})
+	ts.AddTag(5, "asia")
+	ts.AddTag(6, "europe/france")
+
+	tests := []struct {
+		expr string
+		want []uint32
+	}{
+		{"asia", []uint32{1, 2, 3, 4, 5}},
+		{"asia/china", []uint32{1, 2, 3}},
+		{"asia/china/beijing", []uint32{1}},
+		{"asia AND NOT asia/china", []uint32{4, 5}},
+		{"asia AND vip", []uint32{4}},
+		{"NOT asia", []uint32{6}},
+	}
+	for _, tt := range tests {
+		result, err := ts.QueryExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := result.ToArray(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	// Removals keep an object in the roll-up while a sibling still has it
+	ts.AddTag(1, "asia/china/shanghai")
+	ts.RemoveTag(1, "asia/china/beijing")
+	if result, _ := ts.Query("asia/china"); !reflect.DeepEqual(result.ToArray(), []uint32{1, 2, 3}) {
+		t.Errorf("asia/china = %v after moving object 1, want [1 2 3]", result.ToArray())
+	}
+
+	ts.RemoveTag(1, "asia/china/shanghai")
+	if result, _ := ts.Query("asia/china"); !reflect.DeepEqual(result.ToArray(), []uint32{2, 3}) {
+		t.Errorf("asia/china = %v after removal, want [2 3]", result.ToArray())
+	}
+	if result, _ := ts.Query("asia"); result.Contains(1) {
+		t.Error("object 1 should have left the asia roll-up")
+	}
+
+	// HasTag and GetTagCount stay literal
+	if ts.HasTag(2, "asia") {
+		t.Error("HasTag should not match descendants")
+	}
+	if count, _ := ts.GetTagCount("asia"); count != 1 {
+		t.Errorf("expected 1 object tagged asia itself, got %d", count)
+	}
+}
+
+// TestTagSystem_HierarchyDropsEmptyRollups tests removing the last descendant
+func TestTagSystem_HierarchyDropsEmptyRollups(t *testing.T) {
+	ts := newHierarchyTagSystem(t, NewMemoryStore())
+
+	ts.AddTag(1, "asia")
+	ts.AddTag(2, "asia/china")
+	ts.RemoveTag(2, "asia/china")
+
+	if len(ts.hier.rollups) != 0 {
+		t.Errorf("expected no roll-ups left, got %v", ts.hier.rollups)
+	}
+	if result, _ := ts.Query("asia"); !reflect.DeepEqual(result.ToArray(), []uint32{1}) {
+		t.Errorf("asia = %v, want [1]", result.ToArray())
+	}
+}
+
+// TestTagSystem_GetObjectTagsWithAncestors tests listing ancestors with the tags
+func TestTagSystem_GetObjectTagsWithAncestors(t *testing.T) {
+	ts := newHierarchyTagSystem(t, NewMemoryStore())
+
+	ts.BatchAddTags(1, []string{"asia/china/beijing", "product/phone", "vip"})
+
+	tags, err := ts.GetObjectTagsWithAncestors(1)
+	if err != nil {
+		t.Fatalf("GetObjectTagsWithAncestors failed: %v", err)
+	}
+	want := []string{"asia", "asia/china", "asia/china/beijing", "product", "product/phone", "vip"}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("GetObjectTagsWithAncestors = %v, want %v", tags, want)
+	}
+}
+
+// TestTagSystem_HierarchyPersistence tests that roll-ups are rebuilt on load
+func TestTagSystem_HierarchyPersistence(t *testing.T) {
+	store := NewMemoryStore()
+	path := filepath.Join(t.TempDir(), "tags.snap")
+
+	ts1 := newHierarchyTagSystem(t, store)
+	ts1.AddTag(1, "asia/china")
+	ts1.AddTag(2, "asia/japan")
+	if _, err := ts1.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	ts2 := newHierarchyTagSystem(t, store)
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	if result, _ := ts2.Query("asia"); result.GetCardinality() != 2 {
+		t.Errorf("expected 2 objects under asia after recovery, got %d", result.GetCardinality())
+	}
+
+	ts3 := newHierarchyTagSystem(t, NewMemoryStore())
+	ts3.AddTag(3, "asia/china")
+	if err := ts3.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	if result, _ := ts3.Query("asia"); !reflect.DeepEqual(result.ToArray(), []uint32{1, 2}) {
+		t.Errorf("asia = %v after loading the snapshot, want [1 2]", result.ToArray())
+	}
+}
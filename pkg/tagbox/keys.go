@@ -0,0 +1,307 @@
+package tagbox
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+const (
+	// keysMetaName is the metadata entry that holds the size of the object
+	// key dictionary, and the snapshot entry that holds the whole of it.
+	keysMetaName = "keys"
+
+	// keyChunkMetaPrefix prefixes the metadata entries that hold the keys
+	// in chunks of keyChunkSize IDs, so a flush rewrites only the chunks
+	// that gained keys instead of the whole dictionary.
+	keyChunkMetaPrefix = "keys:"
+	keyChunkSize       = 1 << 14
+)
+
+// keyDict assigns dense uint32 object IDs to external object keys such as
+// UUIDs. IDs are handed out in order starting at 0 and are never reused.
+// Callers must hold the TagSystem lock.
+type keyDict struct {
+	ids  map[string]uint32
+	keys []string // Indexed by ID; "" for IDs assigned out of order
+}
+
+// newKeyDict creates an empty dictionary.
+func newKeyDict() *keyDict {
+	return &keyDict{ids: make(map[string]uint32)}
+}
+
+// id returns the ID of key.
+func (d *keyDict) id(key string) (uint32, bool) {
+	id, exists := d.ids[key]
+	return id, exists
+}
+
+// key returns the key of id.
+func (d *keyDict) key(id uint32) (string, bool) {
+	if uint64(id) >= uint64(len(d.keys)) || d.keys[id] == "" {
+		return "", false
+	}
+
+	return d.keys[id], true
+}
+
+// next returns the ID the next new key will get.
+func (d *keyDict) next() uint32 {
+	return uint32(len(d.keys))
+}
+
+// set maps key to id. Setting an existing mapping again is a no-op, which
+// keeps log replay idempotent.
+func (d *keyDict) set(key string, id uint32) {
+	if _, exists := d.ids[key]; exists {
+		return
+	}
+
+	for uint64(len(d.keys)) <= uint64(id) {
+		d.keys = append(d.keys, "")
+	}
+	d.keys[id] = key
+	d.ids[key] = id
+}
+
+// chunks returns the number of chunks the dictionary spans.
+func (d *keyDict) chunks() uint32 {
+	return uint32((len(d.keys) + keyChunkSize - 1) / keyChunkSize)
+}
+
+// encode serializes the dictionary as the key count followed by the
+// uvarint-prefixed keys in ID order.
+func (d *keyDict) encode() []byte {
+	return encodeKeys(d.keys)
+}
+
+// encodeChunk serializes the keys of one chunk like encode.
+func (d *keyDict) encodeChunk(chunk uint32) []byte {
+	start := int(chunk) * keyChunkSize
+	if start > len(d.keys) {
+		start = len(d.keys)
+	}
+	end := start + keyChunkSize
+	if end > len(d.keys) {
+		end = len(d.keys)
+	}
+
+	return encodeKeys(d.keys[start:end])
+}
+
+// encodeKeys serializes keys as their count followed by the
+// uvarint-prefixed keys.
+func encodeKeys(keys []string) []byte {
+	size := binary.MaxVarintLen64
+	for _, key := range keys {
+		size += binary.MaxVarintLen64 + len(key)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+	}
+
+	return buf
+}
+
+// decodeKeyDict parses a dictionary written by encode.
+func decodeKeyDict(buf []byte) (*keyDict, error) {
+	keys, err := decodeKeys(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &keyDict{
+		ids:  make(map[string]uint32, len(keys)),
+		keys: keys,
+	}
+	for id, key := range keys {
+		if key != "" {
+			d.ids[key] = uint32(id)
+		}
+	}
+
+	return d, nil
+}
+
+// setChunk adds the keys of a chunk written by encodeChunk.
+func (d *keyDict) setChunk(chunk uint32, buf []byte) error {
+	keys, err := decodeKeys(buf)
+	if err != nil {
+		return err
+	}
+
+	base := uint64(chunk) * keyChunkSize
+	for i, key := range keys {
+		if key != "" {
+			d.set(key, uint32(base+uint64(i)))
+		}
+	}
+
+	for uint64(len(d.keys)) < base+uint64(len(keys)) {
+		d.keys = append(d.keys, "")
+	}
+
+	return nil
+}
+
+// keyChunkName returns the metadata entry of a chunk of keys.
+func keyChunkName(chunk uint32) string {
+	return keyChunkMetaPrefix + strconv.FormatUint(uint64(chunk), 10)
+}
+
+// decodeKeys parses keys written by encodeKeys.
+func decodeKeys(buf []byte) ([]string, error) {
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, fmt.Errorf("key dictionary truncated")
+		}
+		buf = buf[n:]
+		return v, nil
+	}
+
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(buf)) {
+		return nil, fmt.Errorf("key dictionary truncated")
+	}
+
+	keys := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(len(buf)) {
+			return nil, fmt.Errorf("key dictionary truncated")
+		}
+
+		key := string(buf[:size])
+		buf = buf[size:]
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// assignLocked returns the ID of key, assigning the next free ID if the
+// key is new.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) assignLocked(key string) (uint32, error) {
+	if key == "" {
+		return 0, fmt.Errorf("object key must not be empty")
+	}
+	if id, exists := ts.keys.id(key); exists {
+		return id, nil
+	}
+
+	id := ts.keys.next()
+	if err := ts.logLocked(walRecord{op: walAssignKey, tags: []string{key}, ids: []uint32{id}}); err != nil {
+		return 0, err
+	}
+
+	ts.assignKeyLocked(key, id)
+
+	return id, nil
+}
+
+// assignKeyLocked records a key assignment and marks the dictionary dirty.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) assignKeyLocked(key string, id uint32) {
+	if _, exists := ts.keys.id(key); exists {
+		return
+	}
+
+	ts.keys.set(key, id)
+	ts.keysDirty[id/keyChunkSize] = struct{}{}
+}
+
+// ObjectID returns the object ID assigned to an external key.
+func (ts *TagSystem) ObjectID(key string) (uint32, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.keys.id(key)
+}
+
+// ObjectKey returns the external key an object ID was assigned to.
+func (ts *TagSystem) ObjectKey(objectID uint32) (string, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.keys.key(objectID)
+}
+
+// ResolveKeys translates a query result to external keys in ID order.
+// Objects that were not added by key are skipped.
+func (ts *TagSystem) ResolveKeys(bitmap *roaring.Bitmap) []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	keys := make([]string, 0, bitmap.GetCardinality())
+	it := bitmap.Iterator()
+	for it.HasNext() {
+		if key, exists := ts.keys.key(it.Next()); exists {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// AddTagByKey adds a tag to the object with an external key, assigning the
+// key an object ID the first time it is seen.
+//
+// Keyed objects share the ID space with objects added by ID, so a tag
+// system should use one or the other.
+func (ts *TagSystem) AddTagByKey(key, tag string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	objectID, err := ts.assignLocked(key)
+	if err != nil {
+		return err
+	}
+
+	return ts.addTagLocked(objectID, tag)
+}
+
+// RemoveTagByKey removes a tag from the object with an external key.
+func (ts *TagSystem) RemoveTagByKey(key, tag string) error {
+	objectID, exists := ts.ObjectID(key)
+	if !exists {
+		return nil // Never tagged
+	}
+
+	return ts.RemoveTag(objectID, tag)
+}
+
+// HasTagByKey checks if the object with an external key has a tag.
+func (ts *TagSystem) HasTagByKey(key, tag string) bool {
+	objectID, exists := ts.ObjectID(key)
+	if !exists {
+		return false
+	}
+
+	return ts.HasTag(objectID, tag)
+}
+
+// GetObjectTagsByKey returns all tags of the object with an external key.
+func (ts *TagSystem) GetObjectTagsByKey(key string) ([]string, error) {
+	objectID, exists := ts.ObjectID(key)
+	if !exists {
+		return nil, nil
+	}
+
+	return ts.GetObjectTags(objectID)
+}
@@ -0,0 +1,210 @@
+package tagbox
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestTagSystem_ObjectKeys tests the string-keyed API
+func TestTagSystem_ObjectKeys(t *testing.T) {
+	ts := newMemoryTagSystem(t)
+
+	ts.AddTagByKey("user-a", "vip")
+	ts.AddTagByKey("user-b", "vip")
+	ts.AddTagByKey("user-a", "male")
+	ts.AddTagByKey("user-a", "male") // No-op
+
+	if id, _ := ts.ObjectID("user-b"); id != 1 {
+		t.Errorf("expected dense IDs, user-b got %d", id)
+	}
+	if key, _ := ts.ObjectKey(0); key != "user-a" {
+		t.Errorf("ObjectKey(0) = %q, want user-a", key)
+	}
+	if _, exists := ts.ObjectID("user-c"); exists {
+		t.Error("unknown key should not have an ID")
+	}
+
+	if !ts.HasTagByKey("user-a", "male") || ts.HasTagByKey("user-b", "male") || ts.HasTagByKey("user-c", "vip") {
+		t.Error("HasTagByKey returned wrong results")
+	}
+
+	tags, _ := ts.GetObjectTagsByKey("user-a")
+	sort.Strings(tags)
+	if !reflect.DeepEqual(tags, []string{"male", "vip"}) {
+		t.Errorf("GetObjectTagsByKey = %v, want [male vip]", tags)
+	}
+
+	result, _ := ts.Query("vip")
+	if keys := ts.ResolveKeys(result); !reflect.DeepEqual(keys, []string{"user-a", "user-b"}) {
+		t.Errorf("ResolveKeys = %v, want [user-a user-b]", keys)
+	}
+
+	ts.RemoveTagByKey("user-a", "vip")
+	if ts.HasTagByKey("user-a", "vip") {
+		t.Error("user-a should not have vip after removal")
+	}
+
+	if err := ts.AddTagByKey("", "vip"); err == nil {
+		t.Error("expected an error for an empty key")
+	}
+	if stats := ts.GetStats(); stats.ObjectKeys != 2 {
+		t.Errorf("expected 2 object keys, got %d", stats.ObjectKeys)
+	}
+}
+
+// TestTagSystem_ObjectKeysPersistence tests saving the dictionary with the tags
+func TestTagSystem_ObjectKeysPersistence(t *testing.T) {
+	_, client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	config := DefaultConfig()
+	config.RedisAddr = client.Options().Addr
+	config.AutoSave = false
+
+	ts1, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	ts1.AddTagByKey("user-a", "vip")
+	ts1.AddTagByKey("user-b", "vip")
+	if _, err := ts1.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	ts1.Close()
+
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create second TagSystem: %v", err)
+	}
+	defer ts2.Close()
+
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+
+	if tags := ts2.GetAllTags(); !reflect.DeepEqual(tags, []string{"vip"}) {
+		t.Errorf("metadata must not be loaded as a tag, got %v", tags)
+	}
+	if !ts2.HasTagByKey("user-b", "vip") {
+		t.Error("user-b should have vip tag after recovery")
+	}
+
+	// New keys continue after the recovered ones
+	ts2.AddTagByKey("user-c", "vip")
+	if id, _ := ts2.ObjectID("user-c"); id != 2 {
+		t.Errorf("expected user-c to get ID 2, got %d", id)
+	}
+}
+
+// TestTagSystem_ObjectKeysSnapshotAndWAL tests the dictionary in snapshots and the log
+func TestTagSystem_ObjectKeysSnapshotAndWAL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tags.snap")
+	walDir := filepath.Join(dir, "wal")
+
+	ts1 := newWALTagSystem(t, walDir, NewMemoryStore())
+	ts1.AddTagByKey("user-a", "vip")
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+	ts1.AddTagByKey("user-b", "vip")
+	crash(t, ts1)
+
+	ts2 := newWALTagSystem(t, walDir, NewMemoryStore())
+	defer ts2.Close()
+
+	if err := ts2.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+
+	result, _ := ts2.Query("vip")
+	if keys := ts2.ResolveKeys(result); !reflect.DeepEqual(keys, []string{"user-a", "user-b"}) {
+		t.Errorf("ResolveKeys = %v, want [user-a user-b]", keys)
+	}
+}
+
+// metaRecorder records the metadata entries written to a MemoryStore
+type metaRecorder struct {
+	*MemoryStore
+	saved []string
+}
+
+func (r *metaRecorder) WriteBatchWithMeta(ctx context.Context, saves map[string][]byte, deletes []string, meta map[string][]byte) error {
+	for name := range meta {
+		r.saved = append(r.saved, name)
+	}
+	return r.MemoryStore.WriteBatchWithMeta(ctx, saves, deletes, meta)
+}
+
+// TestTagSystem_ObjectKeysChunks tests that a flush writes only the chunks
+// of the dictionary that gained keys
+func TestTagSystem_ObjectKeysChunks(t *testing.T) {
+	store := &metaRecorder{MemoryStore: NewMemoryStore()}
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+
+	ts1, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts1.Close()
+
+	for i := 0; i <= keyChunkSize; i++ {
+		ts1.AddTagByKey(fmt.Sprintf("user-%d", i), "vip")
+	}
+	if _, err := ts1.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	store.saved = nil
+	ts1.AddTagByKey("user-new", "vip")
+	if _, err := ts1.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	sort.Strings(store.saved)
+	if want := []string{keysMetaName, keyChunkName(1)}; !reflect.DeepEqual(store.saved, want) {
+		t.Errorf("flush wrote %v, want %v", store.saved, want)
+	}
+
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create second TagSystem: %v", err)
+	}
+	defer ts2.Close()
+
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	if id, _ := ts2.ObjectID("user-new"); id != keyChunkSize+1 {
+		t.Errorf("user-new has ID %d, want %d", id, keyChunkSize+1)
+	}
+	if key, _ := ts2.ObjectKey(5); key != "user-5" {
+		t.Errorf("ObjectKey(5) = %q, want user-5", key)
+	}
+	ts2.AddTagByKey("user-next", "vip")
+	if id, _ := ts2.ObjectID("user-next"); id != keyChunkSize+2 {
+		t.Errorf("user-next has ID %d, want %d", id, keyChunkSize+2)
+	}
+
+	// The IDs of a lost chunk are not given to new keys
+	delete(store.meta, keyChunkName(1))
+	ts3, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create third TagSystem: %v", err)
+	}
+	defer ts3.Close()
+
+	if err := ts3.Recover(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	ts3.AddTagByKey("user-after", "vip")
+	if id, _ := ts3.ObjectID("user-after"); id != keyChunkSize+2 {
+		t.Errorf("user-after has ID %d, want %d", id, keyChunkSize+2)
+	}
+}
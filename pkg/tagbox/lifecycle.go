@@ -0,0 +1,268 @@
+package tagbox
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// ErrTagExists is returned when renaming or copying a tag onto a tag that
+// already exists.
+var ErrTagExists = errors.New("tag already exists")
+
+// DeleteTag removes a tag from every object that has it. Deadlines of its
+// assignments are cleared and the next flush deletes it from the store.
+// Objects stay in the universe that NOT queries complement against, as
+// with RemoveTag. Deleting a tag that does not exist does nothing.
+func (ts *TagSystem) DeleteTag(tag string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, exists := ts.tags[tag]; !exists {
+		return nil
+	}
+
+	if err := ts.logLocked(walRecord{op: walDeleteTag, tags: []string{tag}}); err != nil {
+		return err
+	}
+
+	ts.dropLocked(tag)
+
+	return nil
+}
+
+// dropLocked removes a tag from every object that has it.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) dropLocked(tag string) {
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		return
+	}
+
+	if ts.reverse != nil {
+		for it := bitmap.Iterator(); it.HasNext(); {
+			ts.reverse.remove(it.Next(), tag)
+		}
+	}
+	if ts.expiry.drop(tag) {
+		ts.expiryDirty = true
+	}
+
+	ts.deleteTagLocked(tag)
+	if ts.hier != nil {
+		ts.hier.refresh(tag, ts.tags)
+	}
+
+	ts.changedLocked(false, tag)
+}
+
+// RenameTag gives the objects of tag from to tag to instead, along with
+// their deadlines. It fails with ErrTagNotFound if from does not exist
+// and with ErrTagExists if to does; use MergeTags to combine two tags.
+func (ts *TagSystem) RenameTag(from, to string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if rename, err := checkRename(ts.tags, from, to); !rename {
+		return err
+	}
+
+	ids := ts.tags[from].ToArray()
+	if err := ts.logLocked(walRecord{op: walMoveTag, tags: []string{from, to}, ids: ids}); err != nil {
+		return err
+	}
+
+	ts.moveLocked(ids, from, to)
+
+	return nil
+}
+
+// MergeTags moves the objects of every tag in from to tag into, which is
+// created if needed, and deletes the tags in from. Objects that already
+// have into keep their deadline for it; the others bring the deadline they
+// had for the merged tag. It fails with ErrTagNotFound, changing nothing,
+// if a tag in from does not exist.
+func (ts *TagSystem) MergeTags(into string, from ...string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	from, err := checkMerge(ts.tags, into, from)
+	if err != nil {
+		return err
+	}
+
+	records := make([]walRecord, 0, len(from))
+	for _, tag := range from {
+		records = append(records, walRecord{op: walMoveTag, tags: []string{tag, into}, ids: ts.tags[tag].ToArray()})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	rec := walRecord{op: walTxn, records: records}
+	if err := ts.logLocked(rec); err != nil {
+		return err
+	}
+
+	ts.applyLocked(rec)
+
+	return nil
+}
+
+// moveLocked moves the objects in objectIDs that have tag from to tag to,
+// with their deadlines. Objects that already have to keep its deadline.
+// Moving every object to a new tag renames the bitmap in place.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) moveLocked(objectIDs []uint32, from, to string) {
+	bitmap, exists := ts.tags[from]
+	if !exists || from == to {
+		return
+	}
+	objects := roaring.And(bitmap, roaring.BitmapOf(objectIDs...))
+	if objects.IsEmpty() {
+		return
+	}
+
+	target, exists := ts.tags[to]
+	if !exists && objects.GetCardinality() == bitmap.GetCardinality() {
+		ts.renameLocked(from, to)
+		return
+	}
+
+	carried := objects
+	if exists {
+		carried = roaring.AndNot(objects, target)
+	}
+	moved := ts.expiry.copy(carried, from, to)
+
+	for it := objects.Iterator(); it.HasNext(); {
+		ts.removeLocked(it.Next(), from)
+	}
+	ts.addObjectsLocked(objects.ToArray(), to)
+
+	if moved {
+		ts.expiryDirty = true
+		ts.startReaperLocked()
+	}
+}
+
+// renameLocked moves the bitmap of tag from, which must exist, to tag to,
+// which must not.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) renameLocked(from, to string) {
+	bitmap := ts.tags[from]
+
+	if ts.reverse != nil {
+		for it := bitmap.Iterator(); it.HasNext(); {
+			objectID := it.Next()
+			ts.reverse.remove(objectID, from)
+			ts.reverse.add(objectID, to)
+		}
+	}
+	if ts.expiry.rename(from, to) {
+		ts.expiryDirty = true
+	}
+
+	ts.deleteTagLocked(from)
+	if ts.hier != nil {
+		ts.hier.refresh(from, ts.tags)
+	}
+	ts.setTagLocked(to, bitmap)
+
+	ts.changedLocked(false, from, to)
+	ts.exclusiveLocked(bitmap, to)
+}
+
+// CopyTag creates tag to with the objects of tag from and their deadlines.
+// It fails with ErrTagNotFound if from does not exist and with
+// ErrTagExists if to does.
+func (ts *TagSystem) CopyTag(from, to string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err := checkCopy(ts.tags, from, to); err != nil {
+		return err
+	}
+
+	ids := ts.tags[from].ToArray()
+	if err := ts.logLocked(walRecord{op: walCopyTag, tags: []string{from, to}, ids: ids}); err != nil {
+		return err
+	}
+
+	ts.copyLocked(ids, from, to)
+
+	return nil
+}
+
+// copyLocked adds objectIDs to tag to, with the deadlines they have for
+// tag from.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) copyLocked(objectIDs []uint32, from, to string) {
+	if len(objectIDs) == 0 {
+		return
+	}
+
+	// The deadlines are copied first: when to is an exclusive value,
+	// adding it removes from along with its deadlines
+	copied := ts.expiry.copy(roaring.BitmapOf(objectIDs...), from, to)
+	ts.addObjectsLocked(objectIDs, to)
+
+	if copied {
+		ts.expiryDirty = true
+		ts.startReaperLocked()
+	}
+}
+
+// checkRename reports whether tag from can be renamed to tag to. It fails
+// with ErrTagNotFound if from does not exist and with ErrTagExists if to
+// does; renaming a tag to itself is allowed but does nothing.
+func checkRename[B any](tags map[string]B, from, to string) (bool, error) {
+	if _, exists := tags[from]; !exists {
+		return false, fmt.Errorf("%w: %s", ErrTagNotFound, from)
+	}
+	if from == to {
+		return false, nil
+	}
+	if _, exists := tags[to]; exists {
+		return false, fmt.Errorf("%w: %s", ErrTagExists, to)
+	}
+
+	return true, nil
+}
+
+// checkMerge checks that every tag in from exists and differs from into,
+// and returns from without duplicates.
+func checkMerge[B any](tags map[string]B, into string, from []string) ([]string, error) {
+	unique := make([]string, 0, len(from))
+	seen := make(map[string]struct{}, len(from))
+	for _, tag := range from {
+		if tag == into {
+			return nil, fmt.Errorf("cannot merge tag %s into itself", tag)
+		}
+		if _, dup := seen[tag]; dup {
+			continue
+		}
+		seen[tag] = struct{}{}
+
+		if _, exists := tags[tag]; !exists {
+			return nil, fmt.Errorf("%w: %s", ErrTagNotFound, tag)
+		}
+		unique = append(unique, tag)
+	}
+
+	return unique, nil
+}
+
+// checkCopy checks that tag from can be copied to tag to. It fails with
+// ErrTagNotFound if from does not exist and with ErrTagExists if to does.
+func checkCopy[B any](tags map[string]B, from, to string) error {
+	if _, exists := tags[from]; !exists {
+		return fmt.Errorf("%w: %s", ErrTagNotFound, from)
+	}
+	if _, exists := tags[to]; exists {
+		return fmt.Errorf("%w: %s", ErrTagExists, to)
+	}
+
+	return nil
+}
@@ -0,0 +1,264 @@
+package tagbox
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newLifecycleTagSystem creates a TagSystem with every tag index enabled
+func newLifecycleTagSystem(t *testing.T, store Store, walDir string) *TagSystem {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+	config.ReverseIndex = true
+	config.TagHierarchy = true
+	config.CacheResults = true
+	config.WALDir = walDir
+	config.WALSync = SyncAlways
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	t.Cleanup(func() { ts.Close() })
+
+	return ts
+}
+
+// checkQuery compares the result of an expression
+func checkQuery(t *testing.T, ts *TagSystem, expr string, want ...uint32) {
+	t.Helper()
+
+	result, err := ts.QueryExpr(expr)
+	if err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	if got := result.ToArray(); !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+		t.Errorf("%s = %v, want %v", expr, got, want)
+	}
+}
+
+// TestTagSystem_DeleteTag tests that deleting a tag updates every index and
+// the store
+func TestTagSystem_DeleteTag(t *testing.T) {
+	store := NewMemoryStore()
+	ts := newLifecycleTagSystem(t, store, "")
+	ts.BatchAddObjectsToTag([]uint32{1, 2}, "asia/china")
+	ts.AddTag(3, "asia/japan")
+	ts.AddTagWithTTL(2, "city:beijing", time.Hour)
+	ts.AddTag(2, "vip")
+	ts.Save()
+
+	checkQuery(t, ts, "asia", 1, 2, 3) // Cache the roll-up
+
+	if err := ts.DeleteTag("asia/china"); err != nil {
+		t.Fatalf("DeleteTag failed: %v", err)
+	}
+	ts.DeleteTag("city:beijing")
+	if err := ts.DeleteTag("missing"); err != nil {
+		t.Errorf("deleting a missing tag = %v", err)
+	}
+
+	checkQuery(t, ts, "asia", 3)
+	checkQuery(t, ts, "NOT vip", 1, 3)
+	if tags, _ := ts.GetObjectTags(2); !reflect.DeepEqual(tags, []string{"vip"}) {
+		t.Errorf("object 2 tags = %v, want [vip]", tags)
+	}
+	if dims := ts.GetDimensions(); len(dims) != 0 {
+		t.Errorf("dimensions = %v, want none", dims)
+	}
+	if _, ok := ts.GetTagExpiry(2, "city:beijing"); ok {
+		t.Error("deadline of a deleted tag was kept")
+	}
+
+	if err := ts.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	tags, _ := store.ListTags(ts.ctx)
+	sort.Strings(tags)
+	if !reflect.DeepEqual(tags, []string{"asia/japan", "vip"}) {
+		t.Errorf("stored tags = %v", tags)
+	}
+}
+
+// TestTagSystem_RenameTag tests renaming a tag with its deadlines
+func TestTagSystem_RenameTag(t *testing.T) {
+	ts := newLifecycleTagSystem(t, NewMemoryStore(), "")
+	ts.BatchAddObjectsToTag([]uint32{1, 2}, "asia/china/peking")
+	ts.AddTagWithTTL(1, "asia/china/peking", time.Hour)
+	ts.AddTag(3, "vip")
+
+	checkQuery(t, ts, "asia/china", 1, 2)
+
+	if err := ts.RenameTag("asia/china/peking", "asia/china/beijing"); err != nil {
+		t.Fatalf("RenameTag failed: %v", err)
+	}
+	checkQuery(t, ts, "asia/china", 1, 2)
+	checkQuery(t, ts, "asia/china/beijing", 1, 2)
+	checkQuery(t, ts, "asia/china/peking")
+	if tags, _ := ts.GetObjectTags(2); !reflect.DeepEqual(tags, []string{"asia/china/beijing"}) {
+		t.Errorf("object 2 tags = %v", tags)
+	}
+	if _, ok := ts.GetTagExpiry(1, "asia/china/beijing"); !ok {
+		t.Error("deadline was not renamed")
+	}
+
+	if err := ts.RenameTag("asia/china/beijing", "europe"); err != nil {
+		t.Fatalf("RenameTag failed: %v", err)
+	}
+	checkQuery(t, ts, "asia")
+	checkQuery(t, ts, "europe", 1, 2)
+
+	if err := ts.RenameTag("missing", "x"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("renaming a missing tag = %v, want ErrTagNotFound", err)
+	}
+	if err := ts.RenameTag("europe", "vip"); !errors.Is(err, ErrTagExists) {
+		t.Errorf("renaming onto an existing tag = %v, want ErrTagExists", err)
+	}
+	checkQuery(t, ts, "vip", 3)
+}
+
+// TestTagSystem_MergeTags tests merging tags and that a failed merge
+// changes nothing
+func TestTagSystem_MergeTags(t *testing.T) {
+	ts := newLifecycleTagSystem(t, NewMemoryStore(), "")
+	ts.BatchAddObjectsToTag([]uint32{1, 2}, "city:peking")
+	ts.AddTagWithTTL(3, "city:peking", time.Hour)
+	ts.AddTag(2, "city:pekin")
+	ts.AddTagWithTTL(4, "city:pekin", time.Hour)
+	ts.AddTag(1, "city:beijing")
+
+	if err := ts.MergeTags("city:beijing", "city:peking", "missing"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("merging a missing tag = %v, want ErrTagNotFound", err)
+	}
+	checkQuery(t, ts, "city:peking", 1, 2, 3)
+	if err := ts.MergeTags("city:beijing", "city:beijing"); err == nil {
+		t.Error("merging a tag into itself succeeded")
+	}
+
+	if err := ts.MergeTags("city:beijing", "city:peking", "city:pekin"); err != nil {
+		t.Fatalf("MergeTags failed: %v", err)
+	}
+	checkQuery(t, ts, "city:beijing", 1, 2, 3, 4)
+	if values := ts.GetDimensionValues("city"); !reflect.DeepEqual(values, []string{"beijing"}) {
+		t.Errorf("city values = %v", values)
+	}
+
+	// Objects 3 and 4 bring their deadlines; object 2 got city:beijing
+	// from city:peking, without one
+	tests := []struct {
+		objectID uint32
+		expiring bool
+	}{
+		{1, false}, {2, false}, {3, true}, {4, true},
+	}
+	for _, tt := range tests {
+		if _, ok := ts.GetTagExpiry(tt.objectID, "city:beijing"); ok != tt.expiring {
+			t.Errorf("object %d expiring = %v, want %v", tt.objectID, ok, tt.expiring)
+		}
+	}
+	if stats := ts.GetStats(); stats.Expiring != 2 || stats.TotalTags != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+// TestTagSystem_CopyTag tests copying a tag with its deadlines
+func TestTagSystem_CopyTag(t *testing.T) {
+	ts := newLifecycleTagSystem(t, NewMemoryStore(), "")
+	ts.BatchAddObjectsToTag([]uint32{1, 2}, "segment")
+	ts.AddTagWithTTL(2, "segment", time.Hour)
+
+	if err := ts.CopyTag("segment", "segment/backup"); err != nil {
+		t.Fatalf("CopyTag failed: %v", err)
+	}
+	ts.RemoveTag(1, "segment")
+
+	checkQuery(t, ts, "segment", 1, 2)
+	checkQuery(t, ts, "segment/backup", 1, 2)
+	if _, ok := ts.GetTagExpiry(2, "segment/backup"); !ok {
+		t.Error("deadline was not copied")
+	}
+	if err := ts.CopyTag("segment", "segment/backup"); !errors.Is(err, ErrTagExists) {
+		t.Errorf("copying onto an existing tag = %v, want ErrTagExists", err)
+	}
+	if err := ts.CopyTag("missing", "x"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("copying a missing tag = %v, want ErrTagNotFound", err)
+	}
+}
+
+// TestTagSystem_LifecycleWAL tests that lifecycle operations replay
+// idempotently
+func TestTagSystem_LifecycleWAL(t *testing.T) {
+	dir := t.TempDir()
+	store := NewMemoryStore()
+
+	ts1 := newLifecycleTagSystem(t, store, dir)
+	ts1.BatchAddObjectsToTag([]uint32{1, 2}, "a")
+	ts1.AddTag(3, "b")
+	ts1.AddTag(4, "c")
+	ts1.AddTag(5, "d")
+	if err := ts1.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	ts1.RenameTag("a", "renamed")
+	ts1.AddTag(9, "a") // Recreated after the rename
+	ts1.MergeTags("renamed", "b")
+	ts1.CopyTag("c", "c2")
+	ts1.DeleteTag("d")
+	crash(t, ts1)
+
+	ts2 := newLifecycleTagSystem(t, store, dir)
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	ts2.ReplayWAL() // Replaying again changes nothing
+
+	tests := []struct {
+		expr string
+		want []uint32
+	}{
+		{"renamed", []uint32{1, 2, 3}},
+		{"a", []uint32{9}},
+		{"b", nil},
+		{"c", []uint32{4}},
+		{"c2", []uint32{4}},
+		{"d", nil},
+	}
+	for _, tt := range tests {
+		checkQuery(t, ts2, tt.expr, tt.want...)
+	}
+	if tags, _ := ts2.GetObjectTags(9); !reflect.DeepEqual(tags, []string{"a"}) {
+		t.Errorf("object 9 tags = %v, want [a]", tags)
+	}
+}
+
+// TestTagSystem_LifecycleExclusive tests renaming into an exclusive
+// dimension
+func TestTagSystem_LifecycleExclusive(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.ExclusiveDimensions = []string{"plan"}
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.AddTag(1, "plan:free")
+	ts.AddTag(2, "legacy")
+	ts.AddTag(2, "plan:free")
+
+	if err := ts.RenameTag("legacy", "plan:basic"); err != nil {
+		t.Fatalf("RenameTag failed: %v", err)
+	}
+	checkQuery(t, ts, "plan:basic", 2)
+	checkQuery(t, ts, "plan:free", 1)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package tagbox
+
+import "os"
+
+// mapFile reads the whole file on platforms without mmap support.
+func mapFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// unmapFile is a no-op; the data is garbage collected.
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package tagbox
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// DimensionSeparator separates the dimension of a namespaced tag from its
+// value, as in "city:beijing".
+const DimensionSeparator = ":"
+
+// SplitTag splits a namespaced tag at the first DimensionSeparator into
+// its dimension and value. ok is false for tags without a dimension.
+func SplitTag(tag string) (dimension, value string, ok bool) {
+	i := strings.Index(tag, DimensionSeparator)
+	if i <= 0 {
+		return "", "", false
+	}
+
+	return tag[:i], tag[i+len(DimensionSeparator):], true
+}
+
+// dimensionDep is the cache dependency key of a dimension query. Changes
+// to any tag of the dimension invalidate it.
+func dimensionDep(dimension string) string {
+	return dimension + DimensionSeparator + "*"
+}
+
+// tagBitmapLocked returns the bitmap of a tag, creating the tag if needed.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) tagBitmapLocked(tag string) *roaring.Bitmap {
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		bitmap = roaring.NewBitmap()
+		ts.setTagLocked(tag, bitmap)
+	}
+
+	return bitmap
+}
+
+// setTagLocked stores the bitmap of a tag and indexes the tag under its
+// dimension and in the hierarchy.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) setTagLocked(tag string, bitmap *roaring.Bitmap) {
+	_, replaced := ts.tags[tag]
+	ts.tags[tag] = bitmap
+	if ts.hier != nil {
+		ts.hier.insert(tag, ts.tags, replaced)
+	}
+
+	if dimension, _, ok := SplitTag(tag); ok {
+		values, exists := ts.dims[dimension]
+		if !exists {
+			values = make(map[string]struct{})
+			ts.dims[dimension] = values
+		}
+		values[tag] = struct{}{}
+	}
+}
+
+// deleteTagLocked drops a tag and its dimension and hierarchy entries.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) deleteTagLocked(tag string) {
+	delete(ts.tags, tag)
+	if ts.hier != nil {
+		ts.hier.delete(tag)
+	}
+
+	if dimension, _, ok := SplitTag(tag); ok {
+		values := ts.dims[dimension]
+		delete(values, tag)
+		if len(values) == 0 {
+			delete(ts.dims, dimension)
+		}
+	}
+}
+
+// exclusiveLocked removes every other value of the tag's dimension from
+// the objects when the dimension is exclusive. The removals are not
+// logged: replaying the add re-derives them.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) exclusiveLocked(objects *roaring.Bitmap, tag string) {
+	dimension, _, ok := SplitTag(tag)
+	if !ok {
+		return
+	}
+	if _, exclusive := ts.exclusive[dimension]; !exclusive {
+		return
+	}
+
+	for sibling := range ts.dims[dimension] {
+		if sibling == tag {
+			continue
+		}
+
+		it := roaring.And(ts.tags[sibling], objects).Iterator()
+		for it.HasNext() {
+			ts.removeLocked(it.Next(), sibling)
+		}
+	}
+}
+
+// execDimensionLocked unions the tags of a dimension. A single tag is
+// returned as it is, without copying.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) execDimensionLocked(dimension string) (*roaring.Bitmap, bool, error) {
+	values := ts.dims[dimension]
+	switch len(values) {
+	case 0:
+		return roaring.NewBitmap(), true, nil
+	case 1:
+		for tag := range values {
+			return ts.tags[tag], false, nil
+		}
+	}
+
+	bitmaps := make([]*roaring.Bitmap, 0, len(values))
+	for tag := range values {
+		bitmaps = append(bitmaps, ts.tags[tag])
+	}
+
+	return roaring.FastOr(bitmaps...), true, nil
+}
+
+// GetDimensions returns the dimensions of all namespaced tags in sorted
+// order.
+func (ts *TagSystem) GetDimensions() []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	dimensions := make([]string, 0, len(ts.dims))
+	for dimension := range ts.dims {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+
+	return dimensions
+}
+
+// GetDimensionValues returns the values of a dimension in sorted order,
+// without the dimension prefix.
+func (ts *TagSystem) GetDimensionValues(dimension string) []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	values := make([]string, 0, len(ts.dims[dimension]))
+	for tag := range ts.dims[dimension] {
+		_, value, _ := SplitTag(tag)
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	return values
+}
+
+// GetDimensionCounts returns the number of objects carrying each value of
+// a dimension.
+func (ts *TagSystem) GetDimensionCounts(dimension string) map[string]uint64 {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	counts := make(map[string]uint64, len(ts.dims[dimension]))
+	for tag := range ts.dims[dimension] {
+		_, value, _ := SplitTag(tag)
+		counts[value] = ts.tags[tag].GetCardinality()
+	}
+
+	return counts
+}
+
+// QueryDimension returns the objects carrying any value of a dimension.
+func (ts *TagSystem) QueryDimension(dimension string) (*roaring.Bitmap, error) {
+	return ts.Eval(Dimension(dimension))
+}
@@ -0,0 +1,187 @@
+package tagbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestSplitTag tests splitting namespaced tags
+func TestSplitTag(t *testing.T) {
+	tests := []struct {
+		tag       string
+		dimension string
+		value     string
+		ok        bool
+	}{
+		{"city:beijing", "city", "beijing", true},
+		{"url:http://x", "url", "http://x", true},
+		{"city:", "city", "", true},
+		{"vip", "", "", false},
+		{":orphan", "", "", false},
+	}
+
+	for _, tt := range tests {
+		dimension, value, ok := SplitTag(tt.tag)
+		if dimension != tt.dimension || value != tt.value || ok != tt.ok {
+			t.Errorf("SplitTag(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.tag, dimension, value, ok, tt.dimension, tt.value, tt.ok)
+		}
+	}
+}
+
+// TestTagSystem_Dimensions tests listing and counting dimension values
+func TestTagSystem_Dimensions(t *testing.T) {
+	ts := newMemoryTagSystem(t)
+
+	ts.BatchAddObjectsToTag([]uint32{1, 2, 3}, "city:beijing")
+	ts.AddTag(4, "city:shanghai")
+	ts.AddTag(1, "gender:male")
+	ts.AddTag(1, "vip")
+
+	if dims := ts.GetDimensions(); !reflect.DeepEqual(dims, []string{"city", "gender"}) {
+		t.Errorf("GetDimensions = %v, want [city gender]", dims)
+	}
+	if values := ts.GetDimensionValues("city"); !reflect.DeepEqual(values, []string{"beijing", "shanghai"}) {
+		t.Errorf("GetDimensionValues = %v, want [beijing shanghai]", values)
+	}
+	counts := ts.GetDimensionCounts("city")
+	if want := map[string]uint64{"beijing": 3, "shanghai": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("GetDimensionCounts = %v, want %v", counts, want)
+	}
+
+	// Removing the last object of a value drops it from the dimension
+	ts.RemoveTag(4, "city:shanghai")
+	if values := ts.GetDimensionValues("city"); !reflect.DeepEqual(values, []string{"beijing"}) {
+		t.Errorf("GetDimensionValues after removal = %v, want [beijing]", values)
+	}
+	ts.RemoveTag(1, "gender:male")
+	if dims := ts.GetDimensions(); !reflect.DeepEqual(dims, []string{"city"}) {
+		t.Errorf("GetDimensions after removal = %v, want [city]", dims)
+	}
+}
+
+// TestTagSystem_ExclusiveDimensions tests that exclusive values replace each other
+func TestTagSystem_ExclusiveDimensions(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.ExclusiveDimensions = []string{"gender"}
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.AddTag(1, "gender:male")
+	ts.AddTag(1, "city:beijing")
+	ts.AddTag(1, "city:shanghai") // Not exclusive
+	ts.AddTag(1, "gender:female")
+
+	tags, _ := ts.GetObjectTags(1)
+	if len(tags) != 3 || ts.HasTag(1, "gender:male") {
+		t.Errorf("expected gender:male to be replaced, got %v", tags)
+	}
+
+	// The last value of a batch wins
+	ts.BatchAddTags(2, []string{"gender:female", "gender:male"})
+	if ts.HasTag(2, "gender:female") || !ts.HasTag(2, "gender:male") {
+		t.Error("expected the last gender of the batch to win")
+	}
+
+	ts.BatchAddObjectsToTag([]uint32{1, 2, 3}, "gender:other")
+	if counts := ts.GetDimensionCounts("gender"); !reflect.DeepEqual(counts, map[string]uint64{"other": 3}) {
+		t.Errorf("expected every object to switch to other, got %v", counts)
+	}
+}
+
+// TestTagSystem_ExclusiveDimensionsWAL tests that replay re-derives exclusive removals
+func TestTagSystem_ExclusiveDimensionsWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.WALDir = dir
+	config.WALSync = SyncAlways
+	config.ExclusiveDimensions = []string{"gender"}
+
+	ts1, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	ts1.AddTag(1, "gender:male")
+	ts1.AddTag(1, "gender:female")
+	crash(t, ts1)
+
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create second TagSystem: %v", err)
+	}
+	defer ts2.Close()
+
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	if ts2.HasTag(1, "gender:male") || !ts2.HasTag(1, "gender:female") {
+		t.Error("expected only gender:female after replay")
+	}
+}
+
+// TestTagSystem_DimensionQuery tests the dim:* query shorthand
+func TestTagSystem_DimensionQuery(t *testing.T) {
+	ts := newMemoryTagSystem(t)
+
+	ts.AddTag(1, "city:beijing")
+	ts.AddTag(2, "city:shanghai")
+	ts.AddTag(3, "gender:male")
+	ts.AddTag(2, "gender:female")
+
+	tests := []struct {
+		expr string
+		want []uint32
+	}{
+		{"city:*", []uint32{1, 2}},
+		{"city:* AND NOT gender:*", []uint32{1}},
+		{"NOT city:*", []uint32{3}},
+		{"country:*", []uint32{}},
+	}
+	for _, tt := range tests {
+		result, err := ts.QueryExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := result.ToArray(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	result, _ := ts.QueryDimension("gender")
+	if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{2, 3}) {
+		t.Errorf("QueryDimension(gender) = %v, want [2 3]", got)
+	}
+}
+
+// TestTagSystem_DimensionQueryCache tests that new values invalidate cached dimension queries
+func TestTagSystem_DimensionQueryCache(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.CacheResults = true
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.AddTag(1, "city:beijing")
+	if result, _ := ts.QueryDimension("city"); result.GetCardinality() != 1 {
+		t.Fatalf("expected 1 object, got %d", result.GetCardinality())
+	}
+
+	ts.AddTag(2, "city:shanghai")
+	if result, _ := ts.QueryDimension("city"); result.GetCardinality() != 2 {
+		t.Errorf("expected the new value to invalidate the cached result, got %d objects", result.GetCardinality())
+	}
+}
@@ -0,0 +1,223 @@
+package tagbox
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// ErrInvalidCursor is returned for a cursor that was not produced by a
+// Page or an ObjectIterator.
+var ErrInvalidCursor = errors.New("tagbox: invalid cursor")
+
+// cursorVersion starts every encoded cursor.
+const cursorVersion = 1
+
+// Page is one page of a query result in ID order.
+type Page struct {
+	Objects []uint32 // The objects of the page
+	Total   uint64   // Size of the whole result
+	Offset  uint64   // Rank of the first object of the page in the result
+	Next    string   // Cursor of the next page, empty on the last page
+}
+
+// encodeCursor returns the opaque cursor of the position after objectID.
+func encodeCursor(objectID uint32) string {
+	buf := binary.AppendUvarint([]byte{cursorVersion}, uint64(objectID))
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// decodeCursor returns the last object ID before the position of a
+// cursor.
+func decodeCursor(cursor string) (uint32, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) < 2 || buf[0] != cursorVersion {
+		return 0, ErrInvalidCursor
+	}
+
+	id, n := binary.Uvarint(buf[1:])
+	if n != len(buf)-1 || id > math.MaxUint32 {
+		return 0, ErrInvalidCursor
+	}
+	return uint32(id), nil
+}
+
+// PageAfter returns up to limit objects of bitmap following the position
+// of cursor, or from the start when cursor is empty. Cursors hold the last
+// ID of a page rather than an offset, so paging stays correct while
+// objects before the position are added or removed.
+func PageAfter(bitmap *roaring.Bitmap, cursor string, limit int) (Page, error) {
+	if limit <= 0 {
+		return Page{}, fmt.Errorf("tagbox: page limit must be positive, got %d", limit)
+	}
+
+	it := bitmap.Iterator()
+	page := Page{Total: bitmap.GetCardinality()}
+	if cursor != "" {
+		last, err := decodeCursor(cursor)
+		if err != nil {
+			return Page{}, err
+		}
+		page.Offset = bitmap.Rank(last)
+		if last == math.MaxUint32 {
+			return page, nil
+		}
+		it.AdvanceIfNeeded(last + 1)
+	}
+
+	return fillPage(page, it, limit), nil
+}
+
+// PageAt returns up to limit objects of bitmap starting at the object of
+// rank offset, so page n of size k is PageAt(bitmap, n*k, k). The object
+// is found with Select without walking the ones before it.
+func PageAt(bitmap *roaring.Bitmap, offset uint64, limit int) (Page, error) {
+	if limit <= 0 {
+		return Page{}, fmt.Errorf("tagbox: page limit must be positive, got %d", limit)
+	}
+
+	page := Page{Total: bitmap.GetCardinality(), Offset: offset}
+	if offset >= page.Total {
+		return page, nil
+	}
+
+	first, err := bitmap.Select(uint32(offset))
+	if err != nil {
+		return Page{}, err
+	}
+	it := bitmap.Iterator()
+	it.AdvanceIfNeeded(first)
+
+	return fillPage(page, it, limit), nil
+}
+
+// fillPage reads up to limit objects from it into page and sets the cursor
+// of the next page.
+func fillPage(page Page, it roaring.IntPeekable, limit int) Page {
+	n := page.Total - page.Offset
+	if n > uint64(limit) {
+		n = uint64(limit)
+	}
+
+	page.Objects = make([]uint32, 0, n)
+	for len(page.Objects) < limit && it.HasNext() {
+		page.Objects = append(page.Objects, it.Next())
+	}
+	if it.HasNext() {
+		page.Next = encodeCursor(page.Objects[len(page.Objects)-1])
+	}
+	return page
+}
+
+// QueryPage evaluates an expression (see QueryExpr) and returns the page
+// following cursor.
+func (ts *TagSystem) QueryPage(expr, cursor string, limit int) (Page, error) {
+	result, err := ts.QueryExpr(expr)
+	if err != nil {
+		return Page{}, err
+	}
+	return PageAfter(result, cursor, limit)
+}
+
+// QueryPageAt evaluates an expression (see QueryExpr) and returns the page
+// starting at rank offset.
+func (ts *TagSystem) QueryPageAt(expr string, offset uint64, limit int) (Page, error) {
+	result, err := ts.QueryExpr(expr)
+	if err != nil {
+		return Page{}, err
+	}
+	return PageAt(result, offset, limit)
+}
+
+// TagPage returns the objects of tag following cursor. Unlike
+// PageAfter(Query(tag)), it reads the tag in place instead of copying it,
+// so walking many large tags side by side holds a page of each.
+func (ts *TagSystem) TagPage(tag, cursor string, limit int) (Page, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	bitmap, exists := ts.queryBitmapLocked(tag)
+	if !exists {
+		bitmap = roaring.NewBitmap()
+	}
+	return PageAfter(bitmap, cursor, limit)
+}
+
+// ObjectIterator walks a result in ID order without copying it, and can
+// hand out a cursor to resume from, for instance in another request.
+type ObjectIterator struct {
+	it   roaring.IntPeekable
+	last uint32
+	read bool
+}
+
+// Iterate returns an iterator over the objects of bitmap.
+func Iterate(bitmap *roaring.Bitmap) *ObjectIterator {
+	return &ObjectIterator{it: bitmap.Iterator()}
+}
+
+// IterateAfter returns an iterator over the objects of bitmap following
+// the position of cursor, or from the start when cursor is empty.
+func IterateAfter(bitmap *roaring.Bitmap, cursor string) (*ObjectIterator, error) {
+	it := Iterate(bitmap)
+	if cursor == "" {
+		return it, nil
+	}
+
+	last, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	it.last, it.read = last, true
+	if last == math.MaxUint32 {
+		it.it = roaring.NewBitmap().Iterator()
+	} else {
+		it.it.AdvanceIfNeeded(last + 1)
+	}
+	return it, nil
+}
+
+// Next returns the next object, or false at the end.
+func (it *ObjectIterator) Next() (uint32, bool) {
+	if !it.it.HasNext() {
+		return 0, false
+	}
+	it.last, it.read = it.it.Next(), true
+	return it.last, true
+}
+
+// Seek skips the objects below objectID.
+func (it *ObjectIterator) Seek(objectID uint32) {
+	it.it.AdvanceIfNeeded(objectID)
+}
+
+// Cursor returns the cursor of the position after the last object
+// returned, which PageAfter and IterateAfter resume from. It is empty
+// before the first object.
+func (it *ObjectIterator) Cursor() string {
+	if !it.read {
+		return ""
+	}
+	return encodeCursor(it.last)
+}
+
+// Objects returns a function that ranges over the objects of bitmap in ID
+// order without copying them. With Go 1.23 or later it can be used in a
+// range loop:
+//
+//	for objectID := range tagbox.Objects(result) {
+//		...
+//	}
+func Objects(bitmap *roaring.Bitmap) func(yield func(uint32) bool) {
+	return func(yield func(uint32) bool) {
+		for it := bitmap.Iterator(); it.HasNext(); {
+			if !yield(it.Next()) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package tagbox
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// TestPageAfter tests walking a result page by page with cursors
+func TestPageAfter(t *testing.T) {
+	bitmap := roaring.BitmapOf(1, 5, 9, 12, 70000, math.MaxUint32)
+
+	var got [][]uint32
+	var offsets []uint64
+	cursor := ""
+	for {
+		page, err := PageAfter(bitmap, cursor, 4)
+		if err != nil {
+			t.Fatalf("PageAfter(%q): %v", cursor, err)
+		}
+		if page.Total != 6 {
+			t.Errorf("Total = %d, want 6", page.Total)
+		}
+		got = append(got, page.Objects)
+		offsets = append(offsets, page.Offset)
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+
+	want := [][]uint32{{1, 5, 9, 12}, {70000, math.MaxUint32}}
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(offsets, []uint64{0, 4}) {
+		t.Errorf("pages = %v at %v, want %v at [0 4]", got, offsets, want)
+	}
+
+	// A cursor stays valid when its object is removed
+	page, _ := PageAfter(bitmap, encodeCursor(12), 4)
+	bitmap.Remove(12)
+	if again, _ := PageAfter(bitmap, encodeCursor(12), 4); !reflect.DeepEqual(again.Objects, page.Objects) || again.Offset != 3 {
+		t.Errorf("page after a removed object = %+v, want %v", again, page.Objects)
+	}
+
+	if page, err := PageAfter(bitmap, encodeCursor(math.MaxUint32), 4); err != nil || len(page.Objects) != 0 || page.Next != "" {
+		t.Errorf("page after the last ID = %+v, %v", page, err)
+	}
+
+	for _, cursor := range []string{"x", "AQ", encodeCursor(1) + "A", "AoAB"} {
+		if _, err := PageAfter(bitmap, cursor, 4); err != ErrInvalidCursor {
+			t.Errorf("PageAfter(%q) error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+	if _, err := PageAfter(bitmap, "", 0); err == nil {
+		t.Error("a limit of 0 was accepted")
+	}
+}
+
+// TestPageAt tests rank-based pages
+func TestPageAt(t *testing.T) {
+	bitmap := roaring.NewBitmap()
+	bitmap.AddRange(1000, 2000)
+	bitmap.AddRange(100000, 100500)
+
+	tests := []struct {
+		offset uint64
+		want   []uint32
+		next   bool
+	}{
+		{0, []uint32{1000, 1001, 1002}, true},
+		{999, []uint32{1999, 100000, 100001}, true},
+		{1497, []uint32{100497, 100498, 100499}, false},
+		{1499, []uint32{100499}, false},
+		{1500, []uint32{}, false},
+	}
+	for _, tt := range tests {
+		page, err := PageAt(bitmap, tt.offset, 3)
+		if err != nil {
+			t.Fatalf("PageAt(%d): %v", tt.offset, err)
+		}
+		if !reflect.DeepEqual(page.Objects, tt.want) && len(tt.want)+len(page.Objects) > 0 || (page.Next != "") != tt.next {
+			t.Errorf("PageAt(%d) = %v next %q, want %v", tt.offset, page.Objects, page.Next, tt.want)
+		}
+	}
+
+	// The cursor of a rank-based page continues where it ended
+	page, _ := PageAt(bitmap, 999, 3)
+	next, _ := PageAfter(bitmap, page.Next, 1)
+	if !reflect.DeepEqual(next.Objects, []uint32{100002}) || next.Offset != 1002 {
+		t.Errorf("page after PageAt = %+v", next)
+	}
+}
+
+// TestObjectIterator tests iterating, seeking and resuming from a cursor
+func TestObjectIterator(t *testing.T) {
+	bitmap := roaring.BitmapOf(2, 4, 6, 8, 10)
+
+	it := Iterate(bitmap)
+	if it.Cursor() != "" {
+		t.Error("cursor before the first object is not empty")
+	}
+	it.Next()
+	it.Seek(7)
+	if id, ok := it.Next(); !ok || id != 8 {
+		t.Errorf("Next after Seek(7) = %d, %v", id, ok)
+	}
+
+	rest, err := IterateAfter(bitmap, it.Cursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint32
+	for id, ok := rest.Next(); ok; id, ok = rest.Next() {
+		got = append(got, id)
+	}
+	if !reflect.DeepEqual(got, []uint32{10}) {
+		t.Errorf("resumed iteration = %v, want [10]", got)
+	}
+
+	got = got[:0]
+	Objects(bitmap)(func(id uint32) bool {
+		got = append(got, id)
+		return id < 6
+	})
+	if !reflect.DeepEqual(got, []uint32{2, 4, 6}) {
+		t.Errorf("Objects stopped at %v, want [2 4 6]", got)
+	}
+}
+
+// TestTagSystem_QueryPage tests paging through an expression
+func TestTagSystem_QueryPage(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ids := make([]uint32, 500)
+	for i := range ids {
+		ids[i] = uint32(i * 2)
+	}
+	ts.BatchAddObjectsToTag(ids, "even")
+	ts.BatchAddObjectsToTag([]uint32{0, 2, 4}, "excluded")
+
+	page, err := ts.QueryPageAt("even AND NOT excluded", 36*10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 497 || page.Objects[0] != 726 || len(page.Objects) != 10 {
+		t.Errorf("page 37 = %+v", page)
+	}
+
+	page, err = ts.QueryPage("even AND NOT excluded", page.Next, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Objects) != 127 || page.Objects[0] != 746 || page.Next != "" {
+		t.Errorf("last page = %d objects from %d, next %q", len(page.Objects), page.Objects[0], page.Next)
+	}
+
+	if _, err := ts.QueryPage("even AND", "", 10); err == nil {
+		t.Error("bad expression was accepted")
+	}
+
+	page, err = ts.TagPage("even", "", 10)
+	if err != nil || page.Total != 500 || page.Objects[9] != 18 || page.Next == "" {
+		t.Errorf("first page of even = %+v, %v", page, err)
+	}
+	if page, _ := ts.TagPage("missing", "", 10); page.Total != 0 || page.Next != "" {
+		t.Errorf("page of a missing tag = %+v", page)
+	}
+}
@@ -0,0 +1,791 @@
+package tagbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// ErrReadOnly is returned when saving a tag system opened with
+// Config.ReadOnly.
+var ErrReadOnly = errors.New("tag system is read-only")
+
+// FlushStats describes one write of tags to the store.
+type FlushStats struct {
+	Full     bool          // Whether every tag was written, as by Save
+	Saved    int           // Number of tags written
+	Deleted  int           // Number of tags deleted from the store
+	Bytes    uint64        // Serialized size of the written tags
+	Duration time.Duration // Time spent serializing and writing
+	Err      error         // Error returned by the store, if any
+	At       time.Time     // When the flush finished
+
+	// MetaUnsaved is set when the store is not a MetaStore but object
+	// keys, deadlines or attributes are in use. The store cannot keep
+	// them: they are lost on restart, or with Config.WALDir kept only by
+	// the write-ahead log, which then grows without ever being compacted.
+	MetaUnsaved bool
+}
+
+// saveWorker runs in the background and calls flush after each burst of
+// modifications signalled on saveChan, until done is closed.
+func saveWorker(saveChan <-chan struct{}, done <-chan struct{}, flush func()) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Batch save timer: save after no activity for 1 second
+	var lastTrigger time.Time
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		select {
+		case <-saveChan:
+			lastTrigger = time.Now()
+		default:
+			// Save if 1 second has passed since last trigger
+			if !lastTrigger.IsZero() && time.Since(lastTrigger) >= time.Second {
+				flush()
+				lastTrigger = time.Time{}
+			}
+		}
+	}
+}
+
+// persister is the persistence plumbing shared by TagSystem and
+// TagSystem64: the lock, the store, dirty tracking, flushes, the save
+// worker, periodic snapshots and Close. The tag system it persists
+// provides the tags through the persisted interface.
+type persister struct {
+	mu     sync.RWMutex
+	store  Store
+	ctx    context.Context
+	config Config
+
+	owner persisted
+
+	// Tags modified since the last flush; tags the owner no longer has
+	// are deleted from the store by the next flush
+	dirty     map[string]struct{}
+	flushMu   sync.Mutex
+	lastFlush FlushStats
+
+	// Save worker shutdown
+	workerDone chan struct{}
+
+	// Snapshot management
+	snapshotTicker *time.Ticker
+	snapshotDone   chan struct{}
+
+	// Close runs once and keeps its result
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// persisted is implemented by the tag systems a persister saves.
+type persisted interface {
+	// tagNamesLocked returns the names of all tags.
+	tagNamesLocked() []string
+
+	// serializeTagLocked returns the serialization of a tag and whether
+	// it exists.
+	serializeTagLocked(tag string) ([]byte, bool, error)
+
+	// beginFlushLocked prepares what the tag system adds to a flush.
+	beginFlushLocked(full bool) flushPlan
+
+	// stopWorkers stops the background work of the tag system before
+	// the final save of Close.
+	stopWorkers()
+
+	// release frees the resources of the tag system after the final
+	// save of Close.
+	release() error
+
+	Recover() error
+	LoadTag(tag string) error
+	SaveSnapshot(filePath string) error
+}
+
+// flushPlan is what a tag system adds to a flush.
+type flushPlan struct {
+	meta map[string][]byte // Metadata entries written along with the tags
+	errs []error           // Failures met while preparing them
+
+	metaUnsaved bool // Whether there is metadata the store cannot keep
+
+	// done, if set, is called under the write lock when the flush is
+	// over, with the error of the store write and whether the flush
+	// succeeded entirely
+	done func(writeErr error, clean bool) error
+}
+
+// newPersister creates the persistence of owner.
+func newPersister(ctx context.Context, owner persisted, store Store, config Config) *persister {
+	return &persister{
+		store:      store,
+		ctx:        ctx,
+		config:     config,
+		owner:      owner,
+		dirty:      make(map[string]struct{}),
+		workerDone: make(chan struct{}),
+	}
+}
+
+// startSaveWorker starts the background save worker if AutoSave is
+// enabled and the tag system is not read-only.
+func (p *persister) startSaveWorker() {
+	if p.config.AutoSave && !p.config.ReadOnly {
+		go saveWorker(p.config.SaveChan, p.workerDone, func() { p.Flush() })
+	}
+}
+
+// markDirtyLocked marks the tags dirty for the next flush and triggers the
+// save worker.
+// Caller must hold p.mu.Lock().
+func (p *persister) markDirtyLocked(tags ...string) {
+	for _, tag := range tags {
+		p.dirty[tag] = struct{}{}
+	}
+
+	p.triggerSaveLocked()
+}
+
+// triggerSaveLocked wakes the save worker when AutoSave is enabled.
+// Caller must hold p.mu.Lock().
+func (p *persister) triggerSaveLocked() {
+	if p.config.AutoSave {
+		select {
+		case p.config.SaveChan <- struct{}{}:
+		default:
+			// Channel is full, skip save trigger
+		}
+	}
+}
+
+// Store returns the store the tag system persists to.
+func (p *persister) Store() Store {
+	return p.store
+}
+
+// Save saves all tags to the store and deletes the tags removed since the
+// last save.
+func (p *persister) Save() error {
+	_, err := p.flush(true)
+	return err
+}
+
+// Flush writes only the tags modified since the last flush or save to the
+// store, in one batch when the store is a BatchStore, and deletes the tags
+// that became empty. The AutoSave worker calls it after each burst of
+// modifications.
+func (p *persister) Flush() (FlushStats, error) {
+	return p.flush(false)
+}
+
+// LastFlush returns the statistics of the most recent Flush or Save.
+func (p *persister) LastFlush() FlushStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.lastFlush
+}
+
+// flush serializes the dirty tags, or all tags when full is set, under the
+// write lock and writes them to the store after releasing it. Tags whose
+// write fails are marked dirty again.
+func (p *persister) flush(full bool) (FlushStats, error) {
+	if p.config.ReadOnly {
+		return FlushStats{Full: full, Err: ErrReadOnly}, ErrReadOnly
+	}
+
+	// Serialize flushes so an older flush can never overwrite the data
+	// written by a newer one
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+
+	start := time.Now()
+	stats := FlushStats{Full: full}
+
+	p.mu.Lock()
+	pending := p.dirty
+	p.dirty = make(map[string]struct{})
+
+	plan := p.owner.beginFlushLocked(full)
+	errs := plan.errs
+	stats.MetaUnsaved = plan.metaUnsaved
+
+	saves := make(map[string][]byte)
+	var deletes []string
+
+	serialize := func(tag string) {
+		data, exists, err := p.owner.serializeTagLocked(tag)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
+			p.dirty[tag] = struct{}{}
+		case !exists:
+			deletes = append(deletes, tag)
+		default:
+			saves[tag] = data
+			stats.Bytes += uint64(len(data))
+		}
+	}
+
+	if full {
+		for _, tag := range p.owner.tagNamesLocked() {
+			serialize(tag)
+		}
+		for tag := range pending {
+			if _, saved := saves[tag]; !saved {
+				serialize(tag)
+			}
+		}
+	} else {
+		for tag := range pending {
+			serialize(tag)
+		}
+	}
+	p.mu.Unlock()
+
+	err := writeBatch(p.ctx, p.store, saves, deletes, plan.meta)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	p.mu.Lock()
+	if err != nil {
+		// Nothing is known to have been written; retry every tag
+		for tag := range saves {
+			p.dirty[tag] = struct{}{}
+		}
+		for _, tag := range deletes {
+			p.dirty[tag] = struct{}{}
+		}
+	} else {
+		stats.Saved = len(saves)
+		stats.Deleted = len(deletes)
+	}
+
+	if plan.done != nil {
+		if doneErr := plan.done(err, len(errs) == 0); doneErr != nil {
+			errs = append(errs, doneErr)
+		}
+	}
+
+	if len(errs) > 0 {
+		err = fmt.Errorf("save completed with %d errors: %v", len(errs), errs)
+	}
+	stats.Duration = time.Since(start)
+	stats.Err = err
+	stats.At = time.Now()
+	p.lastFlush = stats
+	p.mu.Unlock()
+
+	return stats, err
+}
+
+// SaveTag saves a specific tag to the store immediately.
+func (p *persister) SaveTag(tag string) error {
+	if p.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	data, exists, err := p.owner.serializeTagLocked(tag)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("tag not found: %s", tag)
+	}
+
+	return p.store.SaveTag(p.ctx, tag, data)
+}
+
+// Close closes the tag system, saves all data unless it is read-only and
+// closes the store. Later calls return the result of the first.
+func (p *persister) Close() error {
+	p.closeOnce.Do(func() { p.closeErr = p.close(!p.config.ReadOnly) })
+	return p.closeErr
+}
+
+// abandon closes the tag system without saving anything, as a crash
+// would, and makes later calls to Close do nothing. Tests use it to
+// simulate a crash.
+func (p *persister) abandon() error {
+	p.closeOnce.Do(func() { p.closeErr = p.close(false) })
+	return p.closeErr
+}
+
+// close stops the workers, saves all data if save is set and releases the
+// resources.
+func (p *persister) close(save bool) error {
+	// Stop snapshot ticker if running
+	if p.snapshotTicker != nil {
+		p.snapshotTicker.Stop()
+		close(p.snapshotDone)
+	}
+
+	// Stop the save worker; the full save below covers pending changes
+	close(p.workerDone)
+	p.owner.stopWorkers()
+
+	// Save all data to the store. The log, mappings and store are released
+	// even if it fails, as Close cannot be retried.
+	var saveErr error
+	if save {
+		if err := p.Save(); err != nil {
+			saveErr = fmt.Errorf("save failed: %w", err)
+		}
+	}
+
+	releaseErr := p.owner.release()
+	closeErr := p.store.Close()
+
+	return errors.Join(saveErr, releaseErr, closeErr)
+}
+
+// StartSnapshot enables periodic snapshot to disk.
+func (p *persister) StartSnapshot() {
+	if !p.config.EnableSnapshot || p.config.SnapshotPath == "" {
+		return
+	}
+
+	p.mu.Lock()
+	if p.snapshotTicker != nil {
+		p.mu.Unlock()
+		return // Already started
+	}
+	p.snapshotTicker = time.NewTicker(p.config.SnapshotInterval)
+	p.snapshotDone = make(chan struct{})
+	p.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-p.snapshotTicker.C:
+				if err := p.owner.SaveSnapshot(p.config.SnapshotPath); err != nil {
+					fmt.Printf("snapshot failed: %v\n", err)
+				}
+			case <-p.snapshotDone:
+				return
+			}
+		}
+	}()
+}
+
+// SaveToRedis saves all tags to the store.
+//
+// Deprecated: use Save, which works with any Store.
+func (p *persister) SaveToRedis() error {
+	return p.Save()
+}
+
+// RecoverFromRedis recovers tag data from the store.
+//
+// Deprecated: use Recover, which works with any Store.
+func (p *persister) RecoverFromRedis() error {
+	return p.owner.Recover()
+}
+
+// SaveTagToRedis saves a specific tag to the store immediately.
+//
+// Deprecated: use SaveTag, which works with any Store.
+func (p *persister) SaveTagToRedis(tag string) error {
+	return p.SaveTag(tag)
+}
+
+// LoadTagFromRedis loads a specific tag from the store.
+//
+// Deprecated: use LoadTag, which works with any Store.
+func (p *persister) LoadTagFromRedis(tag string) error {
+	return p.owner.LoadTag(tag)
+}
+
+// tagNamesLocked returns the names of all tags.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) tagNamesLocked() []string {
+	tags := make([]string, 0, len(ts.tags))
+	for tag := range ts.tags {
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// serializeTagLocked returns the serialization of a tag and whether it
+// exists.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) serializeTagLocked(tag string) ([]byte, bool, error) {
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		return nil, false, nil
+	}
+
+	data, err := serializeBitmap(bitmap)
+	return data, true, err
+}
+
+// beginFlushLocked rotates the WAL and collects the dirty metadata. Once
+// the flush succeeded entirely, the store holds every mutation logged
+// before the rotation and the WAL up to it is compacted.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) beginFlushLocked(full bool) flushPlan {
+	var plan flushPlan
+
+	// Everything logged so far is covered by this flush
+	var walSeq uint64
+	if ts.wal != nil {
+		seq, err := ts.wal.rotate()
+		if err != nil {
+			plan.errs = append(plan.errs, err)
+		}
+		walSeq = seq
+	}
+
+	// The metadata is written along with the tags when it changed
+	meta, err := ts.dirtyMetaLocked(full)
+	if err != nil {
+		plan.errs = append(plan.errs, err)
+	}
+	plan.meta = meta
+	plan.metaUnsaved = ts.unsavedMetaLocked()
+
+	plan.done = func(writeErr error, clean bool) error {
+		if writeErr != nil {
+			ts.metaFailedLocked(meta)
+		}
+
+		// The store now holds every logged mutation up to the rotation,
+		// unless it keeps no metadata and the WAL is the only copy of
+		// some
+		if clean && walSeq > 0 && !ts.unsavedMetaLocked() {
+			if err := ts.wal.compact(walSeq); err != nil {
+				return fmt.Errorf("wal compaction failed: %w", err)
+			}
+		}
+		return nil
+	}
+
+	return plan
+}
+
+// dirtyMetaLocked serializes the metadata entries that changed since the
+// last flush, or all non-empty ones when full is set, and clears their
+// dirty marks. It returns nothing when the store keeps no metadata.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) dirtyMetaLocked(full bool) (map[string][]byte, error) {
+	if _, ok := ts.store.(MetaStore); !ok {
+		return nil, nil
+	}
+
+	meta := make(map[string][]byte)
+	var errs []error
+
+	// Only the chunks of the key dictionary that gained keys are written
+	if full {
+		for chunk := uint32(0); chunk < ts.keys.chunks(); chunk++ {
+			ts.keysDirty[chunk] = struct{}{}
+		}
+	}
+	if len(ts.keysDirty) > 0 {
+		meta[keysMetaName] = binary.AppendUvarint(nil, uint64(len(ts.keys.keys)))
+	}
+	for chunk := range ts.keysDirty {
+		meta[keyChunkName(chunk)] = ts.keys.encodeChunk(chunk)
+		delete(ts.keysDirty, chunk)
+	}
+
+	if ts.expiryDirty || full && len(ts.expiry.tags) > 0 {
+		if data, err := ts.expiry.encode(); err != nil {
+			errs = append(errs, fmt.Errorf("expiry: %w", err))
+		} else {
+			meta[expiryMetaName] = data
+			ts.expiryDirty = false
+		}
+	}
+
+	if full {
+		for attr := range ts.attrs {
+			ts.attrsDirty[attr] = struct{}{}
+		}
+	}
+	if len(ts.attrsDirty) > 0 {
+		meta[attrsMetaName] = encodeNames(ts.attrNamesLocked())
+	}
+	for attr := range ts.attrsDirty {
+		index, exists := ts.attrs[attr]
+		if !exists {
+			index = newBSI() // Dropped; the list of names no longer has it
+		}
+		if data, err := index.encode(); err != nil {
+			errs = append(errs, fmt.Errorf("attribute %s: %w", attr, err))
+		} else {
+			meta[attrMetaPrefix+attr] = data
+			delete(ts.attrsDirty, attr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return meta, fmt.Errorf("metadata: %v", errs)
+	}
+	return meta, nil
+}
+
+// unsavedMetaLocked reports whether there are object keys, deadlines or
+// attributes that the store cannot keep, so that the WAL must not be
+// compacted. Flushes report it in FlushStats.MetaUnsaved.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) unsavedMetaLocked() bool {
+	if _, ok := ts.store.(MetaStore); ok {
+		return false
+	}
+
+	return len(ts.keys.keys) > 0 || len(ts.expiry.tags) > 0 || len(ts.attrs) > 0
+}
+
+// metaFailedLocked marks the metadata entries of a failed flush dirty
+// again.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) metaFailedLocked(meta map[string][]byte) {
+	for name := range meta {
+		switch {
+		case strings.HasPrefix(name, keyChunkMetaPrefix):
+			chunk, err := strconv.ParseUint(strings.TrimPrefix(name, keyChunkMetaPrefix), 10, 32)
+			if err == nil {
+				ts.keysDirty[uint32(chunk)] = struct{}{}
+			}
+		case name == expiryMetaName:
+			ts.expiryDirty = true
+		case strings.HasPrefix(name, attrMetaPrefix):
+			ts.attrsDirty[strings.TrimPrefix(name, attrMetaPrefix)] = struct{}{}
+		}
+	}
+}
+
+// serializeBitmap returns the portable serialization of a bitmap.
+func serializeBitmap(bitmap *roaring.Bitmap) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(bitmap.GetSerializedSizeInBytes()))
+	if _, err := bitmap.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Recover recovers tag data from the store.
+// This should be called after creating a new TagSystem to restore existing data.
+func (ts *TagSystem) Recover() error {
+	data, loadErr := ts.store.LoadAll(ts.ctx)
+	if data == nil && loadErr != nil {
+		return loadErr
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var errs []error
+	if loadErr != nil {
+		errs = append(errs, loadErr)
+	}
+
+	for tag, buf := range data {
+		bitmap := roaring.NewBitmap()
+		if _, err := bitmap.ReadFrom(bytes.NewReader(buf)); err != nil {
+			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
+			continue
+		}
+
+		ts.setTagLocked(tag, bitmap)
+		ts.allObjects.Or(bitmap)
+	}
+
+	if err := ts.loadKeysLocked(); err != nil {
+		errs = append(errs, fmt.Errorf("object keys: %w", err))
+	}
+	if err := ts.loadExpiryLocked(); err != nil {
+		errs = append(errs, fmt.Errorf("expiry: %w", err))
+	}
+	if err := ts.loadAttrsLocked(); err != nil {
+		errs = append(errs, fmt.Errorf("attributes: %w", err))
+	}
+	ts.rebuildReverseLocked()
+
+	if ts.cache != nil {
+		ts.cache.purge()
+	}
+
+	// Apply the mutations logged after the last save
+	if ts.wal != nil {
+		if _, err := ts.wal.replay(ts.applyLocked); err != nil {
+			errs = append(errs, fmt.Errorf("wal replay failed: %w", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("recover completed with %d errors: %v", len(errs), errs)
+	}
+
+	return nil
+}
+
+// loadMeta loads a metadata entry from the store. It returns nil data
+// when the store keeps no metadata or has no such entry.
+func (ts *TagSystem) loadMeta(name string) ([]byte, error) {
+	metaStore, ok := ts.store.(MetaStore)
+	if !ok {
+		return nil, nil
+	}
+
+	data, err := metaStore.LoadMeta(ts.ctx, name)
+	if errors.Is(err, ErrMetaNotFound) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+// loadKeysLocked loads the object key dictionary from the store, if the
+// store keeps metadata.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) loadKeysLocked() error {
+	data, err := ts.loadMeta(keysMetaName)
+	if data == nil {
+		return err
+	}
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return fmt.Errorf("key dictionary truncated")
+	}
+
+	// Earlier versions wrote the whole dictionary to a single entry; it is
+	// rewritten in chunks by the next flush
+	if n < len(data) {
+		keys, err := decodeKeyDict(data)
+		if err != nil {
+			return err
+		}
+		ts.keys = keys
+		for chunk := uint32(0); chunk < keys.chunks(); chunk++ {
+			ts.keysDirty[chunk] = struct{}{}
+		}
+		return nil
+	}
+
+	keys := newKeyDict()
+	for chunk := uint32(0); uint64(chunk)*keyChunkSize < count; chunk++ {
+		data, err := ts.loadMeta(keyChunkName(chunk))
+		if err != nil {
+			return fmt.Errorf("key chunk %d: %w", chunk, err)
+		}
+		if data == nil {
+			continue
+		}
+		if err := keys.setChunk(chunk, data); err != nil {
+			return fmt.Errorf("key chunk %d: %w", chunk, err)
+		}
+	}
+
+	// The keys of a missing chunk are lost, but tags may still hold their
+	// IDs, so they are never given to new keys
+	for uint64(len(keys.keys)) < count {
+		keys.keys = append(keys.keys, "")
+	}
+	ts.keys = keys
+
+	return nil
+}
+
+// loadExpiryLocked loads the assignment deadlines from the store, if the
+// store keeps metadata, and starts the reaper when there are any.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) loadExpiryLocked() error {
+	data, err := ts.loadMeta(expiryMetaName)
+	if data == nil {
+		return err
+	}
+
+	deadlines, err := decodeExpiry(data, ts.config.ExpiryResolution)
+	if err != nil {
+		return err
+	}
+	ts.setExpiryLocked(deadlines)
+
+	return nil
+}
+
+// loadAttrsLocked loads the numeric attributes from the store, if the
+// store keeps metadata.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) loadAttrsLocked() error {
+	data, err := ts.loadMeta(attrsMetaName)
+	if data == nil {
+		return err
+	}
+
+	names, err := decodeNames(data)
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range names {
+		data, err := ts.loadMeta(attrMetaPrefix + attr)
+		if err != nil {
+			return fmt.Errorf("attribute %s: %w", attr, err)
+		}
+		if data == nil {
+			continue
+		}
+
+		index, err := decodeBSI(data)
+		if err != nil {
+			return fmt.Errorf("attribute %s: %w", attr, err)
+		}
+		ts.attrs[attr] = index
+		ts.allObjects.Or(index.exists)
+	}
+
+	return nil
+}
+
+// LoadTag loads a specific tag from the store.
+func (ts *TagSystem) LoadTag(tag string) error {
+	data, err := ts.store.LoadTag(ts.ctx, tag)
+	if err != nil {
+		if errors.Is(err, ErrTagNotFound) {
+			return fmt.Errorf("tag not found: %s", tag)
+		}
+		return err
+	}
+
+	bitmap := roaring.NewBitmap()
+	if _, err := bitmap.ReadFrom(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("deserialization failed: %w", err)
+	}
+
+	ts.mu.Lock()
+	ts.setTagLocked(tag, bitmap)
+	ts.allObjects.Or(bitmap)
+	ts.invalidateLocked(true, tag)
+	ts.rebuildReverseLocked()
+	ts.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,393 @@
+package tagbox
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+// plan rewrites a query tree into an equivalent tree that is cheaper to
+// evaluate. It flattens nested operators of the same kind, removes double
+// negation, folds ALL and NONE constants and drops duplicate operands.
+// The input tree is never modified.
+func plan(node Node) Node {
+	switch n := node.(type) {
+	case *andNode:
+		var children []Node
+		for _, child := range flatten(n.children, func(c Node) []Node {
+			if and, ok := c.(*andNode); ok {
+				return and.children
+			}
+			return nil
+		}) {
+			switch child.(type) {
+			case *emptyNode:
+				return Empty()
+			case *allNode:
+				continue // Identity of AND
+			}
+			children = append(children, child)
+		}
+		return And(dedupe(children)...)
+
+	case *orNode:
+		var children []Node
+		for _, child := range flatten(n.children, func(c Node) []Node {
+			if or, ok := c.(*orNode); ok {
+				return or.children
+			}
+			return nil
+		}) {
+			switch child.(type) {
+			case *allNode:
+				return All()
+			case *emptyNode:
+				continue // Identity of OR
+			}
+			children = append(children, child)
+		}
+		return Or(dedupe(children)...)
+
+	case *xorNode:
+		var children []Node
+		for _, child := range flatten(n.children, func(c Node) []Node {
+			if xor, ok := c.(*xorNode); ok {
+				return xor.children
+			}
+			return nil
+		}) {
+			if _, ok := child.(*emptyNode); ok {
+				continue // Identity of XOR
+			}
+			children = append(children, child)
+		}
+		return Xor(children...)
+
+	case *notNode:
+		switch child := plan(n.child).(type) {
+		case *notNode:
+			return child.child
+		case *allNode:
+			return Empty()
+		case *emptyNode:
+			return All()
+		default:
+			return Not(child)
+		}
+
+	default:
+		return node
+	}
+}
+
+// flatten plans every child and splices the children of nested operators
+// of the same kind, as reported by nested, into one list.
+func flatten(children []Node, nested func(Node) []Node) []Node {
+	flat := make([]Node, 0, len(children))
+	for _, child := range children {
+		child = plan(child)
+		if grandchildren := nested(child); grandchildren != nil {
+			flat = append(flat, grandchildren...)
+			continue
+		}
+		flat = append(flat, child)
+	}
+	return flat
+}
+
+// dedupe removes operands that print identically. AND and OR are
+// idempotent, so this never changes their result.
+func dedupe(children []Node) []Node {
+	if len(children) < 2 {
+		return children
+	}
+
+	seen := make(map[string]struct{}, len(children))
+	unique := children[:0:0]
+	for _, child := range children {
+		key := child.String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, child)
+	}
+	return unique
+}
+
+// evalLocked plans and evaluates a query tree while holding read lock,
+// going through the result cache when it is enabled.
+// The returned bitmap is always a new bitmap owned by the caller.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) evalLocked(node Node) (*roaring.Bitmap, error) {
+	planned := plan(node)
+
+	// Single tags and constants are cheaper to copy than to cache
+	cacheable := ts.cache != nil
+	switch planned.(type) {
+	case *tagNode, *allNode, *emptyNode:
+		cacheable = false
+	}
+
+	var key string
+	if cacheable {
+		key = cacheKey(planned)
+		if result, ok := ts.cache.get(key); ok {
+			return result, nil
+		}
+	}
+
+	result, owned, err := ts.execLocked(planned)
+	if err != nil {
+		return nil, err
+	}
+
+	if !owned {
+		result = result.Clone()
+	}
+
+	if cacheable {
+		// Writers are excluded by the read lock, so the result cannot
+		// be stale by the time it is stored.
+		tags, universe := queryDeps(planned)
+		ts.cache.put(key, result, tags, universe)
+	}
+
+	return result, nil
+}
+
+// queryBitmap is a bitmap the query executor works on: *roaring.Bitmap
+// for TagSystem and *roaring64.Bitmap for TagSystem64.
+type queryBitmap[B any] interface {
+	And(B)
+	AndNot(B)
+	Xor(B)
+	IsEmpty() bool
+	GetCardinality() uint64
+}
+
+// bitmapFuncs are the package functions of a bitmap type that the query
+// executor uses.
+type bitmapFuncs[B any] struct {
+	empty   func() B
+	andNot  func(x1, x2 B) B
+	fastAnd func(bitmaps ...B) B
+	fastOr  func(bitmaps ...B) B
+}
+
+var (
+	bitmapFuncs32 = bitmapFuncs[*roaring.Bitmap]{roaring.NewBitmap, roaring.AndNot, roaring.FastAnd, roaring.FastOr}
+	bitmapFuncs64 = bitmapFuncs[*roaring64.Bitmap]{roaring64.New, roaring64.AndNot, roaring64.FastAnd, roaring64.FastOr}
+)
+
+// queryIndex is what a tag system provides to the query executor. Its
+// methods are called with the read lock held.
+type queryIndex[B any] interface {
+	// queryBitmapLocked returns the bitmap a query for tag matches and
+	// whether there is one.
+	queryBitmapLocked(tag string) (B, bool)
+
+	// execDimensionLocked returns the union of the tags of a dimension
+	// and whether it is a new bitmap.
+	execDimensionLocked(dimension string) (B, bool, error)
+
+	// execAttrLocked returns a new bitmap of the objects matching an
+	// attribute comparison.
+	execAttrLocked(n *attrNode) (B, error)
+
+	// universeLocked returns the bitmap of all known objects.
+	universeLocked() B
+}
+
+// executor evaluates planned query trees against a tag system of either
+// ID width.
+type executor[B queryBitmap[B]] struct {
+	funcs bitmapFuncs[B]
+	index queryIndex[B]
+}
+
+// execLocked evaluates a planned query tree.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) execLocked(node Node) (result *roaring.Bitmap, owned bool, err error) {
+	return executor[*roaring.Bitmap]{bitmapFuncs32, ts}.exec(node)
+}
+
+// universeLocked returns the bitmap of all known objects.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem) universeLocked() *roaring.Bitmap {
+	return ts.allObjects
+}
+
+// exec evaluates a planned query tree. Tag bitmaps and the universe are
+// returned as they are, without copying, and owned is false; such results
+// must be cloned before they are modified or handed out.
+func (e executor[B]) exec(node Node) (result B, owned bool, err error) {
+	switch n := node.(type) {
+	case *tagNode:
+		bitmap, exists := e.index.queryBitmapLocked(n.name)
+		if !exists {
+			return e.funcs.empty(), true, nil
+		}
+		return bitmap, false, nil
+
+	case *dimensionNode:
+		return e.index.execDimensionLocked(n.name)
+
+	case *attrNode:
+		result, err := e.index.execAttrLocked(n)
+		return result, true, err
+
+	case *allNode:
+		return e.index.universeLocked(), false, nil
+
+	case *emptyNode:
+		return e.funcs.empty(), true, nil
+
+	case *andNode:
+		return e.execAnd(n.children)
+
+	case *orNode:
+		return e.execOr(n.children)
+
+	case *xorNode:
+		return e.execXor(n.children)
+
+	case *notNode:
+		// A NOT outside of an AND has nothing to subtract from but the
+		// universe of known objects.
+		excluded, _, err := e.exec(n.child)
+		if err != nil {
+			return result, false, err
+		}
+		return e.funcs.andNot(e.index.universeLocked(), excluded), true, nil
+
+	default:
+		return result, false, fmt.Errorf("unsupported query node: %T", node)
+	}
+}
+
+// andOperand is an evaluated AND operand with its cardinality.
+type andOperand[B any] struct {
+	bitmap      B
+	owned       bool
+	cardinality uint64
+}
+
+// execAnd intersects the children of an AND node.
+//
+// Negated children are applied with AndNot to the intersection of the
+// other children, so `A AND NOT B` never materializes the complement of B.
+// Plain tags are looked up before any nested operator is evaluated, and
+// operands are intersected from the smallest to the largest, stopping as
+// soon as the intermediate result is empty.
+func (e executor[B]) execAnd(children []Node) (B, bool, error) {
+	var tags, nested, negated []Node
+	for _, child := range children {
+		switch c := child.(type) {
+		case *tagNode:
+			tags = append(tags, c)
+		case *notNode:
+			negated = append(negated, c.child)
+		default:
+			nested = append(nested, c)
+		}
+	}
+
+	operands := make([]andOperand[B], 0, len(tags)+len(nested))
+	for _, group := range [][]Node{tags, nested} {
+		for _, child := range group {
+			bitmap, owned, err := e.exec(child)
+			if err != nil {
+				return bitmap, false, err
+			}
+			if bitmap.IsEmpty() {
+				return e.funcs.empty(), true, nil
+			}
+			operands = append(operands, andOperand[B]{
+				bitmap:      bitmap,
+				owned:       owned,
+				cardinality: bitmap.GetCardinality(),
+			})
+		}
+	}
+
+	if len(operands) == 0 {
+		// Only negated operands: subtract them from all known objects
+		operands = append(operands, andOperand[B]{bitmap: e.index.universeLocked()})
+	}
+
+	sort.Slice(operands, func(i, j int) bool {
+		return operands[i].cardinality < operands[j].cardinality
+	})
+
+	result, owned := operands[0].bitmap, operands[0].owned
+	if len(operands) > 1 {
+		result, owned = e.funcs.fastAnd(operands[0].bitmap, operands[1].bitmap), true
+		for _, operand := range operands[2:] {
+			if result.IsEmpty() {
+				return result, true, nil
+			}
+			result.And(operand.bitmap)
+		}
+	}
+
+	for _, child := range negated {
+		if result.IsEmpty() {
+			break
+		}
+		excluded, _, err := e.exec(child)
+		if err != nil {
+			return excluded, false, err
+		}
+		if !owned {
+			result, owned = e.funcs.andNot(result, excluded), true
+			continue
+		}
+		result.AndNot(excluded)
+	}
+
+	return result, owned, nil
+}
+
+// execOr unions the children of an OR node with FastOr.
+func (e executor[B]) execOr(children []Node) (B, bool, error) {
+	bitmaps := make([]B, 0, len(children))
+	lastOwned := true
+	for _, child := range children {
+		bitmap, owned, err := e.exec(child)
+		if err != nil {
+			return bitmap, false, err
+		}
+		if !bitmap.IsEmpty() {
+			bitmaps = append(bitmaps, bitmap)
+			lastOwned = owned
+		}
+	}
+
+	switch len(bitmaps) {
+	case 0:
+		return e.funcs.empty(), true, nil
+	case 1:
+		// Every other operand is empty, so the union is this one
+		return bitmaps[0], lastOwned, nil
+	}
+
+	return e.funcs.fastOr(bitmaps...), true, nil
+}
+
+// execXor computes the symmetric difference of the children of an XOR
+// node.
+func (e executor[B]) execXor(children []Node) (B, bool, error) {
+	result := e.funcs.empty()
+	for _, child := range children {
+		bitmap, _, err := e.exec(child)
+		if err != nil {
+			return bitmap, false, err
+		}
+		result.Xor(bitmap)
+	}
+
+	return result, true, nil
+}
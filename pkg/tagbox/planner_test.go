@@ -0,0 +1,150 @@
+package tagbox
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// TestPlan tests the rewrites applied by the query planner
+func TestPlan(t *testing.T) {
+	tests := []struct {
+		node Node
+		want string
+	}{
+		{And(Tag("a"), And(Tag("b"), Tag("c"))), "a AND b AND c"},
+		{Or(Or(Tag("a"), Tag("b")), Tag("a")), "a OR b"},
+		{Not(Not(Tag("a"))), "a"},
+		{And(Tag("a"), All()), "a"},
+		{And(Tag("a"), Empty()), "NONE"},
+		{Or(Tag("a"), All()), "ALL"},
+		{Xor(Tag("a"), Empty(), Xor(Tag("b"), Tag("c"))), "a XOR b XOR c"},
+		{Not(All()), "NONE"},
+		{And(Tag("a"), Not(Not(Tag("b")))), "a AND b"},
+	}
+
+	for _, tt := range tests {
+		if got := plan(tt.node).String(); got != tt.want {
+			t.Errorf("plan(%s) = %s, want %s", tt.node, got, tt.want)
+		}
+	}
+}
+
+// naiveEval evaluates a query tree without the planner
+func naiveEval(ts *TagSystem, node Node) *roaring.Bitmap {
+	switch n := node.(type) {
+	case *tagNode:
+		if bitmap, ok := ts.tags[n.name]; ok {
+			return bitmap.Clone()
+		}
+		return roaring.NewBitmap()
+	case *andNode:
+		result := naiveEval(ts, n.children[0])
+		for _, child := range n.children[1:] {
+			result.And(naiveEval(ts, child))
+		}
+		return result
+	case *orNode:
+		result := roaring.NewBitmap()
+		for _, child := range n.children {
+			result.Or(naiveEval(ts, child))
+		}
+		return result
+	case *xorNode:
+		result := roaring.NewBitmap()
+		for _, child := range n.children {
+			result.Xor(naiveEval(ts, child))
+		}
+		return result
+	case *notNode:
+		result := ts.allObjects.Clone()
+		result.AndNot(naiveEval(ts, n.child))
+		return result
+	case *allNode:
+		return ts.allObjects.Clone()
+	default:
+		return roaring.NewBitmap()
+	}
+}
+
+// randomNode builds a random query tree over the given tags
+func randomNode(r *rand.Rand, tags []string, depth int) Node {
+	if depth == 0 || r.Intn(4) == 0 {
+		return Tag(tags[r.Intn(len(tags))])
+	}
+
+	children := make([]Node, 2+r.Intn(3))
+	for i := range children {
+		children[i] = randomNode(r, tags, depth-1)
+	}
+
+	switch r.Intn(5) {
+	case 0:
+		return Or(children...)
+	case 1:
+		return Xor(children...)
+	case 2:
+		return Not(children[0])
+	default:
+		return And(children...)
+	}
+}
+
+// TestTagSystem_PlannerMatchesNaive checks planned evaluation against a naive evaluator
+func TestTagSystem_PlannerMatchesNaive(t *testing.T) {
+	ts := newTestTagSystem(t)
+
+	r := rand.New(rand.NewSource(1))
+	tags := []string{"a", "b", "c", "d", "empty_soon", "missing"}
+	for i := 0; i < 2000; i++ {
+		for _, tag := range tags[:4] {
+			if r.Intn(3) == 0 {
+				ts.AddTag(uint32(r.Intn(5000)), tag)
+			}
+		}
+	}
+	ts.AddTag(1, "empty_soon")
+	ts.RemoveTag(1, "empty_soon")
+
+	for i := 0; i < 500; i++ {
+		node := randomNode(r, tags, 4)
+
+		got, err := ts.Eval(node)
+		if err != nil {
+			t.Fatalf("Eval(%s) failed: %v", node, err)
+		}
+
+		want := naiveEval(ts, node)
+		if !got.Equals(want) {
+			t.Fatalf("Eval(%s): got %d objects, want %d", node, got.GetCardinality(), want.GetCardinality())
+		}
+	}
+
+	// Results must never alias the stored tag bitmaps
+	result, _ := ts.Eval(And(Tag("a"), All()))
+	result.Add(1 << 30)
+	if ts.HasTag(1<<30, "a") {
+		t.Error("modifying a query result changed the tag")
+	}
+}
+
+// BenchmarkTagSystem_QueryAndNot benchmarks `A AND NOT B` on a large universe
+func BenchmarkTagSystem_QueryAndNot(b *testing.B) {
+	ts := newTestTagSystem(b)
+
+	all := make([]uint32, 0, 1000000)
+	for i := 0; i < 1000000; i++ {
+		all = append(all, uint32(i))
+	}
+	ts.BatchAddObjectsToTag(all, "registered")
+	ts.BatchAddObjectsToTag(all[:1000], "vip")
+	ts.BatchAddObjectsToTag(all[500:600000], "churned")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ts.QueryExpr("vip AND NOT churned"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -6,18 +6,46 @@ import (
 	"github.com/RoaringBitmap/roaring"
 )
 
+// Query operation types for QueryOp.Type.
+const (
+	OpAnd = "AND"
+	OpOr  = "OR"
+	OpNot = "NOT"
+)
+
 // QueryOp represents a query operation type.
 type QueryOp struct {
-	Type string // "AND", "OR", "NOT"
+	Type string // OpAnd, OpOr or OpNot
 	Tags []string
 }
 
+// Node converts the operation into a query tree.
+// A NOT operation matches the objects that have none of its tags.
+func (op QueryOp) Node() (Node, error) {
+	switch op.Type {
+	case OpAnd:
+		if len(op.Tags) == 0 {
+			return Empty(), nil
+		}
+		return And(Tags(op.Tags...)...), nil
+	case OpOr:
+		return Or(Tags(op.Tags...)...), nil
+	case OpNot:
+		if len(op.Tags) == 0 {
+			return nil, fmt.Errorf("NOT operation requires at least one tag")
+		}
+		return Not(Or(Tags(op.Tags...)...)), nil
+	default:
+		return nil, fmt.Errorf("unknown operation: %s", op.Type)
+	}
+}
+
 // Query returns objects that have a specific tag.
 func (ts *TagSystem) Query(tag string) (*roaring.Bitmap, error) {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
 
-	bitmap, exists := ts.tags[tag]
+	bitmap, exists := ts.queryBitmapLocked(tag)
 	if !exists {
 		return roaring.NewBitmap(), nil
 	}
@@ -26,49 +54,18 @@ func (ts *TagSystem) Query(tag string) (*roaring.Bitmap, error) {
 }
 
 // QueryAnd returns objects that have ALL the specified tags (intersection).
+// Tags are intersected from the smallest to the largest.
 func (ts *TagSystem) QueryAnd(tags []string) (*roaring.Bitmap, error) {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
-
 	if len(tags) == 0 {
 		return roaring.NewBitmap(), nil
 	}
 
-	// Get first tag's bitmap
-	firstBitmap, exists := ts.tags[tags[0]]
-	if !exists {
-		return roaring.NewBitmap(), nil
-	}
-
-	result := firstBitmap.Clone()
-
-	// Intersect with other tags
-	for _, tag := range tags[1:] {
-		bitmap, exists := ts.tags[tag]
-		if !exists {
-			return roaring.NewBitmap(), nil // Tag doesn't exist, empty result
-		}
-		result.And(bitmap)
-	}
-
-	return result, nil
+	return ts.Eval(And(Tags(tags...)...))
 }
 
 // QueryOr returns objects that have ANY of the specified tags (union).
 func (ts *TagSystem) QueryOr(tags []string) (*roaring.Bitmap, error) {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
-
-	result := roaring.NewBitmap()
-
-	for _, tag := range tags {
-		bitmap, exists := ts.tags[tag]
-		if exists {
-			result.Or(bitmap)
-		}
-	}
-
-	return result, nil
+	return ts.Eval(Or(Tags(tags...)...))
 }
 
 // QueryNot returns objects that do NOT have the specified tag.
@@ -77,7 +74,7 @@ func (ts *TagSystem) QueryNot(tag string, allObjects *roaring.Bitmap) (*roaring.
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
 
-	bitmap, exists := ts.tags[tag]
+	bitmap, exists := ts.queryBitmapLocked(tag)
 	if !exists {
 		return allObjects.Clone(), nil
 	}
@@ -91,164 +88,79 @@ func (ts *TagSystem) QueryNot(tag string, allObjects *roaring.Bitmap) (*roaring.
 // QueryNotInSystem returns objects that do NOT have the specified tag,
 // using the system's allObjects as the universe.
 func (ts *TagSystem) QueryNotInSystem(tag string) (*roaring.Bitmap, error) {
-	ts.mu.RLock()
-	allObjectsClone := ts.allObjects.Clone()
-	ts.mu.RUnlock()
-
-	return ts.QueryNot(tag, allObjectsClone)
+	return ts.Eval(Not(Tag(tag)))
 }
 
 // ComplexQuery executes a complex query with multiple operations.
 // Example:
 //   [
 //     {Type: "AND", Tags: ["male", "vip"]},
-//     {Type: "OR", Tags: ["new_user", "referred"]}
+//     {Type: "NOT", Tags: ["churned"]}
 //   ]
-// This returns objects that are (male AND vip) OR (new_user OR referred).
+// This returns objects that are (male AND vip) AND NOT churned.
+// Operations are implicitly ANDed together.
+//
+// Deprecated: build the query with And, Or and Not and run it with Eval,
+// which can also express ORs between groups.
 func (ts *TagSystem) ComplexQuery(ops []QueryOp) (*roaring.Bitmap, error) {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
-
 	if len(ops) == 0 {
 		return roaring.NewBitmap(), nil
 	}
 
-	var result *roaring.Bitmap
-
+	nodes := make([]Node, len(ops))
 	for i, op := range ops {
-		var partial *roaring.Bitmap
-		var err error
-
-		switch op.Type {
-		case "AND":
-			partial, err = ts.queryAndLocked(op.Tags)
-		case "OR":
-			partial, err = ts.queryOrLocked(op.Tags)
-		case "NOT":
-			if len(op.Tags) != 1 {
-				return nil, fmt.Errorf("NOT operation requires exactly one tag")
-			}
-			partial = ts.queryNotLocked(op.Tags[0])
-		default:
-			return nil, fmt.Errorf("unknown operation: %s", op.Type)
-		}
-
+		node, err := op.Node()
 		if err != nil {
 			return nil, err
 		}
-
-		if i == 0 {
-			result = partial
-		} else {
-			// Combine results with AND by default
-			// (operations are implicitly ANDed together)
-			result.And(partial)
-		}
-	}
-
-	return result, nil
-}
-
-// queryAndLocked performs AND query while holding read lock.
-// Caller must hold ts.mu.RLock().
-func (ts *TagSystem) queryAndLocked(tags []string) (*roaring.Bitmap, error) {
-	if len(tags) == 0 {
-		return roaring.NewBitmap(), nil
-	}
-
-	firstBitmap, exists := ts.tags[tags[0]]
-	if !exists {
-		return roaring.NewBitmap(), nil
-	}
-
-	result := firstBitmap.Clone()
-
-	for _, tag := range tags[1:] {
-		bitmap, exists := ts.tags[tag]
-		if !exists {
-			return roaring.NewBitmap(), nil
-		}
-		result.And(bitmap)
+		nodes[i] = node
 	}
 
-	return result, nil
+	return ts.Eval(And(nodes...))
 }
 
-// queryOrLocked performs OR query while holding read lock.
-// Caller must hold ts.mu.RLock().
-func (ts *TagSystem) queryOrLocked(tags []string) (*roaring.Bitmap, error) {
-	result := roaring.NewBitmap()
-
-	for _, tag := range tags {
-		bitmap, exists := ts.tags[tag]
-		if exists {
-			result.Or(bitmap)
-		}
+// QueryExpr parses a boolean query expression (see ParseQuery) and
+// evaluates it against the current tags.
+// Example: `(vip AND male) OR (new_user AND NOT churned)`.
+func (ts *TagSystem) QueryExpr(expr string) (*roaring.Bitmap, error) {
+	node, err := ParseQuery(expr)
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nil
+	return ts.Eval(node)
 }
 
-// queryNotLocked performs NOT query while holding read lock.
-// Caller must hold ts.mu.RLock().
-func (ts *TagSystem) queryNotLocked(tag string) *roaring.Bitmap {
-	bitmap, exists := ts.tags[tag]
-	if !exists {
-		return ts.allObjects.Clone()
+// Eval evaluates a query tree against the current tags under a single
+// read lock. Example:
+//   ts.Eval(tagbox.Or(
+//       tagbox.And(tagbox.Tag("vip"), tagbox.Tag("male")),
+//       tagbox.And(tagbox.Tag("new_user"), tagbox.Not(tagbox.Tag("churned"))),
+//   ))
+func (ts *TagSystem) Eval(node Node) (*roaring.Bitmap, error) {
+	if node == nil {
+		return nil, fmt.Errorf("query node is nil")
 	}
 
-	result := ts.allObjects.Clone()
-	result.AndNot(bitmap)
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
 
-	return result
+	return ts.evalLocked(node)
 }
 
 // QueryDifference returns objects that are in tag1 but not in tag2.
 func (ts *TagSystem) QueryDifference(tag1, tag2 string) (*roaring.Bitmap, error) {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
-
-	bitmap1, exists1 := ts.tags[tag1]
-	if !exists1 {
-		return roaring.NewBitmap(), nil
-	}
-
-	bitmap2, exists2 := ts.tags[tag2]
-	if !exists2 {
-		return bitmap1.Clone(), nil
-	}
-
-	result := bitmap1.Clone()
-	result.AndNot(bitmap2)
-
-	return result, nil
+	return ts.Eval(And(Tag(tag1), Not(Tag(tag2))))
 }
 
 // QueryXor returns objects that are in exactly one of the tags (exclusive or).
 func (ts *TagSystem) QueryXor(tag1, tag2 string) (*roaring.Bitmap, error) {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
-
-	bitmap1, exists1 := ts.tags[tag1]
-	bitmap2, exists2 := ts.tags[tag2]
-
-	if !exists1 && !exists2 {
-		return roaring.NewBitmap(), nil
-	}
-	if !exists1 {
-		return bitmap2.Clone(), nil
-	}
-	if !exists2 {
-		return bitmap1.Clone(), nil
-	}
-
-	result := bitmap1.Clone()
-	result.Xor(bitmap2)
-
-	return result, nil
+	return ts.Eval(Xor(Tag(tag1), Tag(tag2)))
 }
 
-// GetObjectIDs returns the object IDs from a bitmap as a slice.
+// GetObjectIDs returns the object IDs from a bitmap as a slice. It copies
+// the whole result; page through large results with PageAfter or PageAt,
+// or walk them with Objects.
 func GetObjectIDs(bitmap *roaring.Bitmap) []uint32 {
 	return bitmap.ToArray()
 }
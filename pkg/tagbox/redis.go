@@ -1,104 +1,338 @@
 package tagbox
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"time"
+	"sort"
+	"strings"
 
-	"github.com/RoaringBitmap/roaring"
 	"github.com/redis/go-redis/v9"
 )
 
-// saveWorker runs in the background to save tags to Redis when triggered.
-func (ts *TagSystem) saveWorker() {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-
-	// Batch save timer: save after no activity for 1 second
-	var lastTrigger time.Time
-
-	for range ticker.C {
-		select {
-		case <-ts.config.SaveChan:
-			lastTrigger = time.Now()
-		default:
-			// Save if 1 second has passed since last trigger
-			if !lastTrigger.IsZero() && time.Since(lastTrigger) >= time.Second {
-				ts.SaveToRedis()
-				lastTrigger = time.Time{}
-			}
+// redisMetaKey is the key suffix reserved for metadata; it and the keys
+// under redisMetaKey+":" are never tags.
+const redisMetaKey = "_meta"
+
+// redisKeyFormatName is the metadata entry that records the key layout of
+// a store, and redisKeyFormat is the current layout. Stores without the
+// entry were written by versions that kept every tag unescaped under
+// prefix+tag and had no metadata keys.
+const (
+	redisKeyFormatName = "keyformat"
+	redisKeyFormat     = "2"
+)
+
+// ErrKeyFormat is returned by OpenRedisStore for a store whose key layout
+// this version does not know.
+var ErrKeyFormat = errors.New("unknown Redis key format")
+
+// RedisStore is a Store that keeps each tag in a Redis string key made of
+// a prefix and the tag name.
+//
+// Tag names made of underscores followed by "meta", such as "_meta:x",
+// are stored with one more leading underscore, so no tag can collide with
+// the metadata keys. OpenRedisStore moves the tags of stores written by
+// earlier versions, which did not escape them, to their escaped keys.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+	legacy bool // Read-only view of a store in the unescaped layout
+}
+
+// NewRedisStore creates a store on an existing client. Tags are saved
+// under keyPrefix+tag. It assumes the current key layout; use
+// OpenRedisStore for a store that earlier versions may have written.
+func NewRedisStore(client *redis.Client, keyPrefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: keyPrefix}
+}
+
+// OpenRedisStore creates a store on an existing client like NewRedisStore
+// and upgrades a store written by earlier versions to the current key
+// layout. With readOnly set nothing is written; such a store is read in
+// its old layout, and writing to it fails with ErrReadOnly.
+func OpenRedisStore(ctx context.Context, client *redis.Client, keyPrefix string, readOnly bool) (*RedisStore, error) {
+	s := NewRedisStore(client, keyPrefix)
+
+	format, err := s.LoadMeta(ctx, redisKeyFormatName)
+	switch {
+	case err == nil && string(format) == redisKeyFormat:
+		return s, nil
+	case err == nil:
+		return nil, fmt.Errorf("%w: %q", ErrKeyFormat, format)
+	case !errors.Is(err, ErrMetaNotFound):
+		return nil, err
+	}
+
+	if readOnly {
+		keys, err := s.scanKeys(ctx)
+		if err != nil {
+			return nil, err
 		}
+		s.legacy = len(keys) > 0
+		return s, nil
+	}
+
+	if err := s.upgrade(ctx); err != nil {
+		return nil, fmt.Errorf("upgrade redis keys: %w", err)
 	}
+
+	return s, nil
 }
 
-// SaveToRedis saves all tags to Redis.
-func (ts *TagSystem) SaveToRedis() error {
-	ts.mu.RLock()
-	defer ts.mu.RUnlock()
+// DialRedisStore connects to the Redis server described by config and
+// checks that it is reachable.
+func DialRedisStore(ctx context.Context, config Config) (*RedisStore, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     config.RedisAddr,
+		Password: config.RedisPassword,
+		DB:       config.RedisDB,
+	})
 
-	var errs []error
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("redis connection failed: %w", err)
+	}
+
+	store, err := OpenRedisStore(ctx, rdb, config.KeyPrefix, config.ReadOnly)
+	if err != nil {
+		rdb.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
 
-	for tag, bitmap := range ts.tags {
-		if err := ts.saveTagToRedis(tag, bitmap); err != nil {
+// Client returns the underlying Redis client.
+func (s *RedisStore) Client() *redis.Client {
+	return s.client
+}
+
+// LoadAll reads every tag key under the prefix.
+func (s *RedisStore) LoadAll(ctx context.Context) (map[string][]byte, error) {
+	names, err := s.ListTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string][]byte, len(names))
+	var errs []error
+	for _, tag := range names {
+		data, err := s.LoadTag(ctx, tag)
+		if err != nil {
+			if errors.Is(err, ErrTagNotFound) {
+				continue // Deleted since the scan, skip
+			}
 			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
+			continue
 		}
+		tags[tag] = data
 	}
 
 	if len(errs) > 0 {
-		return fmt.Errorf("save completed with %d errors: %v", len(errs), errs)
+		return tags, fmt.Errorf("load completed with %d errors: %v", len(errs), errs)
 	}
 
-	return nil
+	return tags, nil
 }
 
-// saveTagToRedis saves a single tag to Redis.
-func (ts *TagSystem) saveTagToRedis(tag string, bitmap *roaring.Bitmap) error {
-	// Serialize bitmap to bytes
-	var buf bytes.Buffer
-	_, err := bitmap.WriteTo(&buf)
-	if err != nil {
-		return err
+// LoadTag reads a single tag key.
+func (s *RedisStore) LoadTag(ctx context.Context, tag string) ([]byte, error) {
+	data, err := s.client.Get(ctx, s.tagKey(tag)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrTagNotFound
 	}
 
-	// Save to Redis
-	key := ts.config.KeyPrefix + tag
-	return ts.redis.Set(ts.ctx, key, buf.Bytes(), 0).Err()
+	return data, err
 }
 
-// SaveTagToRedis saves a specific tag to Redis immediately.
-func (ts *TagSystem) SaveTagToRedis(tag string) error {
-	ts.mu.RLock()
-	bitmap, exists := ts.tags[tag]
-	ts.mu.RUnlock()
+// SaveTag sets a tag key.
+func (s *RedisStore) SaveTag(ctx context.Context, tag string, data []byte) error {
+	if s.legacy {
+		return ErrReadOnly
+	}
 
-	if !exists {
-		return fmt.Errorf("tag not found: %s", tag)
+	return s.client.Set(ctx, s.tagKey(tag), data, 0).Err()
+}
+
+// DeleteTag deletes a tag key.
+func (s *RedisStore) DeleteTag(ctx context.Context, tag string) error {
+	if s.legacy {
+		return ErrReadOnly
 	}
 
-	return ts.saveTagToRedis(tag, bitmap)
+	return s.client.Del(ctx, s.tagKey(tag)).Err()
+}
+
+// WriteBatch applies saves and deletes in a single MULTI/EXEC pipeline, so
+// other clients see either none or all of a flush.
+func (s *RedisStore) WriteBatch(ctx context.Context, saves map[string][]byte, deletes []string) error {
+	return s.WriteBatchWithMeta(ctx, saves, deletes, nil)
 }
 
-// LoadTagFromRedis loads a specific tag from Redis.
-func (ts *TagSystem) LoadTagFromRedis(tag string) error {
-	key := ts.config.KeyPrefix + tag
+// WriteBatchWithMeta is WriteBatch that also sets the metadata keys in
+// meta in the same pipeline.
+func (s *RedisStore) WriteBatchWithMeta(ctx context.Context, saves map[string][]byte, deletes []string, meta map[string][]byte) error {
+	if len(saves) == 0 && len(deletes) == 0 && len(meta) == 0 {
+		return nil
+	}
+	if s.legacy {
+		return ErrReadOnly
+	}
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for tag, data := range saves {
+			pipe.Set(ctx, s.tagKey(tag), data, 0)
+		}
+		if len(deletes) > 0 {
+			keys := make([]string, 0, len(deletes))
+			for _, tag := range deletes {
+				keys = append(keys, s.tagKey(tag))
+			}
+			pipe.Del(ctx, keys...)
+		}
+		for name, data := range meta {
+			pipe.Set(ctx, s.metaKey(name), data, 0)
+		}
+		return nil
+	})
+
+	return err
+}
 
-	data, err := ts.redis.Get(ts.ctx, key).Bytes()
+// ListTags scans the keys under the prefix.
+func (s *RedisStore) ListTags(ctx context.Context) ([]string, error) {
+	keys, err := s.scanKeys(ctx)
 	if err != nil {
-		if err == redis.Nil {
-			return fmt.Errorf("tag not found: %s", tag)
+		return nil, err
+	}
+
+	var tags []string
+	for _, key := range keys {
+		tag, ok := s.keyTag(key)
+		if !ok {
+			continue // Skip metadata keys
 		}
+		tags = append(tags, tag)
+	}
+
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// scanKeys returns every key under the prefix once.
+func (s *RedisStore) scanKeys(ctx context.Context) ([]string, error) {
+	iter := s.client.Scan(ctx, 0, s.prefix+"*", 0).Iterator()
+
+	var keys []string
+	seen := make(map[string]struct{})
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if _, dup := seen[key]; dup {
+			continue // SCAN may return a key more than once
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("redis scan failed: %w", err)
+	}
+
+	return keys, nil
+}
+
+// upgrade moves the tags of a store in the unescaped layout to their
+// escaped keys and records the current layout, all in one MULTI/EXEC.
+func (s *RedisStore) upgrade(ctx context.Context) error {
+	keys, err := s.scanKeys(ctx)
+	if err != nil {
 		return err
 	}
 
-	bitmap := roaring.NewBitmap()
-	if _, err := bitmap.ReadFrom(bytes.NewReader(data)); err != nil {
-		return fmt.Errorf("deserialization failed: %w", err)
+	// Every key holds the tag it is named after. Escaping a tag adds an
+	// underscore, which may name the key of another tag that moves, so
+	// the longest keys move first.
+	var moves []string
+	for _, key := range keys {
+		if redisEscaped(key[len(s.prefix):]) {
+			moves = append(moves, key)
+		}
 	}
+	sort.Slice(moves, func(i, j int) bool { return len(moves[i]) > len(moves[j]) })
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range moves {
+			pipe.Rename(ctx, key, s.tagKey(key[len(s.prefix):]))
+		}
+		pipe.Set(ctx, s.metaKey(redisKeyFormatName), redisKeyFormat, 0)
+		return nil
+	})
+
+	return err
+}
 
-	ts.mu.Lock()
-	ts.tags[tag] = bitmap
-	ts.allObjects.Or(bitmap)
-	ts.mu.Unlock()
+// LoadMeta reads a metadata key.
+func (s *RedisStore) LoadMeta(ctx context.Context, name string) ([]byte, error) {
+	if s.legacy {
+		return nil, ErrMetaNotFound // The old layout has no metadata
+	}
+
+	data, err := s.client.Get(ctx, s.metaKey(name)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrMetaNotFound
+	}
+
+	return data, err
+}
+
+// SaveMeta sets a metadata key.
+func (s *RedisStore) SaveMeta(ctx context.Context, name string, data []byte) error {
+	if s.legacy {
+		return ErrReadOnly
+	}
+
+	return s.client.Set(ctx, s.metaKey(name), data, 0).Err()
+}
+
+// tagKey returns the Redis key of a tag.
+func (s *RedisStore) tagKey(tag string) string {
+	if redisEscaped(tag) && !s.legacy {
+		return s.prefix + "_" + tag
+	}
+
+	return s.prefix + tag
+}
+
+// keyTag returns the tag of a Redis key under the prefix, or false for a
+// metadata key.
+func (s *RedisStore) keyTag(key string) (string, bool) {
+	tag := key[len(s.prefix):]
+	switch {
+	case s.legacy:
+		return tag, true
+	case tag == redisMetaKey || strings.HasPrefix(tag, redisMetaKey+":"):
+		return "", false
+	case strings.HasPrefix(tag, "__") && redisEscaped(tag):
+		return tag[1:], true
+	}
+
+	return tag, true
+}
+
+// redisEscaped reports whether a tag is one or more underscores followed
+// by "meta", the names that are stored with one more underscore.
+func redisEscaped(tag string) bool {
+	rest := strings.TrimLeft(tag, "_")
+	return len(rest) < len(tag) && strings.HasPrefix(rest, "meta")
+}
+
+// metaKey returns the Redis key of a metadata entry.
+func (s *RedisStore) metaKey(name string) string {
+	return s.prefix + redisMetaKey + ":" + name
+}
 
-	return nil
+// Close closes the Redis client.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
 }
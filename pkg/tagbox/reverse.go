@@ -0,0 +1,98 @@
+package tagbox
+
+import (
+	"sort"
+	"unsafe"
+)
+
+// reverseIndex maps every object to the sorted list of its tags, so
+// GetObjectTags does not have to probe every tag bitmap.
+// Callers must hold the TagSystem lock.
+type reverseIndex struct {
+	objects map[uint32][]string
+}
+
+// newReverseIndex creates an empty reverse index.
+func newReverseIndex() *reverseIndex {
+	return &reverseIndex{objects: make(map[uint32][]string)}
+}
+
+// add records that objectID has tag.
+func (r *reverseIndex) add(objectID uint32, tag string) {
+	tags := r.objects[objectID]
+	i := sort.SearchStrings(tags, tag)
+	if i < len(tags) && tags[i] == tag {
+		return
+	}
+
+	tags = append(tags, "")
+	copy(tags[i+1:], tags[i:])
+	tags[i] = tag
+	r.objects[objectID] = tags
+}
+
+// remove records that objectID no longer has tag.
+func (r *reverseIndex) remove(objectID uint32, tag string) {
+	tags := r.objects[objectID]
+	i := sort.SearchStrings(tags, tag)
+	if i == len(tags) || tags[i] != tag {
+		return
+	}
+
+	if len(tags) == 1 {
+		delete(r.objects, objectID)
+		return
+	}
+	r.objects[objectID] = append(tags[:i], tags[i+1:]...)
+}
+
+// tags returns a copy of the tags of objectID.
+func (r *reverseIndex) tags(objectID uint32) []string {
+	tags := r.objects[objectID]
+	if len(tags) == 0 {
+		return nil
+	}
+
+	return append([]string(nil), tags...)
+}
+
+// memoryUsage estimates the memory held by the index. Tag names share
+// their bytes with the tag map, so only the string headers are counted.
+func (r *reverseIndex) memoryUsage() uint64 {
+	const (
+		entrySize  = uint64(unsafe.Sizeof(uint32(0)) + unsafe.Sizeof([]string(nil)))
+		headerSize = uint64(unsafe.Sizeof(""))
+	)
+
+	var size uint64
+	for _, tags := range r.objects {
+		size += entrySize + uint64(cap(tags))*headerSize
+	}
+
+	return size
+}
+
+// rebuildReverseLocked recomputes the reverse index from the tag bitmaps
+// after tags were loaded in bulk. It is a no-op when the index is
+// disabled.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) rebuildReverseLocked() {
+	if ts.reverse == nil {
+		return
+	}
+
+	// Visiting tags in order makes every insertion an append
+	names := make([]string, 0, len(ts.tags))
+	for tag := range ts.tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+
+	ts.reverse = newReverseIndex()
+	for _, tag := range names {
+		it := ts.tags[tag].Iterator()
+		for it.HasNext() {
+			ts.reverse.add(it.Next(), tag)
+		}
+	}
+}
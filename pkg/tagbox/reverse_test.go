@@ -0,0 +1,121 @@
+package tagbox
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newReverseTagSystem creates a TagSystem with the reverse index enabled
+func newReverseTagSystem(t *testing.T, store Store) *TagSystem {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+	config.ReverseIndex = true
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	t.Cleanup(func() { ts.Close() })
+
+	return ts
+}
+
+// TestTagSystem_ReverseIndex tests that every mutation keeps the index consistent
+func TestTagSystem_ReverseIndex(t *testing.T) {
+	ts := newReverseTagSystem(t, NewMemoryStore())
+
+	ts.AddTag(1, "vip")
+	ts.BatchAddTags(1, []string{"male", "active", "vip"})
+	ts.BatchAddObjectsToTag([]uint32{1, 2, 2}, "beijing")
+	ts.RemoveTag(1, "male")
+	ts.RemoveTag(2, "missing")
+
+	tests := []struct {
+		objectID uint32
+		want     []string
+	}{
+		{1, []string{"active", "beijing", "vip"}},
+		{2, []string{"beijing"}},
+		{3, nil},
+	}
+	for _, tt := range tests {
+		got, _ := ts.GetObjectTags(tt.objectID)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetObjectTags(%d) = %v, want %v", tt.objectID, got, tt.want)
+		}
+	}
+
+	ts.RemoveTag(2, "beijing")
+	if _, exists := ts.reverse.objects[2]; exists {
+		t.Error("objects without tags should leave the index")
+	}
+
+	if ts.GetStats().ReverseMemory == 0 {
+		t.Error("expected the index memory in GetStats")
+	}
+}
+
+// TestTagSystem_ReverseIndexRebuild tests rebuilding the index after bulk loads
+func TestTagSystem_ReverseIndexRebuild(t *testing.T) {
+	store := NewMemoryStore()
+	path := filepath.Join(t.TempDir(), "tags.snap")
+
+	ts1 := newMemoryTagSystem(t)
+	ts1.BatchAddTags(7, []string{"b", "a", "c"})
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	ts2 := newReverseTagSystem(t, store)
+	if err := ts2.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	if got, _ := ts2.GetObjectTags(7); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("GetObjectTags after LoadSnapshot = %v", got)
+	}
+	if err := ts2.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	ts3 := newReverseTagSystem(t, store)
+	if err := ts3.RecoverFromRedis(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	got, _ := ts3.GetObjectTags(7)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("GetObjectTags after Recover = %v", got)
+	}
+}
+
+// BenchmarkTagSystem_GetObjectTags compares scanning and the reverse index
+func BenchmarkTagSystem_GetObjectTags(b *testing.B) {
+	for _, reverse := range []bool{false, true} {
+		config := DefaultConfig()
+		config.AutoSave = false
+		config.Store = NewMemoryStore()
+		config.ReverseIndex = reverse
+
+		ts, _ := New(config)
+		for tag := 0; tag < 5000; tag++ {
+			ts.BatchAddObjectsToTag([]uint32{uint32(tag), uint32(tag + 1)}, fmt.Sprintf("tag%d", tag))
+		}
+
+		name := "scan"
+		if reverse {
+			name = "reverse"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ts.GetObjectTags(uint32(i % 5000))
+			}
+		})
+		ts.Close()
+	}
+}
@@ -0,0 +1,244 @@
+package tagbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Snapshot file layout, all integers little-endian:
+//
+//	header    magic[8] version:u16 flags:u16 reserved:u32
+//	entries   each 8-byte aligned, zero padded
+//	directory per entry: kind:u8 uvarint(len(name)) name
+//	          uvarint(offset) uvarint(length) crc32:u32
+//	footer    dirOffset:u64 count:u32 dirCRC:u32 crc:u32 endMagic[4]
+//
+// The footer CRC covers the header and the footer fields before it. The
+// footer is written last, so a torn file never passes validation.
+const (
+	snapshotMagic      = "RTSNAP\x00\x00"
+	snapshotEndMagic   = "RTSE"
+	snapshotVersion    = 1
+	snapshotHeaderSize = 16
+	snapshotFooterSize = 24
+	snapshotAlign      = 8
+)
+
+// Snapshot entry kinds. Readers skip kinds they don't know.
+const (
+	snapshotTagEntry  byte = 1 // A serialized tag bitmap
+	snapshotMetaEntry byte = 2 // A metadata entry such as the object key dictionary
+)
+
+// Snapshot header flags.
+const (
+	snapshotFlag64 uint16 = 1 << 0 // Tags hold 64-bit object IDs
+)
+
+// ErrCorruptSnapshot is returned when a snapshot fails validation.
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// snapshotEntry is one named blob in a snapshot.
+type snapshotEntry struct {
+	kind byte
+	name string
+	data []byte
+}
+
+// snapshotWriter streams entries to a snapshot file.
+type snapshotWriter struct {
+	w      *bufio.Writer
+	header []byte
+	off    uint64
+	dir    []byte
+	count  uint32
+}
+
+// newSnapshotWriter writes the snapshot header to w.
+func newSnapshotWriter(w io.Writer, flags uint16) (*snapshotWriter, error) {
+	header := make([]byte, snapshotHeaderSize)
+	copy(header, snapshotMagic)
+	binary.LittleEndian.PutUint16(header[8:], snapshotVersion)
+	binary.LittleEndian.PutUint16(header[10:], flags)
+
+	sw := &snapshotWriter{w: bufio.NewWriter(w), header: header}
+	if err := sw.write(header); err != nil {
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+// write writes p and advances the offset.
+func (sw *snapshotWriter) write(p []byte) error {
+	n, err := sw.w.Write(p)
+	sw.off += uint64(n)
+	return err
+}
+
+// add writes an entry whose content is produced by writeTo.
+func (sw *snapshotWriter) add(kind byte, name string, writeTo func(io.Writer) (int64, error)) error {
+	start := sw.off
+	crc := crc32.NewIEEE()
+
+	n, err := writeTo(io.MultiWriter(sw.w, crc))
+	sw.off += uint64(n)
+	if err != nil {
+		return err
+	}
+
+	// Keep every entry aligned so it can be used in place
+	if pad := sw.off % snapshotAlign; pad != 0 {
+		if err := sw.write(make([]byte, snapshotAlign-pad)); err != nil {
+			return err
+		}
+	}
+
+	sw.dir = append(sw.dir, kind)
+	sw.dir = binary.AppendUvarint(sw.dir, uint64(len(name)))
+	sw.dir = append(sw.dir, name...)
+	sw.dir = binary.AppendUvarint(sw.dir, start)
+	sw.dir = binary.AppendUvarint(sw.dir, uint64(n))
+	sw.dir = binary.LittleEndian.AppendUint32(sw.dir, crc.Sum32())
+	sw.count++
+
+	return nil
+}
+
+// close writes the directory and the footer and flushes the output.
+func (sw *snapshotWriter) close() error {
+	dirOffset := sw.off
+	if err := sw.write(sw.dir); err != nil {
+		return err
+	}
+
+	footer := make([]byte, snapshotFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], dirOffset)
+	binary.LittleEndian.PutUint32(footer[8:], sw.count)
+	binary.LittleEndian.PutUint32(footer[12:], crc32.ChecksumIEEE(sw.dir))
+
+	crc := crc32.NewIEEE()
+	crc.Write(sw.header)
+	crc.Write(footer[:16])
+	binary.LittleEndian.PutUint32(footer[16:], crc.Sum32())
+	copy(footer[20:], snapshotEndMagic)
+
+	if err := sw.write(footer); err != nil {
+		return err
+	}
+
+	return sw.w.Flush()
+}
+
+// parseSnapshot validates a snapshot and returns its flags and entries.
+// Entry data aliases buf. Files that are not in the binary format are
+// decoded as legacy JSON snapshots.
+func parseSnapshot(buf []byte) (uint16, []snapshotEntry, error) {
+	if !bytes.HasPrefix(buf, []byte(snapshotMagic)) {
+		entries, err := parseLegacySnapshot(buf)
+		return 0, entries, err
+	}
+
+	corrupt := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrCorruptSnapshot, fmt.Sprintf(format, args...))
+	}
+
+	if len(buf) < snapshotHeaderSize+snapshotFooterSize {
+		return 0, nil, corrupt("file too short")
+	}
+
+	header := buf[:snapshotHeaderSize]
+	footer := buf[len(buf)-snapshotFooterSize:]
+	if string(footer[20:]) != snapshotEndMagic {
+		return 0, nil, corrupt("missing footer")
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	crc.Write(footer[:16])
+	if crc.Sum32() != binary.LittleEndian.Uint32(footer[16:]) {
+		return 0, nil, corrupt("header checksum mismatch")
+	}
+
+	if version := binary.LittleEndian.Uint16(header[8:]); version != snapshotVersion {
+		return 0, nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	flags := binary.LittleEndian.Uint16(header[10:])
+
+	dirOffset := binary.LittleEndian.Uint64(footer[0:])
+	dirEnd := uint64(len(buf) - snapshotFooterSize)
+	if dirOffset < snapshotHeaderSize || dirOffset > dirEnd {
+		return 0, nil, corrupt("directory offset %d out of range", dirOffset)
+	}
+	dir := buf[dirOffset:dirEnd]
+	if crc32.ChecksumIEEE(dir) != binary.LittleEndian.Uint32(footer[12:]) {
+		return 0, nil, corrupt("directory checksum mismatch")
+	}
+
+	var truncated bool
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(dir)
+		if n <= 0 {
+			truncated = true
+			return 0
+		}
+		dir = dir[n:]
+		return v
+	}
+	next := func(n uint64) []byte {
+		if truncated || n > uint64(len(dir)) {
+			truncated = true
+			return nil
+		}
+		p := dir[:n]
+		dir = dir[n:]
+		return p
+	}
+
+	count := binary.LittleEndian.Uint32(footer[8:])
+	entries := make([]snapshotEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		kind := next(1)
+		name := next(uvarint())
+		offset := uvarint()
+		length := uvarint()
+		sum := next(4)
+		if truncated {
+			return 0, nil, corrupt("directory truncated")
+		}
+
+		if offset < snapshotHeaderSize || offset > dirOffset || length > dirOffset-offset {
+			return 0, nil, corrupt("entry %q out of range", name)
+		}
+		data := buf[offset : offset+length]
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(sum) {
+			return 0, nil, corrupt("checksum mismatch in entry %q", name)
+		}
+
+		entries = append(entries, snapshotEntry{kind: kind[0], name: string(name), data: data})
+	}
+
+	return flags, entries, nil
+}
+
+// parseLegacySnapshot decodes the JSON map of tag to bitmap written by
+// earlier versions.
+func parseLegacySnapshot(buf []byte) ([]snapshotEntry, error) {
+	data := make(map[string][]byte)
+	if err := json.Unmarshal(buf, &data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+
+	entries := make([]snapshotEntry, 0, len(data))
+	for tag, bitmap := range data {
+		entries = append(entries, snapshotEntry{kind: snapshotTagEntry, name: tag, data: bitmap})
+	}
+
+	return entries, nil
+}
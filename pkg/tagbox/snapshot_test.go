@@ -0,0 +1,282 @@
+package tagbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// newMemoryTagSystem creates a TagSystem backed by a MemoryStore
+func newMemoryTagSystem(t *testing.T) *TagSystem {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	t.Cleanup(func() { ts.Close() })
+
+	return ts
+}
+
+// TestTagSystem_SnapshotRoundTrip tests the binary snapshot format
+func TestTagSystem_SnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tags.snap")
+
+	ts1 := newMemoryTagSystem(t)
+	ts1.BatchAddObjectsToTag([]uint32{1, 2, 3, 100000}, "vip")
+	ts1.AddTag(7, "odd")
+	ts1.AddTag(1, "city:new york")
+
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	// Only the snapshot is left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected only the snapshot in %s, got %d files", dir, len(entries))
+	}
+
+	ts2 := newMemoryTagSystem(t)
+	if err := ts2.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+
+	for _, tag := range []string{"vip", "odd", "city:new york"} {
+		want, _ := ts1.Query(tag)
+		got, _ := ts2.Query(tag)
+		if !got.Equals(want) {
+			t.Errorf("tag %s = %v, want %v", tag, got.ToArray(), want.ToArray())
+		}
+	}
+	if got := ts2.GetStats().UniqueObjects; got != 5 {
+		t.Errorf("expected 5 unique objects, got %d", got)
+	}
+}
+
+// TestTagSystem_SnapshotLegacyJSON tests loading snapshots written by earlier versions
+func TestTagSystem_SnapshotLegacyJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+
+	var buf bytes.Buffer
+	roaring.BitmapOf(1, 2).WriteTo(&buf)
+	data, _ := json.Marshal(map[string][]byte{"vip": buf.Bytes()})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newMemoryTagSystem(t)
+	if err := ts.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load legacy snapshot: %v", err)
+	}
+
+	result, _ := ts.Query("vip")
+	if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{1, 2}) {
+		t.Errorf("vip = %v, want [1 2]", got)
+	}
+}
+
+// TestTagSystem_SnapshotCorruption tests that damaged snapshots are rejected
+func TestTagSystem_SnapshotCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.snap")
+
+	ts1 := newMemoryTagSystem(t)
+	ts1.BatchAddObjectsToTag([]uint32{1, 2, 3}, "vip")
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	good, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		damage func([]byte) []byte
+	}{
+		{"flipped data byte", func(b []byte) []byte { b[snapshotHeaderSize+4] ^= 0xff; return b }},
+		{"flipped flags", func(b []byte) []byte { b[10] ^= 0x01; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-10] }},
+		{"header only", func(b []byte) []byte { return b[:snapshotHeaderSize] }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := tt.damage(append([]byte(nil), good...))
+			if err := os.WriteFile(path, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ts := newMemoryTagSystem(t)
+			if err := ts.LoadSnapshot(path); !errors.Is(err, ErrCorruptSnapshot) {
+				t.Fatalf("expected ErrCorruptSnapshot, got %v", err)
+			}
+			if len(ts.GetAllTags()) != 0 {
+				t.Error("a corrupt snapshot must not load any tag")
+			}
+		})
+	}
+}
+
+// TestTagSystem_SnapshotMmap tests zero-copy loading and copy-on-write mutation
+func TestTagSystem_SnapshotMmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.snap")
+
+	ts1 := newMemoryTagSystem(t)
+	ids := make([]uint32, 0, 10000)
+	for i := uint32(0); i < 10000; i++ {
+		ids = append(ids, i*3)
+	}
+	ts1.BatchAddObjectsToTag(ids, "vip")
+	ts1.AddTag(1, "odd")
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+	original, _ := os.ReadFile(path)
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.MmapSnapshot = true
+
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+
+	if err := ts2.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	if len(ts2.mapped) != 1 {
+		t.Fatalf("expected the snapshot to stay mapped, got %d mappings", len(ts2.mapped))
+	}
+
+	if count, _ := ts2.GetTagCount("vip"); count != 10000 {
+		t.Errorf("expected 10000 objects with vip tag, got %d", count)
+	}
+
+	// Mutations copy the touched containers instead of writing to the file
+	ts2.AddTag(1, "vip")
+	ts2.RemoveTag(3, "vip")
+	ts2.RemoveTag(1, "odd")
+
+	if !ts2.HasTag(1, "vip") || ts2.HasTag(3, "vip") || !ts2.HasTag(6, "vip") {
+		t.Error("mutations of a mapped tag were not applied")
+	}
+	if tags := ts2.GetAllTags(); len(tags) != 1 {
+		t.Errorf("expected only vip to remain, got %v", tags)
+	}
+
+	result, err := ts2.QueryExpr("vip AND NOT odd")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.GetCardinality() != 10000 {
+		t.Errorf("expected 10000 results, got %d", result.GetCardinality())
+	}
+
+	if current, _ := os.ReadFile(path); !bytes.Equal(current, original) {
+		t.Error("mutating a mapped tag modified the snapshot file")
+	}
+
+	// Close releases the mapping after detaching the bitmaps from it
+	if err := ts2.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if len(ts2.mapped) != 0 {
+		t.Error("expected Close to release the mapping")
+	}
+	if count, _ := ts2.GetTagCount("vip"); count != 10000 {
+		t.Errorf("expected 10000 objects with vip tag after close, got %d", count)
+	}
+}
+
+// TestTagSystem_SnapshotMmapHierarchy tests that roll-ups are detached from
+// a mapped snapshot before it is released
+func TestTagSystem_SnapshotMmapHierarchy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.snap")
+
+	ts1 := newMemoryTagSystem(t)
+	ids := make([]uint32, 0, 100000)
+	for i := uint32(0); i < 100000; i++ {
+		ids = append(ids, i*7) // Many containers, most only in one tag
+	}
+	ts1.BatchAddObjectsToTag(ids, "asia/china")
+	ts1.BatchAddObjectsToTag([]uint32{1, 2}, "asia/japan")
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.MmapSnapshot = true
+	config.TagHierarchy = true
+
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	if err := ts2.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	if err := ts2.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	result, err := ts2.Query("asia")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.GetCardinality() != 100002 {
+		t.Errorf("expected 100002 objects in asia, got %d", result.GetCardinality())
+	}
+}
+
+// BenchmarkTagSystem_LoadSnapshot compares copying and mapping a snapshot
+func BenchmarkTagSystem_LoadSnapshot(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "tags.snap")
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+
+	ts, _ := New(config)
+	for tag := 0; tag < 100; tag++ {
+		bitmap := roaring.New()
+		bitmap.AddRange(uint64(tag)*10000, uint64(tag)*10000+500000)
+		ts.BatchAddObjectsToTag(bitmap.ToArray(), fmt.Sprintf("tag%d", tag))
+	}
+	if err := ts.SaveSnapshot(path); err != nil {
+		b.Fatal(err)
+	}
+	ts.Close()
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			config.MmapSnapshot = mmap
+			for i := 0; i < b.N; i++ {
+				config.Store = NewMemoryStore()
+				ts, _ := New(config)
+				if err := ts.LoadSnapshot(path); err != nil {
+					b.Fatal(err)
+				}
+				ts.Close()
+			}
+		})
+	}
+}
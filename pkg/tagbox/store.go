@@ -0,0 +1,295 @@
+package tagbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ErrTagNotFound is returned by a Store when a tag has not been saved.
+var ErrTagNotFound = errors.New("tag not found")
+
+// ErrIDWidthMismatch is returned when a store or snapshot holds object IDs
+// of a different width than the tag system opening it.
+var ErrIDWidthMismatch = errors.New("object ID width mismatch")
+
+// ErrMetaNotFound is returned by a MetaStore when a metadata entry has not
+// been saved.
+var ErrMetaNotFound = errors.New("metadata not found")
+
+// Store persists serialized tag bitmaps.
+//
+// A TagSystem serializes bitmaps itself, so a Store only moves opaque
+// bytes keyed by tag name. Implementations must be safe for concurrent use.
+type Store interface {
+	// LoadAll returns every saved tag. When some tags cannot be read, it
+	// returns the tags it could read together with an error.
+	LoadAll(ctx context.Context) (map[string][]byte, error)
+
+	// LoadTag returns a single tag, or ErrTagNotFound.
+	LoadTag(ctx context.Context, tag string) ([]byte, error)
+
+	// SaveTag creates or replaces a tag.
+	SaveTag(ctx context.Context, tag string, data []byte) error
+
+	// DeleteTag removes a tag. Deleting a missing tag is not an error.
+	DeleteTag(ctx context.Context, tag string) error
+
+	// ListTags returns the names of all saved tags.
+	ListTags(ctx context.Context) ([]string, error)
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// BatchStore is implemented by stores that can apply many saves and
+// deletes in one round trip. TagSystem uses it for flushes when available.
+type BatchStore interface {
+	Store
+
+	// WriteBatch saves every tag in saves and deletes every tag in deletes.
+	// Implementations should apply the batch atomically, which makes a
+	// committed Txn reach the store as one unit.
+	WriteBatch(ctx context.Context, saves map[string][]byte, deletes []string) error
+}
+
+// MetaStore is implemented by stores that can keep named metadata next to
+// the tags, such as the object key dictionary. Metadata entries are never
+// returned as tags. TagSystem only persists metadata to stores that
+// implement it.
+type MetaStore interface {
+	Store
+
+	// LoadMeta returns a metadata entry, or ErrMetaNotFound.
+	LoadMeta(ctx context.Context, name string) ([]byte, error)
+
+	// SaveMeta creates or replaces a metadata entry.
+	SaveMeta(ctx context.Context, name string, data []byte) error
+}
+
+// MetaBatchStore is implemented by stores that can write metadata in the
+// same batch as the tags. TagSystem uses it for flushes when available, so
+// the tags and the metadata in the store never get out of step.
+type MetaBatchStore interface {
+	BatchStore
+	MetaStore
+
+	// WriteBatchWithMeta is WriteBatch that also saves every entry in meta
+	// as part of the batch.
+	WriteBatchWithMeta(ctx context.Context, saves map[string][]byte, deletes []string, meta map[string][]byte) error
+}
+
+// idWidthMetaName is the metadata entry that records whether a store holds
+// 32-bit or 64-bit object IDs.
+const idWidthMetaName = "idwidth"
+
+// claimIDWidth checks that store holds object IDs of the given width and,
+// unless readOnly is set, records the width if the store has none yet.
+// Tags saved before widths were recorded are 32-bit. Stores without
+// metadata are not checked.
+func claimIDWidth(ctx context.Context, store Store, width int, readOnly bool) error {
+	metaStore, ok := store.(MetaStore)
+	if !ok {
+		return nil
+	}
+
+	data, err := metaStore.LoadMeta(ctx, idWidthMetaName)
+	if err == nil {
+		if string(data) != strconv.Itoa(width) {
+			return fmt.Errorf("%w: store holds %s-bit object IDs, not %d-bit", ErrIDWidthMismatch, data, width)
+		}
+		return nil
+	}
+	if !errors.Is(err, ErrMetaNotFound) {
+		return err
+	}
+
+	if width != 32 {
+		tags, err := store.ListTags(ctx)
+		if err != nil {
+			return err
+		}
+		if len(tags) > 0 {
+			return fmt.Errorf("%w: store holds 32-bit object IDs, not %d-bit", ErrIDWidthMismatch, width)
+		}
+	}
+
+	if readOnly {
+		return nil
+	}
+	return metaStore.SaveMeta(ctx, idWidthMetaName, []byte(strconv.Itoa(width)))
+}
+
+// writeBatch applies saves and deletes to store and saves the metadata
+// entries in meta, which must be empty unless store is a MetaStore. The
+// write is one batch when the store supports it.
+func writeBatch(ctx context.Context, store Store, saves map[string][]byte, deletes []string, meta map[string][]byte) error {
+	if batch, ok := store.(MetaBatchStore); ok {
+		return batch.WriteBatchWithMeta(ctx, saves, deletes, meta)
+	}
+
+	if err := writeTags(ctx, store, saves, deletes); err != nil {
+		return err
+	}
+	for name, data := range meta {
+		if err := store.(MetaStore).SaveMeta(ctx, name, data); err != nil {
+			return fmt.Errorf("metadata %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeTags applies saves and deletes to store, in one batch when the
+// store supports it.
+func writeTags(ctx context.Context, store Store, saves map[string][]byte, deletes []string) error {
+	if batch, ok := store.(BatchStore); ok {
+		return batch.WriteBatch(ctx, saves, deletes)
+	}
+
+	var errs []error
+	for tag, data := range saves {
+		if err := store.SaveTag(ctx, tag, data); err != nil {
+			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
+		}
+	}
+	for _, tag := range deletes {
+		if err := store.DeleteTag(ctx, tag); err != nil {
+			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("write completed with %d errors: %v", len(errs), errs)
+	}
+
+	return nil
+}
+
+// MemoryStore is a Store that keeps tags in process memory.
+// It is useful for tests and for purely in-process tag systems.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	tags map[string][]byte
+	meta map[string][]byte
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tags: make(map[string][]byte),
+		meta: make(map[string][]byte),
+	}
+}
+
+// LoadAll returns a copy of every saved tag.
+func (s *MemoryStore) LoadAll(ctx context.Context) (map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tags := make(map[string][]byte, len(s.tags))
+	for tag, data := range s.tags {
+		tags[tag] = append([]byte(nil), data...)
+	}
+
+	return tags, nil
+}
+
+// LoadTag returns a copy of a saved tag.
+func (s *MemoryStore) LoadTag(ctx context.Context, tag string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, exists := s.tags[tag]
+	if !exists {
+		return nil, ErrTagNotFound
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+// SaveTag stores a copy of data under tag.
+func (s *MemoryStore) SaveTag(ctx context.Context, tag string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tags[tag] = append([]byte(nil), data...)
+	return nil
+}
+
+// DeleteTag removes a tag.
+func (s *MemoryStore) DeleteTag(ctx context.Context, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tags, tag)
+	return nil
+}
+
+// ListTags returns the sorted names of all saved tags.
+func (s *MemoryStore) ListTags(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tags := make([]string, 0, len(s.tags))
+	for tag := range s.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return tags, nil
+}
+
+// WriteBatch applies saves and deletes under a single lock.
+func (s *MemoryStore) WriteBatch(ctx context.Context, saves map[string][]byte, deletes []string) error {
+	return s.WriteBatchWithMeta(ctx, saves, deletes, nil)
+}
+
+// WriteBatchWithMeta applies saves and deletes and stores the metadata
+// entries in meta under a single lock.
+func (s *MemoryStore) WriteBatchWithMeta(ctx context.Context, saves map[string][]byte, deletes []string, meta map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tag, data := range saves {
+		s.tags[tag] = append([]byte(nil), data...)
+	}
+	for _, tag := range deletes {
+		delete(s.tags, tag)
+	}
+	for name, data := range meta {
+		s.meta[name] = append([]byte(nil), data...)
+	}
+
+	return nil
+}
+
+// LoadMeta returns a copy of a metadata entry.
+func (s *MemoryStore) LoadMeta(ctx context.Context, name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, exists := s.meta[name]
+	if !exists {
+		return nil, ErrMetaNotFound
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+// SaveMeta stores a copy of data under name.
+func (s *MemoryStore) SaveMeta(ctx context.Context, name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.meta[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// Close is a no-op; the data stays available until the store is dropped.
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,450 @@
+package tagbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testStore runs the Store contract against an implementation
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := store.LoadTag(ctx, "missing"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("expected ErrTagNotFound, got %v", err)
+	}
+
+	tags := map[string][]byte{
+		"vip":              []byte("one"),
+		"city:new york":    []byte("two"),
+		"asia/china/../x%": []byte("three"),
+	}
+	for tag, data := range tags {
+		if err := store.SaveTag(ctx, tag, data); err != nil {
+			t.Fatalf("SaveTag(%q) failed: %v", tag, err)
+		}
+	}
+
+	// Replacing a tag overwrites its data
+	if err := store.SaveTag(ctx, "vip", []byte("four")); err != nil {
+		t.Fatalf("SaveTag failed: %v", err)
+	}
+	tags["vip"] = []byte("four")
+
+	loaded, err := store.LoadAll(ctx)
+	if err != nil {
+		t.Fatalf("LoadAll failed: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, tags) {
+		t.Errorf("LoadAll = %q, want %q", loaded, tags)
+	}
+
+	names, err := store.ListTags(ctx)
+	if err != nil {
+		t.Fatalf("ListTags failed: %v", err)
+	}
+	want := []string{"asia/china/../x%", "city:new york", "vip"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("ListTags = %q, want %q", names, want)
+	}
+
+	if err := store.DeleteTag(ctx, "vip"); err != nil {
+		t.Fatalf("DeleteTag failed: %v", err)
+	}
+	if err := store.DeleteTag(ctx, "vip"); err != nil {
+		t.Errorf("deleting a missing tag should succeed, got %v", err)
+	}
+	if _, err := store.LoadTag(ctx, "vip"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("expected ErrTagNotFound after delete, got %v", err)
+	}
+}
+
+// TestMemoryStore tests the in-memory store
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+// TestFileStore tests the local-directory store
+func TestFileStore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+	testStore(t, store)
+}
+
+// TestFileStore_WriteBatch tests that a batch interrupted by a crash is
+// persisted entirely once committed and not at all before
+func TestFileStore_WriteBatch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+	store.SaveTag(ctx, "old", []byte("zero"))
+
+	if err := store.WriteBatch(ctx, map[string][]byte{"vip": []byte("one")}, []string{"old"}); err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	if names, _ := store.ListTags(ctx); !reflect.DeepEqual(names, []string{"vip"}) {
+		t.Errorf("tags after batch = %q, want [vip]", names)
+	}
+
+	// Crash after the commit: the next open applies the batch
+	saves := map[string][]byte{"vip": []byte("two"), "city:new york": []byte("three")}
+	if err := store.logBatch(saves, []string{"missing"}, nil); err != nil {
+		t.Fatalf("logBatch failed: %v", err)
+	}
+	if data, _ := store.LoadTag(ctx, "vip"); string(data) != "one" {
+		t.Errorf("uncommitted batch visible: vip = %q", data)
+	}
+
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen file store: %v", err)
+	}
+	loaded, _ := store.LoadAll(ctx)
+	if !reflect.DeepEqual(loaded, saves) {
+		t.Errorf("tags after recovery = %q, want %q", loaded, saves)
+	}
+
+	// Crash before the commit: the next open drops the batch
+	if err := store.logBatch(map[string][]byte{"vip": []byte("four")}, []string{"city:new york"}, nil); err != nil {
+		t.Fatalf("logBatch failed: %v", err)
+	}
+	os.Remove(filepath.Join(dir, fileStoreJournal))
+
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen file store: %v", err)
+	}
+	loaded, _ = store.LoadAll(ctx)
+	if !reflect.DeepEqual(loaded, saves) {
+		t.Errorf("tags after torn batch = %q, want %q", loaded, saves)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, fileStoreBatchPattern)); len(leftovers) != 0 {
+		t.Errorf("uncommitted batch files kept: %v", leftovers)
+	}
+}
+
+// TestFileStore_BatchLikeTag tests that a tag named like a batch file
+// survives reopening the store
+func TestFileStore_BatchLikeTag(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+	if err := store.SaveTag(ctx, ".batch-x", []byte("one")); err != nil {
+		t.Fatalf("SaveTag failed: %v", err)
+	}
+	if err := store.SaveMeta(ctx, ".batch-x", []byte("two")); err != nil {
+		t.Fatalf("SaveMeta failed: %v", err)
+	}
+
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen file store: %v", err)
+	}
+	if data, err := store.LoadTag(ctx, ".batch-x"); err != nil || string(data) != "one" {
+		t.Errorf("LoadTag = %q, %v, want one", data, err)
+	}
+	if data, err := store.LoadMeta(ctx, ".batch-x"); err != nil || string(data) != "two" {
+		t.Errorf("LoadMeta = %q, %v, want two", data, err)
+	}
+}
+
+// TestRedisStore tests the Redis store
+func TestRedisStore(t *testing.T) {
+	_, client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	testStore(t, NewRedisStore(client, "tags:"))
+}
+
+// TestRedisStore_ReservedTags tests that tags named like the metadata
+// keys are kept apart from them
+func TestRedisStore_ReservedTags(t *testing.T) {
+	s, client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	store := NewRedisStore(client, "")
+
+	tags := map[string][]byte{
+		"_meta":     []byte("one"),
+		"_meta:x":   []byte("two"),
+		"__meta":    []byte("three"),
+		"_metadata": []byte("four"),
+		"meta":      []byte("five"),
+	}
+	if err := store.WriteBatchWithMeta(ctx, tags, nil, map[string][]byte{"keys": []byte("meta")}); err != nil {
+		t.Fatalf("WriteBatchWithMeta failed: %v", err)
+	}
+
+	loaded, err := store.LoadAll(ctx)
+	if err != nil {
+		t.Fatalf("LoadAll failed: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, tags) {
+		t.Errorf("LoadAll = %q, want %q", loaded, tags)
+	}
+	if data, _ := store.LoadMeta(ctx, "keys"); string(data) != "meta" {
+		t.Errorf("metadata = %q, want meta", data)
+	}
+	if got, _ := s.Get("_meta:keys"); got != "meta" {
+		t.Errorf("metadata key holds %q, want meta", got)
+	}
+
+	store.DeleteTag(ctx, "_meta")
+	if _, err := store.LoadMeta(ctx, "keys"); err != nil {
+		t.Errorf("deleting tag _meta removed metadata: %v", err)
+	}
+}
+
+// TestRedisStore_Upgrade tests opening a store whose keys earlier
+// versions wrote unescaped
+func TestRedisStore_Upgrade(t *testing.T) {
+	s, client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	tags := map[string][]byte{
+		"vip":       []byte("one"),
+		"_metadata": []byte("two"),
+		"_meta:x":   []byte("three"),
+		"__meta_x":  []byte("four"),
+		"_meta":     []byte("five"),
+		"__meta":    []byte("six"),
+	}
+	for tag, data := range tags {
+		s.Set("tags:"+tag, string(data))
+	}
+
+	// A read-only store reads the old layout and writes nothing
+	store, err := OpenRedisStore(ctx, client, "tags:", true)
+	if err != nil {
+		t.Fatalf("OpenRedisStore failed: %v", err)
+	}
+	if loaded, err := store.LoadAll(ctx); err != nil || !reflect.DeepEqual(loaded, tags) {
+		t.Errorf("read-only LoadAll = %q, %v, want %q", loaded, err, tags)
+	}
+	if err := store.SaveTag(ctx, "vip", nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SaveTag on the old layout = %v, want ErrReadOnly", err)
+	}
+	if len(s.Keys()) != len(tags) {
+		t.Errorf("read-only open changed the keys: %v", s.Keys())
+	}
+
+	// Otherwise the tags move to their escaped keys
+	store, err = OpenRedisStore(ctx, client, "tags:", false)
+	if err != nil {
+		t.Fatalf("OpenRedisStore failed: %v", err)
+	}
+	if loaded, err := store.LoadAll(ctx); err != nil || !reflect.DeepEqual(loaded, tags) {
+		t.Errorf("LoadAll after upgrade = %q, %v, want %q", loaded, err, tags)
+	}
+	if got, _ := s.Get("tags:___meta_x"); got != "four" {
+		t.Errorf("tag __meta_x is under tags:___meta_x = %q, want four", got)
+	}
+	if s.Exists("tags:_meta:x") {
+		t.Error("tag _meta:x kept its metadata key")
+	}
+
+	// Saving writes metadata next to the moved tags, and opening again
+	// moves nothing
+	if err := store.SaveMeta(ctx, "keys", []byte("meta")); err != nil {
+		t.Fatalf("SaveMeta failed: %v", err)
+	}
+	store, err = OpenRedisStore(ctx, client, "tags:", false)
+	if err != nil {
+		t.Fatalf("OpenRedisStore failed: %v", err)
+	}
+	if loaded, err := store.LoadAll(ctx); err != nil || !reflect.DeepEqual(loaded, tags) {
+		t.Errorf("LoadAll after reopening = %q, %v, want %q", loaded, err, tags)
+	}
+	if data, _ := store.LoadMeta(ctx, "keys"); string(data) != "meta" {
+		t.Errorf("metadata = %q, want meta", data)
+	}
+
+	s.Set("tags:_meta:keyformat", "99")
+	if _, err := OpenRedisStore(ctx, client, "tags:", false); !errors.Is(err, ErrKeyFormat) {
+		t.Errorf("expected ErrKeyFormat, got %v", err)
+	}
+}
+
+// TestTagSystem_FileStorePersistence tests running without Redis
+func TestTagSystem_FileStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create file store: %v", err)
+	}
+
+	config := DefaultConfig()
+	config.RedisAddr = "127.0.0.1:1" // Never dialed
+	config.AutoSave = false
+	config.Store = store
+
+	ts1, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+
+	ts1.AddTag(1, "vip")
+	ts1.AddTag(2, "vip")
+	ts1.AddTag(1, "gender:male")
+
+	if err := ts1.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	config.Store, _ = NewFileStore(dir)
+	ts2, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create second TagSystem: %v", err)
+	}
+	defer ts2.Close()
+
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+
+	if count, _ := ts2.GetTagCount("vip"); count != 2 {
+		t.Errorf("expected 2 objects with vip tag, got %d", count)
+	}
+	if !ts2.HasTag(1, "gender:male") {
+		t.Error("object 1 should have gender:male tag after recovery")
+	}
+}
+
+// TestTagSystem_Flush tests that flushes write only the modified tags
+func TestTagSystem_Flush(t *testing.T) {
+	store := NewMemoryStore()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.BatchAddTags(1, []string{"a", "b", "c"})
+
+	stats, err := ts.Flush()
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if stats.Saved != 3 || stats.Deleted != 0 || stats.Bytes == 0 {
+		t.Errorf("expected 3 saved tags, got %+v", stats)
+	}
+
+	// Nothing changed since the last flush
+	if stats, _ := ts.Flush(); stats.Saved != 0 {
+		t.Errorf("expected empty flush, got %+v", stats)
+	}
+
+	ts.AddTag(2, "b")
+	ts.AddTag(1, "b") // No-op
+	ts.RemoveTag(1, "c")
+
+	stats, err = ts.Flush()
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if stats.Saved != 1 || stats.Deleted != 1 {
+		t.Errorf("expected 1 saved and 1 deleted tag, got %+v", stats)
+	}
+	if ts.LastFlush().Saved != 1 {
+		t.Errorf("LastFlush = %+v, want the previous flush", ts.LastFlush())
+	}
+
+	names, _ := store.ListTags(context.Background())
+	if !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("store holds %v, want [a b]", names)
+	}
+}
+
+// TestTagSystem_ReadOnly tests that a read-only tag system never writes to
+// its store
+func TestTagSystem_ReadOnly(t *testing.T) {
+	store := NewMemoryStore()
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+	config.ReadOnly = true
+
+	// Opening an empty store does not record the ID width
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	if _, err := store.LoadMeta(context.Background(), idWidthMetaName); !errors.Is(err, ErrMetaNotFound) {
+		t.Errorf("ID width entry error = %v, want ErrMetaNotFound", err)
+	}
+
+	ts.AddTag(1, "a")
+	if err := ts.Save(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Save error = %v, want ErrReadOnly", err)
+	}
+	if _, err := ts.Flush(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Flush error = %v, want ErrReadOnly", err)
+	}
+	if err := ts.SaveTag("a"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SaveTag error = %v, want ErrReadOnly", err)
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if names, _ := store.ListTags(context.Background()); len(names) != 0 {
+		t.Errorf("store holds %v after Close, want nothing", names)
+	}
+
+	config.WALDir = t.TempDir()
+	if _, err := New(config); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("New with a WAL error = %v, want ErrReadOnly", err)
+	}
+}
+
+// TestTagSystem_RedisFlushPipelined tests incremental flushes against Redis
+func TestTagSystem_RedisFlushPipelined(t *testing.T) {
+	s, client, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	config := DefaultConfig()
+	config.RedisAddr = client.Options().Addr
+	config.AutoSave = false
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	ts.AddTag(1, "vip")
+	ts.AddTag(1, "tmp")
+	if _, err := ts.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	ts.RemoveTag(1, "tmp")
+	if _, err := ts.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if !s.Exists("tags:vip") || s.Exists("tags:tmp") {
+		t.Errorf("expected only tags:vip in Redis, got %v", s.Keys())
+	}
+}
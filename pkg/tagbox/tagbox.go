@@ -3,194 +3,278 @@ package tagbox
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/RoaringBitmap/roaring"
-	"github.com/redis/go-redis/v9"
 )
 
 // TagSystem represents a high-performance object tagging system.
-// It uses RoaringBitmap for efficient bitmap operations and Redis for persistence.
+// It uses RoaringBitmap for efficient bitmap operations and a Store
+// (Redis by default) for persistence.
 type TagSystem struct {
-	mu    sync.RWMutex
-	tags  map[string]*roaring.Bitmap
-	redis *redis.Client
-	ctx   context.Context
-	config Config
+	// The lock, the store, dirty tracking and the background workers
+	*persister
 
-	// For tracking unique objects across all tags
+	tags map[string]*roaring.Bitmap
+
+	// For tracking unique objects across all tags and attributes
 	allObjects *roaring.Bitmap
 
-	// Snapshot management
-	snapshotTicker *time.Ticker
-	snapshotDone   chan struct{}
+	// External object keys and the chunks of them that changed since the
+	// last flush
+	keys      *keyDict
+	keysDirty map[uint32]struct{}
+
+	// Assignment deadlines and whether they changed since the last flush
+	expiry      *expiry
+	expiryDirty bool
+
+	// Expiry reaper, started by the first assignment with a TTL
+	reaping       bool
+	reaperDone    chan struct{}
+	reaperStopped chan struct{}
+	reapErr       error // First failure of the reaper, returned by Close
+
+	// Numeric attributes and those modified since the last flush
+	attrs      map[string]*bsi
+	attrsDirty map[string]struct{}
+
+	// Namespaced tags by dimension, and the dimensions whose values are
+	// mutually exclusive
+	dims      map[string]map[string]struct{}
+	exclusive map[string]struct{}
+
+	// Subtree roll-ups, nil unless TagHierarchy is enabled
+	hier *hierarchy
+
+	// Object-to-tags index, nil unless ReverseIndex is enabled
+	reverse *reverseIndex
+
+	// Query result cache, nil unless CacheResults is enabled
+	cache *queryCache
+
+	// Write-ahead log, nil unless WALDir is set
+	wal *wal
+
+	// Mapped snapshots that tag bitmaps may still reference, released by
+	// Close
+	mapped [][]byte
 }
 
 // New creates a new TagSystem with the given configuration.
+// It persists to config.Store, or connects to the Redis server in the
+// configuration when no store is set.
 func New(config Config) (*TagSystem, error) {
-	// Initialize Redis client
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     config.RedisAddr,
-		Password: config.RedisPassword,
-		DB:       config.RedisDB,
-	})
-
 	ctx := context.Background()
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("redis connection failed: %w", err)
+
+	store := config.Store
+	if store == nil {
+		redisStore, err := DialRedisStore(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		store = redisStore
+	}
+
+	if config.ReadOnly && config.WALDir != "" {
+		store.Close()
+		return nil, fmt.Errorf("%w: cannot log to WALDir", ErrReadOnly)
+	}
+	if err := claimIDWidth(ctx, store, 32, config.ReadOnly); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	if config.ExpiryResolution <= 0 {
+		config.ExpiryResolution = time.Second
+	}
+	if config.WALSync == SyncInterval && config.WALSyncInterval <= 0 {
+		config.WALSyncInterval = time.Second
 	}
 
 	ts := &TagSystem{
 		tags:       make(map[string]*roaring.Bitmap),
-		redis:      rdb,
-		ctx:        ctx,
-		config:     config,
 		allObjects: roaring.NewBitmap(),
+		keys:       newKeyDict(),
+		keysDirty:  make(map[uint32]struct{}),
+		expiry:     newExpiry(config.ExpiryResolution),
+		attrs:      make(map[string]*bsi),
+		attrsDirty: make(map[string]struct{}),
+		dims:       make(map[string]map[string]struct{}),
+		exclusive:  make(map[string]struct{}),
+
+		reaperDone:    make(chan struct{}),
+		reaperStopped: make(chan struct{}),
 	}
+	ts.persister = newPersister(ctx, ts, store, config)
 
-	// Start background save worker if AutoSave is enabled
-	if config.AutoSave {
-		go ts.saveWorker()
+	for _, dimension := range config.ExclusiveDimensions {
+		ts.exclusive[dimension] = struct{}{}
 	}
 
-	return ts, nil
-}
-
-// RecoverFromRedis recovers tag data from Redis.
-// This should be called after creating a new TagSystem to restore existing data.
-func (ts *TagSystem) RecoverFromRedis() error {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
-
-	// Scan all tag keys
-	iter := ts.redis.Scan(ts.ctx, 0, ts.config.KeyPrefix+"*", 0).Iterator()
-	keys := make([]string, 0)
-
-	for iter.Next(ts.ctx) {
-		key := iter.Val()
-		if key == ts.config.KeyPrefix+"_meta" {
-			continue // Skip metadata key
-		}
-		keys = append(keys, key)
+	if config.TagHierarchy {
+		ts.hier = newHierarchy()
 	}
 
-	if err := iter.Err(); err != nil {
-		return fmt.Errorf("redis scan failed: %w", err)
+	if config.ReverseIndex {
+		ts.reverse = newReverseIndex()
 	}
 
-	// Load each tag
-	var errs []error
-	for _, key := range keys {
-		tag := key[len(ts.config.KeyPrefix):] // Remove prefix
+	if config.CacheResults {
+		ts.cache = newQueryCache(config.CacheMaxEntries, config.CacheMaxBytes)
+	}
 
-		data, err := ts.redis.Get(ts.ctx, key).Bytes()
+	if config.WALDir != "" {
+		w, err := openWAL(config.WALDir, config.WALSync, config.WALSyncInterval)
 		if err != nil {
-			if err == redis.Nil {
-				continue // Key doesn't exist, skip
-			}
-			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
-			continue
-		}
-
-		bitmap := roaring.NewBitmap()
-		if _, err := bitmap.ReadFrom(bytes.NewReader(data)); err != nil {
-			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
-			continue
+			store.Close()
+			return nil, err
 		}
-
-		ts.tags[tag] = bitmap
-		ts.allObjects.Or(bitmap)
+		ts.wal = w
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("recover completed with %d errors: %v", len(errs), errs)
-	}
+	ts.startSaveWorker()
 
-	return nil
+	return ts, nil
 }
 
 // AddTag adds a tag to an object.
 // If the tag doesn't exist, it will be created.
-// If AutoSave is enabled, the tag will be asynchronously saved to Redis.
+// If AutoSave is enabled, the tag will be asynchronously saved to the store.
 func (ts *TagSystem) AddTag(objectID uint32, tag string) error {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
-	bitmap, exists := ts.tags[tag]
-	if !exists {
-		bitmap = roaring.NewBitmap()
-		ts.tags[tag] = bitmap
-	}
+	return ts.addTagLocked(objectID, tag)
+}
 
-	bitmap.Add(objectID)
-	ts.allObjects.Add(objectID)
+// addTagLocked logs and adds a tag to an object unless it already has it.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) addTagLocked(objectID uint32, tag string) error {
+	if bitmap, exists := ts.tags[tag]; exists && bitmap.Contains(objectID) {
+		return nil // Already tagged
+	}
 
-	// Trigger async save
-	if ts.config.AutoSave {
-		select {
-		case ts.config.SaveChan <- struct{}{}:
-		default:
-			// Channel is full, skip save trigger
-		}
+	if err := ts.logLocked(walRecord{op: walAdd, tags: []string{tag}, ids: []uint32{objectID}}); err != nil {
+		return err
 	}
 
+	ts.addLocked(objectID, tag)
+
 	return nil
 }
 
+// addLocked adds a tag to an object.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) addLocked(objectID uint32, tag string) {
+	bitmap := ts.tagBitmapLocked(tag)
+	if bitmap.CheckedAdd(objectID) {
+		if ts.reverse != nil {
+			ts.reverse.add(objectID, tag)
+		}
+		if ts.hier != nil {
+			ts.hier.add([]uint32{objectID}, tag)
+		}
+		ts.changedLocked(ts.allObjects.CheckedAdd(objectID), tag)
+		ts.exclusiveLocked(roaring.BitmapOf(objectID), tag)
+	}
+}
+
 // RemoveTag removes a tag from an object.
 func (ts *TagSystem) RemoveTag(objectID uint32, tag string) error {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
 	bitmap, exists := ts.tags[tag]
-	if !exists {
-		return nil // Tag doesn't exist, nothing to remove
+	if !exists || !bitmap.Contains(objectID) {
+		return nil // Nothing to remove
 	}
 
-	bitmap.Remove(objectID)
-
-	// If bitmap is empty, remove the tag
-	if bitmap.GetCardinality() == 0 {
-		delete(ts.tags, tag)
-		go ts.redis.Del(ts.ctx, ts.config.KeyPrefix+tag)
-	} else if ts.config.AutoSave {
-		select {
-		case ts.config.SaveChan <- struct{}{}:
-		default:
-		}
+	if err := ts.logLocked(walRecord{op: walRemove, tags: []string{tag}, ids: []uint32{objectID}}); err != nil {
+		return err
 	}
 
+	ts.removeLocked(objectID, tag)
+
 	return nil
 }
 
+// removeLocked removes a tag from an object.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) removeLocked(objectID uint32, tag string) {
+	bitmap, exists := ts.tags[tag]
+	if !exists || !bitmap.CheckedRemove(objectID) {
+		return
+	}
+	if ts.reverse != nil {
+		ts.reverse.remove(objectID, tag)
+	}
+	if ts.expiry.clear(objectID, tag) {
+		ts.expiryDirty = true
+	}
+	if ts.hier != nil {
+		ts.hier.remove(objectID, tag, ts.tags)
+	}
+
+	// If bitmap is empty, remove the tag; the next save deletes it from
+	// the store
+	if bitmap.IsEmpty() {
+		ts.deleteTagLocked(tag)
+	}
+
+	ts.changedLocked(false, tag)
+}
+
 // BatchAddTags adds multiple tags to an object in a single operation.
 func (ts *TagSystem) BatchAddTags(objectID uint32, tags []string) error {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
+	if err := ts.logLocked(walRecord{op: walAddTags, tags: tags, ids: []uint32{objectID}}); err != nil {
+		return err
+	}
+
+	ts.addTagsLocked(objectID, tags)
+
+	return nil
+}
+
+// addTagsLocked adds multiple tags to an object.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) addTagsLocked(objectID uint32, tags []string) {
+	var changed []string
 	for _, tag := range tags {
-		bitmap, exists := ts.tags[tag]
-		if !exists {
-			bitmap = roaring.NewBitmap()
-			ts.tags[tag] = bitmap
+		if ts.tagBitmapLocked(tag).CheckedAdd(objectID) {
+			changed = append(changed, tag)
+			if ts.reverse != nil {
+				ts.reverse.add(objectID, tag)
+			}
+			if ts.hier != nil {
+				ts.hier.add([]uint32{objectID}, tag)
+			}
 		}
-		bitmap.Add(objectID)
 	}
 
-	ts.allObjects.Add(objectID)
+	if len(changed) > 0 {
+		ts.changedLocked(ts.allObjects.CheckedAdd(objectID), changed...)
+	}
 
-	if ts.config.AutoSave {
-		select {
-		case ts.config.SaveChan <- struct{}{}:
-		default:
+	// Visiting the tags backwards lets the last value of an exclusive
+	// dimension win
+	if len(ts.exclusive) > 0 {
+		object := roaring.BitmapOf(objectID)
+		for i := len(changed) - 1; i >= 0; i-- {
+			tag := changed[i]
+			if bitmap, exists := ts.tags[tag]; exists && bitmap.Contains(objectID) {
+				ts.exclusiveLocked(object, tag)
+			}
 		}
 	}
-
-	return nil
 }
 
 // BatchAddObjectsToTag adds multiple objects to a single tag.
@@ -198,27 +282,87 @@ func (ts *TagSystem) BatchAddObjectsToTag(objectIDs []uint32, tag string) error
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
-	bitmap, exists := ts.tags[tag]
-	if !exists {
-		bitmap = roaring.NewBitmap()
-		ts.tags[tag] = bitmap
+	if err := ts.logLocked(walRecord{op: walAddObjects, tags: []string{tag}, ids: objectIDs}); err != nil {
+		return err
 	}
 
-	for _, objectID := range objectIDs {
-		bitmap.Add(objectID)
-		ts.allObjects.Add(objectID)
-	}
+	ts.addObjectsLocked(objectIDs, tag)
+
+	return nil
+}
+
+// addObjectsLocked adds multiple objects to a single tag.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) addObjectsLocked(objectIDs []uint32, tag string) {
+	bitmap := ts.tagBitmapLocked(tag)
 
-	if ts.config.AutoSave {
-		select {
-		case ts.config.SaveChan <- struct{}{}:
-		default:
+	tagSize := bitmap.GetCardinality()
+	universeSize := ts.allObjects.GetCardinality()
+
+	bitmap.AddMany(objectIDs)
+	ts.allObjects.AddMany(objectIDs)
+	if ts.reverse != nil {
+		for _, objectID := range objectIDs {
+			ts.reverse.add(objectID, tag)
 		}
 	}
+	if ts.hier != nil {
+		ts.hier.add(objectIDs, tag)
+	}
+
+	if bitmap.GetCardinality() != tagSize {
+		ts.changedLocked(ts.allObjects.GetCardinality() != universeSize, tag)
+		ts.exclusiveLocked(roaring.BitmapOf(objectIDs...), tag)
+	}
+}
+
+// ReplaceTag sets the objects of a tag to exactly objectIDs, adding the
+// missing ones and removing the others, as a single mutation: readers see
+// either the old contents or the new, never a mix. An empty objectIDs
+// deletes the tag. Deadlines of removed assignments are cleared and those
+// of kept assignments are preserved.
+func (ts *TagSystem) ReplaceTag(tag string, objectIDs []uint32) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err := ts.logLocked(walRecord{op: walReplace, tags: []string{tag}, ids: objectIDs}); err != nil {
+		return err
+	}
+
+	ts.replaceLocked(tag, objectIDs)
 
 	return nil
 }
 
+// replaceLocked sets the objects of a tag to exactly objectIDs.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) replaceLocked(tag string, objectIDs []uint32) {
+	objects := roaring.BitmapOf(objectIDs...)
+
+	if bitmap, exists := ts.tags[tag]; exists {
+		it := roaring.AndNot(bitmap, objects).Iterator()
+		for it.HasNext() {
+			ts.removeLocked(it.Next(), tag)
+		}
+		if bitmap, exists = ts.tags[tag]; exists {
+			objects.AndNot(bitmap)
+		}
+	}
+
+	if !objects.IsEmpty() {
+		ts.addObjectsLocked(objects.ToArray(), tag)
+	}
+}
+
+// changedLocked records that the tags were modified: it drops dependent
+// cached results, marks the tags dirty for the next flush and triggers the
+// save worker. universeChanged reports whether allObjects grew.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) changedLocked(universeChanged bool, tags ...string) {
+	ts.invalidateLocked(universeChanged, tags...)
+	ts.markDirtyLocked(tags...)
+}
+
 // HasTag checks if an object has a specific tag.
 func (ts *TagSystem) HasTag(objectID uint32, tag string) bool {
 	ts.mu.RLock()
@@ -237,6 +381,10 @@ func (ts *TagSystem) GetObjectTags(objectID uint32) ([]string, error) {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
 
+	if ts.reverse != nil {
+		return ts.reverse.tags(objectID), nil
+	}
+
 	var tags []string
 	for tag, bitmap := range ts.tags {
 		if bitmap.Contains(objectID) {
@@ -281,6 +429,14 @@ func (ts *TagSystem) GetStats() Stats {
 	stats := Stats{
 		TotalTags:     len(ts.tags),
 		UniqueObjects: ts.allObjects.GetCardinality(),
+		DirtyTags:     len(ts.dirty),
+		ObjectKeys:    len(ts.keys.ids),
+		Expiring:      ts.expiry.count(),
+		Attrs:         len(ts.attrs),
+	}
+
+	if ts.reverse != nil {
+		stats.ReverseMemory = ts.reverse.memoryUsage()
 	}
 
 	var maxCardinality uint64
@@ -300,97 +456,240 @@ func (ts *TagSystem) GetStats() Stats {
 	return stats
 }
 
-// Close closes the tag system and saves all data to Redis.
+// Close closes the tag system, saves all data and closes the store. It
+// also reports the first failure of the background expiry reaper. Later
+// calls return the result of the first.
 func (ts *TagSystem) Close() error {
-	// Stop snapshot ticker if running
-	if ts.snapshotTicker != nil {
-		ts.snapshotTicker.Stop()
-		close(ts.snapshotDone)
+	return ts.persister.Close()
+}
+
+// stopWorkers stops the expiry reaper.
+func (ts *TagSystem) stopWorkers() {
+	ts.stopReaper()
+}
+
+// release closes the WAL and releases the mapped snapshots, going on after
+// a failure. It also reports the first failure of the expiry reaper.
+func (ts *TagSystem) release() error {
+	var walErr, reapErr error
+	if ts.wal != nil {
+		walErr = ts.wal.close()
 	}
 
-	// Save all data to Redis
-	if err := ts.SaveToRedis(); err != nil {
-		return fmt.Errorf("save to redis failed: %w", err)
+	unmapErr := ts.unmapSnapshots()
+
+	ts.mu.RLock()
+	if ts.reapErr != nil {
+		reapErr = fmt.Errorf("expiry reaper failed: %w", ts.reapErr)
 	}
+	ts.mu.RUnlock()
 
-	// Close Redis connection
-	return ts.redis.Close()
+	return errors.Join(walErr, unmapErr, reapErr)
 }
 
-// StartSnapshot enables periodic snapshot to disk.
-func (ts *TagSystem) StartSnapshot() {
-	if !ts.config.EnableSnapshot || ts.config.SnapshotPath == "" {
-		return
+// unmapSnapshots releases the mapped snapshots. Every bitmap is detached
+// from the mappings first, so the tag system stays usable.
+func (ts *TagSystem) unmapSnapshots() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.mapped) == 0 {
+		return nil
 	}
 
-	ts.mu.Lock()
-	if ts.snapshotTicker != nil {
-		ts.mu.Unlock()
-		return // Already started
-	}
-	ts.snapshotTicker = time.NewTicker(ts.config.SnapshotInterval)
-	ts.snapshotDone = make(chan struct{})
-	ts.mu.Unlock()
-
-	go func() {
-		for {
-			select {
-			case <-ts.snapshotTicker.C:
-				if err := ts.SaveSnapshot(ts.config.SnapshotPath); err != nil {
-					fmt.Printf("snapshot failed: %v\n", err)
-				}
-			case <-ts.snapshotDone:
-				return
-			}
+	for _, bitmap := range ts.tags {
+		bitmap.CloneCopyOnWriteContainers()
+	}
+	ts.allObjects.CloneCopyOnWriteContainers()
+	if ts.hier != nil {
+		// Roll-ups share containers with the tag bitmaps they were
+		// built from
+		for _, rollup := range ts.hier.rollups {
+			rollup.CloneCopyOnWriteContainers()
+		}
+	}
+	if ts.cache != nil {
+		ts.cache.purge()
+	}
+
+	var errs []error
+	for _, data := range ts.mapped {
+		if err := unmapFile(data); err != nil {
+			errs = append(errs, err)
 		}
-	}()
+	}
+	ts.mapped = nil
+
+	if len(errs) > 0 {
+		return fmt.Errorf("unmap completed with %d errors: %v", len(errs), errs)
+	}
+
+	return nil
 }
 
 // SaveSnapshot saves all tags to a snapshot file.
+// The file is written atomically, so an interrupted snapshot leaves the
+// previous one intact.
 func (ts *TagSystem) SaveSnapshot(filePath string) error {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
 
-	data := make(map[string][]byte)
+	return WriteFileAtomic(filePath, func(w io.Writer) error {
+		sw, err := newSnapshotWriter(w, 0)
+		if err != nil {
+			return err
+		}
 
-	for tag, bitmap := range ts.tags {
-		var buf bytes.Buffer
-		if _, err := bitmap.WriteTo(&buf); err != nil {
-			return fmt.Errorf("failed to serialize tag %s: %w", tag, err)
+		for tag, bitmap := range ts.tags {
+			if err := sw.add(snapshotTagEntry, tag, bitmap.WriteTo); err != nil {
+				return fmt.Errorf("failed to serialize tag %s: %w", tag, err)
+			}
 		}
-		data[tag] = buf.Bytes()
-	}
 
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
+		if len(ts.keys.keys) > 0 {
+			if err := sw.add(snapshotMetaEntry, keysMetaName, bytes.NewReader(ts.keys.encode()).WriteTo); err != nil {
+				return fmt.Errorf("failed to serialize object keys: %w", err)
+			}
+		}
+		if len(ts.expiry.tags) > 0 {
+			deadlines, err := ts.expiry.encode()
+			if err == nil {
+				err = sw.add(snapshotMetaEntry, expiryMetaName, bytes.NewReader(deadlines).WriteTo)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to serialize expiry: %w", err)
+			}
+		}
+		for attr, index := range ts.attrs {
+			data, err := index.encode()
+			if err == nil {
+				err = sw.add(snapshotMetaEntry, attrMetaPrefix+attr, bytes.NewReader(data).WriteTo)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to serialize attribute %s: %w", attr, err)
+			}
+		}
 
-	return os.WriteFile(filePath, jsonData, 0644)
+		return sw.close()
+	})
 }
 
-// LoadSnapshot loads all tags from a snapshot file.
+// LoadSnapshot loads all tags from a snapshot file written by SaveSnapshot.
+// Checksums are verified before any tag is loaded; snapshots in the legacy
+// JSON format are also accepted.
+//
+// With Config.MmapSnapshot the file is mapped into memory and the bitmaps
+// are built on top of it without copying. A mapped bitmap copies the
+// containers it modifies on first write. The mapping is released by Close,
+// so query results must not be used after the tag system is closed.
 func (ts *TagSystem) LoadSnapshot(filePath string) error {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
-
-	jsonData, err := os.ReadFile(filePath)
+	var buf []byte
+	var err error
+	if ts.config.MmapSnapshot {
+		buf, err = mapFile(filePath)
+	} else {
+		buf, err = os.ReadFile(filePath)
+	}
 	if err != nil {
 		return err
 	}
 
-	data := make(map[string][]byte)
-	if err := json.Unmarshal(jsonData, &data); err != nil {
-		return err
+	// The mapping is kept only when bitmaps reference it; legacy snapshots
+	// are decoded into fresh memory
+	zeroCopy := ts.config.MmapSnapshot && bytes.HasPrefix(buf, []byte(snapshotMagic))
+	keep := false
+	if ts.config.MmapSnapshot {
+		defer func() {
+			if !keep {
+				unmapFile(buf)
+			}
+		}()
+	}
+
+	flags, entries, err := parseSnapshot(buf)
+	if err != nil {
+		return fmt.Errorf("load snapshot %s: %w", filePath, err)
+	}
+	if flags&snapshotFlag64 != 0 {
+		return fmt.Errorf("load snapshot %s: %w: snapshot holds 64-bit object IDs", filePath, ErrIDWidthMismatch)
 	}
 
-	for tag, buf := range data {
+	tags := make(map[string]*roaring.Bitmap, len(entries))
+	var keys *keyDict
+	var deadlines *expiry
+	attrs := make(map[string]*bsi)
+	for _, entry := range entries {
+		if entry.kind == snapshotMetaEntry && entry.name == keysMetaName {
+			if keys, err = decodeKeyDict(entry.data); err != nil {
+				return fmt.Errorf("load object keys failed: %w", err)
+			}
+		}
+		if entry.kind == snapshotMetaEntry && entry.name == expiryMetaName {
+			if deadlines, err = decodeExpiry(entry.data, ts.config.ExpiryResolution); err != nil {
+				return fmt.Errorf("load expiry failed: %w", err)
+			}
+		}
+		if entry.kind == snapshotMetaEntry && strings.HasPrefix(entry.name, attrMetaPrefix) {
+			attr := strings.TrimPrefix(entry.name, attrMetaPrefix)
+			if attrs[attr], err = decodeBSI(entry.data); err != nil {
+				return fmt.Errorf("load attribute %s failed: %w", attr, err)
+			}
+		}
+		if entry.kind != snapshotTagEntry {
+			continue
+		}
+
 		bitmap := roaring.NewBitmap()
-		if _, err := bitmap.ReadFrom(bytes.NewReader(buf)); err != nil {
-			return fmt.Errorf("load tag %s failed: %w", tag, err)
+		if zeroCopy {
+			_, err = bitmap.FromBuffer(entry.data)
+		} else {
+			_, err = bitmap.ReadFrom(bytes.NewReader(entry.data))
 		}
-		ts.tags[tag] = bitmap
+		if err != nil {
+			return fmt.Errorf("load tag %s failed: %w", entry.name, err)
+		}
+		tags[entry.name] = bitmap
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if zeroCopy {
+		ts.mapped = append(ts.mapped, buf)
+		keep = true
+	}
+
+	for tag, bitmap := range tags {
+		ts.setTagLocked(tag, bitmap)
 		ts.allObjects.Or(bitmap)
+		ts.dirty[tag] = struct{}{} // Not in the store yet
+	}
+	if keys != nil {
+		ts.keys = keys
+		for chunk := uint32(0); chunk < keys.chunks(); chunk++ {
+			ts.keysDirty[chunk] = struct{}{}
+		}
+	}
+	if deadlines != nil {
+		ts.setExpiryLocked(deadlines)
+		ts.expiryDirty = true
+	}
+	for attr, index := range attrs {
+		ts.attrs[attr] = index
+		ts.allObjects.Or(index.exists)
+		ts.attrsDirty[attr] = struct{}{}
+	}
+	ts.rebuildReverseLocked()
+
+	if ts.cache != nil {
+		ts.cache.purge()
+	}
+
+	// Apply the mutations logged after the snapshot was taken
+	if ts.wal != nil {
+		if _, err := ts.wal.replay(ts.applyLocked); err != nil {
+			return fmt.Errorf("wal replay failed: %w", err)
+		}
 	}
 
 	return nil
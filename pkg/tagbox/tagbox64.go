@@ -0,0 +1,657 @@
+package tagbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+// TagSystem64 is a TagSystem for 64-bit object IDs, backed by roaring64
+// bitmaps.
+//
+// It has the same tagging, tag lifecycle, query, persistence and snapshot
+// API as TagSystem. Stores and snapshots record the ID width they hold, so
+// a TagSystem64 refuses to open data written by a TagSystem and vice
+// versa. The write-ahead log, transactions, deadlines, attributes, the
+// query result cache, memory-mapped snapshots and the object key
+// dictionary are only available on TagSystem.
+type TagSystem64 struct {
+	// The lock, the store, dirty tracking and the background workers
+	*persister
+
+	tags map[string]*roaring64.Bitmap
+
+	// For tracking unique objects across all tags
+	allObjects *roaring64.Bitmap
+}
+
+// ErrUnsupportedConfig is returned by New64 when the configuration enables
+// a feature that only TagSystem implements.
+var ErrUnsupportedConfig = errors.New("configuration not supported by TagSystem64")
+
+// New64 creates a new TagSystem64 with the given configuration.
+// It persists to config.Store, or connects to the Redis server in the
+// configuration when no store is set. It fails with ErrUnsupportedConfig
+// if the configuration enables a feature TagSystem64 lacks, rather than
+// silently running without it.
+func New64(config Config) (*TagSystem64, error) {
+	if err := checkConfig64(config); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	store := config.Store
+	if store == nil {
+		redisStore, err := DialRedisStore(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		store = redisStore
+	}
+
+	if err := claimIDWidth(ctx, store, 64, config.ReadOnly); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	ts := &TagSystem64{
+		tags:       make(map[string]*roaring64.Bitmap),
+		allObjects: roaring64.New(),
+	}
+	ts.persister = newPersister(ctx, ts, store, config)
+
+	ts.startSaveWorker()
+
+	return ts, nil
+}
+
+// checkConfig64 reports the first option of config that TagSystem64 does
+// not implement.
+func checkConfig64(config Config) error {
+	var option string
+	switch {
+	case config.WALDir != "":
+		option = "WALDir"
+	case config.CacheResults:
+		option = "CacheResults"
+	case config.ReverseIndex:
+		option = "ReverseIndex"
+	case config.MmapSnapshot:
+		option = "MmapSnapshot"
+	case len(config.ExclusiveDimensions) > 0:
+		option = "ExclusiveDimensions"
+	case config.TagHierarchy:
+		option = "TagHierarchy"
+	default:
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnsupportedConfig, option)
+}
+
+// AddTag adds a tag to an object.
+// If the tag doesn't exist, it will be created.
+func (ts *TagSystem64) AddTag(objectID uint64, tag string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		bitmap = roaring64.New()
+		ts.tags[tag] = bitmap
+	}
+
+	if bitmap.CheckedAdd(objectID) {
+		ts.allObjects.Add(objectID)
+		ts.markDirtyLocked(tag)
+	}
+
+	return nil
+}
+
+// RemoveTag removes a tag from an object.
+func (ts *TagSystem64) RemoveTag(objectID uint64, tag string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	bitmap, exists := ts.tags[tag]
+	if !exists || !bitmap.CheckedRemove(objectID) {
+		return nil // Nothing to remove
+	}
+
+	// If bitmap is empty, remove the tag; the next save deletes it from
+	// the store
+	if bitmap.IsEmpty() {
+		delete(ts.tags, tag)
+	}
+
+	ts.markDirtyLocked(tag)
+
+	return nil
+}
+
+// BatchAddTags adds multiple tags to an object in a single operation.
+func (ts *TagSystem64) BatchAddTags(objectID uint64, tags []string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var changed []string
+	for _, tag := range tags {
+		bitmap, exists := ts.tags[tag]
+		if !exists {
+			bitmap = roaring64.New()
+			ts.tags[tag] = bitmap
+		}
+		if bitmap.CheckedAdd(objectID) {
+			changed = append(changed, tag)
+		}
+	}
+
+	if len(changed) > 0 {
+		ts.allObjects.Add(objectID)
+		ts.markDirtyLocked(changed...)
+	}
+
+	return nil
+}
+
+// BatchAddObjectsToTag adds multiple objects to a single tag.
+func (ts *TagSystem64) BatchAddObjectsToTag(objectIDs []uint64, tag string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		bitmap = roaring64.New()
+		ts.tags[tag] = bitmap
+	}
+
+	tagSize := bitmap.GetCardinality()
+
+	bitmap.AddMany(objectIDs)
+	ts.allObjects.AddMany(objectIDs)
+
+	if bitmap.GetCardinality() != tagSize {
+		ts.markDirtyLocked(tag)
+	}
+
+	return nil
+}
+
+// ReplaceTag sets the objects of a tag to exactly objectIDs as a single
+// mutation: readers see either the old contents or the new, never a mix.
+// An empty objectIDs deletes the tag.
+func (ts *TagSystem64) ReplaceTag(tag string, objectIDs []uint64) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	_, exists := ts.tags[tag]
+	if len(objectIDs) == 0 {
+		if exists {
+			delete(ts.tags, tag)
+			ts.markDirtyLocked(tag)
+		}
+		return nil
+	}
+
+	bitmap := roaring64.BitmapOf(objectIDs...)
+	ts.tags[tag] = bitmap
+	ts.allObjects.Or(bitmap)
+	ts.markDirtyLocked(tag)
+
+	return nil
+}
+
+// DeleteTag removes a tag from every object that has it; the next flush
+// deletes it from the store. Objects stay in the universe that NOT queries
+// complement against, as with RemoveTag. Deleting a tag that does not
+// exist does nothing.
+func (ts *TagSystem64) DeleteTag(tag string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, exists := ts.tags[tag]; !exists {
+		return nil
+	}
+
+	delete(ts.tags, tag)
+	ts.markDirtyLocked(tag)
+
+	return nil
+}
+
+// RenameTag gives the objects of tag from to tag to instead. It fails with
+// ErrTagNotFound if from does not exist and with ErrTagExists if to does;
+// use MergeTags to combine two tags.
+func (ts *TagSystem64) RenameTag(from, to string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if rename, err := checkRename(ts.tags, from, to); !rename {
+		return err
+	}
+
+	ts.tags[to] = ts.tags[from]
+	delete(ts.tags, from)
+	ts.markDirtyLocked(from, to)
+
+	return nil
+}
+
+// MergeTags moves the objects of every tag in from to tag into, which is
+// created if needed, and deletes the tags in from. It fails with
+// ErrTagNotFound, changing nothing, if a tag in from does not exist.
+func (ts *TagSystem64) MergeTags(into string, from ...string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	from, err := checkMerge(ts.tags, into, from)
+	if err != nil {
+		return err
+	}
+	if len(from) == 0 {
+		return nil
+	}
+
+	target, exists := ts.tags[into]
+	if !exists {
+		target = roaring64.New()
+		ts.tags[into] = target
+	}
+	for _, tag := range from {
+		target.Or(ts.tags[tag])
+		delete(ts.tags, tag)
+	}
+	ts.markDirtyLocked(append([]string{into}, from...)...)
+
+	return nil
+}
+
+// CopyTag creates tag to with the objects of tag from. It fails with
+// ErrTagNotFound if from does not exist and with ErrTagExists if to does.
+func (ts *TagSystem64) CopyTag(from, to string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if err := checkCopy(ts.tags, from, to); err != nil {
+		return err
+	}
+
+	ts.tags[to] = ts.tags[from].Clone()
+	ts.markDirtyLocked(to)
+
+	return nil
+}
+
+// HasTag checks if an object has a specific tag.
+func (ts *TagSystem64) HasTag(objectID uint64, tag string) bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		return false
+	}
+
+	return bitmap.Contains(objectID)
+}
+
+// GetObjectTags returns all tags for a specific object.
+func (ts *TagSystem64) GetObjectTags(objectID uint64) ([]string, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	var tags []string
+	for tag, bitmap := range ts.tags {
+		if bitmap.Contains(objectID) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+// GetAllTags returns all tag names in the system.
+func (ts *TagSystem64) GetAllTags() []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	tags := make([]string, 0, len(ts.tags))
+	for tag := range ts.tags {
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// GetTagCount returns the number of objects with a specific tag.
+func (ts *TagSystem64) GetTagCount(tag string) (uint64, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		return 0, nil
+	}
+
+	return bitmap.GetCardinality(), nil
+}
+
+// GetStats returns statistics about the tag system.
+func (ts *TagSystem64) GetStats() Stats {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	stats := Stats{
+		TotalTags:     len(ts.tags),
+		UniqueObjects: ts.allObjects.GetCardinality(),
+		DirtyTags:     len(ts.dirty),
+	}
+
+	var maxCardinality uint64
+
+	for tag, bitmap := range ts.tags {
+		cardinality := bitmap.GetCardinality()
+		stats.TotalObjects += cardinality
+		stats.MemoryUsage += bitmap.GetSizeInBytes()
+
+		if cardinality > maxCardinality {
+			maxCardinality = cardinality
+			stats.LargestTag = tag
+			stats.LargestTagSize = cardinality
+		}
+	}
+
+	return stats
+}
+
+// Query returns objects that have a specific tag.
+func (ts *TagSystem64) Query(tag string) (*roaring64.Bitmap, error) {
+	return ts.Eval(Tag(tag))
+}
+
+// QueryAnd returns objects that have ALL the specified tags (intersection).
+func (ts *TagSystem64) QueryAnd(tags []string) (*roaring64.Bitmap, error) {
+	if len(tags) == 0 {
+		return roaring64.New(), nil
+	}
+
+	return ts.Eval(And(Tags(tags...)...))
+}
+
+// QueryOr returns objects that have ANY of the specified tags (union).
+func (ts *TagSystem64) QueryOr(tags []string) (*roaring64.Bitmap, error) {
+	return ts.Eval(Or(Tags(tags...)...))
+}
+
+// QueryNot returns objects in allObjects that DON'T have the specified tag.
+func (ts *TagSystem64) QueryNot(tag string, allObjects *roaring64.Bitmap) (*roaring64.Bitmap, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		return allObjects.Clone(), nil
+	}
+
+	return roaring64.AndNot(allObjects, bitmap), nil
+}
+
+// QueryNotInSystem returns objects in the system that DON'T have the
+// specified tag.
+func (ts *TagSystem64) QueryNotInSystem(tag string) (*roaring64.Bitmap, error) {
+	return ts.Eval(Not(Tag(tag)))
+}
+
+// QueryDifference returns objects that have tag1 but NOT tag2.
+func (ts *TagSystem64) QueryDifference(tag1, tag2 string) (*roaring64.Bitmap, error) {
+	return ts.Eval(And(Tag(tag1), Not(Tag(tag2))))
+}
+
+// QueryXor returns objects that have either tag1 or tag2, but not both.
+func (ts *TagSystem64) QueryXor(tag1, tag2 string) (*roaring64.Bitmap, error) {
+	return ts.Eval(Xor(Tag(tag1), Tag(tag2)))
+}
+
+// QueryExpr parses a boolean query expression and evaluates it.
+// See ParseQuery for the syntax.
+func (ts *TagSystem64) QueryExpr(expr string) (*roaring64.Bitmap, error) {
+	node, err := ParseQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return ts.Eval(node)
+}
+
+// Eval evaluates a query tree. The returned bitmap is owned by the caller.
+func (ts *TagSystem64) Eval(node Node) (*roaring64.Bitmap, error) {
+	if node == nil {
+		return nil, fmt.Errorf("nil query")
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	result, owned, err := executor[*roaring64.Bitmap]{bitmapFuncs64, ts}.exec(plan(node))
+	if err != nil {
+		return nil, err
+	}
+	if !owned {
+		result = result.Clone()
+	}
+
+	return result, nil
+}
+
+// queryBitmapLocked returns the bitmap of tag.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem64) queryBitmapLocked(tag string) (*roaring64.Bitmap, bool) {
+	bitmap, exists := ts.tags[tag]
+	return bitmap, exists
+}
+
+// execDimensionLocked returns the union of the tags of a dimension.
+// Without a dimension index, it scans the tag names.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem64) execDimensionLocked(dimension string) (*roaring64.Bitmap, bool, error) {
+	var bitmaps []*roaring64.Bitmap
+	for tag, bitmap := range ts.tags {
+		if d, _, ok := SplitTag(tag); ok && d == dimension {
+			bitmaps = append(bitmaps, bitmap)
+		}
+	}
+
+	switch len(bitmaps) {
+	case 0:
+		return roaring64.New(), true, nil
+	case 1:
+		return bitmaps[0], false, nil
+	}
+
+	return roaring64.FastOr(bitmaps...), true, nil
+}
+
+// execAttrLocked fails: TagSystem64 does not store attributes.
+func (ts *TagSystem64) execAttrLocked(n *attrNode) (*roaring64.Bitmap, error) {
+	return nil, fmt.Errorf("attribute queries are not supported by TagSystem64: %s", n)
+}
+
+// universeLocked returns the bitmap of all known objects.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem64) universeLocked() *roaring64.Bitmap {
+	return ts.allObjects
+}
+
+// tagNamesLocked returns the names of all tags.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem64) tagNamesLocked() []string {
+	tags := make([]string, 0, len(ts.tags))
+	for tag := range ts.tags {
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// serializeTagLocked returns the serialization of a tag and whether it
+// exists.
+// Caller must hold ts.mu.RLock().
+func (ts *TagSystem64) serializeTagLocked(tag string) ([]byte, bool, error) {
+	bitmap, exists := ts.tags[tag]
+	if !exists {
+		return nil, false, nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := bitmap.WriteTo(&buf); err != nil {
+		return nil, true, err
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+// beginFlushLocked adds nothing to a flush; a TagSystem64 has no
+// metadata or log.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem64) beginFlushLocked(full bool) flushPlan {
+	return flushPlan{}
+}
+
+// stopWorkers does nothing; the save and snapshot workers are stopped by
+// the persister.
+func (ts *TagSystem64) stopWorkers() {}
+
+// release does nothing; a TagSystem64 holds no resources besides the
+// store.
+func (ts *TagSystem64) release() error {
+	return nil
+}
+
+// LoadTag loads a specific tag from the store.
+func (ts *TagSystem64) LoadTag(tag string) error {
+	data, err := ts.store.LoadTag(ts.ctx, tag)
+	if err != nil {
+		if errors.Is(err, ErrTagNotFound) {
+			return fmt.Errorf("tag not found: %s", tag)
+		}
+		return err
+	}
+
+	bitmap := roaring64.New()
+	if _, err := bitmap.ReadFrom(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("deserialization failed: %w", err)
+	}
+
+	ts.mu.Lock()
+	ts.tags[tag] = bitmap
+	ts.allObjects.Or(bitmap)
+	ts.mu.Unlock()
+
+	return nil
+}
+
+// Recover recovers tag data from the store.
+// This should be called after creating a new TagSystem64 to restore
+// existing data.
+func (ts *TagSystem64) Recover() error {
+	data, loadErr := ts.store.LoadAll(ts.ctx)
+	if data == nil && loadErr != nil {
+		return loadErr
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var errs []error
+	if loadErr != nil {
+		errs = append(errs, loadErr)
+	}
+
+	for tag, buf := range data {
+		bitmap := roaring64.New()
+		if _, err := bitmap.ReadFrom(bytes.NewReader(buf)); err != nil {
+			errs = append(errs, fmt.Errorf("tag %s: %w", tag, err))
+			continue
+		}
+
+		ts.tags[tag] = bitmap
+		ts.allObjects.Or(bitmap)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("recover completed with %d errors: %v", len(errs), errs)
+	}
+
+	return nil
+}
+
+// SaveSnapshot saves all tags to a snapshot file.
+// The file is written atomically and marked as holding 64-bit object IDs.
+func (ts *TagSystem64) SaveSnapshot(filePath string) error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return WriteFileAtomic(filePath, func(w io.Writer) error {
+		sw, err := newSnapshotWriter(w, snapshotFlag64)
+		if err != nil {
+			return err
+		}
+
+		for tag, bitmap := range ts.tags {
+			if err := sw.add(snapshotTagEntry, tag, bitmap.WriteTo); err != nil {
+				return fmt.Errorf("failed to serialize tag %s: %w", tag, err)
+			}
+		}
+
+		return sw.close()
+	})
+}
+
+// LoadSnapshot loads all tags from a snapshot file written by
+// TagSystem64.SaveSnapshot. Checksums are verified before any tag is
+// loaded.
+func (ts *TagSystem64) LoadSnapshot(filePath string) error {
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	flags, entries, err := parseSnapshot(buf)
+	if err != nil {
+		return fmt.Errorf("load snapshot %s: %w", filePath, err)
+	}
+	if flags&snapshotFlag64 == 0 {
+		return fmt.Errorf("load snapshot %s: %w: snapshot holds 32-bit object IDs", filePath, ErrIDWidthMismatch)
+	}
+
+	tags := make(map[string]*roaring64.Bitmap, len(entries))
+	for _, entry := range entries {
+		if entry.kind != snapshotTagEntry {
+			continue
+		}
+
+		bitmap := roaring64.New()
+		if _, err := bitmap.ReadFrom(bytes.NewReader(entry.data)); err != nil {
+			return fmt.Errorf("load tag %s failed: %w", entry.name, err)
+		}
+		tags[entry.name] = bitmap
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for tag, bitmap := range tags {
+		ts.tags[tag] = bitmap
+		ts.allObjects.Or(bitmap)
+		ts.dirty[tag] = struct{}{} // Not in the store yet
+	}
+
+	return nil
+}
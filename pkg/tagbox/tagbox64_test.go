@@ -0,0 +1,251 @@
+package tagbox
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestTagSystem64 creates a TagSystem64 on the given store
+func newTestTagSystem64(t *testing.T, store Store) *TagSystem64 {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+
+	ts, err := New64(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem64: %v", err)
+	}
+
+	return ts
+}
+
+// TestTagSystem64_Basic tests tagging and querying IDs beyond 32 bits
+func TestTagSystem64_Basic(t *testing.T) {
+	ts := newTestTagSystem64(t, NewMemoryStore())
+	defer ts.Close()
+
+	const big = uint64(1) << 40
+
+	ts.AddTag(big, "vip")
+	ts.AddTag(big+1, "vip")
+	ts.BatchAddTags(big, []string{"male", "active"})
+	ts.BatchAddObjectsToTag([]uint64{7, big + 1}, "active")
+
+	if !ts.HasTag(big, "male") || ts.HasTag(big+1, "male") {
+		t.Error("HasTag returned wrong results")
+	}
+	if count, _ := ts.GetTagCount("active"); count != 3 {
+		t.Errorf("expected 3 active objects, got %d", count)
+	}
+
+	tests := []struct {
+		expr string
+		want []uint64
+	}{
+		{"vip", []uint64{big, big + 1}},
+		{"vip AND male", []uint64{big}},
+		{"active AND NOT vip", []uint64{7}},
+		{"male XOR active", []uint64{7, big + 1}},
+		{"NOT active", []uint64{}},
+	}
+	for _, tt := range tests {
+		result, err := ts.QueryExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := result.ToArray(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	ts.RemoveTag(big, "male")
+	if tags := ts.GetAllTags(); len(tags) != 2 {
+		t.Errorf("expected the empty male tag to be dropped, got %v", tags)
+	}
+	if stats := ts.GetStats(); stats.UniqueObjects != 3 {
+		t.Errorf("expected 3 unique objects, got %d", stats.UniqueObjects)
+	}
+}
+
+// TestTagSystem64_Persistence tests flushing, recovering and snapshots
+func TestTagSystem64_Persistence(t *testing.T) {
+	store := NewMemoryStore()
+	path := filepath.Join(t.TempDir(), "tags64.snap")
+	const big = uint64(1) << 33
+
+	ts1 := newTestTagSystem64(t, store)
+	ts1.AddTag(big, "vip")
+	ts1.AddTag(1, "vip")
+	if _, err := ts1.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := ts1.SaveSnapshot(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	ts2 := newTestTagSystem64(t, store)
+	defer ts2.Close()
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("failed to recover: %v", err)
+	}
+	if !ts2.HasTag(big, "vip") {
+		t.Error("object should have vip tag after recovery")
+	}
+
+	ts3 := newTestTagSystem64(t, NewMemoryStore())
+	defer ts3.Close()
+	if err := ts3.LoadSnapshot(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	if count, _ := ts3.GetTagCount("vip"); count != 2 {
+		t.Errorf("expected 2 objects with vip tag, got %d", count)
+	}
+
+	// A 32-bit tag system refuses the 64-bit snapshot
+	ts32 := newMemoryTagSystem(t)
+	if err := ts32.LoadSnapshot(path); !errors.Is(err, ErrIDWidthMismatch) {
+		t.Errorf("expected ErrIDWidthMismatch, got %v", err)
+	}
+}
+
+// TestTagSystem64_WidthMismatch tests that stores of different widths are never mixed
+func TestTagSystem64_WidthMismatch(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+
+	// A store claimed by a 32-bit tag system
+	config.Store = NewMemoryStore()
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	if _, err := New64(config); !errors.Is(err, ErrIDWidthMismatch) {
+		t.Errorf("expected ErrIDWidthMismatch from New64, got %v", err)
+	}
+	ts.Close()
+
+	// A store claimed by a 64-bit tag system
+	config.Store = NewMemoryStore()
+	ts64, err := New64(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem64: %v", err)
+	}
+	if _, err := New(config); !errors.Is(err, ErrIDWidthMismatch) {
+		t.Errorf("expected ErrIDWidthMismatch from New, got %v", err)
+	}
+	ts64.Close()
+
+	// Tags saved before widths were recorded are 32-bit
+	legacy := NewMemoryStore()
+	legacy.SaveTag(context.Background(), "vip", []byte{})
+	config.Store = legacy
+	if _, err := New64(config); !errors.Is(err, ErrIDWidthMismatch) {
+		t.Errorf("expected ErrIDWidthMismatch for unmarked tags, got %v", err)
+	}
+}
+
+// TestTagSystem64_UnsupportedConfig tests that New64 refuses options it
+// would otherwise ignore
+func TestTagSystem64_UnsupportedConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		option func(*Config)
+	}{
+		{"WALDir", func(c *Config) { c.WALDir = t.TempDir() }},
+		{"CacheResults", func(c *Config) { c.CacheResults = true }},
+		{"ReverseIndex", func(c *Config) { c.ReverseIndex = true }},
+		{"MmapSnapshot", func(c *Config) { c.MmapSnapshot = true }},
+		{"ExclusiveDimensions", func(c *Config) { c.ExclusiveDimensions = []string{"city"} }},
+		{"TagHierarchy", func(c *Config) { c.TagHierarchy = true }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.AutoSave = false
+			config.Store = NewMemoryStore()
+			tt.option(&config)
+
+			if _, err := New64(config); !errors.Is(err, ErrUnsupportedConfig) {
+				t.Errorf("expected ErrUnsupportedConfig, got %v", err)
+			}
+		})
+	}
+}
+
+// TestTagSystem64_Lifecycle tests replacing, renaming, merging, copying
+// and deleting tags, and that they reach the store
+func TestTagSystem64_Lifecycle(t *testing.T) {
+	store := NewMemoryStore()
+	ts := newTestTagSystem64(t, store)
+	defer ts.Close()
+
+	const big = uint64(1) << 40
+
+	ts.BatchAddObjectsToTag([]uint64{1, big}, "city:peking")
+	ts.AddTag(2, "city:pekin")
+	ts.AddTag(3, "vip")
+	ts.ReplaceTag("segment", []uint64{big, 4})
+
+	if err := ts.RenameTag("missing", "x"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("renaming a missing tag = %v, want ErrTagNotFound", err)
+	}
+	if err := ts.RenameTag("vip", "segment"); !errors.Is(err, ErrTagExists) {
+		t.Errorf("renaming onto an existing tag = %v, want ErrTagExists", err)
+	}
+	if err := ts.MergeTags("city:beijing", "city:peking", "missing"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("merging a missing tag = %v, want ErrTagNotFound", err)
+	}
+
+	ts.RenameTag("vip", "premium")
+	if err := ts.MergeTags("city:beijing", "city:peking", "city:pekin", "city:peking"); err != nil {
+		t.Fatalf("merging a tag twice: %v", err)
+	}
+	ts.CopyTag("segment", "segment/backup")
+	ts.ReplaceTag("segment", []uint64{5})
+	ts.DeleteTag("premium")
+
+	tests := []struct {
+		expr string
+		want []uint64
+	}{
+		{"city:beijing", []uint64{1, 2, big}},
+		{"city:peking OR city:pekin OR vip OR premium", []uint64{}},
+		{"segment", []uint64{5}},
+		{"segment/backup", []uint64{4, big}},
+		{"city:beijing AND NOT segment/backup", []uint64{1, 2}},
+		{"city:* AND segment/backup", []uint64{big}},
+		{"NOT city:* AND NOT segment", []uint64{3, 4}},
+	}
+	for _, tt := range tests {
+		result, err := ts.QueryExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := result.ToArray(); !reflect.DeepEqual(got, tt.want) && !(len(got) == 0 && len(tt.want) == 0) {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	if _, err := ts.QueryExpr("age > 30"); err == nil {
+		t.Error("expected attribute queries to fail")
+	}
+
+	// Queries never modify the tag bitmaps they read
+	if count, _ := ts.GetTagCount("city:beijing"); count != 3 {
+		t.Errorf("city:beijing has %d objects after the queries, want 3", count)
+	}
+
+	if _, err := ts.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	tags, _ := store.ListTags(context.Background())
+	if want := []string{"city:beijing", "segment", "segment/backup"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("stored tags = %v, want %v", tags, want)
+	}
+}
@@ -1,9 +1,14 @@
 package tagbox
 
 import (
+	"context"
+	"errors"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/alicebob/miniredis/v2"
@@ -577,6 +582,40 @@ func TestTagSystem_Snapshot(t *testing.T) {
 	}
 }
 
+// TestTagSystem_ReplaceTag tests replacing the contents of a tag
+func TestTagSystem_ReplaceTag(t *testing.T) {
+	ts := newReverseTagSystem(t, NewMemoryStore())
+
+	ts.BatchAddObjectsToTag([]uint32{1, 2, 3}, "segment")
+	ts.AddTagWithTTL(2, "segment", time.Hour)
+	ts.AddTagWithTTL(3, "segment", time.Hour)
+
+	if err := ts.ReplaceTag("segment", []uint32{2, 4, 5}); err != nil {
+		t.Fatalf("failed to replace tag: %v", err)
+	}
+
+	result, _ := ts.Query("segment")
+	if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{2, 4, 5}) {
+		t.Errorf("segment = %v, want [2 4 5]", got)
+	}
+	if tags, _ := ts.GetObjectTags(1); len(tags) != 0 {
+		t.Errorf("object 1 tags = %v, want none", tags)
+	}
+	if _, ok := ts.GetTagExpiry(2, "segment"); !ok {
+		t.Error("deadline of a kept assignment was cleared")
+	}
+	if _, ok := ts.GetTagExpiry(3, "segment"); ok {
+		t.Error("deadline of a removed assignment was kept")
+	}
+
+	if err := ts.ReplaceTag("segment", nil); err != nil {
+		t.Fatalf("failed to replace tag: %v", err)
+	}
+	if tags := ts.GetAllTags(); len(tags) != 0 {
+		t.Errorf("tags after an empty replace = %v", tags)
+	}
+}
+
 // BenchmarkTagSystem_AddTag benchmarks adding tags
 func BenchmarkTagSystem_AddTag(b *testing.B) {
 	_, client, cleanup := setupTestRedis(b)
@@ -692,3 +731,66 @@ func BenchmarkTagSystem_HasTag(b *testing.B) {
 //	// Output: [1]
 //}
 //*/
+
+// TestTagSystem_CloseTwice tests that Close can be called again
+func TestTagSystem_CloseTwice(t *testing.T) {
+	config := DefaultConfig()
+	config.Store = NewMemoryStore()
+	config.EnableSnapshot = true
+	config.SnapshotPath = filepath.Join(t.TempDir(), "tags.snap")
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	ts.StartSnapshot()
+	ts.AddTagWithTTL(1, "trial", time.Hour) // Starts the reaper
+
+	if err := ts.Close(); err != nil {
+		t.Fatalf("first close failed: %v", err)
+	}
+	if err := ts.Close(); err != nil {
+		t.Errorf("second close failed: %v", err)
+	}
+}
+
+// failingSaveStore is a store whose saves fail and that records Close
+type failingSaveStore struct {
+	Store
+	closed bool
+}
+
+func (s *failingSaveStore) SaveTag(ctx context.Context, tag string, data []byte) error {
+	return errors.New("disk full")
+}
+
+func (s *failingSaveStore) Close() error {
+	s.closed = true
+	return s.Store.Close()
+}
+
+// TestTagSystem_CloseSaveFails tests that Close releases the store even
+// when the final save fails
+func TestTagSystem_CloseSaveFails(t *testing.T) {
+	store := &failingSaveStore{Store: NewMemoryStore()}
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+	config.WALDir = t.TempDir()
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	ts.AddTag(1, "vip")
+
+	if err := ts.Close(); err == nil {
+		t.Error("Close succeeded although the save failed")
+	}
+	if !store.closed {
+		t.Error("store was not closed after the save failed")
+	}
+	if err := ts.wal.file.Close(); err == nil {
+		t.Error("log segment was left open after the save failed")
+	}
+}
@@ -0,0 +1,18 @@
+package tagbox
+
+import "github.com/RoaringBitmap/roaring"
+
+// Tagger is the set of tag operations shared by an embedded TagSystem and
+// the remote clients in pkg/grpcapi, so callers can switch between them.
+type Tagger interface {
+	AddTag(objectID uint32, tag string) error
+	RemoveTag(objectID uint32, tag string) error
+	BatchAddTags(objectID uint32, tags []string) error
+	BatchAddObjectsToTag(objectIDs []uint32, tag string) error
+	Query(tag string) (*roaring.Bitmap, error)
+	QueryExpr(expr string) (*roaring.Bitmap, error)
+	GetObjectTags(objectID uint32) ([]string, error)
+	GetTagCount(tag string) (uint64, error)
+}
+
+var _ Tagger = (*TagSystem)(nil)
@@ -0,0 +1,236 @@
+package tagbox
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTxnDone is returned when committing a transaction that was already
+// committed or discarded.
+var ErrTxnDone = errors.New("tagbox: transaction already committed or discarded")
+
+// ErrInvalidTxn is returned by Txn.Commit for a malformed operation, such
+// as one with an empty tag. Nothing of the transaction is applied.
+var ErrInvalidTxn = errors.New("tagbox: invalid transaction")
+
+// PreconditionError is returned by Txn.Commit when an object does not
+// carry a tag it must have, or carries one it must not have. Nothing of
+// the transaction is applied.
+type PreconditionError struct {
+	Op       int    // Index of the failed operation
+	ObjectID uint32 // The object checked
+	Tag      string // The tag checked
+	Has      bool   // Whether the object has the tag
+}
+
+func (e *PreconditionError) Error() string {
+	if e.Has {
+		return fmt.Sprintf("tagbox: transaction op %d: object %d already has tag %s", e.Op, e.ObjectID, e.Tag)
+	}
+	return fmt.Sprintf("tagbox: transaction op %d: object %d does not have tag %s", e.Op, e.ObjectID, e.Tag)
+}
+
+// txnKind identifies an operation recorded in a Txn.
+type txnKind uint8
+
+const (
+	txnAdd        txnKind = iota // AddTag
+	txnRemove                    // RemoveTag
+	txnAddTags                   // BatchAddTags
+	txnAddObjects                // BatchAddObjectsToTag
+	txnMove                      // MoveTag
+	txnRequire                   // Require
+	txnRequireNot                // RequireNot
+)
+
+// txnOp is an operation recorded in a Txn.
+type txnOp struct {
+	kind txnKind
+	ids  []uint32
+	tags []string // For txnMove, the source then the destination
+}
+
+// assignment is an object-tag pair.
+type assignment struct {
+	objectID uint32
+	tag      string
+}
+
+// Txn batches mutations across objects and tags and applies them as one
+// unit: Commit validates every operation against the current state and
+// then applies all of them under a single write lock, writes them to the
+// WAL as a single record and marks them dirty together, so readers, crash
+// recovery and the next flush see either none or all of them.
+//
+// Operations are recorded in order and nothing is applied before Commit.
+// A Txn is not safe for concurrent use.
+type Txn struct {
+	ts   *TagSystem
+	ops  []txnOp
+	done bool
+}
+
+// Begin starts a transaction.
+func (ts *TagSystem) Begin() *Txn {
+	return &Txn{ts: ts}
+}
+
+// Update runs fn in a transaction and commits it, unless fn returns an
+// error, which discards the transaction and is returned.
+func (ts *TagSystem) Update(fn func(tx *Txn) error) error {
+	tx := ts.Begin()
+	if err := fn(tx); err != nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddTag records adding a tag to an object.
+func (tx *Txn) AddTag(objectID uint32, tag string) {
+	tx.ops = append(tx.ops, txnOp{kind: txnAdd, ids: []uint32{objectID}, tags: []string{tag}})
+}
+
+// RemoveTag records removing a tag from an object.
+func (tx *Txn) RemoveTag(objectID uint32, tag string) {
+	tx.ops = append(tx.ops, txnOp{kind: txnRemove, ids: []uint32{objectID}, tags: []string{tag}})
+}
+
+// BatchAddTags records adding multiple tags to an object.
+func (tx *Txn) BatchAddTags(objectID uint32, tags []string) {
+	tags = append([]string(nil), tags...)
+	tx.ops = append(tx.ops, txnOp{kind: txnAddTags, ids: []uint32{objectID}, tags: tags})
+}
+
+// BatchAddObjectsToTag records adding multiple objects to a tag.
+func (tx *Txn) BatchAddObjectsToTag(objectIDs []uint32, tag string) {
+	objectIDs = append([]uint32(nil), objectIDs...)
+	tx.ops = append(tx.ops, txnOp{kind: txnAddObjects, ids: objectIDs, tags: []string{tag}})
+}
+
+// MoveTag records replacing tag from with tag to on an object. The commit
+// fails unless the object has from at that point of the transaction.
+func (tx *Txn) MoveTag(objectID uint32, from, to string) {
+	tx.ops = append(tx.ops, txnOp{kind: txnMove, ids: []uint32{objectID}, tags: []string{from, to}})
+}
+
+// Require makes the commit fail unless the object has the tag at that
+// point of the transaction.
+func (tx *Txn) Require(objectID uint32, tag string) {
+	tx.ops = append(tx.ops, txnOp{kind: txnRequire, ids: []uint32{objectID}, tags: []string{tag}})
+}
+
+// RequireNot makes the commit fail if the object has the tag at that point
+// of the transaction.
+func (tx *Txn) RequireNot(objectID uint32, tag string) {
+	tx.ops = append(tx.ops, txnOp{kind: txnRequireNot, ids: []uint32{objectID}, tags: []string{tag}})
+}
+
+// Len returns the number of recorded operations.
+func (tx *Txn) Len() int {
+	return len(tx.ops)
+}
+
+// Discard drops the recorded operations without applying them.
+func (tx *Txn) Discard() {
+	tx.ops = nil
+	tx.done = true
+}
+
+// Commit validates and applies the recorded operations. If an operation is
+// invalid or a precondition fails, Commit returns the error and the tag
+// system is left unchanged. Preconditions see the effect of the operations
+// recorded before them, but not removals caused by exclusive dimensions.
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.done = true
+
+	ts := tx.ts
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	records, err := tx.validateLocked()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	rec := walRecord{op: walTxn, records: records}
+	if err := ts.logLocked(rec); err != nil {
+		return err
+	}
+
+	ts.applyLocked(rec)
+
+	return nil
+}
+
+// validateLocked checks the recorded operations against the current state
+// and returns the mutations to log and apply.
+// Caller must hold tx.ts.mu.Lock().
+func (tx *Txn) validateLocked() ([]walRecord, error) {
+	ts := tx.ts
+
+	// pending holds the assignments changed by the operations validated
+	// so far
+	pending := make(map[assignment]bool)
+	has := func(objectID uint32, tag string) bool {
+		if v, ok := pending[assignment{objectID, tag}]; ok {
+			return v
+		}
+		bitmap, exists := ts.tags[tag]
+		return exists && bitmap.Contains(objectID)
+	}
+
+	var records []walRecord
+	for i, op := range tx.ops {
+		for _, tag := range op.tags {
+			if tag == "" {
+				return nil, fmt.Errorf("%w: op %d: empty tag", ErrInvalidTxn, i)
+			}
+		}
+
+		switch op.kind {
+		case txnAdd:
+			pending[assignment{op.ids[0], op.tags[0]}] = true
+			records = append(records, walRecord{op: walAdd, tags: op.tags, ids: op.ids})
+		case txnRemove:
+			pending[assignment{op.ids[0], op.tags[0]}] = false
+			records = append(records, walRecord{op: walRemove, tags: op.tags, ids: op.ids})
+		case txnAddTags:
+			for _, tag := range op.tags {
+				pending[assignment{op.ids[0], tag}] = true
+			}
+			records = append(records, walRecord{op: walAddTags, tags: op.tags, ids: op.ids})
+		case txnAddObjects:
+			for _, objectID := range op.ids {
+				pending[assignment{objectID, op.tags[0]}] = true
+			}
+			records = append(records, walRecord{op: walAddObjects, tags: op.tags, ids: op.ids})
+		case txnMove:
+			from, to := op.tags[0], op.tags[1]
+			if from == to {
+				return nil, fmt.Errorf("%w: op %d: move from %s to itself", ErrInvalidTxn, i, from)
+			}
+			if !has(op.ids[0], from) {
+				return nil, &PreconditionError{Op: i, ObjectID: op.ids[0], Tag: from}
+			}
+			pending[assignment{op.ids[0], from}] = false
+			pending[assignment{op.ids[0], to}] = true
+			records = append(records,
+				walRecord{op: walRemove, tags: []string{from}, ids: op.ids},
+				walRecord{op: walAdd, tags: []string{to}, ids: op.ids})
+		case txnRequire, txnRequireNot:
+			want := op.kind == txnRequire
+			if got := has(op.ids[0], op.tags[0]); got != want {
+				return nil, &PreconditionError{Op: i, ObjectID: op.ids[0], Tag: op.tags[0], Has: got}
+			}
+		}
+	}
+
+	return records, nil
+}
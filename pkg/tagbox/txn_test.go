@@ -0,0 +1,245 @@
+package tagbox
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// TestTxn_Commit tests that a committed transaction applies every operation
+func TestTxn_Commit(t *testing.T) {
+	ts := newReverseTagSystem(t, NewMemoryStore())
+	ts.BatchAddTags(1, []string{"plan:free", "vip"})
+	ts.AddTag(2, "plan:free")
+
+	tx := ts.Begin()
+	tx.Require(1, "vip")
+	tx.MoveTag(1, "plan:free", "plan:premium")
+	tx.RemoveTag(2, "plan:free")
+	tx.BatchAddTags(3, []string{"new", "trial"})
+	tx.BatchAddObjectsToTag([]uint32{2, 3}, "emailed")
+	tx.RequireNot(2, "plan:free")
+	if tx.Len() != 6 {
+		t.Errorf("Len = %d, want 6", tx.Len())
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	tests := []struct {
+		objectID uint32
+		want     []string
+	}{
+		{1, []string{"plan:premium", "vip"}},
+		{2, []string{"emailed"}},
+		{3, []string{"emailed", "new", "trial"}},
+	}
+	for _, tt := range tests {
+		if got := sortedTags(ts, tt.objectID); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("object %d tags = %v, want %v", tt.objectID, got, tt.want)
+		}
+	}
+	if got := ts.GetAllTags(); len(got) != 5 {
+		t.Errorf("tags = %v, want the emptied tag deleted", got)
+	}
+
+	if err := tx.Commit(); err != ErrTxnDone {
+		t.Errorf("second commit error = %v, want ErrTxnDone", err)
+	}
+}
+
+// sortedTags returns the tags of an object in sorted order
+func sortedTags(ts *TagSystem, objectID uint32) []string {
+	tags, _ := ts.GetObjectTags(objectID)
+	sort.Strings(tags)
+	return tags
+}
+
+// TestTxn_Rollback tests that a failed validation applies nothing
+func TestTxn_Rollback(t *testing.T) {
+	ts := newReverseTagSystem(t, NewMemoryStore())
+	ts.AddTag(1, "plan:free")
+
+	before := ts.GetStats()
+
+	tests := []struct {
+		name  string
+		build func(tx *Txn)
+		op    int
+	}{
+		{"require", func(tx *Txn) {
+			tx.AddTag(1, "vip")
+			tx.Require(1, "plan:premium")
+		}, 1},
+		{"require not", func(tx *Txn) {
+			tx.RemoveTag(1, "plan:free")
+			tx.AddTag(2, "vip")
+			tx.RequireNot(2, "vip")
+		}, 2},
+		{"move", func(tx *Txn) {
+			tx.MoveTag(1, "plan:free", "plan:premium")
+			tx.MoveTag(1, "plan:free", "plan:trial")
+		}, 1},
+	}
+	for _, tt := range tests {
+		tx := ts.Begin()
+		tt.build(tx)
+		err := tx.Commit()
+
+		var perr *PreconditionError
+		if !errors.As(err, &perr) || perr.Op != tt.op {
+			t.Errorf("%s: error = %v, want a precondition error at op %d", tt.name, err, tt.op)
+		}
+	}
+
+	for _, build := range []func(tx *Txn){
+		func(tx *Txn) { tx.AddTag(3, "new"); tx.AddTag(3, "") },
+		func(tx *Txn) { tx.MoveTag(1, "plan:free", "plan:free") },
+	} {
+		tx := ts.Begin()
+		build(tx)
+		if err := tx.Commit(); !errors.Is(err, ErrInvalidTxn) {
+			t.Errorf("invalid transaction error = %v, want ErrInvalidTxn", err)
+		}
+	}
+
+	errAbort := errors.New("abort")
+	err := ts.Update(func(tx *Txn) error {
+		tx.AddTag(4, "vip")
+		return errAbort
+	})
+	if err != errAbort {
+		t.Errorf("Update error = %v, want the callback error", err)
+	}
+
+	if after := ts.GetStats(); after.TotalTags != before.TotalTags || after.TotalObjects != before.TotalObjects {
+		t.Errorf("stats changed from %+v to %+v", before, after)
+	}
+	if got := sortedTags(ts, 1); !reflect.DeepEqual(got, []string{"plan:free"}) {
+		t.Errorf("object 1 tags = %v, want [plan:free]", got)
+	}
+}
+
+// TestTxn_Isolation tests that readers never see a partially applied
+// transaction
+func TestTxn_Isolation(t *testing.T) {
+	ts := newReverseTagSystem(t, NewMemoryStore())
+	ts.AddTag(1, "plan:free")
+
+	plans := []string{"plan:free", "plan:premium"}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tags, _ := ts.GetObjectTags(1)
+			if len(tags) != 1 {
+				t.Errorf("reader saw tags %v", tags)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		from, to := plans[i%2], plans[(i+1)%2]
+		err := ts.Update(func(tx *Txn) error {
+			tx.MoveTag(1, from, to)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("move %d failed: %v", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// TestTxn_WAL tests that a transaction is replayed as a whole or not at all
+func TestTxn_WAL(t *testing.T) {
+	dir := t.TempDir()
+	store := NewMemoryStore()
+
+	ts1 := newWALTagSystem(t, dir, store)
+	ts1.AddTag(1, "plan:free")
+	ts1.Update(func(tx *Txn) error {
+		tx.MoveTag(1, "plan:free", "plan:premium")
+		tx.BatchAddObjectsToTag([]uint32{1, 2}, "emailed")
+		return nil
+	})
+	crash(t, ts1)
+
+	ts2 := newWALTagSystem(t, dir, store)
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	ts2.ReplayWAL() // Replaying again changes nothing
+	if got := sortedTags(ts2, 1); !reflect.DeepEqual(got, []string{"emailed", "plan:premium"}) {
+		t.Errorf("object 1 tags after replay = %v", got)
+	}
+	if count, _ := ts2.GetTagCount("emailed"); count != 2 {
+		t.Errorf("emailed has %d objects, want 2", count)
+	}
+
+	// A torn transaction record is dropped entirely
+	ts2.Update(func(tx *Txn) error {
+		tx.MoveTag(1, "plan:premium", "plan:free")
+		tx.AddTag(3, "emailed")
+		return nil
+	})
+	crash(t, ts2)
+
+	segments := walSegments(t, dir)
+	path := segments[len(segments)-1]
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	ts3 := newWALTagSystem(t, dir, store)
+	defer ts3.Close()
+
+	if err := ts3.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	if got := sortedTags(ts3, 1); !reflect.DeepEqual(got, []string{"emailed", "plan:premium"}) {
+		t.Errorf("object 1 tags after torn transaction = %v", got)
+	}
+	if ts3.HasTag(3, "emailed") {
+		t.Error("part of a torn transaction was replayed")
+	}
+}
+
+// TestTxn_Flush tests that a committed transaction reaches the store
+func TestTxn_Flush(t *testing.T) {
+	ts := newTestTagSystem(t)
+	ts.AddTag(1, "plan:free")
+	if err := ts.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	ts.Update(func(tx *Txn) error {
+		tx.MoveTag(1, "plan:free", "plan:premium")
+		return nil
+	})
+	if err := ts.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	tags, err := ts.store.ListTags(ts.ctx)
+	if err != nil || !reflect.DeepEqual(tags, []string{"plan:premium"}) {
+		t.Errorf("stored tags = %v, %v", tags, err)
+	}
+}
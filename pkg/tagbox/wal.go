@@ -0,0 +1,635 @@
+package tagbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when the write-ahead log is fsynced.
+type SyncPolicy int
+
+const (
+	// SyncInterval fsyncs the log every Config.WALSyncInterval. A crash
+	// of the machine may lose the last interval of mutations; a crash of
+	// the process loses nothing.
+	SyncInterval SyncPolicy = iota
+
+	// SyncAlways fsyncs the log before every mutation returns.
+	SyncAlways
+
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// walOp identifies the mutation stored in a log record.
+type walOp byte
+
+const (
+	walAdd        walOp = iota + 1 // AddTag: tags[0], ids[0]
+	walRemove                      // RemoveTag: tags[0], ids
+	walAddTags                     // BatchAddTags: tags, ids[0]
+	walAddObjects                  // BatchAddObjectsToTag: tags[0], ids
+	walAssignKey                   // Object key assignment: tags[0] is the key, ids[0]
+	walAddTTL                      // AddTagWithTTL: tags[0], ids[0], deadline
+	walSetAttr                     // SetAttr: tags[0] is the attribute, ids[0], value
+	walDeleteAttr                  // DeleteAttr: tags[0] is the attribute, ids[0]
+	walReplace                     // ReplaceTag: tags[0], ids are the new contents
+	walTxn                         // Txn.Commit: records, applied as one unit
+	walDeleteTag                   // DeleteTag: tags[0]
+	walMoveTag                     // RenameTag and MergeTags: tags[0] to tags[1], ids moved
+	walCopyTag                     // CopyTag: tags[0] to tags[1], ids copied
+)
+
+// walArity is the number of tags and IDs a record of each op carries, -1
+// standing for any number.
+var walArity = map[walOp][2]int{
+	walAdd:        {1, 1},
+	walRemove:     {1, -1},
+	walAddTags:    {-1, 1},
+	walAddObjects: {1, -1},
+	walAssignKey:  {1, 1},
+	walAddTTL:     {1, 1},
+	walSetAttr:    {1, 1},
+	walDeleteAttr: {1, 1},
+	walReplace:    {1, -1},
+	walDeleteTag:  {1, 0},
+	walMoveTag:    {2, -1},
+	walCopyTag:    {2, -1},
+}
+
+// ErrCorruptWAL is returned when a write-ahead log record that passed its
+// checksum cannot be applied, or when a record claims an impossible length.
+var ErrCorruptWAL = errors.New("corrupt write-ahead log record")
+
+// walRecord is one logged mutation.
+type walRecord struct {
+	op       walOp
+	tags     []string
+	ids      []uint32
+	deadline int64       // Unix nanoseconds, walAddTTL only
+	value    uint64      // Attribute value, walSetAttr only
+	records  []walRecord // Mutations of a transaction, walTxn only
+}
+
+// walMagic starts every log segment, followed by the format version.
+var walMagic = []byte("RTWAL\x00\x00\x01")
+
+// walSegmentPattern names log segments by their sequence number.
+const walSegmentPattern = "wal-%016d.log"
+
+// maxWALRecordSize bounds the payload of a record, so that a corrupt length
+// cannot make replay allocate gigabytes.
+const maxWALRecordSize = 1 << 30
+
+// encode returns the record framed as: payload length (uint32), CRC-32 of
+// the payload (uint32), payload.
+func (r walRecord) encode() []byte {
+	payload := r.payload()
+
+	frame := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...)
+}
+
+// payload returns the op byte followed by the uvarint-prefixed tag list
+// and the uvarint-encoded ID list, and for walAddTTL by the varint-encoded
+// deadline or for walSetAttr by the uvarint-encoded value. The payload of
+// walTxn is instead the op byte followed by the uvarint count of records
+// and each record's payload prefixed by its uvarint length, so that the
+// checksum of the frame covers the whole transaction.
+func (r walRecord) payload() []byte {
+	payload := []byte{byte(r.op)}
+	if r.op == walTxn {
+		payload = binary.AppendUvarint(payload, uint64(len(r.records)))
+		for _, rec := range r.records {
+			sub := rec.payload()
+			payload = binary.AppendUvarint(payload, uint64(len(sub)))
+			payload = append(payload, sub...)
+		}
+		return payload
+	}
+
+	payload = binary.AppendUvarint(payload, uint64(len(r.tags)))
+	for _, tag := range r.tags {
+		payload = binary.AppendUvarint(payload, uint64(len(tag)))
+		payload = append(payload, tag...)
+	}
+	payload = binary.AppendUvarint(payload, uint64(len(r.ids)))
+	for _, id := range r.ids {
+		payload = binary.AppendUvarint(payload, uint64(id))
+	}
+	switch r.op {
+	case walAddTTL:
+		payload = binary.AppendVarint(payload, r.deadline)
+	case walSetAttr:
+		payload = binary.AppendUvarint(payload, r.value)
+	}
+	return payload
+}
+
+// decodeWALPayload parses a record payload.
+func decodeWALPayload(payload []byte) (walRecord, error) {
+	r := bytes.NewReader(payload)
+
+	op, err := r.ReadByte()
+	if err != nil {
+		return walRecord{}, err
+	}
+	rec := walRecord{op: walOp(op)}
+	if rec.op == walTxn {
+		return decodeWALTxn(rec, r)
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return walRecord{}, err
+	}
+	for i := uint64(0); i < n; i++ {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return walRecord{}, err
+		}
+		if size > uint64(r.Len()) {
+			return walRecord{}, io.ErrUnexpectedEOF
+		}
+		tag := make([]byte, size)
+		r.Read(tag)
+		rec.tags = append(rec.tags, string(tag))
+	}
+
+	n, err = binary.ReadUvarint(r)
+	if err != nil {
+		return walRecord{}, err
+	}
+	if n > uint64(r.Len()) {
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+	rec.ids = make([]uint32, 0, n)
+	for i := uint64(0); i < n; i++ {
+		id, err := binary.ReadUvarint(r)
+		if err != nil {
+			return walRecord{}, err
+		}
+		rec.ids = append(rec.ids, uint32(id))
+	}
+
+	switch rec.op {
+	case walAddTTL:
+		rec.deadline, err = binary.ReadVarint(r)
+	case walSetAttr:
+		rec.value, err = binary.ReadUvarint(r)
+	}
+	if err != nil {
+		return walRecord{}, err
+	}
+
+	arity, known := walArity[rec.op]
+	if !known {
+		return walRecord{}, fmt.Errorf("%w: unknown op %d", ErrCorruptWAL, rec.op)
+	}
+	if (arity[0] >= 0 && len(rec.tags) != arity[0]) || (arity[1] >= 0 && len(rec.ids) != arity[1]) {
+		return walRecord{}, fmt.Errorf("%w: op %d with %d tags and %d IDs", ErrCorruptWAL, rec.op, len(rec.tags), len(rec.ids))
+	}
+
+	return rec, nil
+}
+
+// decodeWALTxn parses the records of a walTxn payload.
+func decodeWALTxn(rec walRecord, r *bytes.Reader) (walRecord, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return walRecord{}, err
+	}
+	if n > uint64(r.Len()) {
+		return walRecord{}, io.ErrUnexpectedEOF
+	}
+
+	rec.records = make([]walRecord, 0, n)
+	for i := uint64(0); i < n; i++ {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return walRecord{}, err
+		}
+		if size > uint64(r.Len()) {
+			return walRecord{}, io.ErrUnexpectedEOF
+		}
+		sub := make([]byte, size)
+		r.Read(sub)
+
+		if len(sub) > 0 && walOp(sub[0]) == walTxn {
+			return walRecord{}, fmt.Errorf("%w: nested transaction", ErrCorruptWAL)
+		}
+		subRec, err := decodeWALPayload(sub)
+		if err != nil {
+			return walRecord{}, err
+		}
+		rec.records = append(rec.records, subRec)
+	}
+
+	return rec, nil
+}
+
+// wal is an append-only operation log split into numbered segments.
+//
+// New records always go to a fresh segment, so a torn record left by a
+// crash can only ever be the last record of an older segment. A flush
+// rotates to a new segment under the tag system's write lock; once the
+// store holds everything logged before the rotation, the older segments
+// are deleted.
+type wal struct {
+	dir    string
+	policy SyncPolicy
+
+	mu       sync.Mutex
+	file     *os.File
+	seq      uint64 // Sequence number of the segment being written
+	written  bool   // Whether the current segment has records
+	unsynced bool   // Whether records were written since the last fsync
+	syncErr  error  // Unreported failure of the sync worker, returned by append or close
+
+	// Segments older than this were written by an earlier process and
+	// are kept until they have been replayed
+	replayFrom uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// openWAL opens the log in dir and starts a new segment after the
+// existing ones.
+func openWAL(dir string, policy SyncPolicy, interval time.Duration) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create wal directory: %w", err)
+	}
+
+	w := &wal{dir: dir, policy: policy, done: make(chan struct{})}
+
+	seqs, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		w.seq = seqs[len(seqs)-1]
+	}
+
+	if err := w.openSegment(w.seq + 1); err != nil {
+		return nil, err
+	}
+	w.replayFrom = w.seq
+
+	if policy == SyncInterval {
+		w.wg.Add(1)
+		go w.syncWorker(interval)
+	}
+
+	return w, nil
+}
+
+// segments returns the sequence numbers of the segments on disk in order.
+func (w *wal) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		var seq uint64
+		if !strings.HasPrefix(entry.Name(), "wal-") {
+			continue
+		}
+		if _, err := fmt.Sscanf(entry.Name(), walSegmentPattern, &seq); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	return seqs, nil
+}
+
+// openSegment creates segment seq and makes it the current segment.
+// Caller must hold w.mu or have exclusive access.
+func (w *wal) openSegment(seq uint64) error {
+	path := filepath.Join(w.dir, fmt.Sprintf(walSegmentPattern, seq))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("create wal segment: %w", err)
+	}
+
+	if _, err := file.Write(walMagic); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.seq = seq
+	w.written = false
+	w.unsynced = true
+	return nil
+}
+
+// append writes a record to the current segment, fsyncing it first when
+// the policy is SyncAlways.
+func (w *wal) append(rec walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Records before a failed fsync may never reach the disk
+	if err := w.syncErr; err != nil {
+		w.syncErr = nil
+		return err
+	}
+
+	frame := rec.encode()
+	if len(frame)-8 > maxWALRecordSize {
+		return fmt.Errorf("wal append failed: record of %d bytes exceeds %d", len(frame)-8, maxWALRecordSize)
+	}
+
+	if _, err := w.file.Write(frame); err != nil {
+		return fmt.Errorf("wal append failed: %w", err)
+	}
+	w.written = true
+	w.unsynced = true
+
+	if w.policy == SyncAlways {
+		return w.syncLocked()
+	}
+
+	return nil
+}
+
+// syncLocked fsyncs the current segment if needed.
+// Caller must hold w.mu.
+func (w *wal) syncLocked() error {
+	if !w.unsynced {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("wal sync failed: %w", err)
+	}
+	w.unsynced = false
+	return nil
+}
+
+// syncWorker fsyncs the log periodically.
+func (w *wal) syncWorker(interval time.Duration) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if err := w.syncLocked(); err != nil && w.syncErr == nil {
+				w.syncErr = err
+			}
+			w.mu.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// rotate closes the current segment and starts the next one. It returns
+// the sequence number of the new segment; every record logged before the
+// call lives in an older segment.
+func (w *wal) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.written {
+		return w.seq, nil // Nothing logged since the last rotation
+	}
+
+	if err := w.syncLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := w.openSegment(w.seq + 1); err != nil {
+		return 0, err
+	}
+
+	return w.seq, nil
+}
+
+// compact deletes every segment older than seq, except the segments of
+// an earlier process that have not been replayed yet.
+func (w *wal) compact(seq uint64) error {
+	w.mu.Lock()
+	replayFrom := w.replayFrom
+	w.mu.Unlock()
+
+	seqs, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range seqs {
+		if s >= seq {
+			break
+		}
+		if s < replayFrom {
+			continue // Not replayed yet
+		}
+		path := filepath.Join(w.dir, fmt.Sprintf(walSegmentPattern, s))
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replay calls fn for every record in the segments older than the current
+// one, in log order. A torn record at the end of a segment is skipped.
+func (w *wal) replay(fn func(walRecord)) (int, error) {
+	w.mu.Lock()
+	current := w.seq
+	w.mu.Unlock()
+
+	seqs, err := w.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, seq := range seqs {
+		if seq >= current {
+			break
+		}
+		n, err := w.replaySegment(filepath.Join(w.dir, fmt.Sprintf(walSegmentPattern, seq)), fn)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+
+	w.mu.Lock()
+	w.replayFrom = 0
+	w.mu.Unlock()
+
+	return count, nil
+}
+
+// replaySegment reads the records of one segment file.
+func (w *wal) replaySegment(path string, fn func(walRecord)) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	remaining := info.Size() - int64(len(walMagic))
+
+	r := bufio.NewReader(file)
+
+	magic := make([]byte, len(walMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, nil // Crashed while creating the segment
+	}
+	if !bytes.Equal(magic, walMagic) {
+		return 0, fmt.Errorf("%s: not a wal segment", path)
+	}
+
+	count := 0
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return count, nil // End of segment or torn header
+		}
+		remaining -= int64(len(header))
+
+		size := int64(binary.LittleEndian.Uint32(header[0:4]))
+		if size > remaining {
+			return count, nil // Torn record
+		}
+		if size > maxWALRecordSize {
+			return count, fmt.Errorf("%s: record %d: %w: length %d", path, count+1, ErrCorruptWAL, size)
+		}
+		remaining -= size
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return count, nil // Torn record
+		}
+
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+			if _, err := r.Peek(1); err == io.EOF {
+				return count, nil // Torn last record
+			}
+			return count, fmt.Errorf("%s: checksum mismatch in record %d", path, count+1)
+		}
+
+		rec, err := decodeWALPayload(payload)
+		if err != nil {
+			return count, fmt.Errorf("%s: record %d: %w", path, count+1, err)
+		}
+
+		fn(rec)
+		count++
+	}
+}
+
+// close stops the sync worker and closes the current segment.
+func (w *wal) close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.syncLocked(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.syncErr
+}
+
+// logLocked appends a mutation to the write-ahead log, if enabled.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) logLocked(rec walRecord) error {
+	if ts.wal == nil {
+		return nil
+	}
+
+	return ts.wal.append(rec)
+}
+
+// applyLocked replays a logged mutation.
+// Caller must hold ts.mu.Lock().
+func (ts *TagSystem) applyLocked(rec walRecord) {
+	switch rec.op {
+	case walAdd:
+		ts.addLocked(rec.ids[0], rec.tags[0])
+	case walRemove:
+		for _, objectID := range rec.ids {
+			ts.removeLocked(objectID, rec.tags[0])
+		}
+	case walAddTags:
+		ts.addTagsLocked(rec.ids[0], rec.tags)
+	case walAddObjects:
+		ts.addObjectsLocked(rec.ids, rec.tags[0])
+	case walAssignKey:
+		ts.assignKeyLocked(rec.tags[0], rec.ids[0])
+	case walAddTTL:
+		ts.addWithTTLLocked(rec.ids[0], rec.tags[0], rec.deadline)
+	case walSetAttr:
+		ts.setAttrLocked(rec.ids[0], rec.tags[0], rec.value)
+	case walDeleteAttr:
+		ts.deleteAttrLocked(rec.ids[0], rec.tags[0])
+	case walReplace:
+		ts.replaceLocked(rec.tags[0], rec.ids)
+	case walTxn:
+		for _, sub := range rec.records {
+			ts.applyLocked(sub)
+		}
+	case walDeleteTag:
+		ts.dropLocked(rec.tags[0])
+	case walMoveTag:
+		ts.moveLocked(rec.ids, rec.tags[0], rec.tags[1])
+	case walCopyTag:
+		ts.copyLocked(rec.ids, rec.tags[0], rec.tags[1])
+	}
+}
+
+// ReplayWAL applies the mutations recorded in the write-ahead log that
+// have not been compacted away, and returns how many were applied.
+//
+// Recover and LoadSnapshot call it automatically, so the log is replayed
+// on top of the state they load. Replaying is idempotent: every record
+// sets an object-tag assignment to a definite value, so applying the log
+// to a state that already contains some of it yields the same result.
+func (ts *TagSystem) ReplayWAL() (int, error) {
+	if ts.wal == nil {
+		return 0, nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.wal.replay(ts.applyLocked)
+}
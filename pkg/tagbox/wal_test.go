@@ -0,0 +1,324 @@
+package tagbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWALTagSystem creates a TagSystem with a write-ahead log on the given store
+func newWALTagSystem(t *testing.T, dir string, store Store) *TagSystem {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = store
+	config.WALDir = dir
+	config.WALSync = SyncAlways
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+
+	return ts
+}
+
+// crash simulates a process crash: the tag system stops without saving
+func crash(t *testing.T, ts *TagSystem) {
+	t.Helper()
+
+	if err := ts.abandon(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+}
+
+// walSegments returns the names of the log segments in dir
+func walSegments(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+// TestTagSystem_WALRecovery tests replaying mutations made after the last save
+func TestTagSystem_WALRecovery(t *testing.T) {
+	dir := t.TempDir()
+	store := NewMemoryStore()
+
+	ts1 := newWALTagSystem(t, dir, store)
+	ts1.BatchAddTags(1, []string{"vip", "male"})
+	if err := ts1.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	// Mutations after the save only live in the log
+	ts1.AddTag(2, "vip")
+	ts1.BatchAddObjectsToTag([]uint32{3, 4}, "female")
+	ts1.RemoveTag(1, "male")
+	ts1.AddTag(5, "tmp")
+	ts1.RemoveTag(5, "tmp")
+	ts1.BatchAddObjectsToTag([]uint32{6, 7}, "segment")
+	ts1.ReplaceTag("segment", []uint32{7, 8})
+	crash(t, ts1)
+
+	ts2 := newWALTagSystem(t, dir, store)
+	defer ts2.Close()
+
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+
+	tests := []struct {
+		tag  string
+		want []uint32
+	}{
+		{"vip", []uint32{1, 2}},
+		{"female", []uint32{3, 4}},
+		{"male", []uint32{}},
+		{"tmp", []uint32{}},
+		{"segment", []uint32{7, 8}},
+	}
+	for _, tt := range tests {
+		result, _ := ts2.Query(tt.tag)
+		if got := result.ToArray(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tag %s = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+
+	// Replaying again changes nothing
+	ts2.ReplayWAL()
+	if count, _ := ts2.GetTagCount("vip"); count != 2 {
+		t.Errorf("expected 2 objects with vip tag after second replay, got %d", count)
+	}
+}
+
+// TestTagSystem_WALCompaction tests that a successful save drops the replayed log
+func TestTagSystem_WALCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store := NewMemoryStore()
+
+	ts1 := newWALTagSystem(t, dir, store)
+	ts1.AddTag(1, "vip")
+	crash(t, ts1)
+
+	ts2 := newWALTagSystem(t, dir, store)
+	defer ts2.Close()
+
+	if got := len(walSegments(t, dir)); got != 2 {
+		t.Fatalf("expected the old and the new segment, got %d", got)
+	}
+
+	// The old segment is kept until it has been replayed
+	if err := ts2.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if got := len(walSegments(t, dir)); got != 2 {
+		t.Fatalf("unreplayed segment must survive a save, got %d segments", got)
+	}
+
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	ts2.AddTag(2, "vip")
+
+	if _, err := ts2.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if got := len(walSegments(t, dir)); got != 1 {
+		t.Errorf("expected only the current segment after flush, got %d", got)
+	}
+	if count, _ := ts2.GetTagCount("vip"); count != 2 {
+		t.Errorf("expected 2 objects with vip tag, got %d", count)
+	}
+}
+
+// plainStore hides the optional interfaces of a store
+type plainStore struct {
+	Store
+}
+
+// TestTagSystem_WALWithoutMetaStore tests that the log is not compacted
+// while it is the only copy of the metadata
+func TestTagSystem_WALWithoutMetaStore(t *testing.T) {
+	dir := t.TempDir()
+	store := plainStore{NewMemoryStore()}
+
+	ts1 := newWALTagSystem(t, dir, store)
+	ts1.AddTag(2, "vip")
+	if stats, _ := ts1.Flush(); stats.MetaUnsaved {
+		t.Error("flush reported unsaved metadata before any was used")
+	}
+	ts1.AddTagByKey("user-a", "vip")
+	ts1.AddTagWithTTL(1, "trial", time.Hour)
+	if err := ts1.Save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if !ts1.LastFlush().MetaUnsaved {
+		t.Error("flush did not report the metadata the store cannot keep")
+	}
+	crash(t, ts1)
+
+	ts2 := newWALTagSystem(t, dir, store)
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	if id, ok := ts2.ObjectID("user-a"); !ok || id != 0 {
+		t.Errorf("ObjectID(user-a) = %d, %v after recovery", id, ok)
+	}
+	if _, ok := ts2.GetTagExpiry(1, "trial"); !ok {
+		t.Error("deadline was lost by the compaction")
+	}
+}
+
+// TestTagSystem_WALTornRecord tests that a partially written last record is ignored
+func TestTagSystem_WALTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store := NewMemoryStore()
+
+	ts1 := newWALTagSystem(t, dir, store)
+	ts1.AddTag(1, "vip")
+	ts1.AddTag(2, "vip")
+	crash(t, ts1)
+
+	// Cut the last record in half
+	segments := walSegments(t, dir)
+	path := segments[len(segments)-1]
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	ts2 := newWALTagSystem(t, dir, store)
+	defer ts2.Close()
+
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+
+	result, _ := ts2.Query("vip")
+	if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{1}) {
+		t.Errorf("expected only the complete record to be replayed, got %v", got)
+	}
+}
+
+// TestTagSystem_WALHugeLength tests that a last record whose header claims
+// more bytes than the segment holds is treated as torn, without allocating
+// its length
+func TestTagSystem_WALHugeLength(t *testing.T) {
+	dir := t.TempDir()
+	store := NewMemoryStore()
+
+	ts1 := newWALTagSystem(t, dir, store)
+	ts1.AddTag(1, "vip")
+	crash(t, ts1)
+
+	segments := walSegments(t, dir)
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, byte(walAdd)})
+	f.Close()
+
+	ts2 := newWALTagSystem(t, dir, store)
+	defer ts2.Close()
+
+	if err := ts2.Recover(); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	result, _ := ts2.Query("vip")
+	if got := result.ToArray(); !reflect.DeepEqual(got, []uint32{1}) {
+		t.Errorf("expected the records before the huge header to be replayed, got %v", got)
+	}
+}
+
+// TestTagSystem_WALMalformedRecord tests that a record with the wrong
+// number of tags or IDs fails replay instead of panicking
+func TestTagSystem_WALMalformedRecord(t *testing.T) {
+	records := []walRecord{
+		{op: walAdd, tags: []string{"vip"}},
+		{op: walMoveTag, tags: []string{"vip"}, ids: []uint32{1}},
+		{op: walTxn, records: []walRecord{{op: walCopyTag}}},
+		{op: 200, tags: []string{"vip"}, ids: []uint32{1}},
+	}
+
+	for _, rec := range records {
+		dir := t.TempDir()
+		store := NewMemoryStore()
+
+		ts1 := newWALTagSystem(t, dir, store)
+		ts1.AddTag(1, "vip")
+		crash(t, ts1)
+
+		segments := walSegments(t, dir)
+		f, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(rec.encode())
+		f.Close()
+
+		ts2 := newWALTagSystem(t, dir, store)
+		if _, err := ts2.ReplayWAL(); !errors.Is(err, ErrCorruptWAL) {
+			t.Errorf("replaying op %d = %v, want ErrCorruptWAL", rec.op, err)
+		}
+		ts2.Close()
+	}
+}
+
+// TestTagSystem_WALSyncError tests that a failed background fsync is
+// reported by the next mutation
+func TestTagSystem_WALSyncError(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.WALDir = t.TempDir()
+	config.WALSyncInterval = 10 * time.Millisecond
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	ts.AddTag(1, "vip")
+
+	// Fail the next fsync
+	ts.wal.mu.Lock()
+	ts.wal.file.Close()
+	ts.wal.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := ts.AddTag(2, "vip"); err == nil || !strings.Contains(err.Error(), "sync") {
+		t.Errorf("mutation after a failed fsync = %v, want the sync error", err)
+	}
+}
+
+// TestTagSystem_WALSyncIntervalDefault tests that SyncInterval without an
+// interval falls back to the default
+func TestTagSystem_WALSyncIntervalDefault(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoSave = false
+	config.Store = NewMemoryStore()
+	config.WALDir = t.TempDir()
+	config.WALSyncInterval = 0
+
+	ts, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create TagSystem: %v", err)
+	}
+	defer ts.Close()
+
+	if ts.config.WALSyncInterval != time.Second {
+		t.Errorf("sync interval = %v, want 1s", ts.config.WALSyncInterval)
+	}
+}